@@ -11,8 +11,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"payment-system/pkg"
+	"payment-system/pkg/memStore"
 	"payment-system/pkg/pgStore"
 	"payment-system/pkg/rest"
+	"payment-system/pkg/webhook"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -22,31 +26,86 @@ const port = 3000
 
 var version = "0.0.0"
 
+// store is what the service runs on, pgStore.PG or memStore.Mem with STORE=memory
+type store interface {
+	rest.WalletStore
+	rest.ClientStore
+	webhook.Store
+	SetFeeWallet(wallet string)
+	ExpireHolds(ctx context.Context) (int64, error)
+	PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error)
+}
+
 func main() {
 	log := getLogger()
 	log.Infof("starting payment system service version %s", version)
 	ctx := context.Background()
-	pg, err := pgStore.GetPGStore(ctx, log, os.Getenv("PG_DSN"))
-	if err != nil {
-		log.Fatalf("failed to get pgStore: %s", err)
+	var s store
+	if strings.ToLower(os.Getenv("STORE")) == "memory" {
+		s = getMemStore(ctx, log)
+	} else {
+		pg, err := pgStore.GetPGStore(ctx, log, os.Getenv("PG_DSN"))
+		if err != nil {
+			log.Fatalf("failed to get pgStore: %s", err)
+		}
+		defer pg.DC()
+		if err = pg.Migrate(migrate.Up); err != nil {
+			log.Fatalf("err migrating pg store: %s", err)
+		}
+		go snapshotBalances(ctx, log, pg, durationFromEnv(log, "BALANCE_SNAPSHOT_INTERVAL", 24*time.Hour))
+		go pg.ListenWalletActivity(ctx)
+		s = pg
 	}
-	defer pg.DC()
-	if err = pg.Migrate(migrate.Up); err != nil {
-		log.Fatalf("err migrating pg store: %s", err)
+	if feeWallet := os.Getenv("FEE_WALLET"); feeWallet != "" {
+		s.SetFeeWallet(feeWallet)
 	}
-	router := rest.NewRouter(log, pg, pg, version)
-	if err = startServer(ctx, router, log); err != nil {
+	opts := rest.Options{
+		SignatureSkew:       durationFromEnv(log, "SIGNATURE_SKEW", rest.DefaultSignatureSkew),
+		FXQuoteTTL:          durationFromEnv(log, "FX_QUOTE_TTL", rest.DefaultFXQuoteTTL),
+		HoldTTL:             durationFromEnv(log, "HOLD_TTL", rest.DefaultHoldTTL),
+		ExportFlushInterval: durationFromEnv(log, "EXPORT_FLUSH_INTERVAL", rest.DefaultExportFlushInterval),
+		ExportTimeout:       durationFromEnv(log, "EXPORT_TIMEOUT", rest.DefaultExportTimeout),
+		MaxExports:          intFromEnv(log, "EXPORT_MAX_CONCURRENT", rest.DefaultMaxExports),
+		EventsKeepAlive:     durationFromEnv(log, "EVENTS_KEEP_ALIVE", rest.DefaultEventsKeepAlive),
+		MaxBatchTransfers:   intFromEnv(log, "BATCH_MAX_TRANSFERS", rest.DefaultMaxBatchTransfers),
+		BatchTimeout:        durationFromEnv(log, "BATCH_TIMEOUT", rest.DefaultBatchTimeout),
+	}
+	go expireHolds(ctx, log, s, durationFromEnv(log, "HOLD_EXPIRY_INTERVAL", time.Minute))
+	go purgeIdempotencyKeys(ctx, log, s, durationFromEnv(log, "IDEMPOTENCY_TTL", 24*time.Hour))
+	dispatcher := webhook.NewDispatcher(log, s, webhook.Options{
+		Timeout:     durationFromEnv(log, "WEBHOOK_TIMEOUT", webhook.DefaultTimeout),
+		BaseBackoff: durationFromEnv(log, "WEBHOOK_BASE_BACKOFF", webhook.DefaultBaseBackoff),
+		MaxBackoff:  durationFromEnv(log, "WEBHOOK_MAX_BACKOFF", webhook.DefaultMaxBackoff),
+	})
+	go dispatcher.Run(ctx, durationFromEnv(log, "WEBHOOK_DISPATCH_INTERVAL", 5*time.Second))
+	router := rest.NewRouter(log, s, s, version, opts)
+	if err := startServer(ctx, router, log); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// getMemStore returns an empty in-memory store, the client with API_KEY and SIGNING_SECRET is registered in it
+// if the key is set
+func getMemStore(ctx context.Context, log *logrus.Logger) *memStore.Mem {
+	log.Warn("using the in-memory store, nothing is kept after the service stops")
+	m := memStore.NewMemStore()
+	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+		client := pkg.Client{Name: "local", LimitRPS: 10, Burst: 20, SigningSecret: os.Getenv("SIGNING_SECRET"), Admin: true}
+		if _, err := m.CreateClient(ctx, client, rest.HashAPIKey(apiKey)); err != nil {
+			log.Fatalf("err registering the client: %s", err)
+		}
+	}
+	return m
+}
+
+// startServer serves router. There's no write timeout as event streams are open for as long as clients listen,
+// other requests are limited by timeouts of their routes
 func startServer(ctx context.Context, router http.Handler, log *logrus.Logger) error {
 	log.Infof("starting server on port %d", port)
 	s := &http.Server{
 		Addr:              fmt.Sprintf(":%d", port),
 		ReadHeaderTimeout: 30 * time.Second,
 		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
 		Handler:           router,
 	}
 	errCh := make(chan error)
@@ -68,6 +127,93 @@ func startServer(ctx context.Context, router http.Handler, log *logrus.Logger) e
 	return s.Shutdown(gfCtx)
 }
 
+// expireHolds periodically releases funds of holds past their TTL
+func expireHolds(ctx context.Context, log *logrus.Logger, s store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := s.ExpireHolds(ctx)
+		if err != nil {
+			log.Warnf("err expiring holds: %s", err)
+			continue
+		}
+		if n > 0 {
+			log.Infof("%d holds expired", n)
+		}
+	}
+}
+
+// snapshotBalances takes balance snapshots at the start of each interval once it's an hour old,
+// so transactions in flight at the moment are committed
+func snapshotBalances(ctx context.Context, log *logrus.Logger, pg *pgStore.PG, interval time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		at := time.Now().Add(-time.Hour).Truncate(interval)
+		n, err := pg.SnapshotBalances(ctx, at)
+		if err != nil {
+			log.Warnf("err taking balance snapshots: %s", err)
+		} else if n > 0 {
+			log.Infof("%d balance snapshots taken at %s", n, at)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeIdempotencyKeys periodically deletes idempotency records older than ttl
+func purgeIdempotencyKeys(ctx context.Context, log *logrus.Logger, s store, ttl time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := s.PurgeIdempotencyKeys(ctx, ttl)
+		if err != nil {
+			log.Warnf("err purging idempotency keys: %s", err)
+			continue
+		}
+		if n > 0 {
+			log.Infof("%d idempotency keys purged", n)
+		}
+	}
+}
+
+func durationFromEnv(log *logrus.Logger, name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", name, err)
+	}
+	return d
+}
+
+func intFromEnv(log *logrus.Logger, name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Fatalf("invalid %s: %s", name, value)
+	}
+	return n
+}
+
 func getLogger() *logrus.Logger {
 	log := logrus.New()
 	if strings.ToLower(os.Getenv("VERBOSE")) == "true" {
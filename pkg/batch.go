@@ -0,0 +1,26 @@
+package pkg
+
+import "fmt"
+
+// TransferLeg is a transfer of a batch from its source wallet, Currency and Quote are optional as for single transfers
+type TransferLeg struct {
+	To       string `json:"to"`
+	Amount   Amount `json:"amount"`
+	Currency string `json:"currency"`
+	Quote    string `json:"quote"`
+	Key      string `json:"key"`
+}
+
+// ErrBatchLeg is the error of the transfer of a batch with Index, atomic batches are rolled back on it
+type ErrBatchLeg struct {
+	Index int
+	Err   error
+}
+
+func (e ErrBatchLeg) Error() string {
+	return fmt.Sprintf("transfer %d: %s", e.Index, e.Err)
+}
+
+func (e ErrBatchLeg) Unwrap() error {
+	return e.Err
+}
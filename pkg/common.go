@@ -9,6 +9,13 @@ import (
 var ErrInsufficientFunds = errors.New("err wallet with uuid specified doesn't have enough money on the balance")
 var ErrWalletNotFound = errors.New("err wallet with uuid specified was not found")
 var ErrInvalidTransactionType = errors.New("unknown transaction type")
+var ErrInvalidCursor = errors.New("err invalid cursor")
+var ErrInvalidPeriod = errors.New("err period must be day, week or month")
+var ErrClientNotFound = errors.New("err client with api key specified was not found")
+var ErrNonceReused = errors.New("err request nonce has already been used")
+var ErrTransactionNotFound = errors.New("err transaction with id or key specified was not found")
+var ErrNotRefundable = errors.New("err refunds and split payments can't be refunded")
+var ErrRefundExceedsOriginal = errors.New("err refund amount exceeds the refundable amount of the original transaction")
 
 type ErrDuplicateAction string
 
@@ -16,11 +23,24 @@ func (e ErrDuplicateAction) Error() string {
 	return fmt.Sprintf("duplicate key: %s", string(e))
 }
 
+// Wallet Amount is the ledger balance, Held part of it is reserved by holds, the rest is Available
 type Wallet struct {
-	Amount  float64   `db:"amount" json:"amount"`
-	Wallet  string    `db:"wallet" json:"wallet"`
-	Owner   int       `db:"owner" json:"owner"`
-	Status  int8      `db:"status" json:"status"`
-	Updated time.Time `db:"updated" json:"updated"`
-	Created time.Time `db:"created" json:"created"`
+	Amount    Amount       `db:"amount" json:"amount"`
+	Held      Amount       `db:"held" json:"held"`
+	Available Amount       `db:"available" json:"available"`
+	Currency  string       `db:"currency" json:"currency"`
+	Wallet    string       `db:"wallet" json:"wallet"`
+	Owner     int          `db:"owner" json:"owner"`
+	Status    WalletStatus `db:"status" json:"status"`
+	Updated   time.Time    `db:"updated" json:"updated"`
+	Created   time.Time    `db:"created" json:"created"`
+}
+
+type Client struct {
+	ID            int    `db:"id"`
+	Name          string `db:"name"`
+	LimitRPS      int    `db:"limit_rps"`
+	Burst         int    `db:"burst"`
+	SigningSecret string `db:"signing_secret"`
+	Admin         bool   `db:"admin"`
 }
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultCurrency is assigned to wallets created without a currency
+const DefaultCurrency = "USD"
+
+// MaxCurrencyExponent is the biggest minor unit exponent among known currencies
+const MaxCurrencyExponent = 3
+
+var ErrUnknownCurrency = errors.New("err unknown currency")
+var ErrCurrencyMismatch = errors.New("err currency doesn't match the wallet's one")
+
+// currencyExponents maps ISO 4217 codes to the number of digits after the decimal point of their minor unit
+var currencyExponents = map[string]uint8{
+	"AED": 2, "ARS": 2, "AUD": 2, "BGN": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2,
+	"CLP": 0, "CNY": 2, "COP": 2, "CZK": 2, "DKK": 2, "EGP": 2, "EUR": 2, "GBP": 2,
+	"GEL": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "IQD": 3, "ISK": 0,
+	"JOD": 3, "JPY": 0, "KES": 2, "KRW": 0, "KWD": 3, "KZT": 2, "LYD": 3, "MXN": 2,
+	"MYR": 2, "NGN": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PHP": 2, "PKR": 2, "PLN": 2,
+	"PYG": 0, "QAR": 2, "RON": 2, "RSD": 2, "RUB": 2, "SAR": 2, "SEK": 2, "SGD": 2,
+	"THB": 2, "TND": 3, "TRY": 2, "TWD": 2, "UAH": 2, "UGX": 0, "USD": 2, "UZS": 2,
+	"VND": 0, "XAF": 0, "XOF": 0, "ZAR": 2,
+}
+
+// CurrencyExponent returns the minor unit exponent of the ISO 4217 currency code given
+func CurrencyExponent(currency string) (uint8, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+	return exp, nil
+}
+
+// NormalizeCurrency upper cases the code and checks it's known
+func NormalizeCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(currency)
+	if _, err := CurrencyExponent(currency); err != nil {
+		return "", err
+	}
+	return currency, nil
+}
+
+// maxWholeUnits bounds amounts in any currency, they are stored as numeric(18, 3)
+const maxWholeUnits = 1e15
+
+// InCurrency rescales amount to the currency minor unit, amounts given with more decimal places are rejected
+// as well as ones of maxWholeUnits or more
+func InCurrency(amount Amount, currency string) (Amount, error) {
+	exp, err := CurrencyExponent(currency)
+	if err != nil {
+		return Amount{}, err
+	}
+	if amount.Scale > exp {
+		return Amount{}, ErrAmountPrecision
+	}
+	result, err := amount.Rescale(exp)
+	if err != nil {
+		return Amount{}, err
+	}
+	if limit := maxWholeUnits * pow10[exp]; result.Units >= limit || result.Units <= -limit {
+		return Amount{}, ErrInvalidAmount
+	}
+	return result, nil
+}
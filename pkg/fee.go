@@ -0,0 +1,53 @@
+package pkg
+
+// FeeRule charges Flat plus Percent of the amount, but no less than Min and no more than Max unless Max is zero.
+// Rules apply to a transaction type, a rule without ClientID or Currency applies to all clients or currencies
+type FeeRule struct {
+	ClientID *int   `db:"client_id" json:"client_id"`
+	Type     int8   `db:"type" json:"type"`
+	Currency string `db:"currency" json:"currency"`
+	Flat     Amount `db:"flat" json:"flat"`
+	Percent  Amount `db:"percent" json:"percent"`
+	Min      Amount `db:"min_fee" json:"min"`
+	Max      Amount `db:"max_fee" json:"max"`
+}
+
+// Fee of amount rounded half away from zero to scale decimal places
+func (r FeeRule) Fee(amount Amount, scale uint8) (Amount, error) {
+	if r.Percent.Scale > maxAmountScale-2 {
+		return Amount{}, ErrAmountPrecision
+	}
+	one := NewAmount(1, 0)
+	fee, err := amount.Convert(Amount{Units: r.Percent.Units, Scale: r.Percent.Scale + 2}, scale)
+	if err != nil {
+		return Amount{}, err
+	}
+	flat, err := r.Flat.Convert(one, scale)
+	if err != nil {
+		return Amount{}, err
+	}
+	fee = fee.Add(flat)
+	if fee.Cmp(r.Min) < 0 {
+		if fee, err = r.Min.Convert(one, scale); err != nil {
+			return Amount{}, err
+		}
+	}
+	if r.Max.Sign() > 0 && fee.Cmp(r.Max) > 0 {
+		if fee, err = r.Max.Convert(one, scale); err != nil {
+			return Amount{}, err
+		}
+	}
+	return fee, nil
+}
+
+// Receipt itemizes a money movement, Total is the change of the paying wallet balance including Fee
+type Receipt struct {
+	TransactionID    int64  `json:"transaction_id"`
+	Key              string `json:"key"`
+	Amount           Amount `json:"amount"`
+	Currency         string `json:"currency"`
+	AmountReceived   Amount `json:"amount_received"`
+	CurrencyReceiver string `json:"currency_receiver"`
+	Fee              Amount `json:"fee"`
+	Total            Amount `json:"total"`
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrRateNotFound = errors.New("err no exchange rate for the currency pair")
+var ErrInvalidQuote = errors.New("err exchange rate quote was not found or doesn't match the currencies")
+var ErrQuoteExpired = errors.New("err exchange rate quote has expired")
+
+// FXRateProvider returns how many units of quote currency one unit of base currency buys
+type FXRateProvider interface {
+	Rate(ctx context.Context, base, quote string) (Amount, error)
+}
+
+// StaticFXRates is a fixed FXRateProvider, keys are pairs like "USD/EUR"
+type StaticFXRates map[string]Amount
+
+func (s StaticFXRates) Rate(_ context.Context, base, quote string) (Amount, error) {
+	if rate, ok := s[base+"/"+quote]; ok {
+		return rate, nil
+	}
+	return Amount{}, ErrRateNotFound
+}
+
+// FXRates are rates fetched from a provider ahead of time with errors of fetching them, stores fetch rates of
+// an external provider before a transaction so it doesn't wait for the provider holding locks
+type FXRates struct {
+	rates map[string]Amount
+	errs  map[string]error
+}
+
+// FetchFXRates fetches rates from base to each of quotes other than base
+func FetchFXRates(ctx context.Context, fx FXRateProvider, base string, quotes ...string) FXRates {
+	r := FXRates{rates: make(map[string]Amount), errs: make(map[string]error)}
+	for _, quote := range quotes {
+		pair := base + "/" + quote
+		_, fetched := r.rates[pair]
+		_, failed := r.errs[pair]
+		if quote == base || fetched || failed {
+			continue
+		}
+		rate, err := fx.Rate(ctx, base, quote)
+		if err != nil {
+			r.errs[pair] = err
+			continue
+		}
+		r.rates[pair] = rate
+	}
+	return r
+}
+
+// Rate implements FXRateProvider with the fetched rates, the error of fetching the pair is returned if it failed
+func (r FXRates) Rate(_ context.Context, base, quote string) (Amount, error) {
+	pair := base + "/" + quote
+	if err := r.errs[pair]; err != nil {
+		return Amount{}, err
+	}
+	if rate, ok := r.rates[pair]; ok {
+		return rate, nil
+	}
+	return Amount{}, ErrRateNotFound
+}
+
+// FXQuote is an exchange rate locked until Expires
+type FXQuote struct {
+	ID      string    `db:"id" json:"id"`
+	Base    string    `db:"base" json:"base"`
+	Quote   string    `db:"quote" json:"quote"`
+	Rate    Amount    `db:"rate" json:"rate"`
+	Expires time.Time `db:"expires" json:"expires"`
+}
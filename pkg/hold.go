@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrHoldNotFound = errors.New("err hold with id specified was not found")
+var ErrHoldNotActive = errors.New("err hold has already been captured, voided or expired")
+var ErrHoldExpired = errors.New("err hold has expired")
+var ErrCaptureExceedsHold = errors.New("err capture amount exceeds the hold amount")
+
+type HoldStatus int8
+
+const (
+	HoldActive HoldStatus = iota
+	HoldCaptured
+	HoldVoided
+	HoldExpired
+)
+
+// Hold reserves Amount on a wallet until it's captured, voided or Expires.
+// Held funds are not available for withdrawals and transfers but still belong to the wallet
+type Hold struct {
+	ID       string     `db:"id" json:"id"`
+	Wallet   string     `db:"wallet" json:"wallet"`
+	Key      string     `db:"key" json:"key"`
+	Amount   Amount     `db:"amount" json:"amount"`
+	Captured Amount     `db:"captured" json:"captured"`
+	Currency string     `db:"currency" json:"currency"`
+	Status   HoldStatus `db:"status" json:"status"`
+	Expires  time.Time  `db:"expires" json:"expires"`
+	Updated  time.Time  `db:"updated" json:"updated"`
+	Created  time.Time  `db:"created" json:"created"`
+}
@@ -0,0 +1,19 @@
+package pkg
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrKeyReused = errors.New("err key was already used with different parameters")
+var ErrRequestInProgress = errors.New("err request with the key is in progress")
+
+// IdempotencyRecord is the response to a request with a key, Status is 0 until the request is completed
+type IdempotencyRecord struct {
+	ClientID    int       `db:"client_id"`
+	Key         string    `db:"key"`
+	Fingerprint string    `db:"fingerprint"`
+	Status      int       `db:"status"`
+	Response    []byte    `db:"response"`
+	Created     time.Time `db:"created"`
+}
@@ -0,0 +1,36 @@
+package memStore
+
+import "payment-system/pkg"
+
+// SubscribeWallet returns a channel receiving a value after operations on the wallet succeed
+// and the func to unsubscribe. Notifications may be coalesced, so subscribers should read everything
+// new on each of them
+func (m *Mem) SubscribeWallet(wallet string) (<-chan struct{}, func()) {
+	wallet = pkg.WalletID(wallet)
+	ch := make(chan struct{}, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subs[wallet] == nil {
+		m.subs[wallet] = make(map[chan struct{}]struct{})
+	}
+	m.subs[wallet][ch] = struct{}{}
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subs[wallet], ch)
+		if len(m.subs[wallet]) == 0 {
+			delete(m.subs, wallet)
+		}
+	}
+}
+
+// notify wakes subscribers of the wallet up, those which haven't consumed the previous notification yet
+// aren't notified twice
+func (m *Mem) notify(wallet string) {
+	for ch := range m.subs[wallet] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"time"
+)
+
+type clientRecord struct {
+	pkg.Client
+	apiKeyHash string
+}
+
+func (m *Mem) GetClient(ctx context.Context, apiKeyHash string) (pkg.Client, error) {
+	result := pkg.Client{}
+	err := m.tx(ctx, func(tx *memTx) error {
+		for _, c := range m.clients {
+			if c.apiKeyHash == apiKeyHash {
+				result = c.Client
+				return nil
+			}
+		}
+		return pkg.ErrClientNotFound
+	})
+	return result, err
+}
+
+// CreateClient registers a client, apiKeyHash is expected to be a hex encoded sha256 of the api key
+func (m *Mem) CreateClient(ctx context.Context, client pkg.Client, apiKeyHash string) (int, error) {
+	var id int
+	err := m.tx(ctx, func(tx *memTx) error {
+		for _, c := range m.clients {
+			if c.apiKeyHash == apiKeyHash {
+				return pkg.ErrDuplicateAction(apiKeyHash)
+			}
+		}
+		id = len(m.clients) + 1
+		client.ID = id
+		m.clients = append(m.clients, clientRecord{Client: client, apiKeyHash: apiKeyHash})
+		return nil
+	})
+	return id, err
+}
+
+// RegisterNonce remembers a signed request nonce until expires, returns pkg.ErrNonceReused if it's already known
+func (m *Mem) RegisterNonce(ctx context.Context, clientID int, nonce string, expires time.Time) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		nonces := m.nonces[clientID]
+		if nonces == nil {
+			nonces = make(map[string]time.Time)
+			m.nonces[clientID] = nonces
+		}
+		for n, e := range nonces {
+			if e.Before(tx.now) {
+				delete(nonces, n)
+			}
+		}
+		if _, ok := nonces[nonce]; ok {
+			return pkg.ErrNonceReused
+		}
+		nonces[nonce] = expires.UTC()
+		return nil
+	})
+}
@@ -0,0 +1,116 @@
+package memStore
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"payment-system/pkg"
+	"time"
+)
+
+// SetFXRateProvider replaces the default provider reading rates set by SetFXRate
+func (m *Mem) SetFXRateProvider(fx pkg.FXRateProvider) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fx = fx
+}
+
+// Rate implements pkg.FXRateProvider with rates set by SetFXRate
+func (m *Mem) Rate(ctx context.Context, base, quote string) (pkg.Amount, error) {
+	if err := ctx.Err(); err != nil {
+		return pkg.Amount{}, err
+	}
+	m.ratesMu.RLock()
+	defer m.ratesMu.RUnlock()
+	rate, ok := m.rates[base+"/"+quote]
+	if !ok {
+		return pkg.Amount{}, pkg.ErrRateNotFound
+	}
+	return rate, nil
+}
+
+func (m *Mem) SetFXRate(ctx context.Context, base, quote string, rate pkg.Amount) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rate, err := rate.Rescale(fxRateScale)
+	if err != nil {
+		return err
+	}
+	m.ratesMu.Lock()
+	defer m.ratesMu.Unlock()
+	m.rates[base+"/"+quote] = rate
+	return nil
+}
+
+// CreateFXQuote locks the current base/quote rate for ttl, so transfers referencing it use the same rate
+func (m *Mem) CreateFXQuote(ctx context.Context, base, quote string, ttl time.Duration) (pkg.FXQuote, error) {
+	result := pkg.FXQuote{}
+	m.mu.Lock()
+	fx := m.fx
+	m.mu.Unlock()
+	rate, err := fx.Rate(ctx, base, quote)
+	if err != nil {
+		return result, err
+	}
+	if rate, err = rate.Rescale(fxRateScale); err != nil {
+		return result, err
+	}
+	err = m.tx(ctx, func(tx *memTx) error {
+		result = pkg.FXQuote{ID: uuid.New().String(), Base: base, Quote: quote, Rate: rate, Expires: tx.now.Add(ttl).Truncate(time.Microsecond)}
+		m.quotes[result.ID] = result
+		tx.onRollback(func() {
+			delete(m.quotes, result.ID)
+		})
+		return nil
+	})
+	return result, err
+}
+
+// externalRates fetches current rates of transfers from the wallet by legs without a quote if the provider is external,
+// so the store isn't locked while it waits for the provider. They're nil if the store is the provider
+func (m *Mem) externalRates(ctx context.Context, from string, legs []pkg.TransferLeg) pkg.FXRateProvider {
+	m.mu.Lock()
+	fx := m.fx
+	base := ""
+	quotes := make([]string, 0, len(legs))
+	if w, ok := m.wallets[pkg.WalletID(from)]; ok {
+		base = w.Currency
+	}
+	for _, l := range legs {
+		if w, ok := m.wallets[pkg.WalletID(l.To)]; ok && l.Quote == "" {
+			quotes = append(quotes, w.Currency)
+		}
+	}
+	m.mu.Unlock()
+	switch {
+	case fx == pkg.FXRateProvider(m):
+		return nil
+	case base == "":
+		// the transaction fails as the sender isn't found
+		return pkg.FXRates{}
+	}
+	return pkg.FetchFXRates(ctx, fx, base, quotes...)
+}
+
+// transferRate returns the rate of the quote if one is given, otherwise the current one of rates
+// or of the store if they're nil
+func (m *Mem) transferRate(ctx context.Context, tx *memTx, rates pkg.FXRateProvider, base, quote, quoteID string) (pkg.Amount, error) {
+	if quoteID == "" {
+		if rates == nil {
+			rates = m
+		}
+		rate, err := rates.Rate(ctx, base, quote)
+		if err != nil {
+			return pkg.Amount{}, err
+		}
+		return rate.Rescale(fxRateScale)
+	}
+	q, ok := m.quotes[quoteID]
+	switch {
+	case !ok, q.Base != base || q.Quote != quote:
+		return pkg.Amount{}, pkg.ErrInvalidQuote
+	case !q.Expires.After(tx.now):
+		return pkg.Amount{}, pkg.ErrQuoteExpired
+	}
+	return q.Rate, nil
+}
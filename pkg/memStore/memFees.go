@@ -0,0 +1,79 @@
+package memStore
+
+import (
+	"context"
+	"fmt"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+)
+
+// feeScope is what a fee rule applies to, clientID is -1 and currency is empty for rules of any client or currency
+type feeScope struct {
+	clientID int
+	tType    int8
+	currency string
+}
+
+// SetFeeWallet sets the wallet fees are credited to, fees in other currencies or without the wallet set
+// are posted to the fees account
+func (m *Mem) SetFeeWallet(wallet string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.feeWallet = pkg.WalletID(wallet)
+}
+
+// SetFeeRule creates or replaces the rule for the client, transaction type and currency of rule
+func (m *Mem) SetFeeRule(ctx context.Context, rule pkg.FeeRule) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		scope := feeScope{clientID: -1, tType: rule.Type, currency: rule.Currency}
+		if rule.ClientID != nil {
+			clientID := *rule.ClientID
+			scope.clientID, rule.ClientID = clientID, &clientID
+		}
+		m.feeRules[scope] = rule
+		return nil
+	})
+}
+
+// fee paid by the wallet owner for a transaction of amount, the most specific rule applies: client's over common ones,
+// for the wallet currency over any currency ones
+func (m *Mem) fee(tType pgStore.TransactionType, w *pkg.Wallet, amount pkg.Amount) (pkg.Amount, error) {
+	exp, err := pkg.CurrencyExponent(w.Currency)
+	if err != nil {
+		return pkg.Amount{}, err
+	}
+	for _, scope := range []feeScope{
+		{clientID: w.Owner, tType: int8(tType), currency: w.Currency},
+		{clientID: w.Owner, tType: int8(tType)},
+		{clientID: -1, tType: int8(tType), currency: w.Currency},
+		{clientID: -1, tType: int8(tType)},
+	} {
+		rule, ok := m.feeRules[scope]
+		if !ok {
+			continue
+		}
+		if amount.Sign() < 0 {
+			amount = amount.Neg()
+		}
+		return rule.Fee(amount, exp)
+	}
+	return pkg.NewAmount(0, exp), nil
+}
+
+// chargeFee credits the fee wallet and returns the posting of it
+func (m *Mem) chargeFee(tx *memTx, currency string, fee pkg.Amount) (pgStore.Posting, error) {
+	posting := pgStore.Posting{Account: pgStore.AccountFees, Currency: currency, Amount: fee}
+	if fee.Sign() == 0 || m.feeWallet == "" {
+		return posting, nil
+	}
+	feeWalletCurrency, err := m.walletCurrency(m.feeWallet)
+	if err != nil {
+		return posting, fmt.Errorf("err getting fee wallet %s: %w", m.feeWallet, err)
+	}
+	if feeWalletCurrency != currency {
+		return posting, nil
+	}
+	m.credit(tx, m.wallets[m.feeWallet], fee)
+	posting.Account = m.feeWallet
+	return posting, nil
+}
@@ -0,0 +1,208 @@
+package memStore
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"sort"
+	"time"
+)
+
+// PlaceHold reserves amount on the wallet for ttl, currency if not empty must match the wallet's one
+func (m *Mem) PlaceHold(ctx context.Context, wallet string, amount pkg.Amount, currency string, ttl time.Duration, key string) (pkg.Hold, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Hold{}
+	err := m.tx(ctx, func(tx *memTx) error {
+		w, err := m.lockWallet(wallet, true)
+		if err != nil {
+			return err
+		}
+		if currency != "" && currency != w.Currency {
+			return pkg.ErrCurrencyMismatch
+		}
+		if amount, err = pkg.InCurrency(amount, w.Currency); err != nil {
+			return err
+		}
+		if amount.Sign() <= 0 {
+			return pkg.ErrInvalidAmount
+		}
+		if w.Amount.Sub(w.Held).Cmp(amount) < 0 {
+			return pkg.ErrInsufficientFunds
+		}
+		if m.holdKeys[key] {
+			return pkg.ErrDuplicateAction(key)
+		}
+		m.changeHeld(tx, w, amount)
+		h := &pkg.Hold{
+			ID:       uuid.New().String(),
+			Wallet:   wallet,
+			Key:      key,
+			Amount:   amount,
+			Currency: w.Currency,
+			Status:   pkg.HoldActive,
+			Expires:  tx.now.Add(ttl).Truncate(time.Microsecond),
+			Updated:  tx.now,
+			Created:  tx.now,
+		}
+		m.holds[h.ID], m.holdKeys[key] = h, true
+		tx.onRollback(func() {
+			delete(m.holds, h.ID)
+			delete(m.holdKeys, key)
+		})
+		if result, err = holdToCurrency(*h); err != nil {
+			return err
+		}
+		tx.notify = append(tx.notify, wallet)
+		return m.emitEvent(tx, wallet, pkg.EventHoldPlaced, result)
+	})
+	return result, err
+}
+
+func (m *Mem) GetHold(ctx context.Context, id string) (pkg.Hold, error) {
+	var result pkg.Hold
+	err := m.tx(ctx, func(tx *memTx) error {
+		h, ok := m.holds[id]
+		if !ok {
+			return pkg.ErrHoldNotFound
+		}
+		var err error
+		result, err = holdToCurrency(*h)
+		return err
+	})
+	return result, err
+}
+
+// CaptureHold debits amount of the hold from the wallet and releases the rest of it,
+// zero amount captures the whole hold. A hold may be captured only once
+func (m *Mem) CaptureHold(ctx context.Context, id string, amount pkg.Amount, key string) (pkg.Hold, error) {
+	result := pkg.Hold{}
+	err := m.tx(ctx, func(tx *memTx) error {
+		h, ok := m.holds[id]
+		switch {
+		case !ok:
+			return pkg.ErrHoldNotFound
+		case h.Status != pkg.HoldActive:
+			return pkg.ErrHoldNotActive
+		case !h.Expires.After(tx.now):
+			return pkg.ErrHoldExpired
+		}
+		if amount.Sign() == 0 {
+			amount = h.Amount
+		}
+		var err error
+		if amount, err = pkg.InCurrency(amount, h.Currency); err != nil {
+			return err
+		}
+		if amount.Sign() < 0 {
+			return pkg.ErrInvalidAmount
+		}
+		if amount.Cmp(h.Amount) > 0 {
+			return pkg.ErrCaptureExceedsHold
+		}
+		w, err := m.lockWallet(h.Wallet, true)
+		if err != nil {
+			return err
+		}
+		m.credit(tx, w, amount.Neg())
+		m.changeHeld(tx, w, h.Amount.Neg())
+		if amount.Sign() > 0 {
+			t := &transaction{tType: pgStore.TransactionCapture, wallet: h.Wallet, key: key, amount: amount.Neg(), currency: h.Currency}
+			if _, err = m.insertTransaction(tx, t); err != nil {
+				return err
+			}
+			m.post(tx, t,
+				pgStore.Posting{Account: h.Wallet, Currency: h.Currency, Amount: amount.Neg()},
+				pgStore.Posting{Account: pgStore.AccountCashOut, Currency: h.Currency, Amount: amount},
+			)
+		}
+		m.closeHold(tx, h, pkg.HoldCaptured, amount)
+		if result, err = holdToCurrency(*h); err != nil {
+			return err
+		}
+		tx.notify = append(tx.notify, h.Wallet)
+		return m.emitEvent(tx, h.Wallet, pkg.EventHoldCaptured, result)
+	})
+	return result, err
+}
+
+// VoidHold releases the whole hold, expired holds which haven't been released yet may be voided too
+func (m *Mem) VoidHold(ctx context.Context, id string) (pkg.Hold, error) {
+	result := pkg.Hold{}
+	err := m.tx(ctx, func(tx *memTx) error {
+		h, ok := m.holds[id]
+		if !ok {
+			return pkg.ErrHoldNotFound
+		}
+		if h.Status != pkg.HoldActive {
+			return pkg.ErrHoldNotActive
+		}
+		m.changeHeld(tx, m.wallets[h.Wallet], h.Amount.Neg())
+		m.closeHold(tx, h, pkg.HoldVoided, pkg.Amount{})
+		var err error
+		if result, err = holdToCurrency(*h); err != nil {
+			return err
+		}
+		tx.notify = append(tx.notify, h.Wallet)
+		return m.emitEvent(tx, h.Wallet, pkg.EventHoldVoided, result)
+	})
+	return result, err
+}
+
+// ExpireHolds releases active holds past their expiry, returns the number of holds released
+func (m *Mem) ExpireHolds(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.tx(ctx, func(tx *memTx) error {
+		n = 0
+		expired := make([]*pkg.Hold, 0)
+		for _, h := range m.holds {
+			if h.Status == pkg.HoldActive && !h.Expires.After(tx.now) {
+				expired = append(expired, h)
+			}
+		}
+		sort.Slice(expired, func(i, j int) bool {
+			return expired[i].Created.Before(expired[j].Created)
+		})
+		for _, h := range expired {
+			m.changeHeld(tx, m.wallets[h.Wallet], h.Amount.Neg())
+			m.closeHold(tx, h, pkg.HoldExpired, h.Captured)
+			result, err := holdToCurrency(*h)
+			if err != nil {
+				return err
+			}
+			tx.notify = append(tx.notify, h.Wallet)
+			if err = m.emitEvent(tx, h.Wallet, pkg.EventHoldExpired, result); err != nil {
+				return err
+			}
+		}
+		n = int64(len(expired))
+		return nil
+	})
+	return n, err
+}
+
+// changeHeld changes the amount held on the wallet
+func (m *Mem) changeHeld(tx *memTx, w *pkg.Wallet, change pkg.Amount) {
+	held, updated := w.Held, w.Updated
+	w.Held, w.Updated = w.Held.Add(change), tx.now
+	tx.onRollback(func() {
+		w.Held, w.Updated = held, updated
+	})
+}
+
+func (m *Mem) closeHold(tx *memTx, h *pkg.Hold, status pkg.HoldStatus, captured pkg.Amount) {
+	prev := *h
+	h.Status, h.Captured, h.Updated = status, captured, tx.now
+	tx.onRollback(func() {
+		*h = prev
+	})
+}
+
+func holdToCurrency(h pkg.Hold) (pkg.Hold, error) {
+	var err error
+	if h.Amount, err = toCurrency(h.Amount, h.Currency); err != nil {
+		return h, err
+	}
+	h.Captured, err = toCurrency(h.Captured, h.Currency)
+	return h, err
+}
@@ -0,0 +1,78 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"time"
+)
+
+type idempotencyScope struct {
+	clientID int
+	key      string
+}
+
+// ReserveIdempotencyKey reserves the key of the client for a request with fingerprint.
+// If the key is already used, returns its record: completed ones are to be replayed,
+// pkg.ErrKeyReused is returned if the fingerprint differs and pkg.ErrRequestInProgress if it's not completed yet
+func (m *Mem) ReserveIdempotencyKey(ctx context.Context, clientID int, key, fingerprint string) (pkg.IdempotencyRecord, bool, error) {
+	var result pkg.IdempotencyRecord
+	var reserved bool
+	err := m.tx(ctx, func(tx *memTx) error {
+		scope := idempotencyScope{clientID: clientID, key: key}
+		record, ok := m.idempotency[scope]
+		if reserved = !ok; reserved {
+			m.idempotency[scope] = &pkg.IdempotencyRecord{ClientID: clientID, Key: key, Fingerprint: fingerprint, Created: tx.now}
+			return nil
+		}
+		result = *record
+		if result.Fingerprint != fingerprint {
+			return pkg.ErrKeyReused
+		}
+		if result.Status != 0 {
+			return nil
+		}
+		if reserved = record.Created.Before(tx.now.Add(-idempotencyLockTimeout)); !reserved {
+			return pkg.ErrRequestInProgress
+		}
+		record.Created = tx.now
+		return nil
+	})
+	return result, reserved, err
+}
+
+// SaveIdempotentResponse completes the request with the key reserved
+func (m *Mem) SaveIdempotentResponse(ctx context.Context, clientID int, key string, status int, response []byte) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		if record, ok := m.idempotency[idempotencyScope{clientID: clientID, key: key}]; ok {
+			record.Status, record.Response = status, append([]byte(nil), response...)
+		}
+		return nil
+	})
+}
+
+// ReleaseIdempotencyKey lets the key to be used again after the request with it failed
+func (m *Mem) ReleaseIdempotencyKey(ctx context.Context, clientID int, key string) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		scope := idempotencyScope{clientID: clientID, key: key}
+		if record, ok := m.idempotency[scope]; ok && record.Status == 0 {
+			delete(m.idempotency, scope)
+		}
+		return nil
+	})
+}
+
+// PurgeIdempotencyKeys deletes records older than ttl, returns the number of records deleted
+func (m *Mem) PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error) {
+	var result int64
+	err := m.tx(ctx, func(tx *memTx) error {
+		result = 0
+		for scope, record := range m.idempotency {
+			if record.Created.Before(tx.now.Add(-ttl)) {
+				delete(m.idempotency, scope)
+				result++
+			}
+		}
+		return nil
+	})
+	return result, err
+}
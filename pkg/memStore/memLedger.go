@@ -0,0 +1,139 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"time"
+)
+
+// transaction is the journal entry header, AmountReceived and CurrencyReceiver equal Amount and Currency
+// unless it's a transfer between currencies
+type transaction struct {
+	id               int64
+	tType            pgStore.TransactionType
+	wallet           string
+	walletReceiver   string
+	key              string
+	amount           pkg.Amount
+	currency         string
+	amountReceived   pkg.Amount
+	currencyReceiver string
+	rate             pkg.Amount
+	fee              pkg.Amount
+	originalID       int64
+	paymentID        string
+	ts               time.Time
+	postings         []*posting
+}
+
+type posting struct {
+	id          int64
+	transaction *transaction
+	pgStore.Posting
+	ts time.Time
+}
+
+// insertTransaction adds the journal entry header, returns pkg.ErrDuplicateAction if the key is already used
+func (m *Mem) insertTransaction(tx *memTx, t *transaction) (int64, error) {
+	if _, ok := m.keys[t.key]; ok {
+		return 0, pkg.ErrDuplicateAction(t.key)
+	}
+	if t.currencyReceiver == "" {
+		t.amountReceived, t.currencyReceiver = t.amount, t.currency
+	}
+	if t.rate == (pkg.Amount{}) {
+		t.rate = pkg.NewAmount(1, 0)
+	}
+	t.id = int64(len(m.transactions)) + 1
+	t.ts = tx.now
+	m.transactions = append(m.transactions, t)
+	m.keys[t.key] = t.id
+	tx.onRollback(func() {
+		m.transactions = m.transactions[:len(m.transactions)-1]
+		delete(m.keys, t.key)
+	})
+	return t.id, nil
+}
+
+// post adds postings of the transaction, subscribers of wallet accounts are notified on success
+func (m *Mem) post(tx *memTx, t *transaction, postings ...pgStore.Posting) {
+	for _, p := range postings {
+		if p.Amount.Sign() == 0 {
+			continue
+		}
+		entry := &posting{id: int64(len(m.postings)) + 1, transaction: t, Posting: p, ts: tx.now}
+		m.postings = append(m.postings, entry)
+		m.accounts[p.Account] = append(m.accounts[p.Account], entry)
+		t.postings = append(t.postings, entry)
+		tx.onRollback(func() {
+			m.postings = m.postings[:len(m.postings)-1]
+			m.accounts[entry.Account] = m.accounts[entry.Account][:len(m.accounts[entry.Account])-1]
+			t.postings = t.postings[:len(t.postings)-1]
+		})
+		if !isSystemAccount(p.Account) {
+			tx.notify = append(tx.notify, p.Account)
+		}
+	}
+}
+
+// LedgerBalance sums the postings of an account, for a wallet it always equals the wallet amount
+func (m *Mem) LedgerBalance(ctx context.Context, account string) (pkg.Amount, error) {
+	account = pkg.WalletID(account)
+	var result pkg.Amount
+	err := m.tx(ctx, func(tx *memTx) error {
+		for _, p := range m.accounts[account] {
+			result = result.Add(p.Amount)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// toTransaction is the entry as reported by pgStore, the posting is of the wallet account if given
+func (t *transaction) toTransaction(p *posting) (pgStore.Transaction, error) {
+	amount, err := toCurrency(t.amount, t.currency)
+	if err != nil {
+		return pgStore.Transaction{}, err
+	}
+	received, err := toCurrency(t.amountReceived, t.currencyReceiver)
+	if err != nil {
+		return pgStore.Transaction{}, err
+	}
+	fee, err := toCurrency(t.fee, t.currency)
+	if err != nil {
+		return pgStore.Transaction{}, err
+	}
+	legs := make([]pgStore.Posting, 0, len(t.postings))
+	for _, l := range t.postings {
+		leg := l.Posting
+		if leg.Amount, err = toCurrency(leg.Amount, leg.Currency); err != nil {
+			return pgStore.Transaction{}, err
+		}
+		legs = append(legs, leg)
+	}
+	result := pgStore.Transaction{
+		ID:               t.id,
+		Type:             t.tType,
+		Wallet:           t.wallet,
+		WalletReceiver:   t.walletReceiver,
+		Key:              t.key,
+		Amount:           amount,
+		Currency:         t.currency,
+		AmountReceived:   received,
+		CurrencyReceiver: t.currencyReceiver,
+		Rate:             t.rate,
+		Fee:              fee,
+		OriginalID:       t.originalID,
+		PaymentID:        t.paymentID,
+		Ts:               t.ts,
+		Legs:             legs,
+	}
+	if p != nil {
+		result.PostingID, result.Ts = p.id, p.ts
+		if result.PostingAmount, err = toCurrency(p.Amount, p.Currency); err != nil {
+			return pgStore.Transaction{}, err
+		}
+	}
+	return result, nil
+}
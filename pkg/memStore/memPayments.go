@@ -0,0 +1,140 @@
+package memStore
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+)
+
+// SplitPayment pays amount from the wallet to receivers by parts allocated with pkg.Split, all of them or none.
+// The payment is one transfer keyed by its id: the sender is debited amount and the fee of a transfer of it once,
+// each receiver is credited its part converted by the current rate. Parts are the receipts of the receivers.
+// The error of a failed part is pkg.ErrBatchLeg with its index
+func (m *Mem) SplitPayment(ctx context.Context, from string, amount pkg.Amount, currency string, parts []pkg.SplitPart, key string) (pkg.Payment, error) {
+	from = pkg.WalletID(from)
+	legs := make([]pkg.TransferLeg, 0, len(parts))
+	for _, p := range parts {
+		legs = append(legs, pkg.TransferLeg{To: p.To})
+	}
+	rates := m.externalRates(ctx, from, legs)
+	var payment pkg.Payment
+	err := m.tx(ctx, func(tx *memTx) error {
+		sender, err := m.lockWallet(from, true)
+		if err != nil {
+			return err
+		}
+		if currency != "" && currency != sender.Currency {
+			return pkg.ErrCurrencyMismatch
+		}
+		if amount, err = pkg.InCurrency(amount, sender.Currency); err != nil {
+			return err
+		}
+		shares, err := pkg.Split(amount, parts)
+		if err != nil {
+			return err
+		}
+		zero, err := pkg.InCurrency(pkg.Amount{}, sender.Currency)
+		if err != nil {
+			return err
+		}
+		if m.paymentKeys[key] {
+			return pkg.ErrDuplicateAction(key)
+		}
+		m.paymentKeys[key] = true
+		tx.onRollback(func() {
+			delete(m.paymentKeys, key)
+		})
+		payment = pkg.Payment{ID: uuid.New().String(), Wallet: from, Key: key, Amount: amount, Currency: sender.Currency,
+			Parts: make([]pkg.Receipt, 0, len(parts))}
+		var postings []pgStore.Posting
+		for i, p := range parts {
+			receipt, partPostings, err := m.creditPart(ctx, tx, rates, from, p.To, shares[i], sender.Currency)
+			if err != nil {
+				return pkg.ErrBatchLeg{Index: i, Err: err}
+			}
+			receipt.Key, receipt.Fee = payment.ID, zero
+			payment.Parts = append(payment.Parts, receipt)
+			postings = append(postings, partPostings...)
+		}
+		if payment.Fee, err = m.fee(pgStore.TransactionTransferFunds, sender, amount); err != nil {
+			return err
+		}
+		payment.Total = amount.Add(payment.Fee).Neg()
+		if !m.changeBalance(tx, sender, payment.Total) {
+			return pkg.ErrInsufficientFunds
+		}
+		t := &transaction{tType: pgStore.TransactionTransferFunds, wallet: from, key: payment.ID, amount: amount,
+			currency: sender.Currency, amountReceived: amount, currencyReceiver: sender.Currency, fee: payment.Fee, paymentID: payment.ID}
+		id, err := m.insertTransaction(tx, t)
+		if err != nil {
+			return err
+		}
+		feePosting, err := m.chargeFee(tx, sender.Currency, payment.Fee)
+		if err != nil {
+			return err
+		}
+		postings = append(postings,
+			pgStore.Posting{Account: from, Currency: sender.Currency, Amount: payment.Total},
+			feePosting,
+		)
+		m.post(tx, t, postings...)
+		for i := range payment.Parts {
+			payment.Parts[i].TransactionID = id
+			data := transferEvent{From: from, To: parts[i].To, Receipt: payment.Parts[i]}
+			if err = m.emitEvent(tx, from, pkg.EventTransferSent, data); err != nil {
+				return err
+			}
+			if err = m.emitEvent(tx, data.To, pkg.EventTransferReceived, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return payment, err
+}
+
+// creditPart credits the receiver the share of the payment converted to its currency,
+// returns the receipt of the part and its postings
+func (m *Mem) creditPart(ctx context.Context, tx *memTx, rates pkg.FXRateProvider, from, to string, share pkg.Amount,
+	currency string) (pkg.Receipt, []pgStore.Posting, error) {
+	to = pkg.WalletID(to)
+	if from == to {
+		return pkg.Receipt{}, nil, pkg.ErrSelfTransfer
+	}
+	_, receiver, err := m.lockWallets(from, to)
+	if err != nil {
+		return pkg.Receipt{}, nil, err
+	}
+	received := share
+	postings := make([]pgStore.Posting, 0, 3)
+	if currency != receiver.Currency {
+		rate, err := m.transferRate(ctx, tx, rates, currency, receiver.Currency, "")
+		if err != nil {
+			return pkg.Receipt{}, nil, err
+		}
+		exp, err := pkg.CurrencyExponent(receiver.Currency)
+		if err != nil {
+			return pkg.Receipt{}, nil, err
+		}
+		if received, err = share.Convert(rate, exp); err != nil {
+			return pkg.Receipt{}, nil, err
+		}
+		if received.Sign() <= 0 {
+			return pkg.Receipt{}, nil, pkg.ErrInvalidAmount
+		}
+		postings = append(postings,
+			pgStore.Posting{Account: pgStore.AccountFX, Currency: currency, Amount: share},
+			pgStore.Posting{Account: pgStore.AccountFX, Currency: receiver.Currency, Amount: received.Neg()},
+		)
+	}
+	m.credit(tx, receiver, received)
+	receipt := pkg.Receipt{
+		Amount:           share,
+		Currency:         currency,
+		AmountReceived:   received,
+		CurrencyReceiver: receiver.Currency,
+		Total:            share.Neg(),
+	}
+	return receipt, append(postings, pgStore.Posting{Account: to, Currency: receiver.Currency, Amount: received}), nil
+}
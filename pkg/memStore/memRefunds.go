@@ -0,0 +1,155 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+)
+
+// GetTransaction finds a transaction by id, or by key if id is 0
+func (m *Mem) GetTransaction(ctx context.Context, id int64, key string) (pgStore.Transaction, error) {
+	var result pgStore.Transaction
+	err := m.tx(ctx, func(tx *memTx) error {
+		t, err := m.getTransaction(id, key)
+		if err != nil {
+			return err
+		}
+		result, err = t.toTransaction(nil)
+		return err
+	})
+	return result, err
+}
+
+// Refund reverses amount of the original transaction found by id, or by key if id is 0,
+// zero amount refunds all that is left. Refunds of deposits, withdrawals and captures change the wallet balance back,
+// refunds of transfers return funds from the receiver to the sender by the rate of the original transfer
+func (m *Mem) Refund(ctx context.Context, originalID int64, originalKey string, amount pkg.Amount, key string) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		original, err := m.getTransaction(originalID, originalKey)
+		if err != nil {
+			return err
+		}
+		// split payments have no single receiver to refund them
+		if original.tType == pgStore.TransactionRefund || original.tType == pgStore.TransactionTransferFunds && original.walletReceiver == "" {
+			return pkg.ErrNotRefundable
+		}
+		var refunded, refundedReceived pkg.Amount
+		for _, t := range m.transactions {
+			if t.originalID == original.id {
+				refunded, refundedReceived = refunded.Add(t.amount), refundedReceived.Add(t.amountReceived)
+			}
+		}
+		// refunds are kept with the sign opposite to the original amount
+		negative := original.amount.Sign() < 0
+		remaining := original.amount.Add(refunded)
+		if negative {
+			remaining = remaining.Neg()
+		}
+		if amount.Sign() == 0 {
+			amount = remaining
+		}
+		if amount, err = pkg.InCurrency(amount, original.currency); err != nil {
+			return err
+		}
+		if amount.Sign() <= 0 || amount.Cmp(remaining) > 0 {
+			return pkg.ErrRefundExceedsOriginal
+		}
+		if original.tType != pgStore.TransactionTransferFunds {
+			change := amount.Neg()
+			if negative {
+				change = amount
+			}
+			w, err := m.lockWallet(original.wallet, change.Sign() < 0)
+			if err != nil {
+				return err
+			}
+			return m.refundDepositWithdrawal(tx, original, w, change, key)
+		}
+		receiver, sender, err := m.lockWallets(original.walletReceiver, original.wallet)
+		if err != nil {
+			return err
+		}
+		received := amount
+		if original.currency != original.currencyReceiver {
+			if amount.Cmp(remaining) == 0 {
+				received = original.amountReceived.Add(refundedReceived)
+			} else {
+				exp, err := pkg.CurrencyExponent(original.currencyReceiver)
+				if err != nil {
+					return err
+				}
+				if received, err = amount.Convert(original.rate, exp); err != nil {
+					return err
+				}
+			}
+		}
+		if received, err = pkg.InCurrency(received, original.currencyReceiver); err != nil {
+			return err
+		}
+		if !m.changeBalance(tx, receiver, received.Neg()) {
+			return pkg.ErrInsufficientFunds
+		}
+		m.credit(tx, sender, amount)
+		t := &transaction{tType: pgStore.TransactionRefund, wallet: original.wallet, walletReceiver: original.walletReceiver,
+			key: key, amount: amount.Neg(), currency: original.currency, amountReceived: received.Neg(),
+			currencyReceiver: original.currencyReceiver, rate: original.rate, originalID: original.id}
+		id, err := m.insertTransaction(tx, t)
+		if err != nil {
+			return err
+		}
+		postings := []pgStore.Posting{
+			{Account: original.walletReceiver, Currency: original.currencyReceiver, Amount: received.Neg()},
+			{Account: original.wallet, Currency: original.currency, Amount: amount},
+		}
+		if original.currency != original.currencyReceiver {
+			postings = append(postings,
+				pgStore.Posting{Account: pgStore.AccountFX, Currency: original.currency, Amount: amount.Neg()},
+				pgStore.Posting{Account: pgStore.AccountFX, Currency: original.currencyReceiver, Amount: received},
+			)
+		}
+		m.post(tx, t, postings...)
+		err = m.emitEvent(tx, original.walletReceiver, pkg.EventRefundSucceeded,
+			refundEvent{TransactionID: id, OriginalID: original.id, Key: key, Amount: received.Neg(), Currency: original.currencyReceiver})
+		if err != nil {
+			return err
+		}
+		return m.emitEvent(tx, original.wallet, pkg.EventRefundSucceeded,
+			refundEvent{TransactionID: id, OriginalID: original.id, Key: key, Amount: amount, Currency: original.currency})
+	})
+}
+
+// refundDepositWithdrawal changes the wallet balance by change against the counter account of the original
+func (m *Mem) refundDepositWithdrawal(tx *memTx, original *transaction, w *pkg.Wallet, change pkg.Amount, key string) error {
+	counterAccount := pgStore.AccountCashOut
+	if original.tType == pgStore.TransactionDeposit {
+		counterAccount = pgStore.AccountCashIn
+	}
+	if !m.changeBalance(tx, w, change) {
+		return pkg.ErrInsufficientFunds
+	}
+	t := &transaction{tType: pgStore.TransactionRefund, wallet: original.wallet, key: key, amount: change,
+		currency: original.currency, originalID: original.id}
+	id, err := m.insertTransaction(tx, t)
+	if err != nil {
+		return err
+	}
+	m.post(tx, t,
+		pgStore.Posting{Account: original.wallet, Currency: original.currency, Amount: change},
+		pgStore.Posting{Account: counterAccount, Currency: original.currency, Amount: change.Neg()},
+	)
+	return m.emitEvent(tx, original.wallet, pkg.EventRefundSucceeded,
+		refundEvent{TransactionID: id, OriginalID: original.id, Key: key, Amount: change, Currency: original.currency})
+}
+
+func (m *Mem) getTransaction(id int64, key string) (*transaction, error) {
+	if id == 0 {
+		var ok bool
+		if id, ok = m.keys[key]; !ok {
+			return nil, pkg.ErrTransactionNotFound
+		}
+	}
+	if id < 1 || id > int64(len(m.transactions)) {
+		return nil, pkg.ErrTransactionNotFound
+	}
+	return m.transactions[id-1], nil
+}
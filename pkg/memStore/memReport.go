@@ -0,0 +1,343 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"sort"
+	"time"
+)
+
+// Report returns all postings on the wallet account matching filters, oldest first
+func (m *Mem) Report(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType) ([]pgStore.Transaction, error) {
+	result, _, err := m.ReportPage(ctx, wallet, from, to, tType, pgStore.Page{})
+	return result, err
+}
+
+// ReportPage returns a page of postings on the wallet account matching filters
+// and the cursor of the next page if there is one
+func (m *Mem) ReportPage(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType, page pgStore.Page) ([]pgStore.Transaction, *pgStore.Cursor, error) {
+	wallet = pkg.WalletID(wallet)
+	result := make([]pgStore.Transaction, 0)
+	var next *pgStore.Cursor
+	err := m.tx(ctx, func(tx *memTx) error {
+		postings, err := m.report(wallet, from, to, tType, page)
+		if err != nil {
+			return err
+		}
+		if page.Limit > 0 && len(postings) > page.Limit {
+			postings = postings[:page.Limit]
+			last := postings[len(postings)-1]
+			next = &pgStore.Cursor{Ts: last.ts, ID: last.id}
+		}
+		result, err = toTransactions(postings)
+		return err
+	})
+	return result, next, err
+}
+
+// ExportReport calls fn for every posting on the wallet account matching filters, oldest first unless desc.
+// All of them are of the same snapshot, fn is called without blocking the store
+func (m *Mem) ExportReport(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType, desc bool, fn func(pgStore.Transaction) error) error {
+	wallet = pkg.WalletID(wallet)
+	var result []pgStore.Transaction
+	err := m.tx(ctx, func(tx *memTx) error {
+		postings, err := m.report(wallet, from, to, tType, pgStore.Page{Desc: desc})
+		if err != nil {
+			return err
+		}
+		result, err = toTransactions(postings)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range result {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransactionsAfter returns up to limit postings on the wallet account with ids greater than postingID, by id
+func (m *Mem) TransactionsAfter(ctx context.Context, wallet string, postingID int64, limit int) ([]pgStore.Transaction, error) {
+	wallet = pkg.WalletID(wallet)
+	result := make([]pgStore.Transaction, 0)
+	err := m.tx(ctx, func(tx *memTx) error {
+		postings := make([]*posting, 0)
+		for _, p := range m.accounts[wallet] {
+			if p.id > postingID && len(postings) < limit {
+				postings = append(postings, p)
+			}
+		}
+		var err error
+		result, err = toTransactions(postings)
+		return err
+	})
+	return result, err
+}
+
+// Statement returns postings on the wallet account from the start of the from day to the end of the to day,
+// oldest first. Opening balance is zero if from isn't specified, closing one is the opening plus postings
+func (m *Mem) Statement(ctx context.Context, wallet string, from, to *time.Time) (pgStore.Statement, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pgStore.Statement{Wallet: wallet, From: from, To: to}
+	err := m.tx(ctx, func(tx *memTx) error {
+		var err error
+		if result.Currency, err = m.walletCurrency(wallet); err != nil {
+			return err
+		}
+		if result.Opening, err = toCurrency(pkg.Amount{}, result.Currency); err != nil {
+			return err
+		}
+		if from != nil {
+			if result.Opening, err = m.balanceAt(wallet, *from, result.Currency); err != nil {
+				return err
+			}
+		}
+		postings, err := m.report(wallet, from, to, pgStore.AllTransactions, pgStore.Page{})
+		if err != nil {
+			return err
+		}
+		if result.Entries, err = toTransactions(postings); err != nil {
+			return err
+		}
+		result.Closing = result.Opening
+		for _, t := range result.Entries {
+			result.Closing = result.Closing.Add(t.PostingAmount)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// BalanceAt returns the wallet balance at the moment at, i.e. the sum of its postings before it
+func (m *Mem) BalanceAt(ctx context.Context, wallet string, at time.Time) (pkg.Balance, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Balance{Wallet: wallet, At: at}
+	err := m.tx(ctx, func(tx *memTx) error {
+		var err error
+		if result.Currency, err = m.walletCurrency(wallet); err != nil {
+			return err
+		}
+		result.Amount, err = m.balanceAt(wallet, at, result.Currency)
+		return err
+	})
+	return result, err
+}
+
+// BalanceSummary returns the wallet balances at the start of the from day and the end of the to day
+// with credits and debits in between. Opening balance is zero if from isn't specified
+func (m *Mem) BalanceSummary(ctx context.Context, wallet string, from, to *time.Time) (pkg.BalanceSummary, error) {
+	wallet = pkg.WalletID(wallet)
+	var result pkg.BalanceSummary
+	err := m.tx(ctx, func(tx *memTx) error {
+		currency, err := m.walletCurrency(wallet)
+		if err != nil {
+			return err
+		}
+		if result.Opening, err = toCurrency(pkg.Amount{}, currency); err != nil {
+			return err
+		}
+		if from != nil {
+			if result.Opening, err = m.balanceAt(wallet, *from, currency); err != nil {
+				return err
+			}
+		}
+		var credits, debits pkg.Amount
+		for _, p := range m.accounts[wallet] {
+			if !inPeriod(p.ts, from, to) {
+				continue
+			}
+			if p.Amount.Sign() > 0 {
+				credits = credits.Add(p.Amount)
+			} else {
+				debits = debits.Sub(p.Amount)
+			}
+		}
+		if result.Credits, err = toCurrency(credits, currency); err != nil {
+			return err
+		}
+		if result.Debits, err = toCurrency(debits, currency); err != nil {
+			return err
+		}
+		result.Closing = result.Opening.Add(result.Credits).Sub(result.Debits)
+		return nil
+	})
+	return result, err
+}
+
+// AggregateReport sums postings on the wallet account up by period and type, oldest first.
+// If wallet is empty postings on all wallets of the owner are summed up together per currency
+func (m *Mem) AggregateReport(ctx context.Context, wallet string, owner int, from, to *time.Time, period pgStore.AggregatePeriod) ([]pgStore.Aggregate, error) {
+	wallet = pkg.WalletID(wallet)
+	switch period {
+	case pgStore.PeriodDay, pgStore.PeriodWeek, pgStore.PeriodMonth:
+	default:
+		return nil, pkg.ErrInvalidPeriod
+	}
+	result := make([]pgStore.Aggregate, 0)
+	err := m.tx(ctx, func(tx *memTx) error {
+		accounts := []string{wallet}
+		if wallet == "" {
+			accounts = accounts[:0]
+			for _, w := range m.wallets {
+				if w.Owner == owner {
+					accounts = append(accounts, w.Wallet)
+				}
+			}
+		}
+		type group struct {
+			period   time.Time
+			tType    pgStore.TransactionType
+			currency string
+		}
+		groups := make(map[group]*pgStore.Aggregate)
+		for _, account := range accounts {
+			for _, p := range m.accounts[account] {
+				if !inPeriod(p.ts, from, to) {
+					continue
+				}
+				g := group{period: truncate(p.ts, period), tType: p.transaction.tType, currency: p.Currency}
+				if g.tType == pgStore.TransactionTransferFunds && p.Amount.Sign() > 0 {
+					g.tType = pgStore.TransactionTransferFundsTo
+				}
+				a, ok := groups[g]
+				if !ok {
+					a = &pgStore.Aggregate{Period: g.period, Wallet: wallet, Type: g.tType, Currency: g.currency}
+					groups[g] = a
+				}
+				amount := p.Amount
+				if amount.Sign() < 0 {
+					amount = amount.Neg()
+				}
+				a.Count++
+				a.Amount = a.Amount.Add(amount)
+			}
+		}
+		result = result[:0]
+		for _, a := range groups {
+			var err error
+			if a.Amount, err = toCurrency(a.Amount, a.Currency); err != nil {
+				return err
+			}
+			result = append(result, *a)
+		}
+		sort.Slice(result, func(i, j int) bool {
+			a, b := result[i], result[j]
+			switch {
+			case !a.Period.Equal(b.Period):
+				return a.Period.Before(b.Period)
+			case a.Type != b.Type:
+				return a.Type < b.Type
+			}
+			return a.Currency < b.Currency
+		})
+		return nil
+	})
+	return result, err
+}
+
+// report returns postings on the wallet account matching filters ordered by (ts, id), one more than the page limit
+func (m *Mem) report(wallet string, from, to *time.Time, tType pgStore.TransactionType, page pgStore.Page) ([]*posting, error) {
+	switch tType {
+	case pgStore.TransactionDeposit, pgStore.TransactionWithdrawal, pgStore.TransactionTransferFunds, pgStore.TransactionTransferFundsTo,
+		pgStore.TransactionCapture, pgStore.TransactionRefund, pgStore.AllTransactions:
+	default:
+		return nil, pkg.ErrInvalidTransactionType
+	}
+	result := make([]*posting, 0)
+	for _, p := range m.accounts[wallet] {
+		if !inPeriod(p.ts, from, to) || !ofType(p, tType) || !afterCursor(p, page) {
+			continue
+		}
+		result = append(result, p)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if page.Desc {
+			i, j = j, i
+		}
+		a, b := result[i], result[j]
+		if !a.ts.Equal(b.ts) {
+			return a.ts.Before(b.ts)
+		}
+		return a.id < b.id
+	})
+	if page.Limit > 0 && len(result) > page.Limit+1 {
+		result = result[:page.Limit+1]
+	}
+	return result, nil
+}
+
+func (m *Mem) balanceAt(account string, at time.Time, currency string) (pkg.Amount, error) {
+	var amount pkg.Amount
+	for _, p := range m.accounts[account] {
+		if p.ts.Before(at) {
+			amount = amount.Add(p.Amount)
+		}
+	}
+	return toCurrency(amount, currency)
+}
+
+// ofType mirrors report filters of pgStore: transfers are outgoing ones unless TransactionTransferFundsTo is asked for
+func ofType(p *posting, tType pgStore.TransactionType) bool {
+	switch tType {
+	case pgStore.AllTransactions:
+		return true
+	case pgStore.TransactionTransferFunds:
+		return p.transaction.tType == pgStore.TransactionTransferFunds && p.Amount.Sign() < 0
+	case pgStore.TransactionTransferFundsTo:
+		return p.transaction.tType == pgStore.TransactionTransferFunds && p.Amount.Sign() > 0
+	}
+	return p.transaction.tType == tType
+}
+
+// inPeriod reports if ts is from the start of the from day to the end of the to day, either may be nil
+func inPeriod(ts time.Time, from, to *time.Time) bool {
+	if from != nil && ts.Before(wallClock(*from)) {
+		return false
+	}
+	if to != nil && !ts.Before(wallClock(to.Add(24*time.Hour))) {
+		return false
+	}
+	return true
+}
+
+func afterCursor(p *posting, page pgStore.Page) bool {
+	if page.Cursor == nil {
+		return true
+	}
+	c := page.Cursor
+	if page.Desc {
+		return p.ts.Before(c.Ts) || p.ts.Equal(c.Ts) && p.id < c.ID
+	}
+	return p.ts.After(c.Ts) || p.ts.Equal(c.Ts) && p.id > c.ID
+}
+
+// truncate is date_trunc of pg, weeks start on Monday
+func truncate(ts time.Time, period pgStore.AggregatePeriod) time.Time {
+	day := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case pgStore.PeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case pgStore.PeriodMonth:
+		return time.Date(ts.Year(), ts.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+func toTransactions(postings []*posting) ([]pgStore.Transaction, error) {
+	result := make([]pgStore.Transaction, 0, len(postings))
+	for _, p := range postings {
+		t, err := p.transaction.toTransaction(p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"sync"
+	"time"
+)
+
+// fxRateScale is the number of decimal places rates are kept with, as in the fx_rate table of pgStore
+const fxRateScale = 10
+
+// idempotencyLockTimeout is how long a key stays reserved by a request which is neither completed nor released
+const idempotencyLockTimeout = time.Minute
+
+// Mem is an in-memory store with the semantics of pgStore.PG for tests and local development.
+// Operations are serialized by a single lock and either apply all their changes or none of them
+type Mem struct {
+	mu        sync.Mutex
+	fx        pkg.FXRateProvider
+	feeWallet string
+	state
+	// rates are guarded by their own lock as the store is the rate provider of its transfers by default
+	ratesMu sync.RWMutex
+	rates   map[string]pkg.Amount
+}
+
+// state is everything Truncate forgets
+type state struct {
+	wallets      map[string]*pkg.Wallet
+	transactions []*transaction
+	keys         map[string]int64
+	postings     []*posting
+	accounts     map[string][]*posting
+	holds        map[string]*pkg.Hold
+	holdKeys     map[string]bool
+	paymentKeys  map[string]bool
+	quotes       map[string]pkg.FXQuote
+	feeRules     map[feeScope]pkg.FeeRule
+	history      []pkg.WalletStatusChange
+	clients      []clientRecord
+	nonces       map[int]map[string]time.Time
+	idempotency  map[idempotencyScope]*pkg.IdempotencyRecord
+	webhooks     []*pkg.Webhook
+	events       []event
+	deliveries   []*pkg.WebhookDelivery
+	subs         map[string]map[chan struct{}]struct{}
+}
+
+func newState() state {
+	return state{
+		wallets:     make(map[string]*pkg.Wallet),
+		keys:        make(map[string]int64),
+		accounts:    make(map[string][]*posting),
+		holds:       make(map[string]*pkg.Hold),
+		holdKeys:    make(map[string]bool),
+		paymentKeys: make(map[string]bool),
+		quotes:      make(map[string]pkg.FXQuote),
+		feeRules:    make(map[feeScope]pkg.FeeRule),
+		nonces:      make(map[int]map[string]time.Time),
+		idempotency: make(map[idempotencyScope]*pkg.IdempotencyRecord),
+		subs:        make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+func NewMemStore() *Mem {
+	m := &Mem{state: newState(), rates: make(map[string]pkg.Amount)}
+	m.fx = m
+	return m
+}
+
+// memTx is an operation in progress: changes it made are undone if it fails,
+// subscribers of wallets it changed are notified if it succeeds
+type memTx struct {
+	now    time.Time
+	undo   []func()
+	notify []string
+}
+
+// onRollback registers fn undoing a change made by the operation
+func (tx *memTx) onRollback(fn func()) {
+	tx.undo = append(tx.undo, fn)
+}
+
+func (m *Mem) tx(ctx context.Context, fn func(tx *memTx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := &memTx{now: now()}
+	if err := fn(tx); err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	for _, wallet := range tx.notify {
+		m.notify(wallet)
+	}
+	return nil
+}
+
+// Truncate for tests, subscribers and settings are kept
+func (m *Mem) Truncate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subs := m.subs
+	m.state = newState()
+	m.subs = subs
+	m.ratesMu.Lock()
+	defer m.ratesMu.Unlock()
+	m.rates = make(map[string]pkg.Amount)
+	return nil
+}
+
+// now is rounded to microseconds as timestamps in pg are
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// wallClock drops the location of t keeping its date and time to the second, that's how report filters
+// are compared to timestamps by pgStore
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// toCurrency rescales an amount to the currency minor unit
+func toCurrency(amount pkg.Amount, currency string) (pkg.Amount, error) {
+	exp, err := pkg.CurrencyExponent(currency)
+	if err != nil {
+		return pkg.Amount{}, err
+	}
+	return amount.Rescale(exp)
+}
+
+func isSystemAccount(account string) bool {
+	switch account {
+	case pgStore.AccountCashIn, pgStore.AccountCashOut, pgStore.AccountFees, pgStore.AccountSuspense, pgStore.AccountFX:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+)
+
+// SetWalletStatus changes the wallet status and records the change made by the client with reason,
+// closed wallets can't be reopened, wallets with money on the balance or holds can't be closed
+func (m *Mem) SetWalletStatus(ctx context.Context, wallet string, status pkg.WalletStatus, reason string, clientID int) (pkg.Wallet, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Wallet{}
+	if status < pkg.WalletActive || status > pkg.WalletClosed {
+		return result, pkg.ErrInvalidWalletStatus
+	}
+	err := m.tx(ctx, func(tx *memTx) error {
+		w, ok := m.wallets[wallet]
+		if !ok {
+			return pkg.ErrWalletNotFound
+		}
+		current := w.Status
+		if current == pkg.WalletClosed {
+			return pkg.ErrWalletClosed
+		}
+		if status == pkg.WalletClosed && (w.Amount.Sign() != 0 || w.Held.Sign() != 0) {
+			return pkg.ErrWalletNotEmpty
+		}
+		if status != current {
+			updated := w.Updated
+			w.Status, w.Updated = status, tx.now
+			m.history = append(m.history, pkg.WalletStatusChange{
+				ID:       int64(len(m.history)) + 1,
+				Wallet:   wallet,
+				From:     current,
+				To:       status,
+				Reason:   reason,
+				ClientID: clientID,
+				Ts:       tx.now,
+			})
+			tx.onRollback(func() {
+				w.Status, w.Updated = current, updated
+				m.history = m.history[:len(m.history)-1]
+			})
+		}
+		var err error
+		if result, err = m.getWallet(wallet); err != nil {
+			return err
+		}
+		if status == current {
+			return nil
+		}
+		return m.emitEvent(tx, wallet, pkg.EventWalletStatusChanged,
+			statusEvent{Wallet: wallet, From: current, To: status, Reason: reason})
+	})
+	return result, err
+}
+
+// WalletStatusHistory returns status changes of the wallet, oldest first
+func (m *Mem) WalletStatusHistory(ctx context.Context, wallet string) ([]pkg.WalletStatusChange, error) {
+	wallet = pkg.WalletID(wallet)
+	var result []pkg.WalletStatusChange
+	err := m.tx(ctx, func(tx *memTx) error {
+		for _, change := range m.history {
+			if change.Wallet == wallet {
+				result = append(result, change)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
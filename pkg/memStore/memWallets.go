@@ -0,0 +1,300 @@
+package memStore
+
+import (
+	"context"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+)
+
+func (m *Mem) GetWallet(ctx context.Context, wallet string) (pkg.Wallet, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Wallet{}
+	err := m.tx(ctx, func(tx *memTx) error {
+		var err error
+		result, err = m.getWallet(wallet)
+		return err
+	})
+	return result, err
+}
+
+func (m *Mem) getWallet(wallet string) (pkg.Wallet, error) {
+	w, ok := m.wallets[wallet]
+	if !ok {
+		return pkg.Wallet{}, pkg.ErrWalletNotFound
+	}
+	result := *w
+	var err error
+	if result.Amount, err = toCurrency(w.Amount, w.Currency); err != nil {
+		return result, err
+	}
+	if result.Held, err = toCurrency(w.Held, w.Currency); err != nil {
+		return result, err
+	}
+	result.Available, err = toCurrency(w.Amount.Sub(w.Held), w.Currency)
+	return result, err
+}
+
+func (m *Mem) CreateWallet(ctx context.Context, wallet string, owner int, currency string) error {
+	wallet = pkg.WalletID(wallet)
+	return m.tx(ctx, func(tx *memTx) error {
+		if _, ok := m.wallets[wallet]; ok {
+			return pkg.ErrDuplicateAction(wallet)
+		}
+		m.wallets[wallet] = &pkg.Wallet{Wallet: wallet, Owner: owner, Currency: currency, Updated: tx.now, Created: tx.now}
+		tx.onRollback(func() {
+			delete(m.wallets, wallet)
+		})
+		return m.emitEvent(tx, wallet, pkg.EventWalletCreated, walletEvent{Wallet: wallet, Owner: owner, Currency: currency})
+	})
+}
+
+// DepositWithdraw changes the wallet balance by amount, currency if not empty must match the wallet's one.
+// Withdrawals are charged a fee on top of amount
+func (m *Mem) DepositWithdraw(ctx context.Context, wallet string, amount pkg.Amount, currency, key string) (pkg.Receipt, error) {
+	wallet = pkg.WalletID(wallet)
+	var receipt pkg.Receipt
+	err := m.tx(ctx, func(tx *memTx) error {
+		w, err := m.lockWallet(wallet, amount.Sign() < 0)
+		if err != nil {
+			return err
+		}
+		if currency != "" && currency != w.Currency {
+			return pkg.ErrCurrencyMismatch
+		}
+		if amount, err = pkg.InCurrency(amount, w.Currency); err != nil {
+			return err
+		}
+		tType, counterAccount := pgStore.TransactionDeposit, pgStore.AccountCashIn
+		if amount.Sign() < 0 {
+			tType, counterAccount = pgStore.TransactionWithdrawal, pgStore.AccountCashOut
+		}
+		feeAmount, err := pkg.InCurrency(pkg.Amount{}, w.Currency)
+		if err != nil {
+			return err
+		}
+		if tType == pgStore.TransactionWithdrawal {
+			if feeAmount, err = m.fee(tType, w, amount); err != nil {
+				return err
+			}
+		}
+		total := amount.Sub(feeAmount)
+		if !m.changeBalance(tx, w, total) {
+			return pkg.ErrInsufficientFunds
+		}
+		t := &transaction{tType: tType, wallet: wallet, key: key, amount: amount, currency: w.Currency, fee: feeAmount}
+		id, err := m.insertTransaction(tx, t)
+		if err != nil {
+			return err
+		}
+		feePosting, err := m.chargeFee(tx, w.Currency, feeAmount)
+		if err != nil {
+			return err
+		}
+		receipt = pkg.Receipt{
+			TransactionID:    id,
+			Key:              key,
+			Amount:           amount,
+			Currency:         w.Currency,
+			AmountReceived:   amount,
+			CurrencyReceiver: w.Currency,
+			Fee:              feeAmount,
+			Total:            total,
+		}
+		m.post(tx, t,
+			pgStore.Posting{Account: wallet, Currency: w.Currency, Amount: total},
+			pgStore.Posting{Account: counterAccount, Currency: w.Currency, Amount: amount.Neg()},
+			feePosting,
+		)
+		event := pkg.EventDepositSucceeded
+		if tType == pgStore.TransactionWithdrawal {
+			event = pkg.EventWithdrawalSucceeded
+		}
+		return m.emitEvent(tx, wallet, event, receipt)
+	})
+	return receipt, err
+}
+
+// TransferFunds moves amount in the sender's currency, currency if not empty must match it.
+// Transfers between wallets of different currencies are converted by the rate of quote if given or the current one.
+// The sender is charged a fee on top of amount
+func (m *Mem) TransferFunds(ctx context.Context, from, to string, amount pkg.Amount, currency, quote, key string) (pkg.Receipt, error) {
+	rates := m.externalRates(ctx, from, []pkg.TransferLeg{{To: to, Quote: quote}})
+	var receipt pkg.Receipt
+	err := m.tx(ctx, func(tx *memTx) error {
+		var err error
+		receipt, err = m.transfer(ctx, tx, rates, from, to, amount, currency, quote, key)
+		return err
+	})
+	return receipt, err
+}
+
+// TransferFundsBatch makes transfers from the wallet in one transaction, all of them or none.
+// The error of a failed transfer is pkg.ErrBatchLeg with its index
+func (m *Mem) TransferFundsBatch(ctx context.Context, from string, legs []pkg.TransferLeg) ([]pkg.Receipt, error) {
+	rates := m.externalRates(ctx, from, legs)
+	receipts := make([]pkg.Receipt, 0, len(legs))
+	err := m.tx(ctx, func(tx *memTx) error {
+		for i, l := range legs {
+			receipt, err := m.transfer(ctx, tx, rates, from, l.To, l.Amount, l.Currency, l.Quote, l.Key)
+			if err != nil {
+				return pkg.ErrBatchLeg{Index: i, Err: err}
+			}
+			receipts = append(receipts, receipt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// transfer is TransferFunds within tx, rates are of m.externalRates
+func (m *Mem) transfer(ctx context.Context, tx *memTx, rates pkg.FXRateProvider, from, to string, amount pkg.Amount, currency, quote, key string) (pkg.Receipt, error) {
+	from, to = pkg.WalletID(from), pkg.WalletID(to)
+	if from == to {
+		return pkg.Receipt{}, pkg.ErrSelfTransfer
+	}
+	sender, receiver, err := m.lockWallets(from, to)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	if currency != "" && currency != sender.Currency {
+		return pkg.Receipt{}, pkg.ErrCurrencyMismatch
+	}
+	if amount, err = pkg.InCurrency(amount, sender.Currency); err != nil {
+		return pkg.Receipt{}, err
+	}
+	received := amount
+	var rate pkg.Amount
+	if sender.Currency != receiver.Currency {
+		if rate, err = m.transferRate(ctx, tx, rates, sender.Currency, receiver.Currency, quote); err != nil {
+			return pkg.Receipt{}, err
+		}
+		exp, err := pkg.CurrencyExponent(receiver.Currency)
+		if err != nil {
+			return pkg.Receipt{}, err
+		}
+		if received, err = amount.Convert(rate, exp); err != nil {
+			return pkg.Receipt{}, err
+		}
+		if received.Sign() <= 0 {
+			return pkg.Receipt{}, pkg.ErrInvalidAmount
+		}
+	}
+	feeAmount, err := m.fee(pgStore.TransactionTransferFunds, sender, amount)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	total := amount.Add(feeAmount).Neg()
+	if !m.changeBalance(tx, sender, total) {
+		return pkg.Receipt{}, pkg.ErrInsufficientFunds
+	}
+	t := &transaction{tType: pgStore.TransactionTransferFunds, wallet: from, walletReceiver: to, key: key, amount: amount,
+		currency: sender.Currency, amountReceived: received, currencyReceiver: receiver.Currency, rate: rate, fee: feeAmount}
+	id, err := m.insertTransaction(tx, t)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	m.credit(tx, receiver, received)
+	feePosting, err := m.chargeFee(tx, sender.Currency, feeAmount)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	receipt := pkg.Receipt{
+		TransactionID:    id,
+		Key:              key,
+		Amount:           amount,
+		Currency:         sender.Currency,
+		AmountReceived:   received,
+		CurrencyReceiver: receiver.Currency,
+		Fee:              feeAmount,
+		Total:            total,
+	}
+	postings := []pgStore.Posting{
+		{Account: from, Currency: sender.Currency, Amount: total},
+		{Account: to, Currency: receiver.Currency, Amount: received},
+		feePosting,
+	}
+	if sender.Currency != receiver.Currency {
+		postings = append(postings,
+			pgStore.Posting{Account: pgStore.AccountFX, Currency: sender.Currency, Amount: amount},
+			pgStore.Posting{Account: pgStore.AccountFX, Currency: receiver.Currency, Amount: received.Neg()},
+		)
+	}
+	m.post(tx, t, postings...)
+	data := transferEvent{From: from, To: to, Receipt: receipt}
+	if err = m.emitEvent(tx, from, pkg.EventTransferSent, data); err != nil {
+		return pkg.Receipt{}, err
+	}
+	if err = m.emitEvent(tx, to, pkg.EventTransferReceived, data); err != nil {
+		return pkg.Receipt{}, err
+	}
+	return receipt, nil
+}
+
+func (m *Mem) CheckOwnerWallet(ctx context.Context, wallet string, owner int) (bool, error) {
+	wallet = pkg.WalletID(wallet)
+	var result bool
+	err := m.tx(ctx, func(tx *memTx) error {
+		w, ok := m.wallets[wallet]
+		if !ok {
+			return pkg.ErrWalletNotFound
+		}
+		result = w.Owner == owner
+		return nil
+	})
+	return result, err
+}
+
+// lockWallet checks the wallet status allows debits or credits
+func (m *Mem) lockWallet(wallet string, debit bool) (*pkg.Wallet, error) {
+	w, ok := m.wallets[wallet]
+	if !ok {
+		return nil, pkg.ErrWalletNotFound
+	}
+	if debit {
+		return w, w.Status.CheckDebit()
+	}
+	return w, w.Status.CheckCredit()
+}
+
+// lockWallets checks statuses of the debited and the credited wallets, errors of the credited one
+// are those of the receiver
+func (m *Mem) lockWallets(debit, credit string) (*pkg.Wallet, *pkg.Wallet, error) {
+	d, err := m.lockWallet(debit, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, ok := m.wallets[credit]
+	if !ok {
+		return nil, nil, pkg.ErrReceiverNotFound
+	}
+	return d, c, c.Status.CheckReceiver()
+}
+
+// changeBalance changes the wallet amount unless the change is a debit of more than is available
+func (m *Mem) changeBalance(tx *memTx, w *pkg.Wallet, change pkg.Amount) bool {
+	if w.Amount.Sub(w.Held).Add(change).Sign() < 0 {
+		return false
+	}
+	m.credit(tx, w, change)
+	return true
+}
+
+// credit changes the wallet amount whatever it is
+func (m *Mem) credit(tx *memTx, w *pkg.Wallet, change pkg.Amount) {
+	amount := w.Amount
+	w.Amount = w.Amount.Add(change)
+	tx.onRollback(func() {
+		w.Amount = amount
+	})
+}
+
+func (m *Mem) walletCurrency(wallet string) (string, error) {
+	w, ok := m.wallets[wallet]
+	if !ok {
+		return "", pkg.ErrWalletNotFound
+	}
+	return w.Currency, nil
+}
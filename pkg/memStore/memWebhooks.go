@@ -0,0 +1,242 @@
+package memStore
+
+import (
+	"context"
+	"encoding/json"
+	"payment-system/pkg"
+	"sort"
+	"time"
+)
+
+const maxDeliveriesListed = 100
+
+// event is the payload of deliveries, the same as the one built by pgStore
+type event struct {
+	ID      int64           `json:"id"`
+	Type    pkg.EventType   `json:"type"`
+	Wallet  string          `json:"wallet"`
+	Created time.Time       `json:"created"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type walletEvent struct {
+	Wallet   string `json:"wallet"`
+	Owner    int    `json:"owner"`
+	Currency string `json:"currency"`
+}
+
+type transferEvent struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	pkg.Receipt
+}
+
+// refundEvent is the refund from the point of view of the wallet, Amount is the change of its balance
+type refundEvent struct {
+	TransactionID int64      `json:"transaction_id"`
+	OriginalID    int64      `json:"original_id"`
+	Key           string     `json:"key"`
+	Amount        pkg.Amount `json:"amount"`
+	Currency      string     `json:"currency"`
+}
+
+type statusEvent struct {
+	Wallet string           `json:"wallet"`
+	From   pkg.WalletStatus `json:"status_from"`
+	To     pkg.WalletStatus `json:"status_to"`
+	Reason string           `json:"reason"`
+}
+
+// emitEvent adds the event on the wallet for delivery to webhooks of its owner subscribed to it, data is the payload
+func (m *Mem) emitEvent(tx *memTx, wallet string, eventType pkg.EventType, data interface{}) error {
+	w, ok := m.wallets[wallet]
+	if !ok {
+		return nil
+	}
+	hooks := make([]*pkg.Webhook, 0)
+	for _, h := range m.webhooks {
+		if h.Active && h.ClientID == w.Owner && subscribed(h, eventType) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	e := event{ID: int64(len(m.events)) + 1, Type: eventType, Wallet: wallet, Created: tx.now, Data: raw}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	m.events = append(m.events, e)
+	n := len(m.deliveries)
+	for _, h := range hooks {
+		m.deliveries = append(m.deliveries, &pkg.WebhookDelivery{
+			ID:          int64(len(m.deliveries)) + 1,
+			WebhookID:   h.ID,
+			EventID:     e.ID,
+			EventType:   eventType,
+			Status:      pkg.DeliveryPending,
+			NextAttempt: tx.now,
+			Payload:     payload,
+			Updated:     tx.now,
+			Created:     tx.now,
+		})
+	}
+	tx.onRollback(func() {
+		m.events = m.events[:len(m.events)-1]
+		m.deliveries = m.deliveries[:n]
+	})
+	return nil
+}
+
+func subscribed(h *pkg.Webhook, eventType pkg.EventType) bool {
+	for _, e := range h.Events {
+		if e == string(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mem) CreateWebhook(ctx context.Context, clientID int, url string, events []string, secret string) (pkg.Webhook, error) {
+	var result pkg.Webhook
+	err := m.tx(ctx, func(tx *memTx) error {
+		h := &pkg.Webhook{
+			ID:       int64(len(m.webhooks)) + 1,
+			ClientID: clientID,
+			URL:      url,
+			Events:   append([]string(nil), events...),
+			Secret:   secret,
+			Active:   true,
+			Created:  tx.now,
+		}
+		m.webhooks = append(m.webhooks, h)
+		result = *h
+		return nil
+	})
+	return result, err
+}
+
+// ListWebhooks returns active webhooks of the client without their secrets
+func (m *Mem) ListWebhooks(ctx context.Context, clientID int) ([]pkg.Webhook, error) {
+	result := make([]pkg.Webhook, 0)
+	err := m.tx(ctx, func(tx *memTx) error {
+		for _, h := range m.webhooks {
+			if h.ClientID == clientID && h.Active {
+				w := *h
+				w.Secret = ""
+				result = append(result, w)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// DeleteWebhook deactivates the webhook of the client keeping its deliveries, pending ones are not sent anymore
+func (m *Mem) DeleteWebhook(ctx context.Context, clientID int, id int64) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		h := m.webhook(clientID, id)
+		if h == nil || !h.Active {
+			return pkg.ErrWebhookNotFound
+		}
+		h.Active = false
+		return nil
+	})
+}
+
+// WebhookDeliveries returns the latest deliveries to the webhook of the client, newest first
+func (m *Mem) WebhookDeliveries(ctx context.Context, clientID int, webhookID int64) ([]pkg.WebhookDelivery, error) {
+	result := make([]pkg.WebhookDelivery, 0)
+	err := m.tx(ctx, func(tx *memTx) error {
+		h := m.webhook(clientID, webhookID)
+		if h == nil {
+			return pkg.ErrWebhookNotFound
+		}
+		for i := len(m.deliveries) - 1; i >= 0 && len(result) < maxDeliveriesListed; i-- {
+			if d := m.deliveries[i]; d.WebhookID == webhookID {
+				result = append(result, m.delivery(d))
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// RedeliverWebhook schedules the delivery to the webhook of the client to be sent again right away
+// with a fresh set of attempts
+func (m *Mem) RedeliverWebhook(ctx context.Context, clientID int, webhookID, deliveryID int64) (pkg.WebhookDelivery, error) {
+	var result pkg.WebhookDelivery
+	err := m.tx(ctx, func(tx *memTx) error {
+		if m.webhook(clientID, webhookID) == nil || deliveryID < 1 || deliveryID > int64(len(m.deliveries)) {
+			return pkg.ErrDeliveryNotFound
+		}
+		d := m.deliveries[deliveryID-1]
+		if d.WebhookID != webhookID {
+			return pkg.ErrDeliveryNotFound
+		}
+		d.Status, d.Attempts, d.NextAttempt, d.Updated = pkg.DeliveryPending, 0, tx.now, tx.now
+		result = m.delivery(d)
+		return nil
+	})
+	return result, err
+}
+
+// ClaimWebhookDeliveries returns up to limit due deliveries counting the attempt, they aren't claimed again for lease
+func (m *Mem) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]pkg.WebhookDelivery, error) {
+	result := make([]pkg.WebhookDelivery, 0)
+	err := m.tx(ctx, func(tx *memTx) error {
+		due := make([]*pkg.WebhookDelivery, 0)
+		for _, d := range m.deliveries {
+			if d.Status == pkg.DeliveryPending && !d.NextAttempt.After(tx.now) && m.webhooks[d.WebhookID-1].Active {
+				due = append(due, d)
+			}
+		}
+		sort.SliceStable(due, func(i, j int) bool {
+			return due[i].NextAttempt.Before(due[j].NextAttempt)
+		})
+		if len(due) > limit {
+			due = due[:limit]
+		}
+		for _, d := range due {
+			d.Attempts++
+			d.NextAttempt, d.Updated = tx.now.Add(lease).Truncate(time.Microsecond), tx.now
+			result = append(result, m.delivery(d))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// CompleteWebhookDelivery records the result of the attempt, pending deliveries are attempted again in retryIn
+func (m *Mem) CompleteWebhookDelivery(ctx context.Context, id int64, status pkg.DeliveryStatus, statusCode int, lastError string, retryIn time.Duration) error {
+	return m.tx(ctx, func(tx *memTx) error {
+		if id < 1 || id > int64(len(m.deliveries)) {
+			return nil
+		}
+		d := m.deliveries[id-1]
+		d.Status, d.LastStatusCode, d.LastError = status, statusCode, lastError
+		d.NextAttempt, d.Updated = tx.now.Add(retryIn).Truncate(time.Microsecond), tx.now
+		return nil
+	})
+}
+
+// webhook returns the webhook of the client whether it's active or not, nil if there is none
+func (m *Mem) webhook(clientID int, id int64) *pkg.Webhook {
+	if id < 1 || id > int64(len(m.webhooks)) || m.webhooks[id-1].ClientID != clientID {
+		return nil
+	}
+	return m.webhooks[id-1]
+}
+
+// delivery copies the delivery along with the URL and the secret of its webhook
+func (m *Mem) delivery(d *pkg.WebhookDelivery) pkg.WebhookDelivery {
+	result := *d
+	h := m.webhooks[d.WebhookID-1]
+	result.URL, result.Secret = h.URL, h.Secret
+	return result
+}
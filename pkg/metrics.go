@@ -20,4 +20,18 @@ var (
 			Name:      "db_time",
 			Buckets:   []float64{.025, .05, .1, .5, 1, 2.5, 5, 10},
 		}, []string{"method"})
+	MetricThrottled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "payments",
+			Subsystem: "rate_limit",
+			Name:      "throttled",
+			Help:      "requests rejected by per client rate limit",
+		}, []string{"client"})
+	MetricWebhookAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "payments",
+			Subsystem: "webhook",
+			Name:      "attempts",
+			Help:      "webhook delivery attempts by result",
+		}, []string{"result"})
 )
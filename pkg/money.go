@@ -0,0 +1,281 @@
+package pkg
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultScale is the number of decimal places amounts are stored with
+const DefaultScale = 2
+
+// maxAmountScale keeps Units of any parsed amount within int64
+const maxAmountScale = 18
+
+// maxUnits is the largest Units, arithmetic saturates at ±maxUnits
+const maxUnits = 1<<63 - 1
+
+var ErrInvalidAmount = errors.New("err invalid amount")
+var ErrAmountPrecision = errors.New("err amount has more decimal places than allowed")
+
+var pow10 = func() [maxAmountScale + 1]int64 {
+	var result [maxAmountScale + 1]int64
+	result[0] = 1
+	for i := 1; i <= maxAmountScale; i++ {
+		result[i] = result[i-1] * 10
+	}
+	return result
+}()
+
+// Amount is an exact monetary value of Units minor units with Scale digits after the decimal point,
+// e.g. Amount{Units: 1050, Scale: 2} is 10.50. It's encoded as a decimal string in JSON, CSV and SQL
+type Amount struct {
+	Units int64
+	Scale uint8
+}
+
+func NewAmount(units int64, scale uint8) Amount {
+	return Amount{Units: units, Scale: scale}
+}
+
+// ParseAmount strictly parses a plain decimal like "-10.05", amount keeps the number of decimal places given,
+// more than maxScale decimal places are rejected with ErrAmountPrecision
+func ParseAmount(s string, maxScale uint8) (Amount, error) {
+	digits := s
+	negative := false
+	if strings.HasPrefix(digits, "-") {
+		negative = true
+		digits = digits[1:]
+	}
+	intPart, fracPart := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart, fracPart = digits[:i], digits[i+1:]
+		if fracPart == "" {
+			return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+	if intPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if len(fracPart) > int(maxScale) {
+		return Amount{}, fmt.Errorf("%w: %q", ErrAmountPrecision, s)
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart)+len(fracPart) > 18 {
+		return Amount{}, fmt.Errorf("%w: %q is too big", ErrInvalidAmount, s)
+	}
+	units, err := strconv.ParseInt("0"+intPart+fracPart, 10, 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if negative {
+		units = -units
+	}
+	return Amount{Units: units, Scale: uint8(len(fracPart))}, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Rescale returns the same value with scale decimal places, fails with ErrAmountPrecision if it can't be done exactly
+// and with ErrInvalidAmount if the value is too big for it. Errors are the bare sentinels as callers compare them with ==
+func (a Amount) Rescale(scale uint8) (Amount, error) {
+	switch {
+	case scale > maxAmountScale:
+		return Amount{}, ErrAmountPrecision
+	case scale == a.Scale:
+		return a, nil
+	case scale > a.Scale:
+		k := pow10[scale-a.Scale]
+		if a.Units > 0 && a.Units > maxUnits/k || a.Units < 0 && a.Units < -maxUnits/k {
+			return Amount{}, ErrInvalidAmount
+		}
+		return Amount{Units: a.Units * k, Scale: scale}, nil
+	default:
+		k := pow10[a.Scale-scale]
+		if a.Units%k != 0 {
+			return Amount{}, ErrAmountPrecision
+		}
+		return Amount{Units: a.Units / k, Scale: scale}, nil
+	}
+}
+
+// align rescales the amounts to the larger of their scales, units of one too big for it saturate at ±maxUnits
+func (a Amount) align(b Amount) (Amount, Amount) {
+	if a.Scale < b.Scale {
+		return a.saturate(b.Scale), b
+	}
+	return a, b.saturate(a.Scale)
+}
+
+// saturate rescales the amount to the larger scale, its units are ±maxUnits if it's too big for it
+func (a Amount) saturate(scale uint8) Amount {
+	result, err := a.Rescale(scale)
+	if err != nil {
+		return Amount{Units: int64(a.Sign()) * maxUnits, Scale: scale}
+	}
+	return result
+}
+
+// Add saturates at ±maxUnits rather than overflows
+func (a Amount) Add(b Amount) Amount {
+	a, b = a.align(b)
+	switch {
+	case b.Units > 0 && a.Units > maxUnits-b.Units:
+		return Amount{Units: maxUnits, Scale: a.Scale}
+	case b.Units < 0 && a.Units < -maxUnits-b.Units:
+		return Amount{Units: -maxUnits, Scale: a.Scale}
+	}
+	return Amount{Units: a.Units + b.Units, Scale: a.Scale}
+}
+
+func (a Amount) Sub(b Amount) Amount {
+	return a.Add(b.Neg())
+}
+
+func (a Amount) Neg() Amount {
+	return Amount{Units: -a.Units, Scale: a.Scale}
+}
+
+// Sign returns -1, 0 or 1
+func (a Amount) Sign() int {
+	switch {
+	case a.Units < 0:
+		return -1
+	case a.Units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Cmp compares values regardless of scale, returns -1, 0 or 1
+func (a Amount) Cmp(b Amount) int {
+	return a.Sub(b).Sign()
+}
+
+// Convert multiplies amount by rate and rounds the result half away from zero to scale decimal places,
+// fails with ErrInvalidAmount if the result is too big
+func (a Amount) Convert(rate Amount, scale uint8) (Amount, error) {
+	product := new(big.Int).Mul(big.NewInt(a.Units), big.NewInt(rate.Units))
+	productScale := int(a.Scale) + int(rate.Scale)
+	if productScale < int(scale) {
+		product.Mul(product, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(int(scale)-productScale)), nil))
+	} else {
+		divisor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(productScale-int(scale))), nil)
+		remainder := new(big.Int)
+		product.QuoRem(product, divisor, remainder)
+		if new(big.Int).Lsh(remainder.Abs(remainder), 1).Cmp(divisor) >= 0 {
+			product.Add(product, big.NewInt(int64(a.Sign()*rate.Sign())))
+		}
+	}
+	if !product.IsInt64() {
+		return Amount{}, ErrInvalidAmount
+	}
+	return Amount{Units: product.Int64(), Scale: scale}, nil
+}
+
+func (a Amount) String() string {
+	units := a.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	s := strconv.FormatInt(units, 10)
+	if a.Scale == 0 {
+		return sign + s
+	}
+	if len(s) <= int(a.Scale) {
+		s = strings.Repeat("0", int(a.Scale)-len(s)+1) + s
+	}
+	point := len(s) - int(a.Scale)
+	return sign + s[:point] + "." + s[point:]
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+// UnmarshalJSON accepts both "10.05" and 10.05
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	result, err := ParseAmount(s, maxAmountScale)
+	if err != nil {
+		return err
+	}
+	*a = result
+	return nil
+}
+
+func (a Amount) MarshalCSV() (string, error) {
+	return a.String(), nil
+}
+
+func (a *Amount) UnmarshalCSV(s string) error {
+	result, err := ParseAmount(s, maxAmountScale)
+	if err != nil {
+		return err
+	}
+	*a = result
+	return nil
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// Scan accepts numeric both as a plain decimal and as mantissa with exponent (like "1050e-2") pgx uses
+func (a *Amount) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case int64:
+		*a = Amount{Units: v}
+		return nil
+	default:
+		return fmt.Errorf("%w: can't scan %T", ErrInvalidAmount, src)
+	}
+	mantissa, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		if exp, err = strconv.Atoi(s[i+1:]); err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+		mantissa = s[:i]
+	}
+	result, err := ParseAmount(mantissa, maxAmountScale)
+	if err != nil {
+		return err
+	}
+	switch {
+	case exp > maxAmountScale || exp < -maxAmountScale:
+		return fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	case exp > 0:
+		if result, err = result.Rescale(result.Scale + uint8(exp)); err != nil {
+			return err
+		}
+		result.Scale -= uint8(exp)
+	case exp < 0:
+		if int(result.Scale)-exp > maxAmountScale {
+			return fmt.Errorf("%w: %q", ErrAmountPrecision, s)
+		}
+		result.Scale += uint8(-exp)
+	}
+	*a = result
+	return nil
+}
@@ -0,0 +1,16 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- clients
+-- +migrate Up
+CREATE TABLE client
+(
+    id           serial                  NOT NULL
+        CONSTRAINT client_pk PRIMARY KEY,
+    name         text                    NOT NULL,
+    api_key_hash text UNIQUE             NOT NULL,
+    limit_rps    int       DEFAULT 10    NOT NULL,
+    created      timestamp DEFAULT NOW() NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE client CASCADE;
@@ -0,0 +1,19 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- request signing
+-- +migrate Up
+ALTER TABLE client
+    ADD COLUMN signing_secret text DEFAULT '' NOT NULL;
+
+CREATE TABLE client_nonce
+(
+    client_id int       NOT NULL,
+    nonce     text      NOT NULL,
+    expires   timestamp NOT NULL,
+    CONSTRAINT client_nonce_pk PRIMARY KEY (client_id, nonce)
+);
+
+-- +migrate Down
+DROP TABLE client_nonce CASCADE;
+ALTER TABLE client
+    DROP COLUMN signing_secret;
@@ -0,0 +1,10 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- per client rate limit burst
+-- +migrate Up
+ALTER TABLE client
+    ADD COLUMN burst int DEFAULT 20 NOT NULL;
+
+-- +migrate Down
+ALTER TABLE client
+    DROP COLUMN burst;
@@ -0,0 +1,20 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- multi currency wallets
+-- +migrate Up
+ALTER TABLE wallet
+    ADD COLUMN currency char(3) DEFAULT 'USD' NOT NULL,
+    ALTER COLUMN amount TYPE numeric(18, 3);
+
+ALTER TABLE transaction
+    ADD COLUMN currency char(3) DEFAULT 'USD' NOT NULL,
+    ALTER COLUMN amount TYPE numeric(18, 3);
+
+-- +migrate Down
+ALTER TABLE transaction
+    DROP COLUMN currency,
+    ALTER COLUMN amount TYPE numeric(12, 2);
+
+ALTER TABLE wallet
+    DROP COLUMN currency,
+    ALTER COLUMN amount TYPE numeric(12, 2);
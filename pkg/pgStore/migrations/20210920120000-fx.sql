@@ -0,0 +1,37 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- cross currency transfers
+-- +migrate Up
+CREATE TABLE fx_rate
+(
+    base    char(3)                 NOT NULL,
+    quote   char(3)                 NOT NULL,
+    rate    numeric(20, 10)         NOT NULL CHECK (rate > 0),
+    updated timestamp DEFAULT NOW() NOT NULL,
+    CONSTRAINT fx_rate_pk PRIMARY KEY (base, quote)
+);
+
+CREATE TABLE fx_quote
+(
+    id      uuid                    NOT NULL
+        CONSTRAINT fx_quote_pk PRIMARY KEY,
+    base    char(3)                 NOT NULL,
+    quote   char(3)                 NOT NULL,
+    rate    numeric(20, 10)         NOT NULL,
+    expires timestamp               NOT NULL,
+    created timestamp DEFAULT NOW() NOT NULL
+);
+
+ALTER TABLE transaction
+    ADD COLUMN amount_received   numeric(18, 3),
+    ADD COLUMN currency_receiver char(3),
+    ADD COLUMN rate              numeric(20, 10);
+
+-- +migrate Down
+ALTER TABLE transaction
+    DROP COLUMN amount_received,
+    DROP COLUMN currency_receiver,
+    DROP COLUMN rate;
+
+DROP TABLE fx_quote CASCADE;
+DROP TABLE fx_rate CASCADE;
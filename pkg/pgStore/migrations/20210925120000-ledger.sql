@@ -0,0 +1,94 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- double entry ledger: every transaction is a journal entry of postings summing to zero per currency,
+-- wallet accounts are named by wallet uuid, system accounts by their name
+-- +migrate Up
+CREATE TABLE posting
+(
+    id             bigserial               NOT NULL
+        CONSTRAINT posting_pk PRIMARY KEY,
+    transaction_id int                     NOT NULL
+        CONSTRAINT posting_transaction_fk REFERENCES transaction (id),
+    account        text                    NOT NULL,
+    currency       char(3)                 NOT NULL,
+    amount         numeric(18, 3)          NOT NULL CHECK (amount <> 0),
+    ts             timestamp DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX posting_account_ts_index ON posting (account, ts);
+CREATE INDEX posting_transaction_index ON posting (transaction_id);
+
+-- +migrate StatementBegin
+CREATE FUNCTION posting_check_balanced() RETURNS trigger AS
+$$
+BEGIN
+    IF EXISTS(SELECT 1
+              FROM posting
+              WHERE transaction_id = NEW.transaction_id
+              GROUP BY currency
+              HAVING SUM(amount) <> 0) THEN
+        RAISE EXCEPTION 'postings of transaction % are not balanced', NEW.transaction_id USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE FUNCTION posting_immutable() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'postings can not be changed, post a correcting transaction instead' USING ERRCODE = 'restrict_violation';
+END;
+$$ LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+CREATE CONSTRAINT TRIGGER posting_balanced
+    AFTER INSERT
+    ON posting
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW
+EXECUTE PROCEDURE posting_check_balanced();
+
+CREATE TRIGGER posting_immutable
+    BEFORE UPDATE OR DELETE
+    ON posting
+    FOR EACH ROW
+EXECUTE PROCEDURE posting_immutable();
+
+CREATE VIEW account_balance AS
+SELECT account, currency, SUM(amount) AS balance
+FROM posting
+GROUP BY account, currency;
+
+-- existing transactions, withdrawals are stored with negative amounts
+INSERT INTO posting (transaction_id, account, currency, amount, ts)
+SELECT id, wallet::text, currency, amount, ts
+FROM transaction
+WHERE type IN (0, 1)
+UNION ALL
+SELECT id, CASE WHEN type = 0 THEN 'cash_in' ELSE 'cash_out' END, currency, -amount, ts
+FROM transaction
+WHERE type IN (0, 1)
+UNION ALL
+SELECT id, wallet::text, currency, -amount, ts
+FROM transaction
+WHERE type = 2
+UNION ALL
+SELECT id, wallet_receiver::text, COALESCE(currency_receiver, currency), COALESCE(amount_received, amount), ts
+FROM transaction
+WHERE type = 2
+UNION ALL
+SELECT id, 'fx', currency, amount, ts
+FROM transaction
+WHERE type = 2 AND currency_receiver <> currency
+UNION ALL
+SELECT id, 'fx', currency_receiver, -amount_received, ts
+FROM transaction
+WHERE type = 2 AND currency_receiver <> currency;
+
+-- +migrate Down
+DROP VIEW account_balance;
+DROP TABLE posting CASCADE;
+DROP FUNCTION posting_check_balanced();
+DROP FUNCTION posting_immutable();
@@ -0,0 +1,32 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- authorize/capture holds, held funds stay on the wallet amount but can't be spent
+-- +migrate Up
+ALTER TABLE wallet
+    ADD COLUMN held numeric(18, 3) DEFAULT 0 NOT NULL,
+    ADD CONSTRAINT wallet_held_check CHECK (held >= 0 AND amount >= held);
+
+CREATE TABLE hold
+(
+    id       uuid                           NOT NULL
+        CONSTRAINT hold_pk PRIMARY KEY,
+    wallet   uuid                           NOT NULL,
+    key      text UNIQUE                    NOT NULL,
+    amount   numeric(18, 3)                 NOT NULL CHECK (amount > 0),
+    captured numeric(18, 3) DEFAULT 0       NOT NULL,
+    currency char(3)                        NOT NULL,
+    status   smallint       DEFAULT 0       NOT NULL,
+    expires  timestamp                      NOT NULL,
+    updated  timestamp      DEFAULT NOW()   NOT NULL,
+    created  timestamp      DEFAULT NOW()   NOT NULL
+);
+
+CREATE INDEX hold_wallet_index ON hold (wallet);
+CREATE INDEX hold_active_expires_index ON hold (expires) WHERE status = 0;
+
+-- +migrate Down
+DROP TABLE hold CASCADE;
+
+ALTER TABLE wallet
+    DROP CONSTRAINT wallet_held_check,
+    DROP COLUMN held;
@@ -0,0 +1,13 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- refunds reference the transaction they (partially) reverse
+-- +migrate Up
+ALTER TABLE transaction
+    ADD COLUMN original_id int
+        CONSTRAINT transaction_original_fk REFERENCES transaction (id);
+
+CREATE INDEX transaction_original_index ON transaction (original_id) WHERE original_id IS NOT NULL;
+
+-- +migrate Down
+ALTER TABLE transaction
+    DROP COLUMN original_id;
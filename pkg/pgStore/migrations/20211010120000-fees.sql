@@ -0,0 +1,29 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- fees charged on top of withdrawals and transfers
+-- +migrate Up
+CREATE TABLE fee_rule
+(
+    id        serial                        NOT NULL
+        CONSTRAINT fee_rule_pk PRIMARY KEY,
+    client_id int,
+    type      smallint                      NOT NULL,
+    currency  char(3),
+    flat      numeric(18, 3) DEFAULT 0      NOT NULL CHECK (flat >= 0),
+    percent   numeric(9, 6)  DEFAULT 0      NOT NULL CHECK (percent >= 0 AND percent <= 100),
+    min_fee   numeric(18, 3) DEFAULT 0      NOT NULL CHECK (min_fee >= 0),
+    -- 0 means no cap
+    max_fee   numeric(18, 3) DEFAULT 0      NOT NULL CHECK (max_fee >= 0),
+    updated   timestamp      DEFAULT NOW()  NOT NULL
+);
+
+CREATE UNIQUE INDEX fee_rule_scope_index ON fee_rule (COALESCE(client_id, -1), type, COALESCE(currency, ''));
+
+ALTER TABLE transaction
+    ADD COLUMN fee numeric(18, 3);
+
+-- +migrate Down
+ALTER TABLE transaction
+    DROP COLUMN fee;
+
+DROP TABLE fee_rule CASCADE;
@@ -0,0 +1,26 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- wallet statuses: 0 active, 1 frozen for debits, 2 frozen, 3 closed; changed by admin clients only
+-- +migrate Up
+ALTER TABLE client
+    ADD COLUMN admin boolean DEFAULT FALSE NOT NULL;
+
+CREATE TABLE wallet_status_history
+(
+    id          bigserial               NOT NULL
+        CONSTRAINT wallet_status_history_pk PRIMARY KEY,
+    wallet      uuid                    NOT NULL,
+    status_from smallint                NOT NULL,
+    status_to   smallint                NOT NULL,
+    reason      text                    NOT NULL,
+    client_id   int                     NOT NULL,
+    ts          timestamp DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX wallet_status_history_wallet_index ON wallet_status_history (wallet, ts);
+
+-- +migrate Down
+DROP TABLE wallet_status_history CASCADE;
+
+ALTER TABLE client
+    DROP COLUMN admin;
@@ -0,0 +1,19 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- responses to requests with transaction keys, replayed to retries with the same parameters
+-- +migrate Up
+CREATE TABLE idempotency_key
+(
+    client_id   int                     NOT NULL,
+    key         text                    NOT NULL,
+    fingerprint text                    NOT NULL,
+    status      smallint  DEFAULT 0     NOT NULL,
+    response    bytea,
+    created     timestamp DEFAULT NOW() NOT NULL,
+    CONSTRAINT idempotency_key_pk PRIMARY KEY (client_id, key)
+);
+
+CREATE INDEX idempotency_key_created_index ON idempotency_key (created);
+
+-- +migrate Down
+DROP TABLE idempotency_key CASCADE;
@@ -0,0 +1,10 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- keyset pagination of reports on (ts, id)
+-- +migrate Up
+DROP INDEX posting_account_ts_index;
+CREATE INDEX posting_account_ts_id_index ON posting (account, ts, id);
+
+-- +migrate Down
+DROP INDEX posting_account_ts_id_index;
+CREATE INDEX posting_account_ts_index ON posting (account, ts);
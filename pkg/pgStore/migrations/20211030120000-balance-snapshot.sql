@@ -0,0 +1,17 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- account balances at the moment as sums of all postings before it
+-- +migrate Up
+CREATE TABLE balance_snapshot
+(
+    account text           NOT NULL,
+    ts      timestamp      NOT NULL,
+    amount  numeric(18, 3) NOT NULL,
+    CONSTRAINT balance_snapshot_pk PRIMARY KEY (account, ts)
+);
+
+CREATE INDEX posting_ts_index ON posting (ts);
+
+-- +migrate Down
+DROP INDEX posting_ts_index;
+DROP TABLE balance_snapshot;
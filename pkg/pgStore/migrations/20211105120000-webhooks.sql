@@ -0,0 +1,53 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- webhooks of clients, events on wallets written in the transaction of the change (outbox)
+-- and their deliveries: 0 pending, 1 succeeded, 2 failed
+-- +migrate Up
+CREATE TABLE webhook
+(
+    id        bigserial               NOT NULL
+        CONSTRAINT webhook_pk PRIMARY KEY,
+    client_id int                     NOT NULL,
+    url       text                    NOT NULL,
+    events    text[]                  NOT NULL,
+    secret    text                    NOT NULL,
+    active    boolean   DEFAULT TRUE  NOT NULL,
+    created   timestamp DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX webhook_client_index ON webhook (client_id);
+
+CREATE TABLE webhook_event
+(
+    id      bigserial               NOT NULL
+        CONSTRAINT webhook_event_pk PRIMARY KEY,
+    type    text                    NOT NULL,
+    wallet  uuid                    NOT NULL,
+    data    jsonb                   NOT NULL,
+    created timestamp DEFAULT NOW() NOT NULL
+);
+
+CREATE TABLE webhook_delivery
+(
+    id               bigserial               NOT NULL
+        CONSTRAINT webhook_delivery_pk PRIMARY KEY,
+    webhook_id       bigint                  NOT NULL
+        CONSTRAINT webhook_delivery_webhook_fk REFERENCES webhook (id),
+    event_id         bigint                  NOT NULL
+        CONSTRAINT webhook_delivery_event_fk REFERENCES webhook_event (id),
+    status           smallint  DEFAULT 0     NOT NULL,
+    attempts         int       DEFAULT 0     NOT NULL,
+    next_attempt     timestamp DEFAULT NOW() NOT NULL,
+    last_status_code int       DEFAULT 0     NOT NULL,
+    last_error       text      DEFAULT ''    NOT NULL,
+    updated          timestamp DEFAULT NOW() NOT NULL,
+    created          timestamp DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX webhook_delivery_pending_index ON webhook_delivery (next_attempt) WHERE status = 0;
+CREATE INDEX webhook_delivery_webhook_index ON webhook_delivery (webhook_id, id);
+
+-- +migrate Down
+DROP TABLE webhook_delivery;
+DROP TABLE webhook_event;
+DROP TABLE webhook;
@@ -0,0 +1,28 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- split payments, each is a transfer referencing the payment
+-- +migrate Up
+CREATE TABLE payment
+(
+    id       uuid                    NOT NULL
+        CONSTRAINT payment_pk PRIMARY KEY,
+    wallet   uuid                    NOT NULL,
+    key      text UNIQUE             NOT NULL,
+    amount   numeric(18, 3)          NOT NULL CHECK (amount > 0),
+    currency char(3)                 NOT NULL,
+    created  timestamp DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX payment_wallet_index ON payment (wallet);
+
+ALTER TABLE transaction
+    ADD COLUMN payment_id uuid
+        CONSTRAINT transaction_payment_fk REFERENCES payment (id);
+
+CREATE INDEX transaction_payment_index ON transaction (payment_id) WHERE payment_id IS NOT NULL;
+
+-- +migrate Down
+ALTER TABLE transaction
+    DROP COLUMN payment_id;
+
+DROP TABLE payment CASCADE;
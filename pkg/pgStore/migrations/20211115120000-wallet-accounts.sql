@@ -0,0 +1,12 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- wallet accounts are named by lower case wallet uuids, postings made with upper case ones are renamed.
+-- Snapshots summed without them are dropped, all of them as new ones are summed since the latest
+-- +migrate Up
+DELETE FROM balance_snapshot
+WHERE EXISTS(SELECT 1 FROM posting WHERE account <> lower(account));
+
+UPDATE posting SET account = lower(account)
+WHERE account <> lower(account);
+
+-- +migrate Down
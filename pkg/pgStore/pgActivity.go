@@ -0,0 +1,142 @@
+package pgStore
+
+import (
+	"context"
+	"fmt"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"sync"
+	"time"
+)
+
+// activityChannel is notified with the wallet on commit of transactions changing its balance
+const activityChannel = "wallet_activity"
+const activityRetryInterval = time.Second
+
+// activityHub fans notifications of the listening connection out to subscribers of wallets
+type activityHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func newActivityHub() *activityHub {
+	return &activityHub{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+func (h *activityHub) subscribe(wallet string) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[wallet] == nil {
+		h.subs[wallet] = make(map[chan struct{}]struct{})
+	}
+	h.subs[wallet][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[wallet], ch)
+		if len(h.subs[wallet]) == 0 {
+			delete(h.subs, wallet)
+		}
+	}
+}
+
+// notify wakes subscribers of the wallet up, or all of them if wallet is empty.
+// Subscribers which haven't consumed the previous notification yet aren't notified twice
+func (h *activityHub) notify(wallet string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w, subs := range h.subs {
+		if wallet != "" && w != wallet {
+			continue
+		}
+		for ch := range subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notifyActivity notifies listeners of the wallet once tx is committed, notifications of a tx are deduplicated by pg
+func notifyActivity(ctx context.Context, tx pgx.Tx, wallet string) error {
+	_, err := tx.Exec(ctx, "SELECT pg_notify($1, $2)", activityChannel, wallet)
+	return err
+}
+
+func isSystemAccount(account string) bool {
+	switch account {
+	case AccountCashIn, AccountCashOut, AccountFees, AccountSuspense, AccountFX:
+		return true
+	}
+	return false
+}
+
+// SubscribeWallet returns a channel receiving a value after transactions on the wallet are committed
+// and the func to unsubscribe. Notifications may be coalesced, so subscribers should read everything
+// new on each of them. Nothing is received unless ListenWalletActivity is running
+func (pg *PG) SubscribeWallet(wallet string) (<-chan struct{}, func()) {
+	return pg.activity.subscribe(pkg.WalletID(wallet))
+}
+
+// ListenWalletActivity listens for notifications of committed transactions on a dedicated connection
+// until ctx is done. Subscribers are woken up after reconnects as notifications may have been missed
+func (pg *PG) ListenWalletActivity(ctx context.Context) {
+	for {
+		err := pg.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		pg.log.Warnf("err listening for wallet activity: %s", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(activityRetryInterval):
+		}
+	}
+}
+
+func (pg *PG) listen(ctx context.Context) error {
+	// listening connections aren't of any use for the pool
+	conn, err := pgx.ConnectConfig(ctx, pg.db.Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err = conn.Exec(ctx, "LISTEN "+activityChannel); err != nil {
+		return err
+	}
+	pg.activity.notify("")
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		pg.activity.notify(n.Payload)
+	}
+}
+
+// TransactionsAfter returns up to limit postings on the wallet account with ids greater than postingID, by id
+func (pg *PG) TransactionsAfter(ctx context.Context, wallet string, postingID int64, limit int) ([]Transaction, error) {
+	wallet = pkg.WalletID(wallet)
+	query := walletReportTmpl + fmt.Sprintf("AND p.id > %d\nORDER BY p.id\nLIMIT %d\n", postingID, limit)
+	result := make([]Transaction, 0)
+	err := pg.tx(ctx, "TransactionsAfter", func(tx pgx.Tx) error {
+		tmp := make([]transaction, 0)
+		if err := pgxscan.Select(ctx, tx, &tmp, query, wallet); err != nil {
+			return err
+		}
+		result = result[:0]
+		for _, tr := range tmp {
+			t, err := tr.tx2Tx()
+			if err != nil {
+				return err
+			}
+			result = append(result, t)
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,95 @@
+package pgStore
+
+import (
+	"context"
+	"fmt"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"strings"
+	"time"
+)
+
+// AggregatePeriod is the date_trunc field aggregates are grouped by
+type AggregatePeriod string
+
+const (
+	PeriodDay   AggregatePeriod = "day"
+	PeriodWeek  AggregatePeriod = "week"
+	PeriodMonth AggregatePeriod = "month"
+)
+
+// incoming transfers are type 2 transactions posted to the receiver's account
+const aggregateReportTmpl = `
+SELECT date_trunc('%s', p.ts) AS period,
+       %s AS wallet,
+       (CASE WHEN t.type = 2 AND p.amount > 0 THEN 3 ELSE t.type END)::smallint AS type,
+       p.currency,
+       COUNT(*) AS count,
+       SUM(ABS(p.amount)) AS amount
+FROM posting p
+JOIN transaction t ON t.id = p.transaction_id
+`
+
+// Aggregate is the count and the sum of postings of a type on the wallet account, or on all accounts
+// of the client if Wallet is empty, in the period starting at Period
+type Aggregate struct {
+	Period   time.Time       `db:"period" json:"period" csv:"PERIOD"`
+	Wallet   string          `db:"wallet" json:"wallet,omitempty" csv:"WALLET"`
+	Type     TransactionType `db:"type" json:"type" csv:"TYPE"`
+	Currency string          `db:"currency" json:"currency" csv:"CURRENCY"`
+	Count    int64           `db:"count" json:"count" csv:"COUNT"`
+	Amount   pkg.Amount      `db:"amount" json:"amount" csv:"AMOUNT"`
+}
+
+// AggregateReport sums postings on the wallet account up by period and type, oldest first.
+// If wallet is empty postings on all wallets of the owner are summed up together per currency
+func (pg *PG) AggregateReport(ctx context.Context, wallet string, owner int, from, to *time.Time, period AggregatePeriod) ([]Aggregate, error) {
+	wallet = pkg.WalletID(wallet)
+	query, err := aggregateReportQuery(wallet, from, to, period)
+	if err != nil {
+		return nil, err
+	}
+	var arg interface{} = wallet
+	if wallet == "" {
+		arg = owner
+	}
+	result := make([]Aggregate, 0)
+	err = pg.tx(ctx, "AggregateReport", func(tx pgx.Tx) error {
+		result = result[:0]
+		if err := pgxscan.Select(ctx, tx, &result, query, arg); err != nil {
+			return err
+		}
+		for i := range result {
+			if result[i].Amount, err = toCurrency(result[i].Amount, result[i].Currency); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func aggregateReportQuery(wallet string, from, to *time.Time, period AggregatePeriod) (string, error) {
+	switch period {
+	case PeriodDay, PeriodWeek, PeriodMonth:
+	default:
+		return "", pkg.ErrInvalidPeriod
+	}
+	queryBuilder := strings.Builder{}
+	if wallet != "" {
+		queryBuilder.WriteString(fmt.Sprintf(aggregateReportTmpl, period, "p.account"))
+		queryBuilder.WriteString("WHERE p.account = $1\n")
+	} else {
+		queryBuilder.WriteString(fmt.Sprintf(aggregateReportTmpl, period, "''"))
+		queryBuilder.WriteString("WHERE p.account IN (SELECT wallet::text FROM wallet WHERE owner = $1)\n")
+	}
+	if from != nil {
+		queryBuilder.WriteString(fmt.Sprintf("AND p.ts >= timestamp '%s'\n", from.Format(pgDateTimeFmt)))
+	}
+	if to != nil {
+		queryBuilder.WriteString(fmt.Sprintf("AND p.ts < timestamp '%s'\n", to.Add(24*time.Hour).Format(pgDateTimeFmt)))
+	}
+	queryBuilder.WriteString("GROUP BY 1, 2, 3, 4\nORDER BY 1, 2, 3, 4\n")
+	return queryBuilder.String(), nil
+}
@@ -0,0 +1,135 @@
+package pgStore
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"strings"
+	"time"
+)
+
+// balanceAtQuery adds postings since the latest snapshot to it
+const balanceAtQuery = `
+WITH s AS (
+    SELECT ts, amount
+    FROM balance_snapshot
+    WHERE account = $1 AND ts <= $2::timestamp
+    ORDER BY ts DESC
+    LIMIT 1
+)
+SELECT COALESCE((SELECT amount FROM s), 0) + COALESCE(SUM(p.amount), 0)
+FROM posting p
+WHERE p.account = $1 AND p.ts >= COALESCE((SELECT ts FROM s), '-infinity') AND p.ts < $2::timestamp
+`
+
+// snapshotBalancesQuery snapshots accounts with postings since the previous snapshot taken, others still have
+// their latest snapshots valid
+const snapshotBalancesQuery = `
+WITH prev AS (
+    SELECT COALESCE(MAX(ts), '-infinity') AS ts
+    FROM balance_snapshot
+    WHERE ts < $1::timestamp
+), since AS (
+    SELECT account, SUM(amount) AS amount
+    FROM posting
+    WHERE ts >= (SELECT ts FROM prev) AND ts < $1::timestamp
+    GROUP BY account
+)
+INSERT INTO balance_snapshot (account, ts, amount)
+SELECT s.account, $1::timestamp, s.amount + COALESCE((
+    SELECT b.amount
+    FROM balance_snapshot b
+    WHERE b.account = s.account AND b.ts < $1::timestamp
+    ORDER BY b.ts DESC
+    LIMIT 1
+), 0)
+FROM since s
+ON CONFLICT (account, ts) DO NOTHING
+`
+
+const creditsDebitsQuery = `
+SELECT COALESCE(SUM(amount) FILTER (WHERE amount > 0), 0), COALESCE(-SUM(amount) FILTER (WHERE amount < 0), 0)
+FROM posting
+WHERE account = $1
+`
+
+// BalanceAt returns the wallet balance at the moment at, i.e. the sum of its postings before it
+func (pg *PG) BalanceAt(ctx context.Context, wallet string, at time.Time) (pkg.Balance, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Balance{Wallet: wallet, At: at}
+	err := pg.tx(ctx, "BalanceAt", func(tx pgx.Tx) error {
+		var err error
+		if result.Currency, err = getWalletCurrency(ctx, tx, wallet); err != nil {
+			return err
+		}
+		result.Amount, err = balanceAt(ctx, tx, wallet, at, result.Currency)
+		return err
+	})
+	return result, err
+}
+
+// BalanceSummary returns the wallet balances at the start of the from day and the end of the to day
+// with credits and debits in between. Opening balance is zero if from isn't specified
+func (pg *PG) BalanceSummary(ctx context.Context, wallet string, from, to *time.Time) (pkg.BalanceSummary, error) {
+	wallet = pkg.WalletID(wallet)
+	var result pkg.BalanceSummary
+	query := strings.Builder{}
+	query.WriteString(creditsDebitsQuery)
+	if from != nil {
+		query.WriteString(fmt.Sprintf("AND ts >= timestamp '%s'\n", from.Format(pgDateTimeFmt)))
+	}
+	if to != nil {
+		query.WriteString(fmt.Sprintf("AND ts < timestamp '%s'\n", to.Add(24*time.Hour).Format(pgDateTimeFmt)))
+	}
+	err := pg.tx(ctx, "BalanceSummary", func(tx pgx.Tx) error {
+		currency, err := getWalletCurrency(ctx, tx, wallet)
+		if err != nil {
+			return err
+		}
+		if result.Opening, err = toCurrency(pkg.Amount{}, currency); err != nil {
+			return err
+		}
+		if from != nil {
+			if result.Opening, err = balanceAt(ctx, tx, wallet, *from, currency); err != nil {
+				return err
+			}
+		}
+		var credits, debits pkg.Amount
+		if err = tx.QueryRow(ctx, query.String(), wallet).Scan(&credits, &debits); err != nil {
+			return err
+		}
+		if result.Credits, err = toCurrency(credits, currency); err != nil {
+			return err
+		}
+		if result.Debits, err = toCurrency(debits, currency); err != nil {
+			return err
+		}
+		result.Closing = result.Opening.Add(result.Credits).Sub(result.Debits)
+		return nil
+	})
+	return result, err
+}
+
+// SnapshotBalances saves balances of accounts at the moment at, which must be far enough in the past
+// for all transactions posted before it to be committed. Returns the number of snapshots taken
+func (pg *PG) SnapshotBalances(ctx context.Context, at time.Time) (int64, error) {
+	var result int64
+	err := pg.tx(ctx, "SnapshotBalances", func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, snapshotBalancesQuery, at.UTC())
+		if err != nil {
+			return err
+		}
+		result = res.RowsAffected()
+		return nil
+	})
+	return result, err
+}
+
+func balanceAt(ctx context.Context, tx pgx.Tx, account string, at time.Time, currency string) (pkg.Amount, error) {
+	var amount pkg.Amount
+	if err := tx.QueryRow(ctx, balanceAtQuery, account, at.UTC()).Scan(&amount); err != nil {
+		return amount, err
+	}
+	return toCurrency(amount, currency)
+}
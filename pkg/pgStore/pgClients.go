@@ -0,0 +1,68 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"time"
+)
+
+const getClientQuery = `
+SELECT id, name, limit_rps, burst, signing_secret, admin
+FROM client
+WHERE api_key_hash = $1
+`
+const createClientQuery = `
+INSERT INTO client (name, api_key_hash, limit_rps, burst, signing_secret, admin)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id
+`
+const cleanNoncesQuery = `
+DELETE FROM client_nonce
+WHERE client_id = $1 AND expires < NOW()
+`
+const registerNonceQuery = `
+INSERT INTO client_nonce (client_id, nonce, expires)
+VALUES ($1, $2, $3)
+ON CONFLICT (client_id, nonce) DO NOTHING
+`
+
+func (pg *PG) GetClient(ctx context.Context, apiKeyHash string) (pkg.Client, error) {
+	result := pkg.Client{}
+	err := pg.tx(ctx, "GetClient", func(tx pgx.Tx) error {
+		err := pgxscan.Get(ctx, tx, &result, getClientQuery, apiKeyHash)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pkg.ErrClientNotFound
+		}
+		return err
+	})
+	return result, err
+}
+
+// CreateClient registers a client, apiKeyHash is expected to be a hex encoded sha256 of the api key
+func (pg *PG) CreateClient(ctx context.Context, client pkg.Client, apiKeyHash string) (int, error) {
+	var id int
+	err := pg.tx(ctx, "CreateClient", func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, createClientQuery, client.Name, apiKeyHash, client.LimitRPS, client.Burst, client.SigningSecret, client.Admin).Scan(&id)
+	})
+	return id, err
+}
+
+// RegisterNonce remembers a signed request nonce until expires, returns pkg.ErrNonceReused if it's already known
+func (pg *PG) RegisterNonce(ctx context.Context, clientID int, nonce string, expires time.Time) error {
+	return pg.tx(ctx, "RegisterNonce", func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, cleanNoncesQuery, clientID); err != nil {
+			return err
+		}
+		result, err := tx.Exec(ctx, registerNonceQuery, clientID, nonce, expires.UTC())
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return pkg.ErrNonceReused
+		}
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"strings"
+	"time"
+)
+
+const getFXRateQuery = `
+SELECT rate
+FROM fx_rate
+WHERE base = $1 AND quote = $2
+`
+const walletCurrenciesQuery = `
+SELECT wallet, currency
+FROM wallet
+WHERE wallet = ANY($1::uuid[])
+`
+const setFXRateQuery = `
+INSERT INTO fx_rate (base, quote, rate)
+VALUES ($1, $2, $3)
+ON CONFLICT (base, quote) DO UPDATE SET rate = excluded.rate, updated = NOW()
+`
+const createFXQuoteQuery = `
+INSERT INTO fx_quote (id, base, quote, rate, expires)
+VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5))
+RETURNING id, base, quote, rate, expires
+`
+const getFXQuoteQuery = `
+SELECT base, quote, rate, expires > NOW() AS valid
+FROM fx_quote
+WHERE id = $1
+`
+
+// SetFXRateProvider replaces the default provider reading rates from the fx_rate table
+func (pg *PG) SetFXRateProvider(fx pkg.FXRateProvider) {
+	pg.fx = fx
+}
+
+// Rate implements pkg.FXRateProvider with rates from the fx_rate table
+func (pg *PG) Rate(ctx context.Context, base, quote string) (pkg.Amount, error) {
+	var rate pkg.Amount
+	err := pg.tx(ctx, "Rate", func(tx pgx.Tx) error {
+		var err error
+		rate, err = getFXRate(ctx, tx, base, quote)
+		return err
+	})
+	return rate, err
+}
+
+func getFXRate(ctx context.Context, tx pgx.Tx, base, quote string) (pkg.Amount, error) {
+	var rate pkg.Amount
+	err := tx.QueryRow(ctx, getFXRateQuery, base, quote).Scan(&rate)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return rate, pkg.ErrRateNotFound
+	}
+	return rate, err
+}
+
+func (pg *PG) SetFXRate(ctx context.Context, base, quote string, rate pkg.Amount) error {
+	return pg.tx(ctx, "SetFXRate", func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, setFXRateQuery, base, quote, rate)
+		return err
+	})
+}
+
+// CreateFXQuote locks the current base/quote rate for ttl, so transfers referencing it use the same rate
+func (pg *PG) CreateFXQuote(ctx context.Context, base, quote string, ttl time.Duration) (pkg.FXQuote, error) {
+	result := pkg.FXQuote{}
+	rate, err := pg.fx.Rate(ctx, base, quote)
+	if err != nil {
+		return result, err
+	}
+	err = pg.tx(ctx, "CreateFXQuote", func(tx pgx.Tx) error {
+		return pgxscan.Get(ctx, tx, &result, createFXQuoteQuery, uuid.New().String(), base, quote, rate, ttl.Seconds())
+	})
+	return result, err
+}
+
+// externalRates fetches current rates of transfers from the wallet by legs without a quote if the provider is external,
+// so the transaction making them doesn't wait for it holding locks. They're nil if the store is the provider,
+// its rates are read within the transaction then
+func (pg *PG) externalRates(ctx context.Context, from string, legs []pkg.TransferLeg) (pkg.FXRateProvider, error) {
+	fx := pg.fx
+	if fx == pkg.FXRateProvider(pg) {
+		return nil, nil
+	}
+	wallets := []string{from}
+	for _, l := range legs {
+		if l.Quote == "" {
+			wallets = append(wallets, l.To)
+		}
+	}
+	var currencies []struct {
+		Wallet   string `db:"wallet"`
+		Currency string `db:"currency"`
+	}
+	err := pg.tx(ctx, "externalRates", func(tx pgx.Tx) error {
+		return pgxscan.Select(ctx, tx, &currencies, walletCurrenciesQuery, wallets)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var base string
+	quotes := make([]string, 0, len(currencies))
+	for _, c := range currencies {
+		if strings.EqualFold(c.Wallet, from) {
+			base = c.Currency
+		}
+		quotes = append(quotes, c.Currency)
+	}
+	if base == "" {
+		// the transaction fails as the sender isn't found
+		return pkg.FXRates{}, nil
+	}
+	return pkg.FetchFXRates(ctx, fx, base, quotes...), nil
+}
+
+// transferRate returns the rate of the quote if one is given, otherwise the current one of rates
+// or of the fx_rate table if they're nil
+func (pg *PG) transferRate(ctx context.Context, tx pgx.Tx, rates pkg.FXRateProvider, base, quote, quoteID string) (pkg.Amount, error) {
+	if quoteID == "" && rates == nil {
+		return getFXRate(ctx, tx, base, quote)
+	}
+	if quoteID == "" {
+		return rates.Rate(ctx, base, quote)
+	}
+	var q struct {
+		Base  string     `db:"base"`
+		Quote string     `db:"quote"`
+		Rate  pkg.Amount `db:"rate"`
+		Valid bool       `db:"valid"`
+	}
+	err := pgxscan.Get(ctx, tx, &q, getFXQuoteQuery, quoteID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return pkg.Amount{}, pkg.ErrInvalidQuote
+	case err != nil:
+		return pkg.Amount{}, err
+	case q.Base != base || q.Quote != quote:
+		return pkg.Amount{}, pkg.ErrInvalidQuote
+	case !q.Valid:
+		return pkg.Amount{}, pkg.ErrQuoteExpired
+	}
+	return q.Rate, nil
+}
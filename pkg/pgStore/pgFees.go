@@ -0,0 +1,80 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+)
+
+const feeRuleQuery = `
+SELECT r.client_id, r.type, COALESCE(r.currency, '') AS currency, r.flat, r.percent, r.min_fee, r.max_fee
+FROM fee_rule r
+JOIN wallet w ON w.wallet = $2
+WHERE r.type = $1 AND (r.client_id = w.owner OR r.client_id IS NULL) AND (r.currency = w.currency OR r.currency IS NULL)
+ORDER BY r.client_id IS NULL, r.currency IS NULL
+LIMIT 1
+`
+const setFeeRuleQuery = `
+INSERT INTO fee_rule (client_id, type, currency, flat, percent, min_fee, max_fee)
+VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7)
+ON CONFLICT (COALESCE(client_id, -1), type, COALESCE(currency, ''))
+    DO UPDATE SET flat = excluded.flat, percent = excluded.percent, min_fee = excluded.min_fee, max_fee = excluded.max_fee, updated = NOW()
+`
+
+// SetFeeWallet sets the wallet fees are credited to, fees in other currencies or without the wallet set
+// are posted to the fees account
+func (pg *PG) SetFeeWallet(wallet string) {
+	pg.feeWallet = pkg.WalletID(wallet)
+}
+
+// SetFeeRule creates or replaces the rule for the client, transaction type and currency of rule
+func (pg *PG) SetFeeRule(ctx context.Context, rule pkg.FeeRule) error {
+	return pg.tx(ctx, "SetFeeRule", func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, setFeeRuleQuery, rule.ClientID, rule.Type, rule.Currency, rule.Flat, rule.Percent, rule.Min, rule.Max)
+		return err
+	})
+}
+
+// fee paid by the wallet owner for a transaction of amount, the most specific rule applies: client's over common ones,
+// for the wallet currency over any currency ones
+func fee(ctx context.Context, tx pgx.Tx, tType TransactionType, wallet, currency string, amount pkg.Amount) (pkg.Amount, error) {
+	exp, err := pkg.CurrencyExponent(currency)
+	if err != nil {
+		return pkg.Amount{}, err
+	}
+	var rule pkg.FeeRule
+	err = pgxscan.Get(ctx, tx, &rule, feeRuleQuery, tType, wallet)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pkg.NewAmount(0, exp), nil
+	}
+	if err != nil {
+		return pkg.Amount{}, err
+	}
+	if amount.Sign() < 0 {
+		amount = amount.Neg()
+	}
+	return rule.Fee(amount, exp)
+}
+
+// chargeFee credits the fee wallet and returns the posting of it
+func (pg *PG) chargeFee(ctx context.Context, tx pgx.Tx, currency string, fee pkg.Amount) (Posting, error) {
+	posting := Posting{Account: AccountFees, Currency: currency, Amount: fee}
+	if fee.Sign() == 0 || pg.feeWallet == "" {
+		return posting, nil
+	}
+	feeWalletCurrency, err := getWalletCurrency(ctx, tx, pg.feeWallet)
+	if err != nil {
+		return posting, fmt.Errorf("err getting fee wallet %s: %w", pg.feeWallet, err)
+	}
+	if feeWalletCurrency != currency {
+		return posting, nil
+	}
+	if _, err = tx.Exec(ctx, changeBalanceQuery, fee, pg.feeWallet); err != nil {
+		return posting, err
+	}
+	posting.Account = pg.feeWallet
+	return posting, nil
+}
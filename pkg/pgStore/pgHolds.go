@@ -0,0 +1,244 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"time"
+)
+
+const holdFundsQuery = `
+UPDATE wallet SET held = held + $1::numeric(18, 3), updated = NOW()
+WHERE wallet = $2 AND amount - held >= $1::numeric(18, 3)
+`
+const releaseFundsQuery = `
+UPDATE wallet SET amount = amount - $1::numeric(18, 3), held = held - $2::numeric(18, 3), updated = NOW()
+WHERE wallet = $3
+`
+const insertHoldQuery = `
+INSERT INTO hold (id, wallet, key, amount, currency, expires)
+VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6))
+RETURNING id, wallet, key, amount, captured, currency, status, expires, updated, created
+`
+const getHoldQuery = `
+SELECT id, wallet, key, amount, captured, currency, status, expires, updated, created, expires <= NOW() AS expired
+FROM hold
+WHERE id = $1
+`
+const closeHoldQuery = `
+UPDATE hold SET status = $1, captured = $2, updated = NOW()
+WHERE id = $3
+RETURNING id, wallet, key, amount, captured, currency, status, expires, updated, created
+`
+const expireHoldsQuery = `
+WITH expired AS (
+    UPDATE hold SET status = 3, updated = NOW()
+    WHERE status = 0 AND expires <= NOW()
+    RETURNING id, wallet, key, amount, captured, currency, status, expires, updated, created
+), released AS (
+    UPDATE wallet w SET held = w.held - e.amount, updated = NOW()
+    FROM (SELECT wallet, SUM(amount) AS amount FROM expired GROUP BY wallet) e
+    WHERE w.wallet = e.wallet
+)
+SELECT *
+FROM expired
+`
+
+type hold struct {
+	pkg.Hold
+	Expired bool `db:"expired"`
+}
+
+// PlaceHold reserves amount on the wallet for ttl, currency if not empty must match the wallet's one
+func (pg *PG) PlaceHold(ctx context.Context, wallet string, amount pkg.Amount, currency string, ttl time.Duration, key string) (pkg.Hold, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Hold{}
+	err := pg.tx(ctx, "PlaceHold", func(tx pgx.Tx) error {
+		walletCurrency, err := lockWallet(ctx, tx, wallet, true)
+		if err != nil {
+			return err
+		}
+		if currency != "" && currency != walletCurrency {
+			return pkg.ErrCurrencyMismatch
+		}
+		if amount, err = pkg.InCurrency(amount, walletCurrency); err != nil {
+			return err
+		}
+		if amount.Sign() <= 0 {
+			return pkg.ErrInvalidAmount
+		}
+		res, err := tx.Exec(ctx, holdFundsQuery, amount, wallet)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return pkg.ErrInsufficientFunds
+		}
+		err = pgxscan.Get(ctx, tx, &result, insertHoldQuery, uuid.New().String(), wallet, key, amount, walletCurrency, ttl.Seconds())
+		if isUniqueViolation(err) {
+			return pkg.ErrDuplicateAction(key)
+		}
+		if err != nil {
+			return err
+		}
+		if err = holdToCurrency(&result); err != nil {
+			return err
+		}
+		if err = notifyActivity(ctx, tx, wallet); err != nil {
+			return err
+		}
+		return emitEvent(ctx, tx, wallet, pkg.EventHoldPlaced, result)
+	})
+	return result, err
+}
+
+func (pg *PG) GetHold(ctx context.Context, id string) (pkg.Hold, error) {
+	var result hold
+	err := pg.tx(ctx, "GetHold", func(tx pgx.Tx) error {
+		var err error
+		result, err = getHold(ctx, tx, id, false)
+		return err
+	})
+	return result.Hold, err
+}
+
+// CaptureHold debits amount of the hold from the wallet and releases the rest of it,
+// zero amount captures the whole hold. A hold may be captured only once
+func (pg *PG) CaptureHold(ctx context.Context, id string, amount pkg.Amount, key string) (pkg.Hold, error) {
+	result := pkg.Hold{}
+	err := pg.tx(ctx, "CaptureHold", func(tx pgx.Tx) error {
+		h, err := getHold(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		switch {
+		case h.Status != pkg.HoldActive:
+			return pkg.ErrHoldNotActive
+		case h.Expired:
+			return pkg.ErrHoldExpired
+		}
+		if amount.Sign() == 0 {
+			amount = h.Amount
+		}
+		if amount, err = pkg.InCurrency(amount, h.Currency); err != nil {
+			return err
+		}
+		if amount.Sign() < 0 {
+			return pkg.ErrInvalidAmount
+		}
+		if amount.Cmp(h.Amount) > 0 {
+			return pkg.ErrCaptureExceedsHold
+		}
+		if _, err = lockWallet(ctx, tx, h.Wallet, true); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, releaseFundsQuery, amount, h.Amount, h.Wallet); err != nil {
+			return err
+		}
+		if amount.Sign() > 0 {
+			query := `INSERT INTO transaction (type, wallet, key, amount, currency) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+			transactionID, err := insertTransaction(ctx, tx, key, query, TransactionCapture, h.Wallet, key, amount.Neg(), h.Currency)
+			if err != nil {
+				return err
+			}
+			err = post(ctx, tx, transactionID,
+				Posting{Account: h.Wallet, Currency: h.Currency, Amount: amount.Neg()},
+				Posting{Account: AccountCashOut, Currency: h.Currency, Amount: amount},
+			)
+			if err != nil {
+				return err
+			}
+		}
+		if err = pgxscan.Get(ctx, tx, &result, closeHoldQuery, pkg.HoldCaptured, amount, id); err != nil {
+			return err
+		}
+		if err = holdToCurrency(&result); err != nil {
+			return err
+		}
+		if err = notifyActivity(ctx, tx, result.Wallet); err != nil {
+			return err
+		}
+		return emitEvent(ctx, tx, result.Wallet, pkg.EventHoldCaptured, result)
+	})
+	return result, err
+}
+
+// VoidHold releases the whole hold, expired holds which haven't been released yet may be voided too
+func (pg *PG) VoidHold(ctx context.Context, id string) (pkg.Hold, error) {
+	result := pkg.Hold{}
+	err := pg.tx(ctx, "VoidHold", func(tx pgx.Tx) error {
+		h, err := getHold(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		if h.Status != pkg.HoldActive {
+			return pkg.ErrHoldNotActive
+		}
+		if _, err = tx.Exec(ctx, releaseFundsQuery, pkg.Amount{}, h.Amount, h.Wallet); err != nil {
+			return err
+		}
+		if err = pgxscan.Get(ctx, tx, &result, closeHoldQuery, pkg.HoldVoided, pkg.Amount{}, id); err != nil {
+			return err
+		}
+		if err = holdToCurrency(&result); err != nil {
+			return err
+		}
+		if err = notifyActivity(ctx, tx, result.Wallet); err != nil {
+			return err
+		}
+		return emitEvent(ctx, tx, result.Wallet, pkg.EventHoldVoided, result)
+	})
+	return result, err
+}
+
+// ExpireHolds releases active holds past their expiry, returns the number of holds released
+func (pg *PG) ExpireHolds(ctx context.Context) (int64, error) {
+	var expired []pkg.Hold
+	err := pg.tx(ctx, "ExpireHolds", func(tx pgx.Tx) error {
+		expired = expired[:0]
+		if err := pgxscan.Select(ctx, tx, &expired, expireHoldsQuery); err != nil {
+			return err
+		}
+		for i := range expired {
+			if err := holdToCurrency(&expired[i]); err != nil {
+				return err
+			}
+			if err := notifyActivity(ctx, tx, expired[i].Wallet); err != nil {
+				return err
+			}
+			if err := emitEvent(ctx, tx, expired[i].Wallet, pkg.EventHoldExpired, expired[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return int64(len(expired)), err
+}
+
+func getHold(ctx context.Context, tx pgx.Tx, id string, forUpdate bool) (hold, error) {
+	var result hold
+	query := getHoldQuery
+	if forUpdate {
+		query += "FOR UPDATE\n"
+	}
+	err := pgxscan.Get(ctx, tx, &result, query, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return result, pkg.ErrHoldNotFound
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, holdToCurrency(&result.Hold)
+}
+
+func holdToCurrency(h *pkg.Hold) error {
+	var err error
+	if h.Amount, err = toCurrency(h.Amount, h.Currency); err != nil {
+		return err
+	}
+	h.Captured, err = toCurrency(h.Captured, h.Currency)
+	return err
+}
@@ -0,0 +1,106 @@
+package pgStore
+
+import (
+	"context"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"time"
+)
+
+// idempotencyLockTimeout is how long a key stays reserved by a request which is neither completed nor released,
+// e.g. because the service was restarted
+const idempotencyLockTimeout = time.Minute
+
+const reserveIdempotencyKeyQuery = `
+INSERT INTO idempotency_key (client_id, key, fingerprint)
+VALUES ($1, $2, $3)
+ON CONFLICT (client_id, key) DO NOTHING
+`
+const getIdempotencyKeyQuery = `
+SELECT client_id, key, fingerprint, status, response, created
+FROM idempotency_key
+WHERE client_id = $1 AND key = $2
+FOR UPDATE
+`
+const takeOverIdempotencyKeyQuery = `
+UPDATE idempotency_key SET created = NOW()
+WHERE client_id = $1 AND key = $2 AND status = 0 AND created < NOW() - make_interval(secs => $3)
+`
+const saveIdempotentResponseQuery = `
+UPDATE idempotency_key SET status = $3, response = $4
+WHERE client_id = $1 AND key = $2
+`
+const releaseIdempotencyKeyQuery = `
+DELETE FROM idempotency_key
+WHERE client_id = $1 AND key = $2 AND status = 0
+`
+const purgeIdempotencyKeysQuery = `
+DELETE FROM idempotency_key
+WHERE created < NOW() - make_interval(secs => $1)
+`
+
+// ReserveIdempotencyKey reserves the key of the client for a request with fingerprint.
+// If the key is already used, returns its record: completed ones are to be replayed,
+// pkg.ErrKeyReused is returned if the fingerprint differs and pkg.ErrRequestInProgress if it's not completed yet
+func (pg *PG) ReserveIdempotencyKey(ctx context.Context, clientID int, key, fingerprint string) (pkg.IdempotencyRecord, bool, error) {
+	var result pkg.IdempotencyRecord
+	var reserved bool
+	err := pg.tx(ctx, "ReserveIdempotencyKey", func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, reserveIdempotencyKeyQuery, clientID, key, fingerprint)
+		if err != nil {
+			return err
+		}
+		if reserved = res.RowsAffected() == 1; reserved {
+			return nil
+		}
+		if err = pgxscan.Get(ctx, tx, &result, getIdempotencyKeyQuery, clientID, key); err != nil {
+			return err
+		}
+		if result.Fingerprint != fingerprint {
+			return pkg.ErrKeyReused
+		}
+		if result.Status != 0 {
+			return nil
+		}
+		res, err = tx.Exec(ctx, takeOverIdempotencyKeyQuery, clientID, key, idempotencyLockTimeout.Seconds())
+		if err != nil {
+			return err
+		}
+		if reserved = res.RowsAffected() == 1; !reserved {
+			return pkg.ErrRequestInProgress
+		}
+		return nil
+	})
+	return result, reserved, err
+}
+
+// SaveIdempotentResponse completes the request with the key reserved
+func (pg *PG) SaveIdempotentResponse(ctx context.Context, clientID int, key string, status int, response []byte) error {
+	return pg.tx(ctx, "SaveIdempotentResponse", func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, saveIdempotentResponseQuery, clientID, key, status, response)
+		return err
+	})
+}
+
+// ReleaseIdempotencyKey lets the key to be used again after the request with it failed
+func (pg *PG) ReleaseIdempotencyKey(ctx context.Context, clientID int, key string) error {
+	return pg.tx(ctx, "ReleaseIdempotencyKey", func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, releaseIdempotencyKeyQuery, clientID, key)
+		return err
+	})
+}
+
+// PurgeIdempotencyKeys deletes records older than ttl, returns the number of records deleted
+func (pg *PG) PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error) {
+	var result int64
+	err := pg.tx(ctx, "PurgeIdempotencyKeys", func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, purgeIdempotencyKeysQuery, ttl.Seconds())
+		if err != nil {
+			return err
+		}
+		result = res.RowsAffected()
+		return nil
+	})
+	return result, err
+}
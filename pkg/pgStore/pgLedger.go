@@ -0,0 +1,79 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+)
+
+// System accounts, wallet accounts are named by the wallet uuid
+const (
+	AccountCashIn   = "cash_in"
+	AccountCashOut  = "cash_out"
+	AccountFees     = "fees"
+	AccountSuspense = "suspense"
+	AccountFX       = "fx"
+)
+
+const insertPostingQuery = `
+INSERT INTO posting (transaction_id, account, currency, amount)
+VALUES ($1, $2, $3, $4)
+`
+const ledgerBalanceQuery = `
+SELECT COALESCE(SUM(amount), 0)
+FROM posting
+WHERE account = $1
+`
+
+// Posting is a leg of a transaction, postings of a transaction sum to zero in each currency
+type Posting struct {
+	Account  string     `json:"account"`
+	Currency string     `json:"currency"`
+	Amount   pkg.Amount `json:"amount"`
+}
+
+// insertTransaction creates the journal entry header, returns pkg.ErrDuplicateAction if the key is already used
+func insertTransaction(ctx context.Context, tx pgx.Tx, key, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRow(ctx, query, args...).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, pkg.ErrDuplicateAction(key)
+	}
+	return id, err
+}
+
+// post writes postings of the transaction, listeners of wallet accounts are notified on commit
+func post(ctx context.Context, tx pgx.Tx, transactionID int64, postings ...Posting) error {
+	for _, p := range postings {
+		if p.Amount.Sign() == 0 {
+			continue
+		}
+		if _, err := tx.Exec(ctx, insertPostingQuery, transactionID, p.Account, p.Currency, p.Amount); err != nil {
+			return err
+		}
+		if isSystemAccount(p.Account) {
+			continue
+		}
+		if err := notifyActivity(ctx, tx, p.Account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LedgerBalance sums the postings of an account, for a wallet it always equals the wallet amount
+func (pg *PG) LedgerBalance(ctx context.Context, account string) (pkg.Amount, error) {
+	account = pkg.WalletID(account)
+	var result pkg.Amount
+	err := pg.tx(ctx, "LedgerBalance", func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, ledgerBalanceQuery, account).Scan(&result)
+	})
+	return result, err
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
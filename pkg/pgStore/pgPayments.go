@@ -0,0 +1,196 @@
+package pgStore
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+)
+
+const insertPaymentQuery = `
+INSERT INTO payment (id, wallet, key, amount, currency)
+VALUES ($1, $2, $3, $4, $5)
+`
+const insertPaymentTransactionQuery = `
+INSERT INTO transaction (type, wallet, key, amount, currency, fee, payment_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id
+`
+
+// lockedWallet is the currency and the status of a wallet locked by lockPayment
+type lockedWallet struct {
+	currency string
+	status   pkg.WalletStatus
+}
+
+// SplitPayment pays amount from the wallet to receivers by parts allocated with pkg.Split, all of them or none.
+// The payment is one transfer keyed by its id: the sender is debited amount and the fee of a transfer of it once,
+// each receiver is credited its part converted by the current rate. Parts are the receipts of the receivers.
+// The error of a failed part is pkg.ErrBatchLeg with its index
+func (pg *PG) SplitPayment(ctx context.Context, from string, amount pkg.Amount, currency string, parts []pkg.SplitPart, key string) (pkg.Payment, error) {
+	from = pkg.WalletID(from)
+	wallets := make([]string, 0, len(parts)+1)
+	wallets = append(wallets, from)
+	legs := make([]pkg.TransferLeg, 0, len(parts))
+	for _, p := range parts {
+		wallets = append(wallets, p.To)
+		legs = append(legs, pkg.TransferLeg{To: p.To})
+	}
+	wallets = append(wallets, pg.feeWallets()...)
+	rates, err := pg.externalRates(ctx, from, legs)
+	if err != nil {
+		return pkg.Payment{}, err
+	}
+	var payment pkg.Payment
+	err = pg.tx(ctx, "SplitPayment", func(tx pgx.Tx) error {
+		locked, err := lockPayment(ctx, tx, wallets)
+		if err != nil {
+			return err
+		}
+		sender, ok := locked[from]
+		if !ok {
+			return pkg.ErrWalletNotFound
+		}
+		if err = sender.status.CheckDebit(); err != nil {
+			return err
+		}
+		if currency != "" && currency != sender.currency {
+			return pkg.ErrCurrencyMismatch
+		}
+		if amount, err = pkg.InCurrency(amount, sender.currency); err != nil {
+			return err
+		}
+		shares, err := pkg.Split(amount, parts)
+		if err != nil {
+			return err
+		}
+		zero, err := pkg.InCurrency(pkg.Amount{}, sender.currency)
+		if err != nil {
+			return err
+		}
+		payment = pkg.Payment{ID: uuid.New().String(), Wallet: from, Key: key, Amount: amount, Currency: sender.currency,
+			Parts: make([]pkg.Receipt, 0, len(parts))}
+		if _, err = tx.Exec(ctx, insertPaymentQuery, payment.ID, from, key, amount, sender.currency); err != nil {
+			if isUniqueViolation(err) {
+				return pkg.ErrDuplicateAction(key)
+			}
+			return err
+		}
+		var postings []Posting
+		for i, p := range parts {
+			receipt, partPostings, err := pg.creditPart(ctx, tx, rates, locked, from, pkg.WalletID(p.To), shares[i], sender.currency)
+			if err != nil {
+				return pkg.ErrBatchLeg{Index: i, Err: err}
+			}
+			receipt.Key, receipt.Fee = payment.ID, zero
+			payment.Parts = append(payment.Parts, receipt)
+			postings = append(postings, partPostings...)
+		}
+		if payment.Fee, err = fee(ctx, tx, TransactionTransferFunds, from, sender.currency, amount); err != nil {
+			return err
+		}
+		payment.Total = amount.Add(payment.Fee).Neg()
+		result, err := tx.Exec(ctx, changeBalanceQuery, payment.Total, from)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return pkg.ErrInsufficientFunds
+		}
+		id, err := insertTransaction(ctx, tx, payment.ID, insertPaymentTransactionQuery, TransactionTransferFunds, from, payment.ID,
+			amount, sender.currency, payment.Fee, payment.ID)
+		if err != nil {
+			return err
+		}
+		feePosting, err := pg.chargeFee(ctx, tx, sender.currency, payment.Fee)
+		if err != nil {
+			return err
+		}
+		postings = append(postings,
+			Posting{Account: from, Currency: sender.currency, Amount: payment.Total},
+			feePosting,
+		)
+		if err = post(ctx, tx, id, postings...); err != nil {
+			return err
+		}
+		for i := range payment.Parts {
+			payment.Parts[i].TransactionID = id
+			data := transferEvent{From: from, To: pkg.WalletID(parts[i].To), Receipt: payment.Parts[i]}
+			if err = emitEvent(ctx, tx, from, pkg.EventTransferSent, data); err != nil {
+				return err
+			}
+			if err = emitEvent(ctx, tx, data.To, pkg.EventTransferReceived, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return payment, err
+}
+
+// creditPart credits the receiver the share of the payment converted to its currency,
+// returns the receipt of the part and its postings
+func (pg *PG) creditPart(ctx context.Context, tx pgx.Tx, rates pkg.FXRateProvider, locked map[string]lockedWallet, from, to string,
+	share pkg.Amount, currency string) (pkg.Receipt, []Posting, error) {
+	if from == to {
+		return pkg.Receipt{}, nil, pkg.ErrSelfTransfer
+	}
+	receiver, ok := locked[to]
+	if !ok {
+		return pkg.Receipt{}, nil, pkg.ErrReceiverNotFound
+	}
+	if err := receiver.status.CheckReceiver(); err != nil {
+		return pkg.Receipt{}, nil, err
+	}
+	received := share
+	postings := make([]Posting, 0, 3)
+	if currency != receiver.currency {
+		rate, err := pg.transferRate(ctx, tx, rates, currency, receiver.currency, "")
+		if err != nil {
+			return pkg.Receipt{}, nil, err
+		}
+		exp, err := pkg.CurrencyExponent(receiver.currency)
+		if err != nil {
+			return pkg.Receipt{}, nil, err
+		}
+		if received, err = share.Convert(rate, exp); err != nil {
+			return pkg.Receipt{}, nil, err
+		}
+		if received.Sign() <= 0 {
+			return pkg.Receipt{}, nil, pkg.ErrInvalidAmount
+		}
+		postings = append(postings,
+			Posting{Account: AccountFX, Currency: currency, Amount: share},
+			Posting{Account: AccountFX, Currency: receiver.currency, Amount: received.Neg()},
+		)
+	}
+	if _, err := tx.Exec(ctx, changeBalanceQuery, received, to); err != nil {
+		return pkg.Receipt{}, nil, err
+	}
+	receipt := pkg.Receipt{
+		Amount:           share,
+		Currency:         currency,
+		AmountReceived:   received,
+		CurrencyReceiver: receiver.currency,
+		Total:            share.Neg(),
+	}
+	return receipt, append(postings, Posting{Account: to, Currency: receiver.currency, Amount: received}), nil
+}
+
+// lockPayment locks the wallets of a payment in the order of uuids, returns the ones found by wallet
+func lockPayment(ctx context.Context, tx pgx.Tx, wallets []string) (map[string]lockedWallet, error) {
+	rows, err := tx.Query(ctx, lockWalletsQuery, wallets)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]lockedWallet, len(wallets))
+	for rows.Next() {
+		var wallet string
+		var w lockedWallet
+		if err = rows.Scan(&wallet, &w.currency, &w.status); err != nil {
+			return nil, err
+		}
+		result[wallet] = w
+	}
+	return result, rows.Err()
+}
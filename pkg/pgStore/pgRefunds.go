@@ -0,0 +1,194 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+)
+
+const getTransactionTmpl = `
+SELECT t.id, t.type, t.wallet, t.wallet_receiver, t.key, t.amount, t.currency,
+       COALESCE(t.amount_received, t.amount) AS amount_received, COALESCE(t.currency_receiver, t.currency) AS currency_receiver,
+       COALESCE(t.rate, 1) AS rate, COALESCE(t.fee, 0) AS fee, t.original_id, t.ts,
+       (SELECT json_agg(json_build_object('account', l.account, 'currency', l.currency, 'amount', l.amount::text) ORDER BY l.id)
+        FROM posting l
+        WHERE l.transaction_id = t.id) AS legs
+FROM transaction t
+`
+const refundedQuery = `
+SELECT COALESCE(SUM(amount), 0) AS amount, COALESCE(SUM(COALESCE(amount_received, amount)), 0) AS amount_received
+FROM transaction
+WHERE original_id = $1
+`
+const insertRefundQuery = `
+INSERT INTO transaction (type, wallet, wallet_receiver, key, amount, currency, amount_received, currency_receiver, rate, original_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id
+`
+
+// GetTransaction finds a transaction by id, or by key if id is 0
+func (pg *PG) GetTransaction(ctx context.Context, id int64, key string) (Transaction, error) {
+	var result Transaction
+	err := pg.tx(ctx, "GetTransaction", func(tx pgx.Tx) error {
+		t, err := getTransaction(ctx, tx, id, key, false)
+		if err != nil {
+			return err
+		}
+		result, err = t.tx2Tx()
+		return err
+	})
+	return result, err
+}
+
+// Refund reverses amount of the original transaction found by id, or by key if id is 0,
+// zero amount refunds all that is left. Refunds of deposits, withdrawals and captures change the wallet balance back,
+// refunds of transfers return funds from the receiver to the sender by the rate of the original transfer
+func (pg *PG) Refund(ctx context.Context, originalID int64, originalKey string, amount pkg.Amount, key string) error {
+	return pg.tx(ctx, "Refund", func(tx pgx.Tx) error {
+		original, err := getTransaction(ctx, tx, originalID, originalKey, true)
+		if err != nil {
+			return err
+		}
+		// split payments have no single receiver to refund them
+		if original.Type == TransactionRefund || original.Type == TransactionTransferFunds && !original.WalletReceiver.Valid {
+			return pkg.ErrNotRefundable
+		}
+		var refunded struct {
+			Amount         pkg.Amount `db:"amount"`
+			AmountReceived pkg.Amount `db:"amount_received"`
+		}
+		if err = pgxscan.Get(ctx, tx, &refunded, refundedQuery, original.ID); err != nil {
+			return err
+		}
+		// refunds are stored with the sign opposite to the original amount
+		negative := original.Amount.Sign() < 0
+		remaining := original.Amount.Add(refunded.Amount)
+		if negative {
+			remaining = remaining.Neg()
+		}
+		if amount.Sign() == 0 {
+			amount = remaining
+		}
+		if amount, err = pkg.InCurrency(amount, original.Currency); err != nil {
+			return err
+		}
+		if amount.Sign() <= 0 || amount.Cmp(remaining) > 0 {
+			return pkg.ErrRefundExceedsOriginal
+		}
+		if original.Type != TransactionTransferFunds {
+			change := amount.Neg()
+			if negative {
+				change = amount
+			}
+			if _, err = lockWallet(ctx, tx, original.Wallet, change.Sign() < 0); err != nil {
+				return err
+			}
+			return refundDepositWithdrawal(ctx, tx, original, change, key)
+		}
+		if _, _, err = lockWallets(ctx, tx, original.WalletReceiver.String, original.Wallet); err != nil {
+			return err
+		}
+		received := amount
+		if original.Currency != original.CurrencyReceiver {
+			if amount.Cmp(remaining) == 0 {
+				received = original.AmountReceived.Add(refunded.AmountReceived)
+			} else {
+				exp, err := pkg.CurrencyExponent(original.CurrencyReceiver)
+				if err != nil {
+					return err
+				}
+				if received, err = amount.Convert(original.Rate, exp); err != nil {
+					return err
+				}
+			}
+		}
+		if received, err = pkg.InCurrency(received, original.CurrencyReceiver); err != nil {
+			return err
+		}
+		result, err := tx.Exec(ctx, changeBalanceQuery, received.Neg(), original.WalletReceiver.String)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return pkg.ErrInsufficientFunds
+		}
+		if _, err = tx.Exec(ctx, changeBalanceQuery, amount, original.Wallet); err != nil {
+			return err
+		}
+		var rate *pkg.Amount
+		if original.Currency != original.CurrencyReceiver {
+			rate = &original.Rate
+		}
+		id, err := insertTransaction(ctx, tx, key, insertRefundQuery, TransactionRefund, original.Wallet, original.WalletReceiver.String,
+			key, amount.Neg(), original.Currency, received.Neg(), original.CurrencyReceiver, rate, original.ID)
+		if err != nil {
+			return err
+		}
+		postings := []Posting{
+			{Account: original.WalletReceiver.String, Currency: original.CurrencyReceiver, Amount: received.Neg()},
+			{Account: original.Wallet, Currency: original.Currency, Amount: amount},
+		}
+		if rate != nil {
+			postings = append(postings,
+				Posting{Account: AccountFX, Currency: original.Currency, Amount: amount.Neg()},
+				Posting{Account: AccountFX, Currency: original.CurrencyReceiver, Amount: received},
+			)
+		}
+		if err = post(ctx, tx, id, postings...); err != nil {
+			return err
+		}
+		err = emitEvent(ctx, tx, original.WalletReceiver.String, pkg.EventRefundSucceeded,
+			refundEvent{TransactionID: id, OriginalID: original.ID, Key: key, Amount: received.Neg(), Currency: original.CurrencyReceiver})
+		if err != nil {
+			return err
+		}
+		return emitEvent(ctx, tx, original.Wallet, pkg.EventRefundSucceeded,
+			refundEvent{TransactionID: id, OriginalID: original.ID, Key: key, Amount: amount, Currency: original.Currency})
+	})
+}
+
+// refundDepositWithdrawal changes the wallet balance by change against the counter account of the original
+func refundDepositWithdrawal(ctx context.Context, tx pgx.Tx, original transaction, change pkg.Amount, key string) error {
+	counterAccount := AccountCashOut
+	if original.Type == TransactionDeposit {
+		counterAccount = AccountCashIn
+	}
+	result, err := tx.Exec(ctx, changeBalanceQuery, change, original.Wallet)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pkg.ErrInsufficientFunds
+	}
+	id, err := insertTransaction(ctx, tx, key, insertRefundQuery, TransactionRefund, original.Wallet, nil,
+		key, change, original.Currency, nil, nil, nil, original.ID)
+	if err != nil {
+		return err
+	}
+	err = post(ctx, tx, id,
+		Posting{Account: original.Wallet, Currency: original.Currency, Amount: change},
+		Posting{Account: counterAccount, Currency: original.Currency, Amount: change.Neg()},
+	)
+	if err != nil {
+		return err
+	}
+	return emitEvent(ctx, tx, original.Wallet, pkg.EventRefundSucceeded,
+		refundEvent{TransactionID: id, OriginalID: original.ID, Key: key, Amount: change, Currency: original.Currency})
+}
+
+func getTransaction(ctx context.Context, tx pgx.Tx, id int64, key string, forUpdate bool) (transaction, error) {
+	var result transaction
+	query, arg := getTransactionTmpl+"WHERE t.id = $1\n", interface{}(id)
+	if id == 0 {
+		query, arg = getTransactionTmpl+"WHERE t.key = $1\n", key
+	}
+	if forUpdate {
+		query += "FOR UPDATE OF t\n"
+	}
+	err := pgxscan.Get(ctx, tx, &result, query, arg)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return result, pkg.ErrTransactionNotFound
+	}
+	return result, err
+}
@@ -0,0 +1,116 @@
+package pgStore
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pgCursorFmt = `2006-01-02 15:04:05.999999`
+
+// Page of a report, Limit 0 means no limit. The page starts after Cursor if it's set
+type Page struct {
+	Limit  int
+	Cursor *Cursor
+	Desc   bool
+}
+
+// Cursor is the position of a posting in reports ordered by (ts, id)
+type Cursor struct {
+	Ts time.Time
+	ID int64
+}
+
+// String encodes the cursor to pass it to clients, its format isn't a part of the API
+func (c Cursor) String() string {
+	s := fmt.Sprintf("%d:%d", c.Ts.UnixNano()/int64(time.Microsecond), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, pkg.ErrInvalidCursor
+	}
+	parts := strings.Split(string(data), ":")
+	if len(parts) != 2 {
+		return Cursor{}, pkg.ErrInvalidCursor
+	}
+	micro, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Cursor{}, pkg.ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Cursor{}, pkg.ErrInvalidCursor
+	}
+	return Cursor{Ts: time.Unix(0, micro*int64(time.Microsecond)).UTC(), ID: id}, nil
+}
+
+// writePage adds the page condition, order and limit to the report query, one extra row is selected
+// to know if there is a next page
+func writePage(queryBuilder *strings.Builder, page Page) {
+	op, order := ">", "ASC"
+	if page.Desc {
+		op, order = "<", "DESC"
+	}
+	if page.Cursor != nil {
+		queryBuilder.WriteString(fmt.Sprintf("AND (p.ts, p.id) %s (timestamp '%s', %d)\n",
+			op, page.Cursor.Ts.UTC().Format(pgCursorFmt), page.Cursor.ID))
+	}
+	queryBuilder.WriteString(fmt.Sprintf("ORDER BY p.ts %s, p.id %s\n", order, order))
+	if page.Limit > 0 {
+		queryBuilder.WriteString(fmt.Sprintf("LIMIT %d\n", page.Limit+1))
+	}
+}
+
+// ExportReport calls fn for every posting on the wallet account matching filters, oldest first unless desc.
+// Rows are read from the connection as fn consumes them, all of them are of the same snapshot.
+// Export isn't retried as fn may have already been called
+func (pg *PG) ExportReport(ctx context.Context, wallet string, from, to *time.Time, tType TransactionType, desc bool, fn func(Transaction) error) error {
+	wallet = pkg.WalletID(wallet)
+	query, err := reportQuery(from, to, tType, Page{Desc: desc})
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	defer func() {
+		pkg.MetricDBTime.WithLabelValues("ExportReport").Observe(time.Since(started).Seconds())
+	}()
+	tx, err := pg.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		pkg.MetricDBErrors.WithLabelValues("ExportReport").Inc()
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	rows, err := tx.Query(ctx, query, wallet)
+	if err != nil {
+		pkg.MetricDBErrors.WithLabelValues("ExportReport").Inc()
+		return err
+	}
+	defer rows.Close()
+	scanner := pgxscan.NewRowScanner(rows)
+	for rows.Next() {
+		var tr transaction
+		if err = scanner.Scan(&tr); err != nil {
+			return err
+		}
+		t, err := tr.tx2Tx()
+		if err != nil {
+			return err
+		}
+		if err = fn(t); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		pkg.MetricDBErrors.WithLabelValues("ExportReport").Inc()
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package pgStore
+
+import (
+	"context"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"time"
+)
+
+// Statement is the wallet account for a period: balances at its start and end and all postings in between
+type Statement struct {
+	Wallet   string
+	Currency string
+	From     *time.Time
+	To       *time.Time
+	Opening  pkg.Amount
+	Closing  pkg.Amount
+	Entries  []Transaction
+}
+
+// Statement returns postings on the wallet account from the start of the from day to the end of the to day,
+// oldest first. Opening balance is zero if from isn't specified, closing one is the opening plus postings
+func (pg *PG) Statement(ctx context.Context, wallet string, from, to *time.Time) (Statement, error) {
+	wallet = pkg.WalletID(wallet)
+	result := Statement{Wallet: wallet, From: from, To: to}
+	query, err := reportQuery(from, to, AllTransactions, Page{})
+	if err != nil {
+		return result, err
+	}
+	err = pg.tx(ctx, "Statement", func(tx pgx.Tx) error {
+		var err error
+		if result.Currency, err = getWalletCurrency(ctx, tx, wallet); err != nil {
+			return err
+		}
+		result.Opening, err = toCurrency(pkg.Amount{}, result.Currency)
+		if err != nil {
+			return err
+		}
+		if from != nil {
+			if result.Opening, err = balanceAt(ctx, tx, wallet, *from, result.Currency); err != nil {
+				return err
+			}
+		}
+		tmp := make([]transaction, 0)
+		if err = pgxscan.Select(ctx, tx, &tmp, query, wallet); err != nil {
+			return err
+		}
+		result.Entries = make([]Transaction, 0, len(tmp))
+		result.Closing = result.Opening
+		for _, tr := range tmp {
+			t, err := tr.tx2Tx()
+			if err != nil {
+				return err
+			}
+			result.Entries = append(result.Entries, t)
+			result.Closing = result.Closing.Add(t.PostingAmount)
+		}
+		return nil
+	})
+	return result, err
+}
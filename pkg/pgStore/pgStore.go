@@ -5,15 +5,18 @@ import (
 	"database/sql"
 	"embed"
 	"errors"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	migrate "github.com/rubenv/sql-migrate"
 	"github.com/sirupsen/logrus"
+	"math/rand"
 	"payment-system/pkg"
 	"time"
 )
 
 const txRetries = 3
+const txBaseBackoff = 20 * time.Millisecond
 const maxConnections = 90
 
 // TODO do we need an opLog? add a table with wallet history if needed
@@ -22,9 +25,12 @@ const maxConnections = 90
 var migrations embed.FS
 
 type PG struct {
-	db  *pgxpool.Pool
-	dsn string
-	log *logrus.Logger
+	db        *pgxpool.Pool
+	dsn       string
+	log       *logrus.Logger
+	fx        pkg.FXRateProvider
+	feeWallet string
+	activity  *activityHub
 }
 
 func GetPGStore(ctx context.Context, log *logrus.Logger, dsn string) (*PG, error) {
@@ -41,11 +47,14 @@ func GetPGStore(ctx context.Context, log *logrus.Logger, dsn string) (*PG, error
 	if err = db.Ping(ctx); err != nil {
 		return nil, err
 	}
-	return &PG{
-		db:  db,
-		dsn: dsn,
-		log: log,
-	}, nil
+	pg := &PG{
+		db:       db,
+		dsn:      dsn,
+		log:      log,
+		activity: newActivityHub(),
+	}
+	pg.fx = pg
+	return pg, nil
 }
 
 func (pg *PG) DC() {
@@ -84,48 +93,109 @@ func (pg *PG) Migrate(direction migrate.MigrationDirection) error {
 	return err
 }
 
+// tx runs fn in a transaction, serialization failures and deadlocks are retried with jittered backoff
 func (pg *PG) tx(ctx context.Context, method string, fn func(tx pgx.Tx) error) error {
-	var err error
 	started := time.Now()
-	for i := 0; i < txRetries; i++ {
-		var tx pgx.Tx
-		if tx, err = pg.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}); err != nil {
-			pkg.MetricDBErrors.WithLabelValues(method).Inc()
-			continue
+	defer func() {
+		pkg.MetricDBTime.WithLabelValues(method).Observe(time.Since(started).Seconds())
+	}()
+	for i := 1; ; i++ {
+		err := pg.attempt(ctx, fn)
+		if err == nil || isFinal(err) {
+			return err
 		}
-		if err = fn(tx); err != nil {
-			_ = tx.Rollback(ctx)
-			var errDup pkg.ErrDuplicateAction
-			if errors.As(err, &errDup) || err == pkg.ErrInsufficientFunds {
-				return err
-			}
-			pkg.MetricDBErrors.WithLabelValues(method).Inc()
-			continue
+		pkg.MetricDBErrors.WithLabelValues(method).Inc()
+		if !isRetryable(err) || i == txRetries {
+			return err
 		}
 		select {
 		case <-ctx.Done():
-			_ = tx.Rollback(ctx)
 			return ctx.Err()
-		default:
+		case <-time.After(txBackoff(i)):
 		}
-		if err = tx.Commit(ctx); err != nil {
-			pkg.MetricDBErrors.WithLabelValues(method).Inc()
-			_ = tx.Rollback(ctx)
-			continue
-		}
-		pkg.MetricDBTime.WithLabelValues(method).Observe(time.Since(started).Seconds())
-		return nil
 	}
-	pkg.MetricDBTime.WithLabelValues(method).Observe(time.Since(started).Seconds())
+}
+
+func (pg *PG) attempt(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := pg.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback(ctx)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		_ = tx.Rollback(ctx)
+		return ctx.Err()
+	default:
+	}
+	if err = tx.Commit(ctx); err != nil {
+		_ = tx.Rollback(ctx)
+	}
 	return err
 }
 
+// isRetryable reports serialization failures and deadlocks, the transaction may succeed if run again
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		return true
+	}
+	return false
+}
+
+// txBackoff is the delay before the retry after the attempt, random in [d/2, d) of exponential d
+// so transactions which conflicted don't conflict again
+func txBackoff(attempt int) time.Duration {
+	d := txBaseBackoff << (attempt - 1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// isFinal reports errors of business logic, they aren't db errors
+func isFinal(err error) bool {
+	var errLeg pkg.ErrBatchLeg
+	if errors.As(err, &errLeg) {
+		return isFinal(errLeg.Err)
+	}
+	var errDup pkg.ErrDuplicateAction
+	if errors.As(err, &errDup) {
+		return true
+	}
+	switch err {
+	case pkg.ErrInsufficientFunds, pkg.ErrClientNotFound, pkg.ErrNonceReused, pkg.ErrWalletNotFound,
+		pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrUnknownCurrency, pkg.ErrInvalidAmount,
+		pkg.ErrRateNotFound, pkg.ErrInvalidQuote, pkg.ErrQuoteExpired,
+		pkg.ErrHoldNotFound, pkg.ErrHoldNotActive, pkg.ErrHoldExpired, pkg.ErrCaptureExceedsHold,
+		pkg.ErrTransactionNotFound, pkg.ErrNotRefundable, pkg.ErrRefundExceedsOriginal,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed, pkg.ErrWalletNotEmpty, pkg.ErrInvalidWalletStatus,
+		pkg.ErrSelfTransfer, pkg.ErrReceiverNotFound, pkg.ErrReceiverFrozen, pkg.ErrReceiverClosed,
+		pkg.ErrKeyReused, pkg.ErrRequestInProgress, pkg.ErrWebhookNotFound, pkg.ErrDeliveryNotFound,
+		pkg.ErrInvalidSplit, pkg.ErrInvalidPercent, pkg.ErrSplitTotal:
+		return true
+	}
+	return false
+}
+
 // Truncate for tests
 func (pg *PG) Truncate() error {
 	_, err := pg.db.Exec(context.Background(), "TRUNCATE TABLE wallet;")
 	if err != nil {
 		return err
 	}
-	_, err = pg.db.Exec(context.Background(), "TRUNCATE TABLE transaction;")
+	_, err = pg.db.Exec(context.Background(), "TRUNCATE TABLE posting, transaction, payment;")
+	if err != nil {
+		return err
+	}
+	_, err = pg.db.Exec(context.Background(), "TRUNCATE TABLE client, client_nonce, fx_rate, fx_quote, hold, fee_rule, wallet_status_history, idempotency_key, balance_snapshot;")
+	if err != nil {
+		return err
+	}
+	_, err = pg.db.Exec(context.Background(), "TRUNCATE TABLE webhook, webhook_event, webhook_delivery;")
 	return err
 }
@@ -0,0 +1,85 @@
+package pgStore
+
+import (
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+)
+
+const walletStatusForUpdateQuery = `
+SELECT status, amount, held
+FROM wallet
+WHERE wallet = $1
+FOR UPDATE
+`
+const setWalletStatusQuery = `
+UPDATE wallet SET status = $1, updated = NOW()
+WHERE wallet = $2
+`
+const insertWalletStatusChangeQuery = `
+INSERT INTO wallet_status_history (wallet, status_from, status_to, reason, client_id)
+VALUES ($1, $2, $3, $4, $5)
+`
+const walletStatusHistoryQuery = `
+SELECT id, wallet, status_from, status_to, reason, client_id, ts
+FROM wallet_status_history
+WHERE wallet = $1
+ORDER BY ts, id
+`
+
+// SetWalletStatus changes the wallet status and records the change made by the client with reason,
+// closed wallets can't be reopened, wallets with money on the balance or holds can't be closed
+func (pg *PG) SetWalletStatus(ctx context.Context, wallet string, status pkg.WalletStatus, reason string, clientID int) (pkg.Wallet, error) {
+	wallet = pkg.WalletID(wallet)
+	result := pkg.Wallet{}
+	if status < pkg.WalletActive || status > pkg.WalletClosed {
+		return result, pkg.ErrInvalidWalletStatus
+	}
+	err := pg.tx(ctx, "SetWalletStatus", func(tx pgx.Tx) error {
+		var current pkg.WalletStatus
+		var amount, held pkg.Amount
+		err := tx.QueryRow(ctx, walletStatusForUpdateQuery, wallet).Scan(&current, &amount, &held)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pkg.ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if current == pkg.WalletClosed {
+			return pkg.ErrWalletClosed
+		}
+		if status == pkg.WalletClosed && (amount.Sign() != 0 || held.Sign() != 0) {
+			return pkg.ErrWalletNotEmpty
+		}
+		if status != current {
+			if _, err = tx.Exec(ctx, setWalletStatusQuery, status, wallet); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, insertWalletStatusChangeQuery, wallet, current, status, reason, clientID); err != nil {
+				return err
+			}
+		}
+		if result, err = getWallet(ctx, tx, wallet); err != nil {
+			return err
+		}
+		if status == current {
+			return nil
+		}
+		return emitEvent(ctx, tx, wallet, pkg.EventWalletStatusChanged,
+			statusEvent{Wallet: wallet, From: current, To: status, Reason: reason})
+	})
+	return result, err
+}
+
+// WalletStatusHistory returns status changes of the wallet, oldest first
+func (pg *PG) WalletStatusHistory(ctx context.Context, wallet string) ([]pkg.WalletStatusChange, error) {
+	wallet = pkg.WalletID(wallet)
+	var result []pkg.WalletStatusChange
+	err := pg.tx(ctx, "WalletStatusHistory", func(tx pgx.Tx) error {
+		result = nil
+		return pgxscan.Select(ctx, tx, &result, walletStatusHistoryQuery, wallet)
+	})
+	return result, err
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/georgysavva/scany/pgxscan"
-	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"payment-system/pkg"
 	"strings"
@@ -20,27 +19,60 @@ const (
 	TransactionWithdrawal
 	TransactionTransferFunds
 	TransactionTransferFundsTo
+	TransactionCapture
+	TransactionRefund
 	AllTransactions = -1
 )
 const pgDateTimeFmt = `2006-01-02 15:04:05`
 const getWalletQuery = `
-SELECT wallet, amount, owner, status, updated, created
+SELECT wallet, amount, held, amount - held AS available, currency, owner, status, updated, created
 FROM wallet
 WHERE wallet = $1
 `
 const createWalletQuery = `
-INSERT INTO wallet (wallet, owner)
-VALUES ($1, $2)
+INSERT INTO wallet (wallet, owner, currency)
+VALUES ($1, $2, $3)
 ON CONFLICT (wallet) DO NOTHING;
 `
 const changeBalanceQuery = `
-UPDATE wallet SET amount = wallet.amount + $1::numeric(12, 2)
-WHERE wallet = $2 AND amount >= ($1::numeric(12, 2) * -1)
+UPDATE wallet SET amount = wallet.amount + $1::numeric(18, 3)
+WHERE wallet = $2 AND amount - held >= ($1::numeric(18, 3) * -1)
 `
 const walletReportTmpl = `
-SELECT id, type, wallet, wallet_receiver, key, amount, ts
-FROM transaction
-WHERE 1=1
+SELECT p.id AS posting_id, t.id, t.type, t.wallet, t.wallet_receiver, t.key, t.amount, t.currency,
+       COALESCE(t.amount_received, t.amount) AS amount_received, COALESCE(t.currency_receiver, t.currency) AS currency_receiver,
+       COALESCE(t.rate, 1) AS rate, COALESCE(t.fee, 0) AS fee, t.original_id, t.payment_id, p.amount AS posting_amount, p.currency AS posting_currency, p.ts,
+       (SELECT json_agg(json_build_object('account', l.account, 'currency', l.currency, 'amount', l.amount::text) ORDER BY l.id)
+        FROM posting l
+        WHERE l.transaction_id = t.id) AS legs
+FROM posting p
+JOIN transaction t ON t.id = p.transaction_id
+WHERE p.account = $1
+`
+const walletCurrencyQuery = `
+SELECT currency
+FROM wallet
+WHERE wallet = $1
+`
+const lockWalletQuery = `
+SELECT currency, status
+FROM wallet
+WHERE wallet = $1
+FOR NO KEY UPDATE
+`
+const lockWalletsQuery = `
+SELECT wallet, currency, status
+FROM wallet
+WHERE wallet = ANY($1::uuid[])
+ORDER BY wallet
+FOR NO KEY UPDATE
+`
+const lockBatchQuery = `
+SELECT wallet
+FROM wallet
+WHERE wallet = ANY($1::uuid[])
+ORDER BY wallet
+FOR NO KEY UPDATE
 `
 const ownerWalletQuery = `
 SELECT owner
@@ -49,16 +81,39 @@ WHERE wallet = $1
 `
 
 func (pg *PG) GetWallet(ctx context.Context, wallet string) (pkg.Wallet, error) {
+	wallet = pkg.WalletID(wallet)
 	result := pkg.Wallet{}
 	err := pg.tx(ctx, "GetWallet", func(tx pgx.Tx) error {
-		return pgxscan.Get(ctx, tx, &result, getWalletQuery, wallet)
+		var err error
+		result, err = getWallet(ctx, tx, wallet)
+		return err
 	})
 	return result, err
 }
 
-func (pg *PG) CreateWallet(ctx context.Context, wallet string, owner int) error {
+func getWallet(ctx context.Context, tx pgx.Tx, wallet string) (pkg.Wallet, error) {
+	result := pkg.Wallet{}
+	err := pgxscan.Get(ctx, tx, &result, getWalletQuery, wallet)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return result, pkg.ErrWalletNotFound
+	}
+	if err != nil {
+		return result, err
+	}
+	if result.Amount, err = toCurrency(result.Amount, result.Currency); err != nil {
+		return result, err
+	}
+	if result.Held, err = toCurrency(result.Held, result.Currency); err != nil {
+		return result, err
+	}
+	result.Available, err = toCurrency(result.Available, result.Currency)
+	return result, err
+}
+
+func (pg *PG) CreateWallet(ctx context.Context, wallet string, owner int, currency string) error {
+	wallet = pkg.WalletID(wallet)
 	return pg.tx(ctx, "CreateWallet", func(tx pgx.Tx) error {
-		result, err := tx.Exec(ctx, createWalletQuery, wallet, owner)
+		result, err := tx.Exec(ctx, createWalletQuery, wallet, owner, currency)
 		if err != nil {
 			return err
 		}
@@ -66,42 +121,47 @@ func (pg *PG) CreateWallet(ctx context.Context, wallet string, owner int) error
 		if n == 0 {
 			return pkg.ErrDuplicateAction(wallet)
 		}
-		return nil
+		return emitEvent(ctx, tx, wallet, pkg.EventWalletCreated, walletEvent{Wallet: wallet, Owner: owner, Currency: currency})
 	})
 }
 
-func (pg *PG) DepositWithdraw(ctx context.Context, wallet string, amount float64, key string) error {
-	return pg.tx(ctx, "DepositWithdraw", func(tx pgx.Tx) error {
-		result, err := tx.Exec(ctx, changeBalanceQuery, amount, wallet)
+// DepositWithdraw changes the wallet balance by amount, currency if not empty must match the wallet's one.
+// Withdrawals are charged a fee on top of amount
+func (pg *PG) DepositWithdraw(ctx context.Context, wallet string, amount pkg.Amount, currency, key string) (pkg.Receipt, error) {
+	wallet = pkg.WalletID(wallet)
+	var receipt pkg.Receipt
+	err := pg.tx(ctx, "DepositWithdraw", func(tx pgx.Tx) error {
+		// withdrawals credit their fee to the fee wallet, it's locked along with the wallet
+		if amount.Sign() < 0 && pg.feeWallet != "" {
+			if _, err := tx.Exec(ctx, lockBatchQuery, append([]string{wallet}, pg.feeWallets()...)); err != nil {
+				return err
+			}
+		}
+		walletCurrency, err := lockWallet(ctx, tx, wallet, amount.Sign() < 0)
 		if err != nil {
 			return err
 		}
-		n := result.RowsAffected()
-		if n == 0 {
-			return pkg.ErrInsufficientFunds
+		if currency != "" && currency != walletCurrency {
+			return pkg.ErrCurrencyMismatch
 		}
-		var tType TransactionType
-		if amount > 0 {
-			tType = TransactionDeposit
-		} else {
-			tType = TransactionWithdrawal
+		if amount, err = pkg.InCurrency(amount, walletCurrency); err != nil {
+			return err
+		}
+		tType, counterAccount := TransactionDeposit, AccountCashIn
+		if amount.Sign() < 0 {
+			tType, counterAccount = TransactionWithdrawal, AccountCashOut
 		}
-		query := `INSERT INTO transaction (type, wallet, key, amount) VALUES ($1, $2, $3, $4)`
-		_, err = tx.Exec(ctx, query, tType, wallet, key, amount)
+		feeAmount, err := pkg.InCurrency(pkg.Amount{}, walletCurrency)
 		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr); pgErr.Code == "23505" {
-				return pkg.ErrDuplicateAction(key)
-			}
 			return err
 		}
-		return nil
-	})
-}
-
-func (pg *PG) TransferFunds(ctx context.Context, from, to string, amount float64, key string) error {
-	return pg.tx(ctx, "TransferFunds", func(tx pgx.Tx) error {
-		result, err := tx.Exec(ctx, changeBalanceQuery, -amount, from)
+		if tType == TransactionWithdrawal {
+			if feeAmount, err = fee(ctx, tx, tType, wallet, walletCurrency, amount); err != nil {
+				return err
+			}
+		}
+		total := amount.Sub(feeAmount)
+		result, err := tx.Exec(ctx, changeBalanceQuery, total, wallet)
 		if err != nil {
 			return err
 		}
@@ -109,94 +169,355 @@ func (pg *PG) TransferFunds(ctx context.Context, from, to string, amount float64
 		if n == 0 {
 			return pkg.ErrInsufficientFunds
 		}
-		query := `INSERT INTO transaction (type, wallet, wallet_receiver, key, amount) VALUES ($1, $2, $3, $4, $5)`
-		_, err = tx.Exec(ctx, query, TransactionTransferFunds, from, to, key, amount)
+		query := `INSERT INTO transaction (type, wallet, key, amount, currency, fee) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+		id, err := insertTransaction(ctx, tx, key, query, tType, wallet, key, amount, walletCurrency, feeAmount)
 		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr); pgErr.Code == "23505" {
-				return pkg.ErrDuplicateAction(key)
-			}
 			return err
 		}
-		_, err = tx.Exec(ctx, changeBalanceQuery, amount, to)
+		feePosting, err := pg.chargeFee(ctx, tx, walletCurrency, feeAmount)
+		if err != nil {
+			return err
+		}
+		receipt = pkg.Receipt{
+			TransactionID:    id,
+			Key:              key,
+			Amount:           amount,
+			Currency:         walletCurrency,
+			AmountReceived:   amount,
+			CurrencyReceiver: walletCurrency,
+			Fee:              feeAmount,
+			Total:            total,
+		}
+		err = post(ctx, tx, id,
+			Posting{Account: wallet, Currency: walletCurrency, Amount: total},
+			Posting{Account: counterAccount, Currency: walletCurrency, Amount: amount.Neg()},
+			feePosting,
+		)
 		if err != nil {
 			return err
 		}
+		event := pkg.EventDepositSucceeded
+		if tType == TransactionWithdrawal {
+			event = pkg.EventWithdrawalSucceeded
+		}
+		return emitEvent(ctx, tx, wallet, event, receipt)
+	})
+	return receipt, err
+}
+
+// TransferFunds moves amount in the sender's currency, currency if not empty must match it.
+// Transfers between wallets of different currencies are converted by the rate of quote if given or the current one.
+// The sender is charged a fee on top of amount
+func (pg *PG) TransferFunds(ctx context.Context, from, to string, amount pkg.Amount, currency, quote, key string) (pkg.Receipt, error) {
+	rates, err := pg.externalRates(ctx, from, []pkg.TransferLeg{{To: to, Quote: quote}})
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	var receipt pkg.Receipt
+	err = pg.tx(ctx, "TransferFunds", func(tx pgx.Tx) error {
+		var err error
+		receipt, err = pg.transfer(ctx, tx, rates, from, to, amount, currency, quote, key)
+		return err
+	})
+	return receipt, err
+}
+
+// TransferFundsBatch makes transfers from the wallet in one transaction, all of them or none.
+// The error of a failed transfer is pkg.ErrBatchLeg with its index
+func (pg *PG) TransferFundsBatch(ctx context.Context, from string, legs []pkg.TransferLeg) ([]pkg.Receipt, error) {
+	wallets := make([]string, 0, len(legs)+1)
+	wallets = append(wallets, from)
+	for _, l := range legs {
+		wallets = append(wallets, l.To)
+	}
+	wallets = append(wallets, pg.feeWallets()...)
+	rates, err := pg.externalRates(ctx, from, legs)
+	if err != nil {
+		return nil, err
+	}
+	receipts := make([]pkg.Receipt, 0, len(legs))
+	err = pg.tx(ctx, "TransferFundsBatch", func(tx pgx.Tx) error {
+		receipts = receipts[:0]
+		// legs lock their wallets in pairs, locking all of them and the fee wallet first keeps the order of uuids
+		// across the batch
+		if _, err := tx.Exec(ctx, lockBatchQuery, wallets); err != nil {
+			return err
+		}
+		for i, l := range legs {
+			receipt, err := pg.transfer(ctx, tx, rates, from, l.To, l.Amount, l.Currency, l.Quote, l.Key)
+			if err != nil {
+				return pkg.ErrBatchLeg{Index: i, Err: err}
+			}
+			receipts = append(receipts, receipt)
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// transfer is TransferFunds within tx, rates are of pg.externalRates
+func (pg *PG) transfer(ctx context.Context, tx pgx.Tx, rates pkg.FXRateProvider, from, to string, amount pkg.Amount, currency, quote, key string) (pkg.Receipt, error) {
+	from, to = pkg.WalletID(from), pkg.WalletID(to)
+	if from == to {
+		return pkg.Receipt{}, pkg.ErrSelfTransfer
+	}
+	senderCurrency, receiverCurrency, err := lockWallets(ctx, tx, from, to, pg.feeWallets()...)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	if currency != "" && currency != senderCurrency {
+		return pkg.Receipt{}, pkg.ErrCurrencyMismatch
+	}
+	if amount, err = pkg.InCurrency(amount, senderCurrency); err != nil {
+		return pkg.Receipt{}, err
+	}
+	received := amount
+	var rate *pkg.Amount
+	if senderCurrency != receiverCurrency {
+		r, err := pg.transferRate(ctx, tx, rates, senderCurrency, receiverCurrency, quote)
+		if err != nil {
+			return pkg.Receipt{}, err
+		}
+		exp, err := pkg.CurrencyExponent(receiverCurrency)
+		if err != nil {
+			return pkg.Receipt{}, err
+		}
+		if received, err = amount.Convert(r, exp); err != nil {
+			return pkg.Receipt{}, err
+		}
+		if received.Sign() <= 0 {
+			return pkg.Receipt{}, pkg.ErrInvalidAmount
+		}
+		rate = &r
+	}
+	feeAmount, err := fee(ctx, tx, TransactionTransferFunds, from, senderCurrency, amount)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	total := amount.Add(feeAmount).Neg()
+	result, err := tx.Exec(ctx, changeBalanceQuery, total, from)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	n := result.RowsAffected()
+	if n == 0 {
+		return pkg.Receipt{}, pkg.ErrInsufficientFunds
+	}
+	query := `INSERT INTO transaction (type, wallet, wallet_receiver, key, amount, currency, amount_received, currency_receiver, rate, fee)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+	id, err := insertTransaction(ctx, tx, key, query, TransactionTransferFunds, from, to, key, amount, senderCurrency, received, receiverCurrency, rate, feeAmount)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	if result, err = tx.Exec(ctx, changeBalanceQuery, received, to); err != nil {
+		return pkg.Receipt{}, err
+	}
+	if result.RowsAffected() == 0 {
+		return pkg.Receipt{}, pkg.ErrReceiverNotFound
+	}
+	feePosting, err := pg.chargeFee(ctx, tx, senderCurrency, feeAmount)
+	if err != nil {
+		return pkg.Receipt{}, err
+	}
+	receipt := pkg.Receipt{
+		TransactionID:    id,
+		Key:              key,
+		Amount:           amount,
+		Currency:         senderCurrency,
+		AmountReceived:   received,
+		CurrencyReceiver: receiverCurrency,
+		Fee:              feeAmount,
+		Total:            total,
+	}
+	postings := []Posting{
+		{Account: from, Currency: senderCurrency, Amount: total},
+		{Account: to, Currency: receiverCurrency, Amount: received},
+		feePosting,
+	}
+	if senderCurrency != receiverCurrency {
+		postings = append(postings,
+			Posting{Account: AccountFX, Currency: senderCurrency, Amount: amount},
+			Posting{Account: AccountFX, Currency: receiverCurrency, Amount: received.Neg()},
+		)
+	}
+	if err = post(ctx, tx, id, postings...); err != nil {
+		return pkg.Receipt{}, err
+	}
+	data := transferEvent{From: from, To: to, Receipt: receipt}
+	if err = emitEvent(ctx, tx, from, pkg.EventTransferSent, data); err != nil {
+		return pkg.Receipt{}, err
+	}
+	if err = emitEvent(ctx, tx, to, pkg.EventTransferReceived, data); err != nil {
+		return pkg.Receipt{}, err
+	}
+	return receipt, nil
 }
 
+// Transaction is a posting on the wallet account along with its journal entry, Legs are all postings of the entry.
+// Transfers which are parts of a split payment have its PaymentID
 type Transaction struct {
-	ID             int64           `json:"id" csv:"ID"`
-	Type           TransactionType `json:"type" csv:"TYPE"`
-	Wallet         string          `json:"wallet" csv:"WALLET"`
-	WalletReceiver string          `json:"wallet_receiver" csv:"WALLET_RECEIVER"`
-	Key            string          `json:"key" csv:"KEY"`
-	Amount         float64         `json:"amount" csv:"AMOUNT"`
-	Ts             time.Time       `json:"ts" csv:"TS"`
+	PostingID        int64           `json:"posting_id" csv:"POSTING_ID"`
+	ID               int64           `json:"id" csv:"ID"`
+	Type             TransactionType `json:"type" csv:"TYPE"`
+	Wallet           string          `json:"wallet" csv:"WALLET"`
+	WalletReceiver   string          `json:"wallet_receiver" csv:"WALLET_RECEIVER"`
+	Key              string          `json:"key" csv:"KEY"`
+	Amount           pkg.Amount      `json:"amount" csv:"AMOUNT"`
+	Currency         string          `json:"currency" csv:"CURRENCY"`
+	AmountReceived   pkg.Amount      `json:"amount_received" csv:"AMOUNT_RECEIVED"`
+	CurrencyReceiver string          `json:"currency_receiver" csv:"CURRENCY_RECEIVER"`
+	Rate             pkg.Amount      `json:"rate" csv:"RATE"`
+	Fee              pkg.Amount      `json:"fee" csv:"FEE"`
+	OriginalID       int64           `json:"original_id,omitempty" csv:"ORIGINAL_ID"`
+	PaymentID        string          `json:"payment_id,omitempty" csv:"PAYMENT_ID"`
+	PostingAmount    pkg.Amount      `json:"posting_amount" csv:"POSTING_AMOUNT"`
+	Ts               time.Time       `json:"ts" csv:"TS"`
+	Legs             []Posting       `json:"legs" csv:"-"`
 }
 
 type transaction struct {
-	ID             int64           `db:"id"`
-	Type           TransactionType `db:"type"`
-	Wallet         string          `db:"wallet"`
-	WalletReceiver sql.NullString  `db:"wallet_receiver"`
-	Key            string          `db:"key"`
-	Amount         float64         `db:"amount"`
-	Ts             time.Time       `db:"ts"`
+	PostingID        int64           `db:"posting_id"`
+	ID               int64           `db:"id"`
+	Type             TransactionType `db:"type"`
+	Wallet           string          `db:"wallet"`
+	WalletReceiver   sql.NullString  `db:"wallet_receiver"`
+	Key              string          `db:"key"`
+	Amount           pkg.Amount      `db:"amount"`
+	Currency         string          `db:"currency"`
+	AmountReceived   pkg.Amount      `db:"amount_received"`
+	CurrencyReceiver string          `db:"currency_receiver"`
+	Rate             pkg.Amount      `db:"rate"`
+	Fee              pkg.Amount      `db:"fee"`
+	OriginalID       sql.NullInt64   `db:"original_id"`
+	PaymentID        sql.NullString  `db:"payment_id"`
+	PostingAmount    pkg.Amount      `db:"posting_amount"`
+	PostingCurrency  string          `db:"posting_currency"`
+	Ts               time.Time       `db:"ts"`
+	Legs             []Posting       `db:"legs"`
 }
 
-func (t transaction) tx2Tx() Transaction {
-	return Transaction{
-		ID:             t.ID,
-		Type:           t.Type,
-		Wallet:         t.Wallet,
-		WalletReceiver: t.WalletReceiver.String,
-		Key:            t.Key,
-		Amount:         t.Amount,
-		Ts:             t.Ts,
+func (t transaction) tx2Tx() (Transaction, error) {
+	amount, err := toCurrency(t.Amount, t.Currency)
+	if err != nil {
+		return Transaction{}, err
+	}
+	received, err := toCurrency(t.AmountReceived, t.CurrencyReceiver)
+	if err != nil {
+		return Transaction{}, err
 	}
+	fee, err := toCurrency(t.Fee, t.Currency)
+	if err != nil {
+		return Transaction{}, err
+	}
+	var posted pkg.Amount
+	if t.PostingCurrency != "" {
+		if posted, err = toCurrency(t.PostingAmount, t.PostingCurrency); err != nil {
+			return Transaction{}, err
+		}
+	}
+	legs := make([]Posting, 0, len(t.Legs))
+	for _, l := range t.Legs {
+		if l.Amount, err = toCurrency(l.Amount, l.Currency); err != nil {
+			return Transaction{}, err
+		}
+		legs = append(legs, l)
+	}
+	return Transaction{
+		PostingID:        t.PostingID,
+		ID:               t.ID,
+		Type:             t.Type,
+		Wallet:           t.Wallet,
+		WalletReceiver:   t.WalletReceiver.String,
+		Key:              t.Key,
+		Amount:           amount,
+		Currency:         t.Currency,
+		AmountReceived:   received,
+		CurrencyReceiver: t.CurrencyReceiver,
+		Rate:             t.Rate,
+		Fee:              fee,
+		OriginalID:       t.OriginalID.Int64,
+		PaymentID:        t.PaymentID.String,
+		PostingAmount:    posted,
+		Ts:               t.Ts,
+		Legs:             legs,
+	}, nil
 }
 
+// Report returns all postings on the wallet account matching filters, oldest first
 func (pg *PG) Report(ctx context.Context, wallet string, from, to *time.Time, tType TransactionType) ([]Transaction, error) {
+	result, _, err := pg.ReportPage(ctx, wallet, from, to, tType, Page{})
+	return result, err
+}
+
+// ReportPage returns a page of postings on the wallet account matching filters
+// and the cursor of the next page if there is one
+func (pg *PG) ReportPage(ctx context.Context, wallet string, from, to *time.Time, tType TransactionType, page Page) ([]Transaction, *Cursor, error) {
+	wallet = pkg.WalletID(wallet)
+	query, err := reportQuery(from, to, tType, page)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := make([]Transaction, 0)
+	var next *Cursor
+	err = pg.tx(ctx, "Report", func(tx pgx.Tx) error {
+		tmp := make([]transaction, 0)
+		err := pgxscan.Select(ctx, tx, &tmp, query, wallet)
+		if err != nil {
+			return err
+		}
+		result, next = result[:0], nil
+		if page.Limit > 0 && len(tmp) > page.Limit {
+			tmp = tmp[:page.Limit]
+			last := tmp[len(tmp)-1]
+			next = &Cursor{Ts: last.Ts, ID: last.PostingID}
+		}
+		for _, tr := range tmp {
+			t, err := tr.tx2Tx()
+			if err != nil {
+				return err
+			}
+			result = append(result, t)
+		}
+		return nil
+	})
+	return result, next, err
+}
+
+func reportQuery(from, to *time.Time, tType TransactionType, page Page) (string, error) {
 	queryBuilder := strings.Builder{}
 	queryBuilder.WriteString(walletReportTmpl)
 	switch tType {
 	case TransactionTransferFundsTo:
-		queryBuilder.WriteString("AND wallet_receiver = $1\n")
+		queryBuilder.WriteString("AND t.type = 2 AND p.amount > 0\n")
 	case TransactionDeposit:
-		queryBuilder.WriteString("AND wallet = $1 AND type = 0\n")
+		queryBuilder.WriteString("AND t.type = 0\n")
 	case TransactionWithdrawal:
-		queryBuilder.WriteString("AND wallet = $1 AND type = 1\n")
+		queryBuilder.WriteString("AND t.type = 1\n")
 	case TransactionTransferFunds:
-		queryBuilder.WriteString("AND wallet = $1 AND type = 2\n")
+		queryBuilder.WriteString("AND t.type = 2 AND p.amount < 0\n")
+	case TransactionCapture:
+		queryBuilder.WriteString("AND t.type = 4\n")
+	case TransactionRefund:
+		queryBuilder.WriteString("AND t.type = 5\n")
 	case AllTransactions:
-		queryBuilder.WriteString("AND (wallet = $1 OR wallet_receiver = $1)\n")
 	default:
-		return nil, pkg.ErrInvalidTransactionType
+		return "", pkg.ErrInvalidTransactionType
 	}
 	if from != nil {
-		queryBuilder.WriteString(fmt.Sprintf("AND ts >= timestamp '%s'\n", from.Format(pgDateTimeFmt)))
+		queryBuilder.WriteString(fmt.Sprintf("AND p.ts >= timestamp '%s'\n", from.Format(pgDateTimeFmt)))
 	}
 	if to != nil {
-		queryBuilder.WriteString(fmt.Sprintf("AND ts < timestamp '%s'\n", to.Add(24*time.Hour).Format(pgDateTimeFmt)))
+		queryBuilder.WriteString(fmt.Sprintf("AND p.ts < timestamp '%s'\n", to.Add(24*time.Hour).Format(pgDateTimeFmt)))
 	}
-	result := make([]Transaction, 0)
-	tmp := make([]transaction, 0)
-	err := pg.tx(ctx, "Report", func(tx pgx.Tx) error {
-		err := pgxscan.Select(ctx, tx, &tmp, queryBuilder.String(), wallet)
-		if err != nil {
-			return err
-		}
-		for _, tr := range tmp {
-			result = append(result, tr.tx2Tx())
-		}
-		return nil
-	})
-	return result, err
+	writePage(&queryBuilder, page)
+	return queryBuilder.String(), nil
 }
 
 func (pg *PG) CheckOwnerWallet(ctx context.Context, wallet string, owner int) (bool, error) {
+	wallet = pkg.WalletID(wallet)
 	var tmp int
 	err := pg.tx(ctx, "CheckOwnerWallet", func(tx pgx.Tx) error {
 		return pgxscan.Get(ctx, tx, &tmp, ownerWalletQuery, wallet)
@@ -212,3 +533,87 @@ func (pg *PG) CheckOwnerWallet(ctx context.Context, wallet string, owner int) (b
 	}
 	return true, nil
 }
+
+func getWalletCurrency(ctx context.Context, tx pgx.Tx, wallet string) (string, error) {
+	var currency string
+	err := tx.QueryRow(ctx, walletCurrencyQuery, wallet).Scan(&currency)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", pkg.ErrWalletNotFound
+	}
+	return currency, err
+}
+
+// lockWallet locks the wallet for a balance change and checks its status allows debits or credits,
+// returns the wallet currency
+func lockWallet(ctx context.Context, tx pgx.Tx, wallet string, debit bool) (string, error) {
+	var currency string
+	var status pkg.WalletStatus
+	err := tx.QueryRow(ctx, lockWalletQuery, wallet).Scan(&currency, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", pkg.ErrWalletNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if debit {
+		return currency, status.CheckDebit()
+	}
+	return currency, status.CheckCredit()
+}
+
+// lockWallets locks both wallets and others changed along with them in the order of their uuids, so transactions
+// locking the same wallets in any direction don't deadlock. Returns currencies of the debited and the credited wallets,
+// errors of the credited one are those of the receiver
+func lockWallets(ctx context.Context, tx pgx.Tx, debit, credit string, others ...string) (string, string, error) {
+	rows, err := tx.Query(ctx, lockWalletsQuery, append([]string{debit, credit}, others...))
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+	var debitStatus, creditStatus *pkg.WalletStatus
+	var debitCurrency, creditCurrency string
+	for rows.Next() {
+		var wallet, currency string
+		var status pkg.WalletStatus
+		if err = rows.Scan(&wallet, &currency, &status); err != nil {
+			return "", "", err
+		}
+		if strings.EqualFold(wallet, debit) {
+			debitCurrency, debitStatus = currency, &status
+		}
+		if strings.EqualFold(wallet, credit) {
+			creditCurrency, creditStatus = currency, &status
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return "", "", err
+	}
+	if debitStatus == nil {
+		return "", "", pkg.ErrWalletNotFound
+	}
+	if err = debitStatus.CheckDebit(); err != nil {
+		return "", "", err
+	}
+	if creditStatus == nil {
+		return "", "", pkg.ErrReceiverNotFound
+	}
+	return debitCurrency, creditCurrency, creditStatus.CheckReceiver()
+}
+
+// feeWallets is the fee wallet if it's set. It's credited after the wallets of an operation are changed,
+// so operations charging fees lock it along with them in the order of uuids
+func (pg *PG) feeWallets() []string {
+	if pg.feeWallet == "" {
+		return nil
+	}
+	return []string{pg.feeWallet}
+}
+
+// toCurrency rescales an amount stored in db to the currency minor unit
+func toCurrency(amount pkg.Amount, currency string) (pkg.Amount, error) {
+	exp, err := pkg.CurrencyExponent(currency)
+	if err != nil {
+		return pkg.Amount{}, err
+	}
+	return amount.Rescale(exp)
+}
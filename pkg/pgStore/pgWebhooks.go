@@ -0,0 +1,211 @@
+package pgStore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"payment-system/pkg"
+	"time"
+)
+
+const maxDeliveriesListed = 100
+
+// emitEventQuery writes the event only if a webhook of the wallet owner is subscribed to it
+const emitEventQuery = `
+WITH s AS (
+    SELECT w.id
+    FROM webhook w
+    JOIN wallet wl ON wl.owner = w.client_id
+    WHERE wl.wallet = $2::uuid AND w.active AND $1::text = ANY (w.events)
+), e AS (
+    INSERT INTO webhook_event (type, wallet, data)
+    SELECT $1::text, $2::uuid, $3::jsonb
+    WHERE EXISTS(SELECT 1 FROM s)
+    RETURNING id
+)
+INSERT INTO webhook_delivery (webhook_id, event_id)
+SELECT s.id, e.id
+FROM s, e
+`
+const createWebhookQuery = `
+INSERT INTO webhook (client_id, url, events, secret)
+VALUES ($1, $2, $3, $4)
+RETURNING id, client_id, url, events, secret, active, created
+`
+const listWebhooksQuery = `
+SELECT id, client_id, url, events, '' AS secret, active, created
+FROM webhook
+WHERE client_id = $1 AND active
+ORDER BY id
+`
+const deactivateWebhookQuery = `
+UPDATE webhook SET active = FALSE
+WHERE id = $1 AND client_id = $2 AND active
+`
+const ownWebhookQuery = `
+SELECT 1
+FROM webhook
+WHERE id = $1 AND client_id = $2
+`
+const deliveryColumns = `
+d.id, d.webhook_id, d.event_id, e.type AS event_type, d.status, d.attempts, d.next_attempt, d.last_status_code,
+d.last_error, json_build_object('id', e.id, 'type', e.type, 'wallet', e.wallet, 'created', e.created, 'data', e.data) AS payload,
+w.url, w.secret, d.updated, d.created
+`
+const webhookDeliveriesQuery = `
+SELECT` + deliveryColumns + `
+FROM webhook_delivery d
+JOIN webhook w ON w.id = d.webhook_id
+JOIN webhook_event e ON e.id = d.event_id
+WHERE d.webhook_id = $1
+ORDER BY d.id DESC
+LIMIT $2
+`
+const redeliverQuery = `
+UPDATE webhook_delivery d SET status = 0, attempts = 0, next_attempt = NOW(), updated = NOW()
+FROM webhook w, webhook_event e
+WHERE d.id = $1 AND d.webhook_id = $2 AND w.id = d.webhook_id AND w.client_id = $3 AND e.id = d.event_id
+RETURNING` + deliveryColumns
+
+// claimDeliveriesQuery postpones due deliveries by the lease so that they are retried
+// if the dispatcher fails to complete them
+const claimDeliveriesQuery = `
+UPDATE webhook_delivery d SET attempts = d.attempts + 1, next_attempt = NOW() + make_interval(secs => $2), updated = NOW()
+FROM webhook w, webhook_event e
+WHERE d.id IN (
+    SELECT due.id
+    FROM webhook_delivery due
+    JOIN webhook active ON active.id = due.webhook_id AND active.active
+    WHERE due.status = 0 AND due.next_attempt <= NOW()
+    ORDER BY due.next_attempt
+    LIMIT $1
+    FOR UPDATE OF due SKIP LOCKED
+) AND w.id = d.webhook_id AND e.id = d.event_id
+RETURNING` + deliveryColumns
+const completeDeliveryQuery = `
+UPDATE webhook_delivery SET status = $1, last_status_code = $2, last_error = $3, next_attempt = NOW() + make_interval(secs => $4),
+    updated = NOW()
+WHERE id = $5
+`
+
+type walletEvent struct {
+	Wallet   string `json:"wallet"`
+	Owner    int    `json:"owner"`
+	Currency string `json:"currency"`
+}
+
+type transferEvent struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	pkg.Receipt
+}
+
+// refundEvent is the refund from the point of view of the wallet, Amount is the change of its balance
+type refundEvent struct {
+	TransactionID int64      `json:"transaction_id"`
+	OriginalID    int64      `json:"original_id"`
+	Key           string     `json:"key"`
+	Amount        pkg.Amount `json:"amount"`
+	Currency      string     `json:"currency"`
+}
+
+type statusEvent struct {
+	Wallet string           `json:"wallet"`
+	From   pkg.WalletStatus `json:"status_from"`
+	To     pkg.WalletStatus `json:"status_to"`
+	Reason string           `json:"reason"`
+}
+
+// emitEvent writes the event on the wallet for delivery to webhooks of its owner, data is the payload of the event
+func emitEvent(ctx context.Context, tx pgx.Tx, wallet string, event pkg.EventType, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, emitEventQuery, string(event), wallet, payload)
+	return err
+}
+
+func (pg *PG) CreateWebhook(ctx context.Context, clientID int, url string, events []string, secret string) (pkg.Webhook, error) {
+	var result pkg.Webhook
+	err := pg.tx(ctx, "CreateWebhook", func(tx pgx.Tx) error {
+		return pgxscan.Get(ctx, tx, &result, createWebhookQuery, clientID, url, events, secret)
+	})
+	return result, err
+}
+
+// ListWebhooks returns active webhooks of the client without their secrets
+func (pg *PG) ListWebhooks(ctx context.Context, clientID int) ([]pkg.Webhook, error) {
+	result := make([]pkg.Webhook, 0)
+	err := pg.tx(ctx, "ListWebhooks", func(tx pgx.Tx) error {
+		result = result[:0]
+		return pgxscan.Select(ctx, tx, &result, listWebhooksQuery, clientID)
+	})
+	return result, err
+}
+
+// DeleteWebhook deactivates the webhook of the client keeping its deliveries, pending ones are not sent anymore
+func (pg *PG) DeleteWebhook(ctx context.Context, clientID int, id int64) error {
+	return pg.tx(ctx, "DeleteWebhook", func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, deactivateWebhookQuery, id, clientID)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return pkg.ErrWebhookNotFound
+		}
+		return nil
+	})
+}
+
+// WebhookDeliveries returns the latest deliveries to the webhook of the client, newest first
+func (pg *PG) WebhookDeliveries(ctx context.Context, clientID int, webhookID int64) ([]pkg.WebhookDelivery, error) {
+	result := make([]pkg.WebhookDelivery, 0)
+	err := pg.tx(ctx, "WebhookDeliveries", func(tx pgx.Tx) error {
+		var tmp int
+		err := tx.QueryRow(ctx, ownWebhookQuery, webhookID, clientID).Scan(&tmp)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pkg.ErrWebhookNotFound
+		}
+		if err != nil {
+			return err
+		}
+		result = result[:0]
+		return pgxscan.Select(ctx, tx, &result, webhookDeliveriesQuery, webhookID, maxDeliveriesListed)
+	})
+	return result, err
+}
+
+// RedeliverWebhook schedules the delivery to the webhook of the client to be sent again right away
+// with a fresh set of attempts
+func (pg *PG) RedeliverWebhook(ctx context.Context, clientID int, webhookID, deliveryID int64) (pkg.WebhookDelivery, error) {
+	var result pkg.WebhookDelivery
+	err := pg.tx(ctx, "RedeliverWebhook", func(tx pgx.Tx) error {
+		err := pgxscan.Get(ctx, tx, &result, redeliverQuery, deliveryID, webhookID, clientID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pkg.ErrDeliveryNotFound
+		}
+		return err
+	})
+	return result, err
+}
+
+// ClaimWebhookDeliveries returns up to limit due deliveries counting the attempt, they aren't claimed again for lease
+func (pg *PG) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]pkg.WebhookDelivery, error) {
+	result := make([]pkg.WebhookDelivery, 0)
+	err := pg.tx(ctx, "ClaimWebhookDeliveries", func(tx pgx.Tx) error {
+		result = result[:0]
+		return pgxscan.Select(ctx, tx, &result, claimDeliveriesQuery, limit, lease.Seconds())
+	})
+	return result, err
+}
+
+// CompleteWebhookDelivery records the result of the attempt, pending deliveries are attempted again in retryIn
+func (pg *PG) CompleteWebhookDelivery(ctx context.Context, id int64, status pkg.DeliveryStatus, statusCode int, lastError string, retryIn time.Duration) error {
+	return pg.tx(ctx, "CompleteWebhookDelivery", func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, completeDeliveryQuery, status, statusCode, lastError, retryIn.Seconds(), id)
+		return err
+	})
+}
@@ -0,0 +1,94 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+	"strconv"
+)
+
+var ErrReasonNotSpecified = errors.New("err reason of the status change not specified")
+
+var walletStatuses = map[string]pkg.WalletStatus{
+	"active":       pkg.WalletActive,
+	"frozen_debit": pkg.WalletFrozenDebit,
+	"frozen_all":   pkg.WalletFrozenAll,
+	"closed":       pkg.WalletClosed,
+}
+
+// adminOnly lets through requests of admin clients only
+func adminOnly() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !ClientFromCtx(r.Context()).Admin {
+				writeErrResponse(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// SetWalletStatus freezes, unfreezes or closes any wallet, the reason is recorded in the wallet status history
+func (h *Handler) SetWalletStatus(w http.ResponseWriter, r *http.Request) {
+	wallet, err := parseAndValidateWallet(r, "wallet")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	status, err := parseWalletStatus(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", ErrReasonNotSpecified), http.StatusBadRequest)
+		return
+	}
+	result, err := h.walletStore.SetWalletStatus(r.Context(), wallet, status, reason, ClientFromCtx(r.Context()).ID)
+	switch err {
+	case pkg.ErrWalletClosed, pkg.ErrWalletNotEmpty, pkg.ErrInvalidWalletStatus:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	case pkg.ErrWalletNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err setting status of wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+func (h *Handler) WalletStatusHistory(w http.ResponseWriter, r *http.Request) {
+	wallet, err := parseAndValidateWallet(r, "wallet")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	result, err := h.walletStore.WalletStatusHistory(r.Context(), wallet)
+	if err != nil {
+		h.log.Warnf("err getting status history of wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+// parseWalletStatus accepts both names and numbers of statuses
+func parseWalletStatus(r *http.Request) (pkg.WalletStatus, error) {
+	s := r.URL.Query().Get("status")
+	if status, ok := walletStatuses[s]; ok {
+		return status, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < int(pkg.WalletActive) || n > int(pkg.WalletClosed) {
+		return 0, pkg.ErrInvalidWalletStatus
+	}
+	return pkg.WalletStatus(n), nil
+}
@@ -0,0 +1,88 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"strings"
+)
+
+var ErrInvalidAggregateFormat = errors.New("err format must be json or csv")
+
+// AggregateReport sums postings up by period and type on the wallet given or across all wallets of the client
+func (h *Handler) AggregateReport(w http.ResponseWriter, r *http.Request) {
+	var wallet string
+	if r.URL.Query().Get("wallet") != "" {
+		var err error
+		if wallet, err = parseAndValidateWallet(r, "wallet"); err != nil {
+			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	from, err := parseDate(r, "from")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDate(r, "to")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	period := pgStore.PeriodDay
+	if p := r.URL.Query().Get("period"); p != "" {
+		period = pgStore.AggregatePeriod(strings.ToLower(p))
+	}
+	switch period {
+	case pgStore.PeriodDay, pgStore.PeriodWeek, pgStore.PeriodMonth:
+	default:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", pkg.ErrInvalidPeriod), http.StatusBadRequest)
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format != "" && format != "json" && format != "csv" {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", ErrInvalidAggregateFormat), http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	if wallet != "" {
+		ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
+		switch err {
+		case pkg.ErrWalletNotFound:
+			writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+			return
+		case nil:
+		default:
+			h.log.Warnf("err checking wallet %s: %s", wallet, err)
+			writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			writeErrResponse(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	aggregates, err := h.walletStore.AggregateReport(r.Context(), wallet, owner, from, to, period)
+	if err != nil {
+		h.log.Warnf("err aggregating report on %q of client %d: %s", wallet, owner, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if format != "csv" {
+		writeOkResponse(w, aggregates)
+		return
+	}
+	data, err := toCsv(aggregates)
+	if err != nil {
+		h.log.Warnf("err converting aggregates to csv: %s", err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment;filename=Aggregates.csv")
+	if _, err = w.Write(data); err != nil {
+		h.log.Warnf("err writing csv response: %s", err)
+	}
+}
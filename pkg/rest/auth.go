@@ -2,13 +2,23 @@ package rest
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"net/http"
+	"payment-system/pkg"
 )
 
+const APIKeyHeader = "X-API-Key"
+
 type Client struct {
-	ID       int
-	Name     string
-	LimitRPS int
+	ID            int
+	Name          string
+	LimitRPS      int
+	Burst         int
+	SigningSecret string
+	Admin         bool
 }
 
 type ClientCtxKeyType struct{}
@@ -22,11 +32,40 @@ func ClientFromCtx(ctx context.Context) *Client {
 	return &Client{Name: "unknown", LimitRPS: 1}
 }
 
-// TODO proper authentication, add client ID to context
-func auth(clientStore ClientStore) func(next http.Handler) http.Handler {
+// HashAPIKey returns the form api keys are stored in by the ClientStore
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func auth(log *logrus.Logger, clientStore ClientStore) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			next.ServeHTTP(w, r)
+			key := r.Header.Get(APIKeyHeader)
+			if key == "" {
+				writeErrResponse(w, "Unauthorized: api key not specified", http.StatusUnauthorized)
+				return
+			}
+			client, err := clientStore.GetClient(r.Context(), HashAPIKey(key))
+			switch err {
+			case pkg.ErrClientNotFound:
+				writeErrResponse(w, "Unauthorized: invalid api key", http.StatusUnauthorized)
+				return
+			case nil:
+			default:
+				log.Warnf("err getting client: %s", err)
+				writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+				return
+			}
+			ctx := context.WithValue(r.Context(), ClientCtxKey, &Client{
+				ID:            client.ID,
+				Name:          client.Name,
+				LimitRPS:      client.LimitRPS,
+				Burst:         client.Burst,
+				SigningSecret: client.SigningSecret,
+				Admin:         client.Admin,
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(fn)
 	}
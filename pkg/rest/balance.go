@@ -0,0 +1,81 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+	"time"
+)
+
+var ErrInvalidMoment = errors.New("err at must be a date or RFC 3339 time")
+
+// BalanceAt is the wallet balance at the moment given by at, the current one by default
+func (h *Handler) BalanceAt(w http.ResponseWriter, r *http.Request) {
+	wallet, err := parseAndValidateWallet(r, "wallet")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	at, err := parseMoment(r, "at")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	h.writeBalanceAt(w, r, wallet, at)
+}
+
+func (h *Handler) BalanceAtV2(w http.ResponseWriter, r *http.Request) {
+	at, err := parseMoment(r, "at")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	wallet, ok := h.ownWallet(w, r)
+	if !ok {
+		return
+	}
+	h.writeBalanceAt(w, r, wallet, at)
+}
+
+func (h *Handler) writeBalanceAt(w http.ResponseWriter, r *http.Request, wallet string, at time.Time) {
+	result, err := h.walletStore.BalanceAt(r.Context(), wallet, at)
+	if err != nil {
+		h.log.Warnf("err getting balance of %s at %s: %s", wallet, at, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+// parseMoment parses RFC 3339 time or a date meaning its end, the current time if not specified
+func parseMoment(r *http.Request, name string) (time.Time, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return time.Now(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(DateFmt, s)
+	if err != nil {
+		return t, ErrInvalidMoment
+	}
+	return t.Add(24 * time.Hour), nil
+}
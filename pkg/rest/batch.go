@@ -0,0 +1,223 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+	"time"
+)
+
+const DefaultMaxBatchTransfers = 500
+const DefaultBatchTimeout = 2 * time.Minute
+
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+)
+
+// Statuses of transfers of a batch, rolled back ones were made but the atomic batch failed
+// and skipped ones weren't attempted after it failed or the batch timeout passed
+const (
+	TransferSucceeded  = "succeeded"
+	TransferFailed     = "failed"
+	TransferRolledBack = "rolled_back"
+	TransferSkipped    = "skipped"
+)
+
+var ErrNoTransfers = errors.New("err no transfers specified")
+var ErrTooManyTransfers = errors.New("err too many transfers in the batch")
+var ErrInvalidBatchMode = errors.New("err mode must be atomic or best_effort")
+
+// batchRequest Key is optional, it's only used to replay the response to retries of the batch
+type batchRequest struct {
+	From      string            `json:"from"`
+	Mode      string            `json:"mode"`
+	Key       string            `json:"key"`
+	Transfers []pkg.TransferLeg `json:"transfers"`
+}
+
+// batchResult is the outcome of a transfer of a batch, Code and Error are what the transfer would get on its own
+type batchResult struct {
+	Index   int          `json:"index"`
+	Key     string       `json:"key"`
+	Status  string       `json:"status"`
+	Code    int          `json:"code,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Receipt *pkg.Receipt `json:"receipt,omitempty"`
+}
+
+type batchReport struct {
+	Mode      string        `json:"mode"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Transfers []batchResult `json:"transfers"`
+}
+
+// TransferBatchV2 makes transfers from a wallet, all of them are validated first. Atomic batches make all of them
+// or none and respond with the status of the failed transfer, best effort ones make each on its own
+// and respond with 207 if some of them failed. Either way the response is the report on every transfer.
+// Batches are limited by the batch timeout rather than the request one
+func (h *Handler) TransferBatchV2(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.opts.BatchTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+	var req batchRequest
+	if status, err := decodeJSON(r, &req); err != nil {
+		writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = BatchAtomic
+	}
+	if req.Mode != BatchAtomic && req.Mode != BatchBestEffort {
+		writeUnprocessable(w, ErrInvalidBatchMode)
+		return
+	}
+	if !isValidUUID(req.From) {
+		writeUnprocessable(w, ErrInvalidUUIDFormat)
+		return
+	}
+	switch {
+	case len(req.Transfers) == 0:
+		writeUnprocessable(w, ErrNoTransfers)
+		return
+	case len(req.Transfers) > h.opts.MaxBatchTransfers:
+		writeUnprocessable(w, ErrTooManyTransfers)
+		return
+	}
+	keys := make(map[string]struct{}, len(req.Transfers))
+	for i := range req.Transfers {
+		if err := validateLeg(&req.Transfers[i], keys); err != nil {
+			writeUnprocessable(w, pkg.ErrBatchLeg{Index: i, Err: err})
+			return
+		}
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), req.From, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeUnprocessable(w, err)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", req.From, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	report := batchReport{Mode: req.Mode, Transfers: make([]batchResult, len(req.Transfers))}
+	for i, l := range req.Transfers {
+		report.Transfers[i] = batchResult{Index: i, Key: l.Key}
+	}
+	if req.Mode == BatchAtomic {
+		h.transferAtomic(w, r, req.From, req.Transfers, report)
+		return
+	}
+	h.transferBestEffort(w, r, req.From, req.Transfers, report)
+}
+
+func (h *Handler) transferAtomic(w http.ResponseWriter, r *http.Request, from string, legs []pkg.TransferLeg, report batchReport) {
+	receipts, err := h.walletStore.TransferFundsBatch(r.Context(), from, legs)
+	if err == nil {
+		for i := range receipts {
+			report.Transfers[i].Status, report.Transfers[i].Receipt = TransferSucceeded, &receipts[i]
+		}
+		report.Succeeded = len(receipts)
+		writeResponse(w, http.StatusCreated, report)
+		return
+	}
+	if r.Context().Err() == context.DeadlineExceeded {
+		writeErrResponse(w, fmt.Sprintf("Gateway Timeout: %s", r.Context().Err()), http.StatusGatewayTimeout)
+		return
+	}
+	var errLeg pkg.ErrBatchLeg
+	status := 0
+	if errors.As(err, &errLeg) {
+		status = transferStatus(errLeg.Err)
+	}
+	if status == 0 {
+		h.log.Warnf("err transfering batch from %s: %s", from, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range report.Transfers {
+		switch {
+		case i < errLeg.Index:
+			report.Transfers[i].Status = TransferRolledBack
+		case i == errLeg.Index:
+			report.Transfers[i].Status, report.Transfers[i].Code, report.Transfers[i].Error = TransferFailed, status, errLeg.Err.Error()
+		default:
+			report.Transfers[i].Status = TransferSkipped
+		}
+	}
+	report.Failed = 1
+	writeResponse(w, status, report)
+}
+
+// transferBestEffort makes transfers one by one, the batch fails with 422 only if none of them succeeded.
+// Transfers not made before the batch is timed out are skipped, the batch is reported as it is then
+func (h *Handler) transferBestEffort(w http.ResponseWriter, r *http.Request, from string, legs []pkg.TransferLeg, report batchReport) {
+	for i, l := range legs {
+		result := &report.Transfers[i]
+		if r.Context().Err() != nil {
+			result.Status = TransferSkipped
+			report.Skipped++
+			continue
+		}
+		receipt, err := h.walletStore.TransferFunds(r.Context(), from, l.To, l.Amount, l.Currency, l.Quote, l.Key)
+		if err == nil {
+			result.Status, result.Receipt = TransferSucceeded, &receipt
+			report.Succeeded++
+			continue
+		}
+		// the transfer is rolled back if the batch is timed out while it's made
+		if r.Context().Err() != nil {
+			result.Status = TransferSkipped
+			report.Skipped++
+			continue
+		}
+		status := transferStatus(err)
+		if status == 0 {
+			h.log.Warnf("err transfering funds from %s to %s: %s", from, l.To, err)
+			status = http.StatusInternalServerError
+		}
+		result.Status, result.Code, result.Error = TransferFailed, status, err.Error()
+		report.Failed++
+	}
+	switch {
+	case report.Failed == 0 && report.Skipped == 0:
+		writeResponse(w, http.StatusCreated, report)
+	case report.Succeeded == 0 && report.Failed == 0:
+		writeResponse(w, http.StatusGatewayTimeout, report)
+	case report.Succeeded == 0:
+		writeResponse(w, http.StatusUnprocessableEntity, report)
+	default:
+		writeResponse(w, http.StatusMultiStatus, report)
+	}
+}
+
+// validateLeg normalizes the transfer as a single one is, keys must be unique within the batch
+func validateLeg(l *pkg.TransferLeg, keys map[string]struct{}) error {
+	if !isValidUUID(l.To) {
+		return ErrInvalidUUIDFormat
+	}
+	if l.Quote != "" && !isValidUUID(l.Quote) {
+		return pkg.ErrInvalidQuote
+	}
+	currency, amount, err := validateMoney(l.Amount, l.Currency, l.Key)
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[l.Key]; ok {
+		return pkg.ErrDuplicateAction(l.Key)
+	}
+	keys[l.Key] = struct{}{}
+	l.Currency, l.Amount = currency, amount
+	return nil
+}
@@ -0,0 +1,141 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg/pgStore"
+	"strconv"
+	"time"
+)
+
+const DefaultEventsKeepAlive = 15 * time.Second
+const LastEventIDHeader = "Last-Event-ID"
+
+// eventsBatch is how many transactions are read at once to catch up with the wallet
+const eventsBatch = 100
+
+// eventsRetry is the reconnection delay suggested to clients in milliseconds
+const eventsRetry = 3000
+
+var ErrInvalidLastEventID = errors.New("err last event id must be a posting id")
+var ErrStreamingUnsupported = errors.New("err streaming is not supported")
+
+// WalletEvents streams transactions on the wallet as they are committed and its balance after them
+// as server-sent events. Transaction events have the posting id as the event id, clients reconnecting
+// with Last-Event-ID get the transactions they missed. New streams start with the current balance
+func (h *Handler) WalletEvents(w http.ResponseWriter, r *http.Request) {
+	lastID, resume, err := parseLastEventID(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", ErrStreamingUnsupported), http.StatusInternalServerError)
+		return
+	}
+	wallet, ok := h.ownWallet(w, r)
+	if !ok {
+		return
+	}
+	// subscribed before reading the wallet so that nothing committed in between is missed
+	activity, unsubscribe := h.walletStore.SubscribeWallet(wallet)
+	defer unsubscribe()
+	if !resume {
+		latest, _, err := h.walletStore.ReportPage(r.Context(), wallet, nil, nil, pgStore.AllTransactions, pgStore.Page{Limit: 1, Desc: true})
+		if err != nil {
+			h.log.Warnf("err getting the latest transaction of %s: %s", wallet, err)
+			writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if len(latest) > 0 {
+			lastID = latest[0].PostingID
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err = fmt.Fprintf(w, "retry: %d\n\n", eventsRetry); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(h.opts.EventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		if lastID, err = h.writeWalletEvents(w, r, wallet, lastID); err != nil {
+			h.log.Warnf("err streaming events of %s: %s", wallet, err)
+			_ = writeEvent(w, "", "error", map[string]string{"message": err.Error()})
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-activity:
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		}
+	}
+}
+
+// writeWalletEvents writes transactions after lastID and the balance, returns the id of the last transaction written
+func (h *Handler) writeWalletEvents(w http.ResponseWriter, r *http.Request, wallet string, lastID int64) (int64, error) {
+	for {
+		transactions, err := h.walletStore.TransactionsAfter(r.Context(), wallet, lastID, eventsBatch)
+		if err != nil {
+			return lastID, err
+		}
+		for _, t := range transactions {
+			if err = writeEvent(w, strconv.FormatInt(t.PostingID, 10), "transaction", t); err != nil {
+				return lastID, err
+			}
+			lastID = t.PostingID
+		}
+		if len(transactions) < eventsBatch {
+			break
+		}
+	}
+	balance, err := h.walletStore.GetWallet(r.Context(), wallet)
+	if err != nil {
+		return lastID, err
+	}
+	return lastID, writeEvent(w, "", "balance", balance)
+}
+
+func writeEvent(w http.ResponseWriter, id, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err = fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+// parseLastEventID takes the id from the header or the lastEventId query parameter for clients which can't set headers
+func parseLastEventID(r *http.Request) (int64, bool, error) {
+	s := r.Header.Get(LastEventIDHeader)
+	if s == "" {
+		s = r.URL.Query().Get("lastEventId")
+	}
+	if s == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, ErrInvalidLastEventID
+	}
+	return id, true, nil
+}
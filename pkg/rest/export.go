@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gocarina/gocsv"
+	"io"
+	"net/http"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"strings"
+	"time"
+)
+
+const DefaultExportFlushInterval = time.Second
+const DefaultExportTimeout = 10 * time.Minute
+const DefaultMaxExports = 5
+const ExportErrorTrailer = "X-Export-Error"
+
+var ErrInvalidFormat = errors.New("err format must be csv or ndjson")
+
+// flushWriter flushes the response every interval, so rows reach the client while the export goes on
+type flushWriter struct {
+	w        io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+	flushed  time.Time
+}
+
+func newFlushWriter(w http.ResponseWriter, interval time.Duration) *flushWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{w: w, flusher: flusher, interval: interval, flushed: time.Now()}
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil && time.Since(f.flushed) >= f.interval {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (f *flushWriter) Flush() {
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+	f.flushed = time.Now()
+}
+
+// ExportReport streams the whole report as csv or newline delimited json, it isn't limited by the request timeout.
+// Once rows are sent errors can't change the status, they are reported in the X-Export-Error trailer
+// and for ndjson by a last line with the message
+func (h *Handler) ExportReport(w http.ResponseWriter, r *http.Request) {
+	wallet, err := parseAndValidateWallet(r, "wallet")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	from, err := parseDate(r, "from")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDate(r, "to")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	tType, err := parseTransactionType(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format != "" && format != "csv" && format != "ndjson" {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", ErrInvalidFormat), http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	fw := newFlushWriter(w, h.opts.ExportFlushInterval)
+	var fn func(t pgStore.Transaction) error
+	if format == "ndjson" {
+		w.Header().Set("Content-type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment;filename=Report.ndjson")
+		encoder := json.NewEncoder(fw)
+		fn = func(t pgStore.Transaction) error {
+			return encoder.Encode(t)
+		}
+	} else {
+		w.Header().Set("Content-type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment;filename=Report.csv")
+		fn = func(t pgStore.Transaction) error {
+			return gocsv.MarshalWithoutHeaders([]pgStore.Transaction{t}, fw)
+		}
+	}
+	w.Header().Set("Trailer", ExportErrorTrailer)
+	w.WriteHeader(http.StatusOK)
+	if format != "ndjson" {
+		if err = gocsv.Marshal([]pgStore.Transaction{}, fw); err != nil {
+			h.log.Warnf("err writing csv header: %s", err)
+			return
+		}
+	}
+	err = h.walletStore.ExportReport(r.Context(), wallet, from, to, tType, page.Desc, fn)
+	if err != nil {
+		h.log.Warnf("err exporting report on %s: %s", wallet, err)
+		if format == "ndjson" {
+			_ = json.NewEncoder(fw).Encode(JSONResponse{Error: stringPtr(err.Error())})
+		}
+		w.Header().Set(ExportErrorTrailer, err.Error())
+	}
+	fw.Flush()
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
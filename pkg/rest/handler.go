@@ -16,32 +16,39 @@ import (
 )
 
 const DateFmt = `2006-01-02`
+const DefaultReportLimit = 100
+const MaxReportLimit = 1000
+const NextCursorHeader = "X-Next-Cursor"
 
 var ErrInvalidUUIDFormat = errors.New("err invalid uuid format")
 var ErrWalletNotSpecified = errors.New("err wallet not specified in the query")
+var ErrInvalidLimit = fmt.Errorf("err limit must be from 1 to %d", MaxReportLimit)
+var ErrInvalidOrder = errors.New("err order must be asc or desc")
+var ErrInvalidReportFormat = errors.New("err format must be json, csv, camt053 or mt940")
 var uuidReqexp = regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-4[a-fA-F0-9]{3}-[89aAbB][a-fA-F0-9]{3}-[a-fA-F0-9]{12}$")
 
 type JSONResponse struct {
-	Data  *interface{} `json:"data,omitempty"`
-	Error *string      `json:"message,omitempty"`
-	Code  *int         `json:"code,omitempty"`
+	Data       *interface{}        `json:"data,omitempty"`
+	NextCursor *string             `json:"next_cursor,omitempty"`
+	Summary    *pkg.BalanceSummary `json:"summary,omitempty"`
+	Error      *string             `json:"message,omitempty"`
+	Code       *int                `json:"code,omitempty"`
 }
 
 type Handler struct {
 	walletStore WalletStore
 	log         *logrus.Logger
+	opts        Options
 }
 
-func NewHandler(log *logrus.Logger, walletStore WalletStore) *Handler {
+func NewHandler(log *logrus.Logger, walletStore WalletStore, opts Options) *Handler {
 	return &Handler{
 		walletStore: walletStore,
 		log:         log,
+		opts:        opts.withDefaults(),
 	}
 }
 
-// TODO remove all ClientFromCtx and CheckOwnerWallet clauses below or add proper authorization mechanics
-// currently ClientFromCtx always returns "unknown" Client with ID 0 and all created wallets belong to it
-
 func (h *Handler) GetWallet(w http.ResponseWriter, r *http.Request) {
 	wallet, err := parseAndValidateWallet(r, "wallet")
 	if err != nil {
@@ -51,6 +58,7 @@ func (h *Handler) GetWallet(w http.ResponseWriter, r *http.Request) {
 	result, err := h.walletStore.GetWallet(r.Context(), wallet)
 	if err != nil {
 		writeErrResponse(w, fmt.Sprintf("Not Found: %s", pkg.ErrWalletNotFound), http.StatusNotFound)
+		return
 	}
 	owner := ClientFromCtx(r.Context()).ID
 	if result.Owner != owner {
@@ -66,8 +74,16 @@ func (h *Handler) CreateWallet(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
+	currency, err := parseCurrency(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if currency == "" {
+		currency = pkg.DefaultCurrency
+	}
 	owner := ClientFromCtx(r.Context()).ID
-	if err = h.walletStore.CreateWallet(r.Context(), wallet, owner); err != nil {
+	if err = h.walletStore.CreateWallet(r.Context(), wallet, owner, currency); err != nil {
 		if _, ok := err.(pkg.ErrDuplicateAction); ok {
 			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 			return
@@ -85,12 +101,17 @@ func (h *Handler) Deposit(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
-	amount, err := parseAmount(r)
+	currency, err := parseCurrency(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	amount, err := parseAmount(r, currency)
 	if err != nil {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
-	if amount <= 0 {
+	if amount.Sign() <= 0 {
 		writeErrResponse(w, "Bad Request: can't deposit negative amount", http.StatusBadRequest)
 		return
 	}
@@ -110,9 +131,10 @@ func (h *Handler) Deposit(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
 		return
 	}
-	err = h.walletStore.DepositWithdraw(r.Context(), wallet, amount, key)
+	receipt, err := h.walletStore.DepositWithdraw(r.Context(), wallet, amount, currency, key)
 	switch err {
-	case pkg.ErrInsufficientFunds:
+	case pkg.ErrInsufficientFunds, pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrWalletNotFound,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed, pkg.ErrInvalidAmount:
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	case nil:
@@ -125,7 +147,7 @@ func (h *Handler) Deposit(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
 		return
 	}
-	writeOkResponse(w, "ok")
+	writeOkResponse(w, receipt)
 }
 
 func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
@@ -134,12 +156,17 @@ func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
-	amount, err := parseAmount(r)
+	currency, err := parseCurrency(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	amount, err := parseAmount(r, currency)
 	if err != nil {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
-	if amount <= 0 {
+	if amount.Sign() <= 0 {
 		writeErrResponse(w, "Bad Request: specify positive amount to withdraw", http.StatusBadRequest)
 		return
 	}
@@ -159,9 +186,10 @@ func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	err = h.walletStore.DepositWithdraw(r.Context(), wallet, -amount, key)
+	receipt, err := h.walletStore.DepositWithdraw(r.Context(), wallet, amount.Neg(), currency, key)
 	switch err {
-	case pkg.ErrInsufficientFunds:
+	case pkg.ErrInsufficientFunds, pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrWalletNotFound,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed, pkg.ErrInvalidAmount:
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	case nil:
@@ -174,7 +202,7 @@ func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
 		return
 	}
-	writeOkResponse(w, "ok")
+	writeOkResponse(w, receipt)
 }
 
 func (h *Handler) TransferFunds(w http.ResponseWriter, r *http.Request) {
@@ -188,15 +216,25 @@ func (h *Handler) TransferFunds(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
-	amount, err := parseAmount(r)
+	currency, err := parseCurrency(r)
 	if err != nil {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
-	if amount <= 0 {
+	amount, err := parseAmount(r, currency)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if amount.Sign() <= 0 {
 		writeErrResponse(w, "Bad Request: specify positive amount to transfer", http.StatusBadRequest)
 		return
 	}
+	quote := r.URL.Query().Get("quote")
+	if quote != "" && !isValidUUID(quote) {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", pkg.ErrInvalidQuote), http.StatusBadRequest)
+		return
+	}
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		writeErrResponse(w, "Bad Request: transaction key not specified", http.StatusBadRequest)
@@ -213,21 +251,18 @@ func (h *Handler) TransferFunds(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	_, err = h.walletStore.CheckOwnerWallet(r.Context(), to, 0)
+	receipt, err := h.walletStore.TransferFunds(r.Context(), from, to, amount, currency, quote, key)
 	switch err {
-	case pkg.ErrWalletNotFound:
+	case pkg.ErrInsufficientFunds, pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrWalletNotFound,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed, pkg.ErrInvalidAmount, pkg.ErrRateNotFound, pkg.ErrInvalidQuote, pkg.ErrQuoteExpired,
+		pkg.ErrSelfTransfer:
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
-	case nil:
-	default:
-		h.log.Warnf("err checking wallet %s: %s", to, err)
-		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+	case pkg.ErrReceiverNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
 		return
-	}
-	err = h.walletStore.TransferFunds(r.Context(), from, to, amount, key)
-	switch err {
-	case pkg.ErrInsufficientFunds:
-		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+	case pkg.ErrReceiverFrozen, pkg.ErrReceiverClosed:
+		writeErrResponse(w, fmt.Sprintf("Conflict: %s", err), http.StatusConflict)
 		return
 	case nil:
 	default:
@@ -239,7 +274,7 @@ func (h *Handler) TransferFunds(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
 		return
 	}
-	writeOkResponse(w, "ok")
+	writeOkResponse(w, receipt)
 }
 
 func (h *Handler) CreateReport(w http.ResponseWriter, r *http.Request) {
@@ -263,6 +298,21 @@ func (h *Handler) CreateReport(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
 		return
 	}
+	page, err := parsePage(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" && r.URL.Query().Get("csv") != "" {
+		format = "csv"
+	}
+	switch format {
+	case "", "json", "csv", "camt053", "mt940":
+	default:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", ErrInvalidReportFormat), http.StatusBadRequest)
+		return
+	}
 	owner := ClientFromCtx(r.Context()).ID
 	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
 	if err != nil {
@@ -274,16 +324,29 @@ func (h *Handler) CreateReport(w http.ResponseWriter, r *http.Request) {
 		writeErrResponse(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	transactions, err := h.walletStore.Report(r.Context(), wallet, from, to, tType)
+	if format == "camt053" || format == "mt940" {
+		h.writeStatement(w, r, wallet, from, to, format)
+		return
+	}
+	transactions, next, err := h.walletStore.ReportPage(r.Context(), wallet, from, to, tType, page)
 	if err != nil {
 		h.log.Warnf("err creating report on %s: %s", wallet, err)
 		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
 		return
 	}
-	if csv := r.URL.Query().Get("csv"); csv == "" {
-		writeOkResponse(w, transactions)
+	if format != "csv" {
+		summary, err := h.walletStore.BalanceSummary(r.Context(), wallet, from, to)
+		if err != nil {
+			h.log.Warnf("err summarizing report on %s: %s", wallet, err)
+			writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+			return
+		}
+		writePageResponse(w, transactions, next, &summary)
 		return
 	}
+	if next != nil {
+		w.Header().Set(NextCursorHeader, next.String())
+	}
 	w.Header().Set("Content-type", "text/csv")
 	w.Header().Set("Content-Disposition", "attachment;filename=Report.csv")
 	data, err := toCsv(transactions)
@@ -299,6 +362,31 @@ func (h *Handler) CreateReport(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) CreateFXQuote(w http.ResponseWriter, r *http.Request) {
+	base, err := pkg.NormalizeCurrency(r.URL.Query().Get("from"))
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	quote, err := pkg.NormalizeCurrency(r.URL.Query().Get("to"))
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	result, err := h.walletStore.CreateFXQuote(r.Context(), base, quote, h.opts.FXQuoteTTL)
+	switch err {
+	case pkg.ErrRateNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err quoting %s/%s: %s", base, quote, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
 func parseTransactionType(r *http.Request) (pgStore.TransactionType, error) {
 	s := r.URL.Query().Get("type")
 	switch strings.ToLower(s) {
@@ -310,6 +398,10 @@ func parseTransactionType(r *http.Request) (pgStore.TransactionType, error) {
 		return pgStore.TransactionTransferFunds, nil
 	case "3", "transferto":
 		return pgStore.TransactionTransferFundsTo, nil
+	case "4", "capture":
+		return pgStore.TransactionCapture, nil
+	case "5", "refund":
+		return pgStore.TransactionRefund, nil
 	case "", "-1":
 		return pgStore.AllTransactions, nil
 	default:
@@ -317,6 +409,33 @@ func parseTransactionType(r *http.Request) (pgStore.TransactionType, error) {
 	}
 }
 
+// parsePage parses limit, cursor and order (asc or desc) of a report, DefaultReportLimit applies if limit isn't specified
+func parsePage(r *http.Request) (pgStore.Page, error) {
+	page := pgStore.Page{Limit: DefaultReportLimit}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxReportLimit {
+			return page, ErrInvalidLimit
+		}
+		page.Limit = limit
+	}
+	if s := r.URL.Query().Get("cursor"); s != "" {
+		cursor, err := pgStore.ParseCursor(s)
+		if err != nil {
+			return page, err
+		}
+		page.Cursor = &cursor
+	}
+	switch strings.ToLower(r.URL.Query().Get("order")) {
+	case "", "asc":
+	case "desc":
+		page.Desc = true
+	default:
+		return page, ErrInvalidOrder
+	}
+	return page, nil
+}
+
 func parseDate(r *http.Request, name string) (*time.Time, error) {
 	s := r.URL.Query().Get(name)
 	if s == "" {
@@ -341,18 +460,28 @@ func isValidUUID(uuid string) bool {
 	return uuidReqexp.MatchString(uuid)
 }
 
-func parseAmount(r *http.Request) (float64, error) {
-	value := r.URL.Query().Get("amount")
-	amount, err := strconv.ParseFloat(value, 64)
-	if err != nil {
-		return 0, err
+// parseAmount checks the amount against the currency minor unit if the currency is known,
+// otherwise it's up to the store to check it against the wallet's currency
+func parseAmount(r *http.Request, currency string) (pkg.Amount, error) {
+	amount, err := pkg.ParseAmount(r.URL.Query().Get("amount"), pkg.MaxCurrencyExponent)
+	if err != nil || currency == "" {
+		return amount, err
+	}
+	return pkg.InCurrency(amount, currency)
+}
+
+// parseCurrency returns empty string if currency isn't specified
+func parseCurrency(r *http.Request) (string, error) {
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		return "", nil
 	}
-	return amount, nil
+	return pkg.NormalizeCurrency(currency)
 }
 
 func writeErrResponse(w http.ResponseWriter, err string, status int) {
-	w.WriteHeader(status)
 	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
 	response := JSONResponse{
 		Error: &err,
 		Code:  &status,
@@ -361,10 +490,26 @@ func writeErrResponse(w http.ResponseWriter, err string, status int) {
 }
 
 func writeOkResponse(w http.ResponseWriter, data interface{}) {
-	w.WriteHeader(http.StatusOK)
+	writeResponse(w, http.StatusOK, data)
+}
+
+// writePageResponse writes a page of data with the cursor of the next page if there is one and the summary of the report
+func writePageResponse(w http.ResponseWriter, data interface{}, next *pgStore.Cursor, summary *pkg.BalanceSummary) {
 	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	ok := http.StatusOK
-	_ = json.NewEncoder(w).Encode(JSONResponse{Data: &data, Code: &ok})
+	response := JSONResponse{Data: &data, Code: &ok, Summary: summary}
+	if next != nil {
+		cursor := next.String()
+		response.NextCursor = &cursor
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func writeResponse(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(JSONResponse{Data: &data, Code: &status})
 }
 
 func toCsv(data interface{}) ([]byte, error) {
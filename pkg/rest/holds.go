@@ -0,0 +1,182 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+)
+
+var ErrHoldNotSpecified = errors.New("err hold not specified in the query")
+
+func (h *Handler) PlaceHold(w http.ResponseWriter, r *http.Request) {
+	wallet, err := parseAndValidateWallet(r, "wallet")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	currency, err := parseCurrency(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	amount, err := parseAmount(r, currency)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if amount.Sign() <= 0 {
+		writeErrResponse(w, "Bad Request: specify positive amount to hold", http.StatusBadRequest)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeErrResponse(w, "Bad Request: transaction key not specified", http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	result, err := h.walletStore.PlaceHold(r.Context(), wallet, amount, currency, h.opts.HoldTTL, key)
+	switch err {
+	case pkg.ErrInsufficientFunds, pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrWalletNotFound, pkg.ErrInvalidAmount,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	case nil:
+	default:
+		if _, ok := err.(pkg.ErrDuplicateAction); ok {
+			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		h.log.Warnf("err placing hold on wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+// CaptureHold captures the whole hold if amount isn't specified
+func (h *Handler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHold(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	var amount pkg.Amount
+	if r.URL.Query().Get("amount") != "" {
+		if amount, err = parseAmount(r, ""); err != nil {
+			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		if amount.Sign() <= 0 {
+			writeErrResponse(w, "Bad Request: specify positive amount to capture", http.StatusBadRequest)
+			return
+		}
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeErrResponse(w, "Bad Request: transaction key not specified", http.StatusBadRequest)
+		return
+	}
+	if !h.checkOwnerHold(w, r, id) {
+		return
+	}
+	result, err := h.walletStore.CaptureHold(r.Context(), id, amount, key)
+	switch err {
+	case pkg.ErrHoldNotActive, pkg.ErrHoldExpired, pkg.ErrCaptureExceedsHold, pkg.ErrAmountPrecision, pkg.ErrInvalidAmount,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	case pkg.ErrHoldNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		if _, ok := err.(pkg.ErrDuplicateAction); ok {
+			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		h.log.Warnf("err capturing hold %s: %s", id, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+func (h *Handler) VoidHold(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHold(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !h.checkOwnerHold(w, r, id) {
+		return
+	}
+	result, err := h.walletStore.VoidHold(r.Context(), id)
+	switch err {
+	case pkg.ErrHoldNotActive:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	case pkg.ErrHoldNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err voiding hold %s: %s", id, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+// checkOwnerHold writes the error response and returns false unless the hold is on a wallet of the client
+func (h *Handler) checkOwnerHold(w http.ResponseWriter, r *http.Request, id string) bool {
+	hold, err := h.walletStore.GetHold(r.Context(), id)
+	switch err {
+	case pkg.ErrHoldNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return false
+	case nil:
+	default:
+		h.log.Warnf("err getting hold %s: %s", id, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return false
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), hold.Wallet, owner)
+	if err != nil {
+		h.log.Warnf("err checking wallet %s: %s", hold.Wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func parseHold(r *http.Request) (string, error) {
+	id := r.URL.Query().Get("hold")
+	if id == "" {
+		return "", ErrHoldNotSpecified
+	}
+	if !isValidUUID(id) {
+		return "", ErrInvalidUUIDFormat
+	}
+	return id, nil
+}
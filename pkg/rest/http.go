@@ -16,20 +16,110 @@ import (
 )
 
 type ClientStore interface {
+	GetClient(ctx context.Context, apiKeyHash string) (pkg.Client, error)
+	RegisterNonce(ctx context.Context, clientID int, nonce string, expires time.Time) error
+	ReserveIdempotencyKey(ctx context.Context, clientID int, key, fingerprint string) (pkg.IdempotencyRecord, bool, error)
+	SaveIdempotentResponse(ctx context.Context, clientID int, key string, status int, response []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, clientID int, key string) error
 }
 
 type WalletStore interface {
 	GetWallet(ctx context.Context, wallet string) (pkg.Wallet, error)
-	CreateWallet(ctx context.Context, wallet string, owner int) error
-	DepositWithdraw(ctx context.Context, wallet string, amount float64, key string) error
-	TransferFunds(ctx context.Context, from, to string, amount float64, key string) error
-	Report(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType) ([]pgStore.Transaction, error)
+	CreateWallet(ctx context.Context, wallet string, owner int, currency string) error
+	DepositWithdraw(ctx context.Context, wallet string, amount pkg.Amount, currency, key string) (pkg.Receipt, error)
+	TransferFunds(ctx context.Context, from, to string, amount pkg.Amount, currency, quote, key string) (pkg.Receipt, error)
+	TransferFundsBatch(ctx context.Context, from string, legs []pkg.TransferLeg) ([]pkg.Receipt, error)
+	SplitPayment(ctx context.Context, from string, amount pkg.Amount, currency string, parts []pkg.SplitPart, key string) (pkg.Payment, error)
+	CreateFXQuote(ctx context.Context, base, quote string, ttl time.Duration) (pkg.FXQuote, error)
+	PlaceHold(ctx context.Context, wallet string, amount pkg.Amount, currency string, ttl time.Duration, key string) (pkg.Hold, error)
+	GetHold(ctx context.Context, id string) (pkg.Hold, error)
+	CaptureHold(ctx context.Context, id string, amount pkg.Amount, key string) (pkg.Hold, error)
+	VoidHold(ctx context.Context, id string) (pkg.Hold, error)
+	GetTransaction(ctx context.Context, id int64, key string) (pgStore.Transaction, error)
+	Refund(ctx context.Context, originalID int64, originalKey string, amount pkg.Amount, key string) error
+	ReportPage(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType, page pgStore.Page) ([]pgStore.Transaction, *pgStore.Cursor, error)
+	ExportReport(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType, desc bool, fn func(pgStore.Transaction) error) error
+	AggregateReport(ctx context.Context, wallet string, owner int, from, to *time.Time, period pgStore.AggregatePeriod) ([]pgStore.Aggregate, error)
+	Statement(ctx context.Context, wallet string, from, to *time.Time) (pgStore.Statement, error)
+	BalanceAt(ctx context.Context, wallet string, at time.Time) (pkg.Balance, error)
+	BalanceSummary(ctx context.Context, wallet string, from, to *time.Time) (pkg.BalanceSummary, error)
 	CheckOwnerWallet(ctx context.Context, wallet string, owner int) (bool, error)
+	SetWalletStatus(ctx context.Context, wallet string, status pkg.WalletStatus, reason string, clientID int) (pkg.Wallet, error)
+	WalletStatusHistory(ctx context.Context, wallet string) ([]pkg.WalletStatusChange, error)
+	SubscribeWallet(wallet string) (<-chan struct{}, func())
+	TransactionsAfter(ctx context.Context, wallet string, postingID int64, limit int) ([]pgStore.Transaction, error)
+	WebhookStore
 }
 
-func NewRouter(log *logrus.Logger, clientStore ClientStore, walletStore WalletStore, version string) *chi.Mux {
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, clientID int, url string, events []string, secret string) (pkg.Webhook, error)
+	ListWebhooks(ctx context.Context, clientID int) ([]pkg.Webhook, error)
+	DeleteWebhook(ctx context.Context, clientID int, id int64) error
+	WebhookDeliveries(ctx context.Context, clientID int, webhookID int64) ([]pkg.WebhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, clientID int, webhookID, deliveryID int64) (pkg.WebhookDelivery, error)
+}
+
+// requestTimeout applies to all the API requests but exports, batch transfers and event streams
+const requestTimeout = 30 * time.Second
+const DefaultFXQuoteTTL = 30 * time.Second
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+type Options struct {
+	// SignatureSkew is the max allowed difference between a signed request timestamp and server time
+	SignatureSkew time.Duration
+	// FXQuoteTTL is how long a quoted exchange rate may be used for transfers
+	FXQuoteTTL time.Duration
+	// HoldTTL is how long funds stay reserved by a hold which is neither captured nor voided
+	HoldTTL time.Duration
+	// ExportFlushInterval is how often streamed report exports are flushed to the client
+	ExportFlushInterval time.Duration
+	// ExportTimeout limits report exports instead of the request timeout
+	ExportTimeout time.Duration
+	// MaxExports is the most report exports running at once, they're throttled apart from other requests
+	MaxExports int
+	// EventsKeepAlive is how often comments are sent to idle event streams so that proxies keep them open
+	EventsKeepAlive time.Duration
+	// MaxBatchTransfers is the most transfers a batch or parts a split payment may have
+	MaxBatchTransfers int
+	// BatchTimeout limits batch transfers instead of the request timeout
+	BatchTimeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.SignatureSkew == 0 {
+		o.SignatureSkew = DefaultSignatureSkew
+	}
+	if o.FXQuoteTTL == 0 {
+		o.FXQuoteTTL = DefaultFXQuoteTTL
+	}
+	if o.HoldTTL == 0 {
+		o.HoldTTL = DefaultHoldTTL
+	}
+	if o.ExportFlushInterval == 0 {
+		o.ExportFlushInterval = DefaultExportFlushInterval
+	}
+	if o.ExportTimeout == 0 {
+		o.ExportTimeout = DefaultExportTimeout
+	}
+	if o.MaxExports == 0 {
+		o.MaxExports = DefaultMaxExports
+	}
+	if o.EventsKeepAlive == 0 {
+		o.EventsKeepAlive = DefaultEventsKeepAlive
+	}
+	if o.MaxBatchTransfers == 0 {
+		o.MaxBatchTransfers = DefaultMaxBatchTransfers
+	}
+	if o.BatchTimeout == 0 {
+		o.BatchTimeout = DefaultBatchTimeout
+	}
+	return o
+}
+
+func NewRouter(log *logrus.Logger, clientStore ClientStore, walletStore WalletStore, version string, opts Options) *chi.Mux {
+	opts = opts.withDefaults()
 	r := chi.NewRouter()
-	h := NewHandler(log, walletStore)
+	h := NewHandler(log, walletStore, opts)
 	r.Use(middleware.Recoverer)
 	r.Use(cors.AllowAll().Handler)
 	r.Use(middleware.NewCompressor(flate.DefaultCompression).Handler)
@@ -39,17 +129,73 @@ func NewRouter(log *logrus.Logger, clientStore ClientStore, walletStore WalletSt
 	r.Get("/metrics", promhttp.Handler().ServeHTTP)
 	r.Group(func(r chi.Router) {
 		r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: log, NoColor: true}))
-		r.Use(middleware.Timeout(30 * time.Second))
-		r.Use(middleware.Throttle(30))
 		r.Use(httprate.LimitByIP(1000, time.Minute))
-		r.Use(auth(clientStore))
+		r.Use(auth(log, clientStore))
+		r.Use(limitByClient())
 		r.Route("/v1", func(r chi.Router) {
-			r.Get("/createWallet", h.CreateWallet)
-			r.Get("/getWallet", h.GetWallet)
-			r.Get("/deposit", h.Deposit)
-			r.Get("/withdraw", h.Withdraw)
-			r.Get("/transferFunds", h.TransferFunds)
-			r.Get("/report", h.CreateReport)
+			// event streams are open for as long as clients listen, so they aren't throttled
+			r.Get("/wallets/{id}/events", h.WalletEvents)
+			// exports stream for as long as it takes up to the export timeout, so they have a throttle of their own
+			// rather than holding up other requests
+			r.With(middleware.Throttle(opts.MaxExports), middleware.Timeout(opts.ExportTimeout)).Get("/export", h.ExportReport)
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.Throttle(30))
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.Timeout(requestTimeout))
+					r.Get("/createWallet", h.CreateWallet)
+					r.Get("/getWallet", h.GetWallet)
+					r.Get("/balanceAt", h.BalanceAt)
+					r.Get("/report", h.CreateReport)
+					r.Get("/aggregate", h.AggregateReport)
+					r.Get("/fxQuote", h.CreateFXQuote)
+					r.Group(func(r chi.Router) {
+						r.Use(signed(log, clientStore, opts.SignatureSkew))
+						r.Use(idempotent(log, clientStore))
+						r.Get("/deposit", h.Deposit)
+						r.Get("/withdraw", h.Withdraw)
+						r.Get("/transferFunds", h.TransferFunds)
+						r.Get("/hold", h.PlaceHold)
+						r.Get("/capture", h.CaptureHold)
+						r.Get("/void", h.VoidHold)
+						r.Get("/refund", h.Refund)
+					})
+					r.Route("/admin", func(r chi.Router) {
+						r.Use(adminOnly())
+						r.Get("/walletStatusHistory", h.WalletStatusHistory)
+						r.Group(func(r chi.Router) {
+							r.Use(signed(log, clientStore, opts.SignatureSkew))
+							r.Get("/setWalletStatus", h.SetWalletStatus)
+							r.Get("/refund", h.AdminRefund)
+						})
+					})
+				})
+			})
+		})
+		r.Route("/v2", func(r chi.Router) {
+			r.Use(middleware.Throttle(30))
+			// batches are limited by the batch timeout, which they answer within rather than being cut off
+			r.With(signed(log, clientStore, opts.SignatureSkew), idempotent(log, clientStore)).
+				Post("/transfers/batch", h.TransferBatchV2)
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.Timeout(requestTimeout))
+				r.Post("/wallets", h.CreateWalletV2)
+				r.Get("/wallets/{id}", h.GetWalletV2)
+				r.Get("/wallets/{id}/balance", h.BalanceAtV2)
+				r.Get("/wallets/{id}/transactions", h.TransactionsV2)
+				r.Group(func(r chi.Router) {
+					r.Use(signed(log, clientStore, opts.SignatureSkew))
+					r.Use(idempotent(log, clientStore))
+					r.Post("/wallets/{id}/deposits", h.DepositV2)
+					r.Post("/wallets/{id}/withdrawals", h.WithdrawV2)
+					r.Post("/transfers", h.TransferFundsV2)
+					r.Post("/payments", h.SplitPaymentV2)
+				})
+				r.Post("/webhooks", h.CreateWebhookV2)
+				r.Get("/webhooks", h.ListWebhooksV2)
+				r.Delete("/webhooks/{id}", h.DeleteWebhookV2)
+				r.Get("/webhooks/{id}/deliveries", h.WebhookDeliveriesV2)
+				r.Post("/webhooks/{id}/deliveries/{delivery}/redeliver", h.RedeliverWebhookV2)
+			})
 		})
 	})
 	return r
@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"payment-system/pkg"
+	"strings"
+	"time"
+)
+
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// responseRecorder passes the response through keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent replays the original successful response to retries of a request with the same key and parameters,
+// the same key with other parameters gets 422. Failed requests release the key, so they may be retried.
+// Requests without a key in the query or the JSON body are passed through
+func idempotent(log *logrus.Logger, clientStore ClientStore) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			body, err := readBody(r)
+			if err != nil {
+				writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			key := requestKey(r, body)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			client := ClientFromCtx(r.Context())
+			record, reserved, err := clientStore.ReserveIdempotencyKey(r.Context(), client.ID, key, fingerprint(r, body))
+			switch err {
+			case pkg.ErrKeyReused:
+				writeErrResponse(w, fmt.Sprintf("Unprocessable Entity: %s", err), http.StatusUnprocessableEntity)
+				return
+			case pkg.ErrRequestInProgress:
+				writeErrResponse(w, fmt.Sprintf("Conflict: %s", err), http.StatusConflict)
+				return
+			case nil:
+			default:
+				log.Warnf("err reserving key %s: %s", key, err)
+				writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				w.Header().Set("Content-type", "application/json")
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(record.Status)
+				_, _ = w.Write(record.Response)
+				return
+			}
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			// the request context may be already cancelled
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if rec.status >= 200 && rec.status < 300 {
+				err = clientStore.SaveIdempotentResponse(ctx, client.ID, key, rec.status, rec.body.Bytes())
+			} else {
+				err = clientStore.ReleaseIdempotencyKey(ctx, client.ID, key)
+			}
+			if err != nil {
+				log.Warnf("err completing request with key %s: %s", key, err)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// requestKey is the transaction key of the query or of the JSON body
+func requestKey(r *http.Request, body []byte) string {
+	if key := r.URL.Query().Get("key"); key != "" {
+		return key
+	}
+	var v struct {
+		Key string `json:"key"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &v) != nil {
+		return ""
+	}
+	return v.Key
+}
+
+// fingerprint is a hex encoded sha256 of method, path, sorted query and body of the request
+func fingerprint(r *http.Request, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		r.Method,
+		r.URL.Path,
+		r.URL.Query().Encode(),
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+	return hex.EncodeToString(sum[:])
+}
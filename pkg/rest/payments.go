@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+)
+
+var ErrNoParts = errors.New("err no parts specified")
+var ErrTooManyParts = errors.New("err too many parts in the payment")
+
+type paymentRequest struct {
+	From     string          `json:"from"`
+	Amount   pkg.Amount      `json:"amount"`
+	Currency string          `json:"currency"`
+	Key      string          `json:"key"`
+	Parts    []pkg.SplitPart `json:"parts"`
+}
+
+// SplitPaymentV2 pays the amount from a wallet to receivers by parts in one transaction,
+// responds with 201 and the payment with receipts of its parts
+func (h *Handler) SplitPaymentV2(w http.ResponseWriter, r *http.Request) {
+	var req paymentRequest
+	if status, err := decodeJSON(r, &req); err != nil {
+		writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	if !isValidUUID(req.From) {
+		writeUnprocessable(w, ErrInvalidUUIDFormat)
+		return
+	}
+	switch {
+	case len(req.Parts) == 0:
+		writeUnprocessable(w, ErrNoParts)
+		return
+	case len(req.Parts) > h.opts.MaxBatchTransfers:
+		writeUnprocessable(w, ErrTooManyParts)
+		return
+	}
+	for i, p := range req.Parts {
+		if !isValidUUID(p.To) {
+			writeUnprocessable(w, pkg.ErrBatchLeg{Index: i, Err: ErrInvalidUUIDFormat})
+			return
+		}
+	}
+	currency, amount, err := validateMoney(req.Amount, req.Currency, req.Key)
+	if err != nil {
+		writeUnprocessable(w, err)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), req.From, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeUnprocessable(w, err)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", req.From, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	payment, err := h.walletStore.SplitPayment(r.Context(), req.From, amount, currency, req.Parts, req.Key)
+	if err != nil {
+		if status := paymentStatus(err); status != 0 {
+			writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+			return
+		}
+		h.log.Warnf("err paying from %s: %s", req.From, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, http.StatusCreated, payment)
+}
+
+// paymentStatus is the status of the response to the error of a split payment or of its part as of a transfer,
+// zero if it's not the client's error
+func paymentStatus(err error) int {
+	var errPart pkg.ErrBatchLeg
+	if errors.As(err, &errPart) {
+		err = errPart.Err
+	}
+	switch err {
+	case pkg.ErrInvalidSplit, pkg.ErrInvalidPercent, pkg.ErrSplitTotal:
+		return http.StatusUnprocessableEntity
+	}
+	return transferStatus(err)
+}
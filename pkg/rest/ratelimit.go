@@ -0,0 +1,80 @@
+package rest
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"payment-system/pkg"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled with LimitRPS tokens per second up to Burst tokens
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type clientLimiter struct {
+	mx      sync.Mutex
+	buckets map[int]*bucket
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{buckets: make(map[int]*bucket)}
+}
+
+// take consumes a token of the client if there is one, returns tokens left and time until the next token otherwise
+func (l *clientLimiter) take(c *Client, now time.Time) (bool, float64, time.Duration) {
+	rate, burst := float64(c.LimitRPS), float64(clientBurst(c))
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	b, ok := l.buckets[c.ID]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[c.ID] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, b.tokens, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, b.tokens, 0
+}
+
+func clientBurst(c *Client) int {
+	if c.Burst < c.LimitRPS {
+		return c.LimitRPS
+	}
+	return c.Burst
+}
+
+// limitByClient applies a per client rate limit, so it must be used after auth. Clients without LimitRPS aren't limited
+func limitByClient() func(next http.Handler) http.Handler {
+	limiter := newClientLimiter()
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			client := ClientFromCtx(r.Context())
+			if client.LimitRPS <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now()
+			ok, tokens, wait := limiter.take(client, now)
+			untilFull := time.Duration((float64(clientBurst(client)) - tokens) / float64(client.LimitRPS) * float64(time.Second))
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(client.LimitRPS))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(untilFull).Unix(), 10))
+			if !ok {
+				pkg.MetricThrottled.WithLabelValues(strconv.Itoa(client.ID)).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeErrResponse(w, fmt.Sprintf("Too Many Requests: limit is %d rps", client.LimitRPS), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
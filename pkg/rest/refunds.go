@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"strconv"
+)
+
+var ErrOriginalNotSpecified = errors.New("err original transaction id or key not specified in the query")
+
+// Refund reverses the transaction given by `id` or `original` key, the whole rest of it if amount isn't specified.
+// A transfer may be refunded by the receiver only. Withdrawals and captures are refunded by admins only with AdminRefund,
+// as their refunds return money that has been paid out
+func (h *Handler) Refund(w http.ResponseWriter, r *http.Request) {
+	h.refund(w, r, false)
+}
+
+// AdminRefund is Refund of a transaction on any wallet, withdrawals and captures included
+func (h *Handler) AdminRefund(w http.ResponseWriter, r *http.Request) {
+	h.refund(w, r, true)
+}
+
+func (h *Handler) refund(w http.ResponseWriter, r *http.Request, admin bool) {
+	id, original, err := parseOriginal(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	var amount pkg.Amount
+	if r.URL.Query().Get("amount") != "" {
+		if amount, err = parseAmount(r, ""); err != nil {
+			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		if amount.Sign() <= 0 {
+			writeErrResponse(w, "Bad Request: specify positive amount to refund", http.StatusBadRequest)
+			return
+		}
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeErrResponse(w, "Bad Request: transaction key not specified", http.StatusBadRequest)
+		return
+	}
+	transaction, err := h.walletStore.GetTransaction(r.Context(), id, original)
+	switch err {
+	case pkg.ErrTransactionNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err getting transaction %d %s: %s", id, original, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !admin && !h.checkRefundOwner(w, r, transaction) {
+		return
+	}
+	err = h.walletStore.Refund(r.Context(), transaction.ID, "", amount, key)
+	switch err {
+	case pkg.ErrInsufficientFunds, pkg.ErrAmountPrecision, pkg.ErrInvalidAmount, pkg.ErrNotRefundable, pkg.ErrRefundExceedsOriginal,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed, pkg.ErrReceiverFrozen, pkg.ErrReceiverClosed:
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	case pkg.ErrTransactionNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		if _, ok := err.(pkg.ErrDuplicateAction); ok {
+			writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		h.log.Warnf("err refunding transaction %d: %s", transaction.ID, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, "ok")
+}
+
+// checkRefundOwner checks the client may refund the transaction itself, writes the error response if it may not
+func (h *Handler) checkRefundOwner(w http.ResponseWriter, r *http.Request, transaction pgStore.Transaction) bool {
+	wallet := transaction.Wallet
+	switch transaction.Type {
+	case pgStore.TransactionWithdrawal, pgStore.TransactionCapture:
+		writeErrResponse(w, "Forbidden: withdrawals and captures are refunded by admins only", http.StatusForbidden)
+		return false
+	case pgStore.TransactionTransferFunds:
+		// split payments have no single receiver, they aren't refundable
+		if transaction.WalletReceiver != "" {
+			wallet = transaction.WalletReceiver
+		}
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
+	if err != nil {
+		h.log.Warnf("err checking wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// parseOriginal returns id of the original transaction or its key if id isn't specified
+func parseOriginal(r *http.Request) (int64, string, error) {
+	if s := r.URL.Query().Get("id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return 0, "", fmt.Errorf("err invalid transaction id %q", s)
+		}
+		return id, "", nil
+	}
+	if original := r.URL.Query().Get("original"); original != "" {
+		return 0, original, nil
+	}
+	return 0, "", ErrOriginalNotSpecified
+}
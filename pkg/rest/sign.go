@@ -0,0 +1,144 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"payment-system/pkg"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
+
+	DefaultSignatureSkew = 5 * time.Minute
+	maxSignedBodySize    = 1 << 20
+)
+
+var ErrBodyTooLarge = errors.New("err request body is too large to be signed")
+
+// SignRequest signs r with the client's signing secret using current time and a random nonce.
+// Body, if any, is read and replaced, so it must be set before signing.
+func SignRequest(r *http.Request, secret string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return SignRequestAt(r, secret, time.Now(), hex.EncodeToString(nonce))
+}
+
+// SignRequestAt signs r as if it was sent at ts with the nonce given
+func SignRequestAt(r *http.Request, secret string, ts time.Time, nonce string) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(SignatureHeader, signature(r, body, timestamp, nonce, secret))
+	return nil
+}
+
+// signature is a hex encoded HMAC-SHA256 over the canonical form of the request:
+// method, path, sorted query, sha256 of body, timestamp and nonce separated by new lines
+func signature(r *http.Request, body []byte, timestamp, nonce, secret string) string {
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.Path,
+		r.URL.Query().Encode(),
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readBody reads the body to sign and replaces it, returns ErrBodyTooLarge rather than signing a part of it
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// signed checks the request signature of an authenticated client, so it must be used after auth
+func signed(log *logrus.Logger, clientStore ClientStore, skew time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			client := ClientFromCtx(r.Context())
+			if client.SigningSecret == "" {
+				writeErrResponse(w, "Unauthorized: client has no signing secret", http.StatusUnauthorized)
+				return
+			}
+			timestamp := r.Header.Get(TimestampHeader)
+			unix, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				writeErrResponse(w, "Unauthorized: invalid request timestamp", http.StatusUnauthorized)
+				return
+			}
+			ts := time.Unix(unix, 0)
+			if diff := time.Since(ts); diff > skew || diff < -skew {
+				writeErrResponse(w, "Unauthorized: request timestamp is out of allowed window", http.StatusUnauthorized)
+				return
+			}
+			nonce := r.Header.Get(NonceHeader)
+			if nonce == "" {
+				writeErrResponse(w, "Unauthorized: request nonce not specified", http.StatusUnauthorized)
+				return
+			}
+			body, err := readBody(r)
+			switch err {
+			case ErrBodyTooLarge:
+				writeErrResponse(w, fmt.Sprintf("Request Entity Too Large: %s", err), http.StatusRequestEntityTooLarge)
+				return
+			case nil:
+			default:
+				writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			expected := signature(r, body, timestamp, nonce, client.SigningSecret)
+			if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+				writeErrResponse(w, "Unauthorized: invalid request signature", http.StatusUnauthorized)
+				return
+			}
+			err = clientStore.RegisterNonce(r.Context(), client.ID, nonce, ts.Add(skew))
+			switch err {
+			case pkg.ErrNonceReused:
+				writeErrResponse(w, fmt.Sprintf("Unauthorized: %s", err), http.StatusUnauthorized)
+				return
+			case nil:
+			default:
+				log.Warnf("err registering nonce: %s", err)
+				writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
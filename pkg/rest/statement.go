@@ -0,0 +1,270 @@
+package rest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"strings"
+	"time"
+)
+
+const camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+const camtDateTimeFmt = "2006-01-02T15:04:05"
+
+type camtDocument struct {
+	XMLName xml.Name          `xml:"Document"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	Stmt    camtBkToCstmrStmt `xml:"BkToCstmrStmt"`
+}
+
+type camtBkToCstmrStmt struct {
+	GrpHdr camtGrpHdr `xml:"GrpHdr"`
+	Stmt   camtStmt   `xml:"Stmt"`
+}
+
+type camtGrpHdr struct {
+	MsgID   string `xml:"MsgId"`
+	CreDtTm string `xml:"CreDtTm"`
+}
+
+type camtStmt struct {
+	ID      string        `xml:"Id"`
+	CreDtTm string        `xml:"CreDtTm"`
+	FrToDt  camtFrToDt    `xml:"FrToDt"`
+	Acct    camtAcct      `xml:"Acct"`
+	Bal     []camtBalance `xml:"Bal"`
+	Ntry    []camtEntry   `xml:"Ntry"`
+}
+
+type camtFrToDt struct {
+	FrDtTm string `xml:"FrDtTm"`
+	ToDtTm string `xml:"ToDtTm"`
+}
+
+type camtAcct struct {
+	ID  string `xml:"Id>Othr>Id"`
+	Ccy string `xml:"Ccy"`
+}
+
+type camtAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+type camtBalance struct {
+	Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amt       camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Dt        string     `xml:"Dt>Dt"`
+}
+
+type camtEntry struct {
+	NtryRef     string     `xml:"NtryRef,omitempty"`
+	Amt         camtAmount `xml:"Amt"`
+	CdtDbtInd   string     `xml:"CdtDbtInd"`
+	RvslInd     bool       `xml:"RvslInd,omitempty"`
+	Sts         string     `xml:"Sts"`
+	BookgDt     string     `xml:"BookgDt>DtTm"`
+	ValDt       string     `xml:"ValDt>DtTm"`
+	AcctSvcrRef string     `xml:"AcctSvcrRef"`
+	BkTxCd      string     `xml:"BkTxCd>Prtry>Cd"`
+	EndToEndID  string     `xml:"NtryDtls>TxDtls>Refs>EndToEndId,omitempty"`
+}
+
+// entryType describes a posting by its transaction type: whether it's a credit of the wallet, a reversal,
+// its proprietary code for camt.053 and transaction type identification code for MT940
+func entryType(t pgStore.Transaction) (credit, reversal bool, code, swiftCode string) {
+	switch t.Type {
+	case pgStore.TransactionDeposit:
+		return true, false, "DEPOSIT", "NMSC"
+	case pgStore.TransactionWithdrawal:
+		return false, false, "WITHDRAWAL", "NMSC"
+	case pgStore.TransactionCapture:
+		return false, false, "CAPTURE", "NMSC"
+	case pgStore.TransactionRefund:
+		return t.PostingAmount.Sign() > 0, true, "REFUND", "NRTI"
+	}
+	// the sender of a transfer is debited, the receiver is credited
+	if t.PostingAmount.Sign() > 0 {
+		return true, false, "TRANSFER", "NTRF"
+	}
+	return false, false, "TRANSFER", "NTRF"
+}
+
+// statementPeriod is from and to days of the statement, the first entry day and today by default
+func statementPeriod(s pgStore.Statement, now time.Time) (time.Time, time.Time) {
+	from, to := now, now
+	if len(s.Entries) > 0 {
+		from = s.Entries[0].Ts
+	}
+	if s.From != nil {
+		from = *s.From
+	}
+	if s.To != nil {
+		to = *s.To
+	}
+	return from, to
+}
+
+func abs(a pkg.Amount) pkg.Amount {
+	if a.Sign() < 0 {
+		return a.Neg()
+	}
+	return a
+}
+
+func creditDebit(credit bool) string {
+	if credit {
+		return "CRDT"
+	}
+	return "DBIT"
+}
+
+// camt053 renders the statement as ISO 20022 BankToCustomerStatement
+func camt053(s pgStore.Statement, now time.Time) ([]byte, error) {
+	from, to := statementPeriod(s, now)
+	id := fmt.Sprintf("%s-%s-%s", s.Wallet, from.Format("20060102"), to.Format("20060102"))
+	doc := camtDocument{
+		Xmlns: camt053Namespace,
+		Stmt: camtBkToCstmrStmt{
+			GrpHdr: camtGrpHdr{MsgID: fmt.Sprintf("%d", now.UnixNano()), CreDtTm: now.UTC().Format(camtDateTimeFmt)},
+			Stmt: camtStmt{
+				ID:      id,
+				CreDtTm: now.UTC().Format(camtDateTimeFmt),
+				FrToDt: camtFrToDt{
+					FrDtTm: from.Format(DateFmt) + "T00:00:00",
+					ToDtTm: to.Format(DateFmt) + "T23:59:59",
+				},
+				Acct: camtAcct{ID: s.Wallet, Ccy: s.Currency},
+				Bal: []camtBalance{
+					{Code: "OPBD", Amt: camtAmount{Ccy: s.Currency, Value: abs(s.Opening).String()},
+						CdtDbtInd: creditDebit(s.Opening.Sign() >= 0), Dt: from.Format(DateFmt)},
+					{Code: "CLBD", Amt: camtAmount{Ccy: s.Currency, Value: abs(s.Closing).String()},
+						CdtDbtInd: creditDebit(s.Closing.Sign() >= 0), Dt: to.Format(DateFmt)},
+				},
+			},
+		},
+	}
+	for _, t := range s.Entries {
+		credit, reversal, code, _ := entryType(t)
+		ts := t.Ts.UTC().Format(camtDateTimeFmt)
+		doc.Stmt.Stmt.Ntry = append(doc.Stmt.Stmt.Ntry, camtEntry{
+			NtryRef:     t.Key,
+			Amt:         camtAmount{Ccy: s.Currency, Value: abs(t.PostingAmount).String()},
+			CdtDbtInd:   creditDebit(credit),
+			RvslInd:     reversal,
+			Sts:         "BOOK",
+			BookgDt:     ts,
+			ValDt:       ts,
+			AcctSvcrRef: fmt.Sprintf("%d", t.ID),
+			BkTxCd:      code,
+			EndToEndID:  t.Key,
+		})
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// mt940 renders the statement as SWIFT MT940 text block, account id is the wallet uuid without dashes
+// as MT940 allows only 35 characters
+func mt940(s pgStore.Statement, now time.Time) []byte {
+	from, to := statementPeriod(s, now)
+	account := strings.ReplaceAll(s.Wallet, "-", "")
+	lines := []string{
+		":20:" + swiftText(account, 12) + now.Format("0102"),
+		":25:" + account,
+		":28C:1/1",
+		":60F:" + mt940Balance(s.Opening, from, s.Currency),
+	}
+	for _, t := range s.Entries {
+		credit, reversal, code, swiftCode := entryType(t)
+		// reversals are marked by the direction they reverse: RD is a credit reversing a debit and RC the other way round
+		mark := "D"
+		switch {
+		case reversal && credit:
+			mark = "RD"
+		case reversal:
+			mark = "RC"
+		case credit:
+			mark = "C"
+		}
+		ref := swiftText(t.Key, 16)
+		if ref == "" {
+			ref = "NONREF"
+		}
+		lines = append(lines,
+			fmt.Sprintf(":61:%s%s%s%s%s%s//%d", t.Ts.UTC().Format("060102"), t.Ts.UTC().Format("0102"), mark,
+				mt940Amount(abs(t.PostingAmount)), swiftCode, ref, t.ID),
+			":86:"+swiftText(fmt.Sprintf("%s %s", code, t.Key), 65),
+		)
+	}
+	lines = append(lines, ":62F:"+mt940Balance(s.Closing, to, s.Currency), "-")
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func mt940Balance(balance pkg.Amount, date time.Time, currency string) string {
+	mark := "C"
+	if balance.Sign() < 0 {
+		mark = "D"
+	}
+	return mark + date.Format("060102") + currency + mt940Amount(abs(balance))
+}
+
+// mt940Amount uses comma as decimal separator and always has it
+func mt940Amount(a pkg.Amount) string {
+	s := strings.Replace(a.String(), ".", ",", 1)
+	if !strings.Contains(s, ",") {
+		s += ","
+	}
+	return s
+}
+
+// swiftText replaces characters out of the SWIFT x character set with dots and truncates s to n characters
+func swiftText(s string, n int) string {
+	b := strings.Builder{}
+	for _, c := range s {
+		if b.Len() == n {
+			break
+		}
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("/-?:().,'+ ", c):
+			b.WriteRune(c)
+		default:
+			b.WriteRune('.')
+		}
+	}
+	return b.String()
+}
+
+// writeStatement responds with the statement of the wallet for the period in camt.053 or MT940 format
+func (h *Handler) writeStatement(w http.ResponseWriter, r *http.Request, wallet string, from, to *time.Time, format string) {
+	statement, err := h.walletStore.Statement(r.Context(), wallet, from, to)
+	if err != nil {
+		h.log.Warnf("err creating statement on %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	var data []byte
+	if format == "mt940" {
+		data = mt940(statement, time.Now())
+		w.Header().Set("Content-type", "text/plain")
+		w.Header().Set("Content-Disposition", "attachment;filename=Statement.sta")
+	} else {
+		data, err = camt053(statement, time.Now())
+		if err != nil {
+			h.log.Warnf("err converting statement to camt.053: %s", err)
+			writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", "application/xml")
+		w.Header().Set("Content-Disposition", "attachment;filename=Statement.xml")
+	}
+	if _, err = w.Write(data); err != nil {
+		h.log.Warnf("err writing statement response: %s", err)
+	}
+}
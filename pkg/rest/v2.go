@@ -0,0 +1,316 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"io"
+	"mime"
+	"net/http"
+	"payment-system/pkg"
+)
+
+const maxJSONBodySize = 1 << 20
+
+var ErrUnsupportedMediaType = errors.New("err request body must be application/json")
+var ErrKeyNotSpecified = errors.New("err transaction key not specified")
+var ErrAmountNotPositive = errors.New("err amount must be positive")
+
+type createWalletRequest struct {
+	ID       string `json:"id"`
+	Currency string `json:"currency"`
+}
+
+type moneyRequest struct {
+	Amount   pkg.Amount `json:"amount"`
+	Currency string     `json:"currency"`
+	Key      string     `json:"key"`
+}
+
+type transferRequest struct {
+	From     string     `json:"from"`
+	To       string     `json:"to"`
+	Amount   pkg.Amount `json:"amount"`
+	Currency string     `json:"currency"`
+	Quote    string     `json:"quote"`
+	Key      string     `json:"key"`
+}
+
+// CreateWalletV2 creates a wallet with the id given or a random one, responds with 201 and the wallet
+func (h *Handler) CreateWalletV2(w http.ResponseWriter, r *http.Request) {
+	var req createWalletRequest
+	if status, err := decodeJSON(r, &req); err != nil {
+		writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	if req.ID == "" {
+		req.ID = uuid.New().String()
+	}
+	if !isValidUUID(req.ID) {
+		writeUnprocessable(w, ErrInvalidUUIDFormat)
+		return
+	}
+	currency := pkg.DefaultCurrency
+	if req.Currency != "" {
+		var err error
+		if currency, err = pkg.NormalizeCurrency(req.Currency); err != nil {
+			writeUnprocessable(w, err)
+			return
+		}
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	if err := h.walletStore.CreateWallet(r.Context(), req.ID, owner, currency); err != nil {
+		if _, ok := err.(pkg.ErrDuplicateAction); ok {
+			writeErrResponse(w, fmt.Sprintf("Conflict: %s", err), http.StatusConflict)
+			return
+		}
+		h.log.Warnf("err creating wallet %s: %s", req.ID, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	result, err := h.walletStore.GetWallet(r.Context(), req.ID)
+	if err != nil {
+		h.log.Warnf("err getting wallet %s: %s", req.ID, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/v2/wallets/"+req.ID)
+	writeResponse(w, http.StatusCreated, result)
+}
+
+func (h *Handler) GetWalletV2(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := h.ownWallet(w, r)
+	if !ok {
+		return
+	}
+	result, err := h.walletStore.GetWallet(r.Context(), wallet)
+	if err != nil {
+		h.log.Warnf("err getting wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+func (h *Handler) DepositV2(w http.ResponseWriter, r *http.Request) {
+	h.depositWithdrawV2(w, r, false)
+}
+
+func (h *Handler) WithdrawV2(w http.ResponseWriter, r *http.Request) {
+	h.depositWithdrawV2(w, r, true)
+}
+
+func (h *Handler) depositWithdrawV2(w http.ResponseWriter, r *http.Request, withdraw bool) {
+	var req moneyRequest
+	if status, err := decodeJSON(r, &req); err != nil {
+		writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	currency, amount, err := validateMoney(req.Amount, req.Currency, req.Key)
+	if err != nil {
+		writeUnprocessable(w, err)
+		return
+	}
+	wallet, ok := h.ownWallet(w, r)
+	if !ok {
+		return
+	}
+	if withdraw {
+		amount = amount.Neg()
+	}
+	receipt, err := h.walletStore.DepositWithdraw(r.Context(), wallet, amount, currency, req.Key)
+	switch err {
+	case pkg.ErrInsufficientFunds, pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrInvalidAmount,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed:
+		writeUnprocessable(w, err)
+		return
+	case pkg.ErrWalletNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		if _, ok := err.(pkg.ErrDuplicateAction); ok {
+			writeErrResponse(w, fmt.Sprintf("Conflict: %s", err), http.StatusConflict)
+			return
+		}
+		h.log.Warnf("err changing balance of wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, http.StatusCreated, receipt)
+}
+
+func (h *Handler) TransferFundsV2(w http.ResponseWriter, r *http.Request) {
+	var req transferRequest
+	if status, err := decodeJSON(r, &req); err != nil {
+		writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	if !isValidUUID(req.From) || !isValidUUID(req.To) {
+		writeUnprocessable(w, ErrInvalidUUIDFormat)
+		return
+	}
+	if req.Quote != "" && !isValidUUID(req.Quote) {
+		writeUnprocessable(w, pkg.ErrInvalidQuote)
+		return
+	}
+	currency, amount, err := validateMoney(req.Amount, req.Currency, req.Key)
+	if err != nil {
+		writeUnprocessable(w, err)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), req.From, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeUnprocessable(w, err)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", req.From, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	receipt, err := h.walletStore.TransferFunds(r.Context(), req.From, req.To, amount, currency, req.Quote, req.Key)
+	if err != nil {
+		if status := transferStatus(err); status != 0 {
+			writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+			return
+		}
+		h.log.Warnf("err transfering funds from %s to %s: %s", req.From, req.To, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, http.StatusCreated, receipt)
+}
+
+// TransactionsV2 is the report of the wallet, filtered and paginated by query parameters as in v1
+func (h *Handler) TransactionsV2(w http.ResponseWriter, r *http.Request) {
+	from, err := parseDate(r, "from")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDate(r, "to")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	tType, err := parseTransactionType(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	wallet, ok := h.ownWallet(w, r)
+	if !ok {
+		return
+	}
+	transactions, next, err := h.walletStore.ReportPage(r.Context(), wallet, from, to, tType, page)
+	if err != nil {
+		h.log.Warnf("err creating report on %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	summary, err := h.walletStore.BalanceSummary(r.Context(), wallet, from, to)
+	if err != nil {
+		h.log.Warnf("err summarizing report on %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writePageResponse(w, transactions, next, &summary)
+}
+
+// ownWallet returns the wallet of the path if it's owned by the client, otherwise writes the error response
+func (h *Handler) ownWallet(w http.ResponseWriter, r *http.Request) (string, bool) {
+	wallet := chi.URLParam(r, "id")
+	if !isValidUUID(wallet) {
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", ErrInvalidUUIDFormat), http.StatusNotFound)
+		return "", false
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	ok, err := h.walletStore.CheckOwnerWallet(r.Context(), wallet, owner)
+	switch err {
+	case pkg.ErrWalletNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return "", false
+	case nil:
+	default:
+		h.log.Warnf("err checking wallet %s: %s", wallet, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return "", false
+	}
+	if !ok {
+		writeErrResponse(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return wallet, true
+}
+
+// decodeJSON decodes the request body into v rejecting unknown fields, returns the status to respond with on error
+func decodeJSON(r *http.Request, v interface{}) (int, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, ErrUnsupportedMediaType
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxJSONBodySize))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(v); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("err invalid json: %w", err)
+	}
+	if decoder.More() {
+		return http.StatusBadRequest, errors.New("err invalid json: unexpected data after the object")
+	}
+	return 0, nil
+}
+
+// validateMoney normalizes the currency if specified and checks the amount is positive and fits it
+func validateMoney(amount pkg.Amount, currency, key string) (string, pkg.Amount, error) {
+	if key == "" {
+		return "", amount, ErrKeyNotSpecified
+	}
+	if amount.Sign() <= 0 {
+		return "", amount, ErrAmountNotPositive
+	}
+	if currency == "" {
+		return "", amount, nil
+	}
+	currency, err := pkg.NormalizeCurrency(currency)
+	if err != nil {
+		return "", amount, err
+	}
+	amount, err = pkg.InCurrency(amount, currency)
+	return currency, amount, err
+}
+
+// transferStatus is the status of the response to the error of a transfer, zero if it's not the client's error
+func transferStatus(err error) int {
+	switch err {
+	case pkg.ErrInsufficientFunds, pkg.ErrCurrencyMismatch, pkg.ErrAmountPrecision, pkg.ErrWalletNotFound,
+		pkg.ErrWalletFrozen, pkg.ErrWalletClosed, pkg.ErrInvalidAmount, pkg.ErrRateNotFound, pkg.ErrInvalidQuote, pkg.ErrQuoteExpired,
+		pkg.ErrSelfTransfer:
+		return http.StatusUnprocessableEntity
+	case pkg.ErrReceiverNotFound:
+		return http.StatusNotFound
+	case pkg.ErrReceiverFrozen, pkg.ErrReceiverClosed:
+		return http.StatusConflict
+	}
+	if _, ok := err.(pkg.ErrDuplicateAction); ok {
+		return http.StatusConflict
+	}
+	return 0
+}
+
+func writeUnprocessable(w http.ResponseWriter, err error) {
+	writeErrResponse(w, fmt.Sprintf("Unprocessable Entity: %s", err), http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,162 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"payment-system/pkg"
+	"payment-system/pkg/webhook"
+	"strconv"
+)
+
+type createWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// CreateWebhookV2 registers a webhook for events on the client's wallets, responds with 201 and the webhook
+// along with its signing secret, which isn't shown anymore
+func (h *Handler) CreateWebhookV2(w http.ResponseWriter, r *http.Request) {
+	var req createWebhookRequest
+	if status, err := decodeJSON(r, &req); err != nil {
+		writeErrResponse(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	events, err := validateWebhook(req.URL, req.Events)
+	if err != nil {
+		writeUnprocessable(w, err)
+		return
+	}
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		h.log.Warnf("err generating webhook secret: %s", err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	result, err := h.walletStore.CreateWebhook(r.Context(), owner, req.URL, events, secret)
+	if err != nil {
+		h.log.Warnf("err creating webhook of client %d: %s", owner, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/webhooks/%d", result.ID))
+	writeResponse(w, http.StatusCreated, result)
+}
+
+func (h *Handler) ListWebhooksV2(w http.ResponseWriter, r *http.Request) {
+	owner := ClientFromCtx(r.Context()).ID
+	result, err := h.walletStore.ListWebhooks(r.Context(), owner)
+	if err != nil {
+		h.log.Warnf("err listing webhooks of client %d: %s", owner, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+func (h *Handler) DeleteWebhookV2(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r, "id")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	err = h.walletStore.DeleteWebhook(r.Context(), owner, id)
+	switch err {
+	case pkg.ErrWebhookNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err deleting webhook %d: %s", id, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhookDeliveriesV2 is the delivery log of the webhook, latest first
+func (h *Handler) WebhookDeliveriesV2(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r, "id")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	result, err := h.walletStore.WebhookDeliveries(r.Context(), owner, id)
+	switch err {
+	case pkg.ErrWebhookNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err getting deliveries of webhook %d: %s", id, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeOkResponse(w, result)
+}
+
+// RedeliverWebhookV2 schedules the delivery to be sent again whatever its status
+func (h *Handler) RedeliverWebhookV2(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r, "delivery")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	webhookID, err := parseID(r, "id")
+	if err != nil {
+		writeErrResponse(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	owner := ClientFromCtx(r.Context()).ID
+	result, err := h.walletStore.RedeliverWebhook(r.Context(), owner, webhookID, id)
+	switch err {
+	case pkg.ErrDeliveryNotFound:
+		writeErrResponse(w, fmt.Sprintf("Not Found: %s", err), http.StatusNotFound)
+		return
+	case nil:
+	default:
+		h.log.Warnf("err redelivering webhook delivery %d: %s", id, err)
+		writeErrResponse(w, fmt.Sprintf("Internal server error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, http.StatusAccepted, result)
+}
+
+// validateWebhook returns events subscribed to without duplicates, hosts of the service's own network are rejected
+func validateWebhook(rawURL string, events []string) ([]string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, pkg.ErrInvalidWebhookURL
+	}
+	if err = webhook.CheckHost(u.Hostname()); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, pkg.ErrNoEvents
+	}
+	result := make([]string, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, e := range events {
+		if !pkg.EventType(e).Valid() {
+			return nil, fmt.Errorf("%w: %q", pkg.ErrUnknownEvent, e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func parseID(r *http.Request, name string) (int64, error) {
+	s := chi.URLParam(r, name)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("err invalid %s id %q", name, s)
+	}
+	return id, nil
+}
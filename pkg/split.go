@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+)
+
+// maxPercentScale is the number of decimal places percents of splits may have, as percents of fee rules
+const maxPercentScale = 6
+
+var ErrInvalidSplit = errors.New("err each part must have either an amount or a percent")
+var ErrInvalidPercent = errors.New("err percent must be greater than 0 and at most 100")
+var ErrSplitTotal = errors.New("err parts must sum to the amount: amounts to it or percents of the rest to 100")
+
+// SplitPart is a receiver of a split payment with either a fixed Amount or a Percent of the rest of the payment
+type SplitPart struct {
+	To      string  `json:"to"`
+	Amount  *Amount `json:"amount,omitempty"`
+	Percent *Amount `json:"percent,omitempty"`
+}
+
+// Payment is a split payment from Wallet, Parts are receipts of its receivers. Fee is charged once on Amount,
+// Total is the debit of the wallet
+type Payment struct {
+	ID       string    `json:"id"`
+	Wallet   string    `json:"wallet"`
+	Key      string    `json:"key"`
+	Amount   Amount    `json:"amount"`
+	Currency string    `json:"currency"`
+	Fee      Amount    `json:"fee"`
+	Total    Amount    `json:"total"`
+	Parts    []Receipt `json:"parts"`
+}
+
+// Split allocates amount to parts in its minor units. Amounts are taken as they are, the rest is shared
+// by percents which must sum to 100. Percent shares are rounded down and the units left are given one by one
+// to the shares with the largest remainders, the first ones on ties, so parts always sum to amount exactly.
+// Errors of a part are ErrBatchLeg with its index
+func Split(amount Amount, parts []SplitPart) ([]Amount, error) {
+	result := make([]Amount, len(parts))
+	rest := amount
+	var percents []int
+	percentSum := Amount{}
+	for i, p := range parts {
+		switch {
+		case (p.Amount == nil) == (p.Percent == nil):
+			return nil, ErrBatchLeg{Index: i, Err: ErrInvalidSplit}
+		case p.Amount != nil:
+			a, err := p.Amount.Rescale(amount.Scale)
+			if err != nil {
+				return nil, ErrBatchLeg{Index: i, Err: ErrAmountPrecision}
+			}
+			if a.Sign() <= 0 {
+				return nil, ErrBatchLeg{Index: i, Err: ErrInvalidAmount}
+			}
+			result[i] = a
+			rest = rest.Sub(a)
+		default:
+			if p.Percent.Scale > maxPercentScale {
+				return nil, ErrBatchLeg{Index: i, Err: ErrAmountPrecision}
+			}
+			if p.Percent.Sign() <= 0 || p.Percent.Cmp(NewAmount(100, 0)) > 0 {
+				return nil, ErrBatchLeg{Index: i, Err: ErrInvalidPercent}
+			}
+			percents = append(percents, i)
+			percentSum = percentSum.Add(*p.Percent)
+		}
+	}
+	if rest.Sign() < 0 || len(percents) == 0 && rest.Sign() != 0 {
+		return nil, ErrSplitTotal
+	}
+	if len(percents) == 0 {
+		return result, nil
+	}
+	if percentSum.Cmp(NewAmount(100, 0)) != 0 {
+		return nil, ErrSplitTotal
+	}
+	// shares are rest * percent / 100 with percents scaled to maxPercentScale
+	divisor := big.NewInt(100 * pow10[maxPercentScale])
+	remainders := make(map[int]*big.Int, len(percents))
+	left := rest.Units
+	for _, i := range percents {
+		percent, _ := parts[i].Percent.Rescale(maxPercentScale)
+		share, remainder := new(big.Int).QuoRem(
+			new(big.Int).Mul(big.NewInt(rest.Units), big.NewInt(percent.Units)), divisor, new(big.Int))
+		result[i], remainders[i] = Amount{Units: share.Int64(), Scale: amount.Scale}, remainder
+		left -= share.Int64()
+	}
+	sort.SliceStable(percents, func(a, b int) bool {
+		return remainders[percents[a]].Cmp(remainders[percents[b]]) > 0
+	})
+	for _, i := range percents[:left] {
+		result[i].Units++
+	}
+	for i := range result {
+		if result[i].Sign() == 0 {
+			return nil, ErrBatchLeg{Index: i, Err: ErrInvalidAmount}
+		}
+	}
+	return result, nil
+}
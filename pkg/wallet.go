@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrWalletFrozen = errors.New("err wallet is frozen")
+var ErrWalletClosed = errors.New("err wallet is closed")
+var ErrWalletNotEmpty = errors.New("err wallet with money on the balance or holds can't be closed")
+var ErrInvalidWalletStatus = errors.New("err unknown wallet status")
+var ErrSelfTransfer = errors.New("err funds can't be transferred to the same wallet")
+var ErrReceiverNotFound = errors.New("err receiver wallet with uuid specified was not found")
+var ErrReceiverFrozen = errors.New("err receiver wallet is frozen")
+var ErrReceiverClosed = errors.New("err receiver wallet is closed")
+
+// WalletID is the wallet uuid in lower case, which stores name wallet accounts and match wallets by
+func WalletID(wallet string) string {
+	return strings.ToLower(wallet)
+}
+
+type WalletStatus int8
+
+const (
+	WalletActive WalletStatus = iota
+	// WalletFrozenDebit wallet may only be credited
+	WalletFrozenDebit
+	// WalletFrozenAll wallet may be neither debited nor credited
+	WalletFrozenAll
+	// WalletClosed is final, only wallets with zero balance may be closed
+	WalletClosed
+)
+
+// CheckDebit returns the error of debiting a wallet in status s, if it's not allowed
+func (s WalletStatus) CheckDebit() error {
+	switch s {
+	case WalletFrozenDebit, WalletFrozenAll:
+		return ErrWalletFrozen
+	case WalletClosed:
+		return ErrWalletClosed
+	}
+	return nil
+}
+
+// CheckCredit returns the error of crediting a wallet in status s, if it's not allowed
+func (s WalletStatus) CheckCredit() error {
+	switch s {
+	case WalletFrozenAll:
+		return ErrWalletFrozen
+	case WalletClosed:
+		return ErrWalletClosed
+	}
+	return nil
+}
+
+// CheckReceiver is CheckCredit of the receiver of a transfer, its errors are distinct from ones of the sender
+func (s WalletStatus) CheckReceiver() error {
+	switch s.CheckCredit() {
+	case ErrWalletFrozen:
+		return ErrReceiverFrozen
+	case ErrWalletClosed:
+		return ErrReceiverClosed
+	}
+	return nil
+}
+
+// WalletStatusChange is a record of wallet status history, ClientID is the admin who changed it
+type WalletStatusChange struct {
+	ID       int64        `db:"id" json:"id"`
+	Wallet   string       `db:"wallet" json:"wallet"`
+	From     WalletStatus `db:"status_from" json:"from"`
+	To       WalletStatus `db:"status_to" json:"to"`
+	Reason   string       `db:"reason" json:"reason"`
+	ClientID int          `db:"client_id" json:"client_id"`
+	Ts       time.Time    `db:"ts" json:"ts"`
+}
+
+// Balance is the wallet balance at the moment computed from its postings
+type Balance struct {
+	Wallet   string    `json:"wallet"`
+	Currency string    `json:"currency"`
+	Amount   Amount    `json:"amount"`
+	At       time.Time `json:"at"`
+}
+
+// BalanceSummary is the wallet balance change over a period, debits are positive
+type BalanceSummary struct {
+	Opening Amount `json:"opening_balance"`
+	Closing Amount `json:"closing_balance"`
+	Credits Amount `json:"total_credits"`
+	Debits  Amount `json:"total_debits"`
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("err webhook with id specified was not found")
+var ErrDeliveryNotFound = errors.New("err webhook delivery with id specified was not found")
+var ErrInvalidWebhookURL = errors.New("err webhook url must be an absolute http or https url")
+var ErrPrivateWebhookHost = errors.New("err webhook url must not point to a loopback, private or link-local address")
+var ErrUnknownEvent = errors.New("err unknown event type")
+var ErrNoEvents = errors.New("err no event types specified")
+
+type EventType string
+
+const (
+	EventWalletCreated       EventType = "wallet.created"
+	EventWalletStatusChanged EventType = "wallet.status_changed"
+	EventDepositSucceeded    EventType = "deposit.succeeded"
+	EventWithdrawalSucceeded EventType = "withdrawal.succeeded"
+	EventTransferSent        EventType = "transfer.sent"
+	EventTransferReceived    EventType = "transfer.received"
+	EventHoldPlaced          EventType = "hold.placed"
+	EventHoldCaptured        EventType = "hold.captured"
+	EventHoldVoided          EventType = "hold.voided"
+	EventHoldExpired         EventType = "hold.expired"
+	EventRefundSucceeded     EventType = "refund.succeeded"
+)
+
+var EventTypes = []EventType{
+	EventWalletCreated, EventWalletStatusChanged, EventDepositSucceeded, EventWithdrawalSucceeded,
+	EventTransferSent, EventTransferReceived, EventHoldPlaced, EventHoldCaptured, EventHoldVoided, EventHoldExpired,
+	EventRefundSucceeded,
+}
+
+func (e EventType) Valid() bool {
+	for _, t := range EventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is a client's URL events on its wallets are delivered to, payloads are signed with Secret
+type Webhook struct {
+	ID       int64     `db:"id" json:"id"`
+	ClientID int       `db:"client_id" json:"-"`
+	URL      string    `db:"url" json:"url"`
+	Events   []string  `db:"events" json:"events"`
+	Secret   string    `db:"secret" json:"secret,omitempty"`
+	Active   bool      `db:"active" json:"active"`
+	Created  time.Time `db:"created" json:"created"`
+}
+
+type DeliveryStatus int8
+
+const (
+	DeliveryPending DeliveryStatus = iota
+	DeliverySucceeded
+	// DeliveryFailed deliveries ran out of attempts, they may be redelivered manually
+	DeliveryFailed
+)
+
+// WebhookDelivery is an event sent to a webhook, LastStatusCode and LastError are of the latest attempt
+type WebhookDelivery struct {
+	ID             int64           `db:"id" json:"id"`
+	WebhookID      int64           `db:"webhook_id" json:"webhook_id"`
+	EventID        int64           `db:"event_id" json:"event_id"`
+	EventType      EventType       `db:"event_type" json:"event_type"`
+	Status         DeliveryStatus  `db:"status" json:"status"`
+	Attempts       int             `db:"attempts" json:"attempts"`
+	NextAttempt    time.Time       `db:"next_attempt" json:"next_attempt"`
+	LastStatusCode int             `db:"last_status_code" json:"last_status_code"`
+	LastError      string          `db:"last_error" json:"last_error"`
+	Payload        json.RawMessage `db:"payload" json:"payload"`
+	URL            string          `db:"url" json:"-"`
+	Secret         string          `db:"secret" json:"-"`
+	Updated        time.Time       `db:"updated" json:"updated"`
+	Created        time.Time       `db:"created" json:"created"`
+}
@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"payment-system/pkg"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBatchSize   = 50
+	DefaultTimeout     = 10 * time.Second
+	DefaultMaxAttempts = 10
+	DefaultBaseBackoff = 30 * time.Second
+	DefaultMaxBackoff  = 6 * time.Hour
+
+	maxErrorLength = 255
+)
+
+// Store keeps deliveries of the outbox
+type Store interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]pkg.WebhookDelivery, error)
+	CompleteWebhookDelivery(ctx context.Context, id int64, status pkg.DeliveryStatus, statusCode int, lastError string, retryIn time.Duration) error
+}
+
+// Options of the dispatcher, zero values are replaced by defaults
+type Options struct {
+	BatchSize   int
+	Timeout     time.Duration
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// AllowPrivateHosts lets deliveries reach loopback and private addresses, for tests
+	AllowPrivateHosts bool
+}
+
+// Dispatcher sends due deliveries to webhooks, failed attempts are retried with exponential backoff
+// until MaxAttempts is reached
+type Dispatcher struct {
+	log    *logrus.Logger
+	store  Store
+	client *http.Client
+	opts   Options
+}
+
+func NewDispatcher(log *logrus.Logger, store Store, opts Options) *Dispatcher {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = DefaultBaseBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	return &Dispatcher{
+		log:    log,
+		store:  store,
+		client: newClient(opts),
+		opts:   opts,
+	}
+}
+
+// newClient connects only to public addresses unless private hosts are allowed, so a webhook can't reach
+// the service's own network even if its host resolves to it. Requests don't go through a proxy for the same reason
+func newClient(opts Options) *http.Client {
+	if opts.AllowPrivateHosts {
+		return &http.Client{Timeout: opts.Timeout}
+	}
+	dialer := &net.Dialer{Timeout: opts.Timeout, Control: checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: opts.Timeout, Transport: transport}
+}
+
+// Run dispatches due deliveries every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			n, err := d.DispatchOnce(ctx)
+			if err != nil {
+				d.log.Warnf("err dispatching webhooks: %s", err)
+			}
+			if err != nil || n < d.opts.BatchSize {
+				break
+			}
+		}
+	}
+}
+
+// DispatchOnce sends a batch of due deliveries concurrently, returns the number of deliveries attempted
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	// deliveries not completed within the lease are claimed again
+	deliveries, err := d.store.ClaimWebhookDeliveries(ctx, d.opts.BatchSize, 2*d.opts.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	wg := sync.WaitGroup{}
+	for i := range deliveries {
+		wg.Add(1)
+		go func(delivery pkg.WebhookDelivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(deliveries[i])
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery pkg.WebhookDelivery) {
+	statusCode, err := d.send(ctx, delivery)
+	status, retryIn, lastError := pkg.DeliverySucceeded, time.Duration(0), ""
+	switch {
+	case err == nil:
+		pkg.MetricWebhookAttempts.WithLabelValues("succeeded").Inc()
+	case delivery.Attempts >= d.opts.MaxAttempts:
+		status, lastError = pkg.DeliveryFailed, err.Error()
+		pkg.MetricWebhookAttempts.WithLabelValues("failed").Inc()
+		d.log.Infof("webhook delivery %d failed after %d attempts: %s", delivery.ID, delivery.Attempts, err)
+	default:
+		status, lastError = pkg.DeliveryPending, err.Error()
+		retryIn = Backoff(delivery.Attempts, d.opts.BaseBackoff, d.opts.MaxBackoff)
+		pkg.MetricWebhookAttempts.WithLabelValues("retried").Inc()
+	}
+	if len(lastError) > maxErrorLength {
+		lastError = lastError[:maxErrorLength]
+	}
+	if err = d.store.CompleteWebhookDelivery(ctx, delivery.ID, status, statusCode, lastError, retryIn); err != nil {
+		d.log.Warnf("err completing webhook delivery %d: %s", delivery.ID, err)
+	}
+}
+
+// send posts the signed payload, responses other than 2xx are errors
+func (d *Dispatcher) send(ctx context.Context, delivery pkg.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, time.Now(), delivery.Payload))
+	req.Header.Set(EventHeader, string(delivery.EventType))
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("err webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Backoff is the delay before the next attempt after the attempt given, starting at base and doubling up to max
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
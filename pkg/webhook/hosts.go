@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"net"
+	"payment-system/pkg"
+	"strings"
+	"syscall"
+)
+
+// internalNets are addresses of the service's own network webhooks mustn't reach, such as cloud metadata at 169.254.169.254
+var internalNets = func() []*net.IPNet {
+	var result []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, n)
+	}
+	return result
+}()
+
+// IsPublicIP reports whether webhooks may be delivered to the address, loopback, private, link-local
+// and multicast ones are internal
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return false
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost rejects webhook hosts which are internal addresses or localhost with pkg.ErrPrivateWebhookHost,
+// other hostnames are checked once they're resolved by the dispatcher
+func CheckHost(host string) error {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return pkg.ErrPrivateWebhookHost
+	}
+	if ip := net.ParseIP(host); ip != nil && !IsPublicIP(ip) {
+		return pkg.ErrPrivateWebhookHost
+	}
+	return nil
+}
+
+// checkDial is net.Dialer Control refusing connections to internal addresses, hosts resolving to them included
+func checkDial(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return pkg.ErrPrivateWebhookHost
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package conformance_test
+
+import (
+	"github.com/stretchr/testify/suite"
+	"payment-system/pkg/memStore"
+	"payment-system/tests/conformance"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	suite.Run(t, &conformance.Suite{Store: memStore.NewMemStore()})
+}
@@ -0,0 +1,1018 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"payment-system/pkg"
+	"payment-system/pkg/pgStore"
+	"payment-system/pkg/rest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is what the service needs of a store along with the methods tests set it up with,
+// pgStore.PG and memStore.Mem implement it
+type Store interface {
+	rest.WalletStore
+	rest.ClientStore
+	pkg.FXRateProvider
+	CreateClient(ctx context.Context, client pkg.Client, apiKeyHash string) (int, error)
+	SetFeeRule(ctx context.Context, rule pkg.FeeRule) error
+	SetFeeWallet(wallet string)
+	SetFXRate(ctx context.Context, base, quote string, rate pkg.Amount) error
+	SetFXRateProvider(fx pkg.FXRateProvider)
+	Report(ctx context.Context, wallet string, from, to *time.Time, tType pgStore.TransactionType) ([]pgStore.Transaction, error)
+	LedgerBalance(ctx context.Context, account string) (pkg.Amount, error)
+	ExpireHolds(ctx context.Context) (int64, error)
+	PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error)
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]pkg.WebhookDelivery, error)
+	CompleteWebhookDelivery(ctx context.Context, id int64, status pkg.DeliveryStatus, statusCode int, lastError string, retryIn time.Duration) error
+	Truncate() error
+}
+
+// Suite checks a Store behaves as the service expects, every implementation is run through it.
+// Subscribers of the Store must be notified of committed changes while the suite runs
+type Suite struct {
+	suite.Suite
+	Store  Store
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *Suite) SetupTest() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+}
+
+func (s *Suite) TearDownTest() {
+	s.cancel()
+	s.Store.SetFXRateProvider(s.Store)
+	s.Store.SetFeeWallet("")
+	require.NoError(s.T(), s.Store.Truncate())
+}
+
+// wallet creates a wallet of the owner with the amount deposited
+func (s *Suite) wallet(owner int, currency string, amount int64) string {
+	wallet := uuid.New().String()
+	require.NoError(s.T(), s.Store.CreateWallet(s.ctx, wallet, owner, currency))
+	if amount != 0 {
+		exp, err := pkg.CurrencyExponent(currency)
+		require.NoError(s.T(), err)
+		_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(amount, exp), "", "init-"+wallet)
+		require.NoError(s.T(), err)
+	}
+	return wallet
+}
+
+// requireBalance checks the wallet amount and that its ledger account agrees
+func (s *Suite) requireBalance(wallet string, amount pkg.Amount) {
+	w, err := s.Store.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), amount, w.Amount)
+	balance, err := s.Store.LedgerBalance(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, amount.Cmp(balance))
+}
+
+// TestWalletIDCase checks a wallet may be given by its uuid in any case
+func (s *Suite) TestWalletIDCase() {
+	wallet := uuid.New().String()
+	upper := strings.ToUpper(wallet)
+	require.NoError(s.T(), s.Store.CreateWallet(s.ctx, upper, 1, "USD"))
+	require.ErrorIs(s.T(), s.Store.CreateWallet(s.ctx, wallet, 1, "USD"), pkg.ErrDuplicateAction(wallet))
+	receiver := s.wallet(1, "USD", 0)
+	_, err := s.Store.DepositWithdraw(s.ctx, upper, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.Store.TransferFunds(s.ctx, wallet, strings.ToUpper(receiver), pkg.NewAmount(1000, 2), "", "", "2")
+	require.NoError(s.T(), err)
+	_, err = s.Store.TransferFunds(s.ctx, upper, wallet, pkg.NewAmount(1000, 2), "", "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrSelfTransfer)
+	for _, id := range []string{wallet, upper} {
+		s.requireBalance(id, pkg.NewAmount(9000, 2))
+		ok, err := s.Store.CheckOwnerWallet(s.ctx, id, 1)
+		require.NoError(s.T(), err)
+		require.True(s.T(), ok)
+		report, err := s.Store.Report(s.ctx, id, nil, nil, pgStore.AllTransactions)
+		require.NoError(s.T(), err)
+		require.Len(s.T(), report, 2)
+	}
+	s.requireBalance(strings.ToUpper(receiver), pkg.NewAmount(1000, 2))
+}
+
+func (s *Suite) TestCreateWallet() {
+	wallet := uuid.New().String()
+	_, err := s.Store.GetWallet(s.ctx, wallet)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+	require.NoError(s.T(), s.Store.CreateWallet(s.ctx, wallet, 1, "EUR"))
+	err = s.Store.CreateWallet(s.ctx, wallet, 2, "USD")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction(wallet))
+	w, err := s.Store.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), wallet, w.Wallet)
+	require.Equal(s.T(), 1, w.Owner)
+	require.Equal(s.T(), "EUR", w.Currency)
+	require.Equal(s.T(), pkg.WalletActive, w.Status)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), w.Amount)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), w.Available)
+	own, err := s.Store.CheckOwnerWallet(s.ctx, wallet, 1)
+	require.NoError(s.T(), err)
+	require.True(s.T(), own)
+	own, err = s.Store.CheckOwnerWallet(s.ctx, wallet, 2)
+	require.NoError(s.T(), err)
+	require.False(s.T(), own)
+	_, err = s.Store.CheckOwnerWallet(s.ctx, uuid.New().String(), 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+}
+
+func (s *Suite) TestDepositWithdraw() {
+	wallet := s.wallet(1, "USD", 0)
+	receipt, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 0), "USD", "1")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(100000, 2), receipt.Amount)
+	require.Equal(s.T(), pkg.NewAmount(100000, 2), receipt.Total)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), receipt.Fee)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(100, 2), "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("1"))
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(100, 2), "EUR", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrCurrencyMismatch)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1, 3), "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrAmountPrecision)
+	// handlers compare errors with ==, amounts too big for the wallet currency fail with the bare sentinel
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(922337203685477580, 0), "", "2")
+	require.Equal(s.T(), pkg.ErrInvalidAmount, err)
+	// amounts which don't fit numeric(18, 3) columns
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000000000000000, 0), "", "2")
+	require.Equal(s.T(), pkg.ErrInvalidAmount, err)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100001, 2), "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.Store.DepositWithdraw(s.ctx, uuid.New().String(), pkg.NewAmount(100, 2), "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+	// keys of failed transactions may be used again
+	receipt, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100000, 2), "", "2")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(-100000, 2), receipt.Total)
+	s.requireBalance(wallet, pkg.NewAmount(0, 2))
+	balance, err := s.Store.LedgerBalance(s.ctx, pgStore.AccountCashIn)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, pkg.NewAmount(-100000, 2).Cmp(balance))
+	balance, err = s.Store.LedgerBalance(s.ctx, pgStore.AccountCashOut)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, pkg.NewAmount(100000, 2).Cmp(balance))
+}
+
+func (s *Suite) TestConcurrentWithdrawals() {
+	wallet := s.wallet(1, "USD", 10000)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded, insufficient := 0, 0
+	for i := 0; i < 150; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100, 2), "", fmt.Sprintf("withdrawal-%d", i))
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				succeeded++
+			case pkg.ErrInsufficientFunds:
+				insufficient++
+			default:
+				s.T().Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(s.T(), 100, succeeded)
+	require.Equal(s.T(), 50, insufficient)
+	s.requireBalance(wallet, pkg.NewAmount(0, 2))
+	report, err := s.Store.Report(s.ctx, wallet, nil, nil, pgStore.TransactionWithdrawal)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 100)
+}
+
+func (s *Suite) TestTransferFunds() {
+	from, to := s.wallet(1, "USD", 10000), s.wallet(2, "USD", 0)
+	receipt, err := s.Store.TransferFunds(s.ctx, from, to, pkg.NewAmount(3000, 2), "", "", "1")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(3000, 2), receipt.AmountReceived)
+	require.Equal(s.T(), pkg.NewAmount(-3000, 2), receipt.Total)
+	_, err = s.Store.TransferFunds(s.ctx, from, to, pkg.NewAmount(100, 2), "", "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("1"))
+	_, err = s.Store.TransferFunds(s.ctx, from, to, pkg.NewAmount(7001, 2), "", "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.Store.TransferFunds(s.ctx, from, uuid.New().String(), pkg.NewAmount(100, 2), "", "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrReceiverNotFound)
+	_, err = s.Store.TransferFunds(s.ctx, from, to, pkg.NewAmount(100, 2), "EUR", "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrCurrencyMismatch)
+	s.requireBalance(from, pkg.NewAmount(7000, 2))
+	s.requireBalance(to, pkg.NewAmount(3000, 2))
+	// the sender reports outgoing transfers and the receiver incoming ones
+	for wallet, counts := range map[string][4]int{from: {1, 0, 1, 0}, to: {0, 0, 0, 1}} {
+		for tType, n := range counts {
+			report, err := s.Store.Report(s.ctx, wallet, nil, nil, pgStore.TransactionType(tType))
+			require.NoError(s.T(), err)
+			require.Len(s.T(), report, n, "type %d", tType)
+		}
+	}
+	report, err := s.Store.Report(s.ctx, to, nil, nil, pgStore.TransactionTransferFundsTo)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "1", report[0].Key)
+	require.Equal(s.T(), from, report[0].Wallet)
+	require.Equal(s.T(), to, report[0].WalletReceiver)
+	require.Equal(s.T(), pkg.NewAmount(3000, 2), report[0].PostingAmount)
+	require.Len(s.T(), report[0].Legs, 2)
+	_, err = s.Store.Report(s.ctx, to, nil, nil, 6)
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidTransactionType)
+}
+
+func (s *Suite) TestTransferReceiver() {
+	from, frozen, closed := s.wallet(1, "USD", 10000), s.wallet(2, "USD", 0), s.wallet(2, "USD", 0)
+	_, err := s.Store.SetWalletStatus(s.ctx, frozen, pkg.WalletFrozenAll, "fraud", 1)
+	require.NoError(s.T(), err)
+	_, err = s.Store.SetWalletStatus(s.ctx, closed, pkg.WalletClosed, "done", 1)
+	require.NoError(s.T(), err)
+	for to, expected := range map[string]error{
+		from:                pkg.ErrSelfTransfer,
+		uuid.New().String(): pkg.ErrReceiverNotFound,
+		frozen:              pkg.ErrReceiverFrozen,
+		closed:              pkg.ErrReceiverClosed,
+	} {
+		_, err = s.Store.TransferFunds(s.ctx, from, to, pkg.NewAmount(1000, 2), "", "", "1")
+		require.ErrorIs(s.T(), err, expected)
+	}
+	// the sender isn't debited whatever is wrong with the receiver
+	s.requireBalance(from, pkg.NewAmount(10000, 2))
+	report, err := s.Store.Report(s.ctx, from, nil, nil, pgStore.TransactionTransferFunds)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), report)
+	// errors of the sender come first
+	_, err = s.Store.TransferFunds(s.ctx, uuid.New().String(), closed, pkg.NewAmount(1000, 2), "", "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+	_, err = s.Store.TransferFunds(s.ctx, closed, frozen, pkg.NewAmount(1000, 2), "", "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletClosed)
+}
+
+func (s *Suite) TestTransferFundsBatch() {
+	from, a, b := s.wallet(1, "USD", 10000), s.wallet(2, "USD", 0), s.wallet(3, "USD", 0)
+	receipts, err := s.Store.TransferFundsBatch(s.ctx, from, []pkg.TransferLeg{
+		{To: a, Amount: pkg.NewAmount(1000, 2), Key: "1"},
+		{To: b, Amount: pkg.NewAmount(2000, 2), Currency: "USD", Key: "2"},
+		{To: a, Amount: pkg.NewAmount(500, 2), Key: "3"},
+	})
+	require.NoError(s.T(), err)
+	require.Len(s.T(), receipts, 3)
+	require.Equal(s.T(), "2", receipts[1].Key)
+	require.Equal(s.T(), pkg.NewAmount(-2000, 2), receipts[1].Total)
+	s.requireBalance(from, pkg.NewAmount(6500, 2))
+	s.requireBalance(a, pkg.NewAmount(1500, 2))
+	s.requireBalance(b, pkg.NewAmount(2000, 2))
+	// a failed transfer rolls back the ones before it
+	for _, c := range []struct {
+		leg pkg.TransferLeg
+		err error
+	}{
+		{pkg.TransferLeg{To: b, Amount: pkg.NewAmount(6001, 2), Key: "6"}, pkg.ErrInsufficientFunds},
+		{pkg.TransferLeg{To: uuid.New().String(), Amount: pkg.NewAmount(100, 2), Key: "6"}, pkg.ErrReceiverNotFound},
+		{pkg.TransferLeg{To: from, Amount: pkg.NewAmount(100, 2), Key: "6"}, pkg.ErrSelfTransfer},
+		{pkg.TransferLeg{To: b, Amount: pkg.NewAmount(100, 2), Key: "1"}, pkg.ErrDuplicateAction("1")},
+		{pkg.TransferLeg{To: b, Amount: pkg.NewAmount(100, 2), Key: "4"}, pkg.ErrDuplicateAction("4")},
+	} {
+		receipts, err = s.Store.TransferFundsBatch(s.ctx, from, []pkg.TransferLeg{
+			{To: a, Amount: pkg.NewAmount(100, 2), Key: "4"},
+			{To: b, Amount: pkg.NewAmount(400, 2), Key: "5"},
+			c.leg,
+		})
+		require.ErrorIs(s.T(), err, c.err)
+		var errLeg pkg.ErrBatchLeg
+		require.ErrorAs(s.T(), err, &errLeg)
+		require.Equal(s.T(), 2, errLeg.Index)
+		require.Empty(s.T(), receipts)
+	}
+	s.requireBalance(from, pkg.NewAmount(6500, 2))
+	s.requireBalance(a, pkg.NewAmount(1500, 2))
+	s.requireBalance(b, pkg.NewAmount(2000, 2))
+	report, err := s.Store.Report(s.ctx, from, nil, nil, pgStore.TransactionTransferFunds)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 3)
+	// keys of rolled back transfers may be used again
+	_, err = s.Store.TransferFunds(s.ctx, from, a, pkg.NewAmount(100, 2), "", "", "4")
+	require.NoError(s.T(), err)
+}
+
+func (s *Suite) TestSplitPayment() {
+	percent := func(p int64) *pkg.Amount {
+		a := pkg.NewAmount(p, 0)
+		return &a
+	}
+	tax := pkg.NewAmount(825, 2)
+	from, seller, platform, taxes := s.wallet(1, "USD", 15000), s.wallet(2, "USD", 0), s.wallet(3, "USD", 0), s.wallet(4, "USD", 0)
+	payment, err := s.Store.SplitPayment(s.ctx, from, pkg.NewAmount(10000, 2), "USD", []pkg.SplitPart{
+		{To: seller, Percent: percent(90)},
+		{To: platform, Percent: percent(10)},
+		{To: taxes, Amount: &tax},
+	}, "order")
+	require.NoError(s.T(), err)
+	require.NotEmpty(s.T(), payment.ID)
+	require.Equal(s.T(), pkg.NewAmount(-10000, 2), payment.Total)
+	require.Len(s.T(), payment.Parts, 3)
+	for _, part := range payment.Parts {
+		require.Equal(s.T(), payment.ID, part.Key)
+		require.Equal(s.T(), payment.Parts[0].TransactionID, part.TransactionID)
+	}
+	s.requireBalance(from, pkg.NewAmount(5000, 2))
+	s.requireBalance(seller, pkg.NewAmount(8258, 2))
+	s.requireBalance(platform, pkg.NewAmount(917, 2))
+	s.requireBalance(taxes, tax)
+	// the payment is one debit of the sender with a credit of each receiver
+	report, err := s.Store.Report(s.ctx, from, nil, nil, pgStore.TransactionTransferFunds)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), payment.ID, report[0].PaymentID)
+	require.Equal(s.T(), pkg.NewAmount(-10000, 2), report[0].PostingAmount)
+	require.Len(s.T(), report[0].Legs, 4)
+	report, err = s.Store.Report(s.ctx, seller, nil, nil, pgStore.AllTransactions)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), payment.ID, report[0].PaymentID)
+	require.ErrorIs(s.T(), s.Store.Refund(s.ctx, report[0].ID, "", pkg.Amount{}, "refund"), pkg.ErrNotRefundable)
+	// a failed part rolls back the payment
+	for _, c := range []struct {
+		amount   int64
+		currency string
+		key      string
+		parts    []pkg.SplitPart
+		err      error
+	}{
+		{5000, "", "order-2", []pkg.SplitPart{{To: seller, Percent: percent(50)}, {To: uuid.New().String(), Percent: percent(50)}}, pkg.ErrReceiverNotFound},
+		{6000, "", "order-2", []pkg.SplitPart{{To: seller, Percent: percent(100)}}, pkg.ErrInsufficientFunds},
+		{5000, "", "order", []pkg.SplitPart{{To: seller, Percent: percent(100)}}, pkg.ErrDuplicateAction("order")},
+		{5000, "", "order-2", []pkg.SplitPart{{To: seller, Percent: percent(99)}}, pkg.ErrSplitTotal},
+		{5000, "EUR", "order-2", []pkg.SplitPart{{To: seller, Percent: percent(100)}}, pkg.ErrCurrencyMismatch},
+	} {
+		_, err = s.Store.SplitPayment(s.ctx, from, pkg.NewAmount(c.amount, 2), c.currency, c.parts, c.key)
+		require.ErrorIs(s.T(), err, c.err)
+	}
+	s.requireBalance(from, pkg.NewAmount(5000, 2))
+	s.requireBalance(seller, pkg.NewAmount(8258, 2))
+	// payment keys don't collide with keys of the client's transfers
+	_, err = s.Store.TransferFunds(s.ctx, from, seller, pkg.NewAmount(100, 2), "", "", "order-2")
+	require.NoError(s.T(), err)
+	_, err = s.Store.SplitPayment(s.ctx, from, pkg.NewAmount(4900, 2), "", []pkg.SplitPart{{To: seller, Percent: percent(100)}}, "order-2")
+	require.NoError(s.T(), err)
+	s.requireBalance(from, pkg.NewAmount(0, 2))
+}
+
+// TestSplitPaymentFee checks a split payment is charged the fee of a transfer once rather than for each part
+func (s *Suite) TestSplitPaymentFee() {
+	feeWallet := s.wallet(5, "USD", 0)
+	s.Store.SetFeeWallet(feeWallet)
+	require.NoError(s.T(), s.Store.SetFeeRule(s.ctx, pkg.FeeRule{Type: int8(pgStore.TransactionTransferFunds), Flat: pkg.NewAmount(100, 2)}))
+	third := pkg.NewAmount(3000, 2)
+	from, a, b, c := s.wallet(1, "USD", 10000), s.wallet(2, "USD", 0), s.wallet(3, "USD", 0), s.wallet(4, "USD", 0)
+	payment, err := s.Store.SplitPayment(s.ctx, from, pkg.NewAmount(9000, 2), "", []pkg.SplitPart{
+		{To: a, Amount: &third},
+		{To: b, Amount: &third},
+		{To: c, Amount: &third},
+	}, "fee")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(100, 2), payment.Fee)
+	require.Equal(s.T(), pkg.NewAmount(-9100, 2), payment.Total)
+	s.requireBalance(from, pkg.NewAmount(900, 2))
+	s.requireBalance(feeWallet, pkg.NewAmount(100, 2))
+	for _, wallet := range []string{a, b, c} {
+		s.requireBalance(wallet, third)
+	}
+	// the fee is on top of the whole amount
+	all := pkg.NewAmount(100, 0)
+	_, err = s.Store.SplitPayment(s.ctx, from, pkg.NewAmount(900, 2), "", []pkg.SplitPart{{To: a, Percent: &all}}, "fee-2")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+}
+
+func (s *Suite) TestConcurrentTransfers() {
+	s.concurrentTransfers(nil)
+}
+
+// TestConcurrentTransfersWithFees checks the fee wallet credited by every transfer doesn't deadlock them
+func (s *Suite) TestConcurrentTransfersWithFees() {
+	feeWallet := s.wallet(5, "USD", 0)
+	s.Store.SetFeeWallet(feeWallet)
+	require.NoError(s.T(), s.Store.SetFeeRule(s.ctx, pkg.FeeRule{Type: int8(pgStore.TransactionTransferFunds), Flat: pkg.NewAmount(1, 2)}))
+	s.concurrentTransfers([]string{feeWallet})
+}
+
+// concurrentTransfers makes transfers between 4 wallets at once, money they have along with others stays the same
+func (s *Suite) concurrentTransfers(others []string) {
+	wallets := make([]string, 4)
+	for i := range wallets {
+		wallets[i] = s.wallet(i+1, "USD", 10000)
+	}
+	// wallets of each pair transfer to each other at once
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			from, to := wallets[i%4], wallets[(i/4+i+1)%4]
+			if from == to {
+				to = wallets[(i+2)%4]
+			}
+			_, err := s.Store.TransferFunds(s.ctx, from, to, pkg.NewAmount(int64(100+i%7*1000), 2), "", "", fmt.Sprintf("transfer-%d", i))
+			if err != nil && err != pkg.ErrInsufficientFunds {
+				s.T().Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	total := pkg.NewAmount(0, 2)
+	for _, wallet := range wallets {
+		w, err := s.Store.GetWallet(s.ctx, wallet)
+		require.NoError(s.T(), err)
+		require.GreaterOrEqual(s.T(), w.Amount.Sign(), 0)
+		s.requireBalance(wallet, w.Amount)
+		total = total.Add(w.Amount)
+	}
+	for _, wallet := range others {
+		w, err := s.Store.GetWallet(s.ctx, wallet)
+		require.NoError(s.T(), err)
+		s.requireBalance(wallet, w.Amount)
+		total = total.Add(w.Amount)
+	}
+	require.Equal(s.T(), pkg.NewAmount(40000, 2), total)
+}
+
+func (s *Suite) TestCrossCurrencyTransfer() {
+	s.Store.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(11012, 2)})
+	usd, jpy := s.wallet(1, "USD", 10000), s.wallet(2, "JPY", 0)
+	receipt, err := s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(1005, 2), "", "", "1")
+	require.NoError(s.T(), err)
+	// 10.05 USD * 110.12 = 1106.706 JPY
+	require.Equal(s.T(), pkg.NewAmount(1107, 0), receipt.AmountReceived)
+	require.Equal(s.T(), "JPY", receipt.CurrencyReceiver)
+	s.requireBalance(jpy, pkg.NewAmount(1107, 0))
+	_, err = s.Store.TransferFunds(s.ctx, jpy, usd, pkg.NewAmount(100, 0), "", "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrRateNotFound)
+	// quoted rates hold until they expire whatever the current rate is
+	quote, err := s.Store.CreateFXQuote(s.ctx, "USD", "JPY", time.Minute)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, pkg.NewAmount(11012, 2).Cmp(quote.Rate))
+	s.Store.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(100, 0)})
+	receipt, err = s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(100, 2), "", quote.ID, "2")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(110, 0), receipt.AmountReceived)
+	_, err = s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(100, 2), "", uuid.New().String(), "3")
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidQuote)
+	expired, err := s.Store.CreateFXQuote(s.ctx, "USD", "JPY", -time.Minute)
+	require.NoError(s.T(), err)
+	_, err = s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(100, 2), "", expired.ID, "3")
+	require.ErrorIs(s.T(), err, pkg.ErrQuoteExpired)
+	report, err := s.Store.Report(s.ctx, jpy, nil, nil, pgStore.TransactionTransferFundsTo)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 2)
+	require.Equal(s.T(), 0, pkg.NewAmount(11012, 2).Cmp(report[0].Rate))
+	require.Len(s.T(), report[0].Legs, 4)
+	balance, err := s.Store.LedgerBalance(s.ctx, pgStore.AccountFX)
+	require.NoError(s.T(), err)
+	require.NotZero(s.T(), balance.Sign())
+	// rates of the store are used unless a provider is set
+	s.Store.SetFXRateProvider(s.Store)
+	require.NoError(s.T(), s.Store.SetFXRate(s.ctx, "USD", "JPY", pkg.NewAmount(120, 0)))
+	receipt, err = s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(100, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(120, 0), receipt.AmountReceived)
+}
+
+// rateFunc is a pkg.FXRateProvider calling the function
+type rateFunc func(ctx context.Context, base, quote string) (pkg.Amount, error)
+
+func (f rateFunc) Rate(ctx context.Context, base, quote string) (pkg.Amount, error) {
+	return f(ctx, base, quote)
+}
+
+// TestExternalRates checks rates of an external provider are fetched before wallets are locked,
+// the provider changes the sender and would wait for the transfer asking it for a rate otherwise
+func (s *Suite) TestExternalRates() {
+	usd, jpy := s.wallet(1, "USD", 10000), s.wallet(2, "JPY", 0)
+	calls := 0
+	s.Store.SetFXRateProvider(rateFunc(func(ctx context.Context, base, quote string) (pkg.Amount, error) {
+		calls++
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if _, err := s.Store.DepositWithdraw(ctx, usd, pkg.NewAmount(100, 2), "", uuid.New().String()); err != nil {
+			return pkg.Amount{}, err
+		}
+		return pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(100, 0)}.Rate(ctx, base, quote)
+	}))
+	receipt, err := s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(1000, 2), "", "", "1")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(1000, 0), receipt.AmountReceived)
+	// legs to wallets of the same currency share the rate
+	receipts, err := s.Store.TransferFundsBatch(s.ctx, usd, []pkg.TransferLeg{
+		{To: jpy, Amount: pkg.NewAmount(500, 2), Key: "2"},
+		{To: jpy, Amount: pkg.NewAmount(500, 2), Key: "3"},
+	})
+	require.NoError(s.T(), err)
+	require.Len(s.T(), receipts, 2)
+	require.Equal(s.T(), 2, calls)
+	s.requireBalance(usd, pkg.NewAmount(8200, 2))
+	s.requireBalance(jpy, pkg.NewAmount(2000, 0))
+}
+
+func (s *Suite) TestReportFilters() {
+	wallet, other := s.wallet(1, "USD", 10000), s.wallet(1, "USD", 0)
+	_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-1000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.Store.TransferFunds(s.ctx, wallet, other, pkg.NewAmount(1000, 2), "", "", "2")
+	require.NoError(s.T(), err)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday, tomorrow := today.Add(-24*time.Hour), today.Add(24*time.Hour)
+	for _, c := range []struct {
+		from, to *time.Time
+		n        int
+	}{
+		{nil, nil, 3},
+		{&today, &today, 3},
+		{&yesterday, nil, 3},
+		{nil, &today, 3},
+		{&tomorrow, nil, 0},
+		{nil, &yesterday, 0},
+		{&yesterday, &yesterday, 0},
+	} {
+		report, err := s.Store.Report(s.ctx, wallet, c.from, c.to, pgStore.AllTransactions)
+		require.NoError(s.T(), err)
+		require.Len(s.T(), report, c.n, "from %v to %v", c.from, c.to)
+	}
+	report, err := s.Store.Report(s.ctx, wallet, &today, &today, pgStore.TransactionWithdrawal)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), "1", report[0].Key)
+	require.Equal(s.T(), pkg.NewAmount(-1000, 2), report[0].Amount)
+	report, err = s.Store.Report(s.ctx, other, &tomorrow, nil, pgStore.TransactionTransferFundsTo)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), report)
+}
+
+func (s *Suite) TestReportPage() {
+	wallet := s.wallet(1, "USD", 0)
+	for i := 1; i <= 5; i++ {
+		_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(int64(i*100), 2), "", fmt.Sprintf("page-%d", i))
+		require.NoError(s.T(), err)
+	}
+	all, err := s.Store.Report(s.ctx, wallet, nil, nil, pgStore.AllTransactions)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), all, 5)
+	for _, desc := range []bool{false, true} {
+		var ids []int64
+		page := pgStore.Page{Limit: 2, Desc: desc}
+		for {
+			result, next, err := s.Store.ReportPage(s.ctx, wallet, nil, nil, pgStore.AllTransactions, page)
+			require.NoError(s.T(), err)
+			for _, t := range result {
+				ids = append(ids, t.PostingID)
+			}
+			if next == nil {
+				break
+			}
+			cursor, err := pgStore.ParseCursor(next.String())
+			require.NoError(s.T(), err)
+			page.Cursor = &cursor
+		}
+		require.Len(s.T(), ids, 5)
+		for i, t := range all {
+			if desc {
+				require.Equal(s.T(), t.PostingID, ids[len(ids)-1-i])
+			} else {
+				require.Equal(s.T(), t.PostingID, ids[i])
+			}
+		}
+	}
+	var exported []pgStore.Transaction
+	err = s.Store.ExportReport(s.ctx, wallet, nil, nil, pgStore.AllTransactions, true, func(t pgStore.Transaction) error {
+		exported = append(exported, t)
+		return nil
+	})
+	require.NoError(s.T(), err)
+	require.Len(s.T(), exported, 5)
+	require.Equal(s.T(), all[0], exported[4])
+	stop := errors.New("stop")
+	err = s.Store.ExportReport(s.ctx, wallet, nil, nil, pgStore.AllTransactions, false, func(t pgStore.Transaction) error {
+		return stop
+	})
+	require.ErrorIs(s.T(), err, stop)
+}
+
+func (s *Suite) TestHolds() {
+	wallet := s.wallet(1, "USD", 10000)
+	_, err := s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(10001, 2), "", time.Minute, "1")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(0, 2), "", time.Minute, "1")
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidAmount)
+	hold, err := s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(6000, 2), "", time.Minute, "1")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(6000, 2), hold.Amount)
+	require.Equal(s.T(), pkg.HoldActive, hold.Status)
+	_, err = s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(100, 2), "", time.Minute, "1")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("1"))
+	w, err := s.Store.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(6000, 2), w.Held)
+	require.Equal(s.T(), pkg.NewAmount(4000, 2), w.Available)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-4001, 2), "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.Store.CaptureHold(s.ctx, hold.ID, pkg.NewAmount(6001, 2), "3")
+	require.ErrorIs(s.T(), err, pkg.ErrCaptureExceedsHold)
+	hold, err = s.Store.CaptureHold(s.ctx, hold.ID, pkg.NewAmount(2500, 2), "3")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.HoldCaptured, hold.Status)
+	require.Equal(s.T(), pkg.NewAmount(2500, 2), hold.Captured)
+	_, err = s.Store.CaptureHold(s.ctx, hold.ID, pkg.Amount{}, "4")
+	require.ErrorIs(s.T(), err, pkg.ErrHoldNotActive)
+	_, err = s.Store.VoidHold(s.ctx, hold.ID)
+	require.ErrorIs(s.T(), err, pkg.ErrHoldNotActive)
+	s.requireBalance(wallet, pkg.NewAmount(7500, 2))
+	report, err := s.Store.Report(s.ctx, wallet, nil, nil, pgStore.TransactionCapture)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), pkg.NewAmount(-2500, 2), report[0].PostingAmount)
+	// captures share keys with other transactions
+	hold, err = s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(1000, 2), "", time.Minute, "4")
+	require.NoError(s.T(), err)
+	_, err = s.Store.CaptureHold(s.ctx, hold.ID, pkg.Amount{}, "3")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("3"))
+	hold, err = s.Store.VoidHold(s.ctx, hold.ID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.HoldVoided, hold.Status)
+	hold, err = s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(1000, 2), "", -time.Minute, "5")
+	require.NoError(s.T(), err)
+	_, err = s.Store.CaptureHold(s.ctx, hold.ID, pkg.Amount{}, "5")
+	require.ErrorIs(s.T(), err, pkg.ErrHoldExpired)
+	n, err := s.Store.ExpireHolds(s.ctx)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(1), n)
+	hold, err = s.Store.GetHold(s.ctx, hold.ID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.HoldExpired, hold.Status)
+	w, err = s.Store.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), w.Held)
+	require.Equal(s.T(), pkg.NewAmount(7500, 2), w.Available)
+	_, err = s.Store.GetHold(s.ctx, uuid.New().String())
+	require.ErrorIs(s.T(), err, pkg.ErrHoldNotFound)
+}
+
+func (s *Suite) TestRefunds() {
+	s.Store.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(11012, 2)})
+	usd, jpy := s.wallet(1, "USD", 10000), s.wallet(2, "JPY", 0)
+	_, err := s.Store.DepositWithdraw(s.ctx, usd, pkg.NewAmount(-2000, 2), "", "1")
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), s.Store.Refund(s.ctx, 0, "1", pkg.NewAmount(500, 2), "r1"))
+	err = s.Store.Refund(s.ctx, 0, "1", pkg.NewAmount(1501, 2), "r2")
+	require.ErrorIs(s.T(), err, pkg.ErrRefundExceedsOriginal)
+	err = s.Store.Refund(s.ctx, 0, "1", pkg.NewAmount(100, 2), "r1")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("r1"))
+	require.NoError(s.T(), s.Store.Refund(s.ctx, 0, "1", pkg.Amount{}, "r2"))
+	err = s.Store.Refund(s.ctx, 0, "1", pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrRefundExceedsOriginal)
+	err = s.Store.Refund(s.ctx, 0, "r1", pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrNotRefundable)
+	err = s.Store.Refund(s.ctx, 0, "missing", pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrTransactionNotFound)
+	s.requireBalance(usd, pkg.NewAmount(10000, 2))
+	// deposits can't be refunded once spent
+	_, err = s.Store.DepositWithdraw(s.ctx, usd, pkg.NewAmount(-9000, 2), "", "2")
+	require.NoError(s.T(), err)
+	err = s.Store.Refund(s.ctx, 0, "init-"+usd, pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	require.NoError(s.T(), s.Store.Refund(s.ctx, 0, "2", pkg.Amount{}, "r3"))
+	// refunds of transfers go back from the receiver by the original rate
+	original, err := s.Store.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(1005, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	s.Store.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(1, 0)})
+	require.NoError(s.T(), s.Store.Refund(s.ctx, original.TransactionID, "", pkg.NewAmount(500, 2), "r4"))
+	require.NoError(s.T(), s.Store.Refund(s.ctx, 0, "3", pkg.Amount{}, "r5"))
+	s.requireBalance(jpy, pkg.NewAmount(0, 0))
+	s.requireBalance(usd, pkg.NewAmount(10000, 2))
+	t, err := s.Store.GetTransaction(s.ctx, 0, "3")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), original.TransactionID, t.ID)
+	require.Equal(s.T(), pgStore.TransactionTransferFunds, t.Type)
+	require.Equal(s.T(), pkg.NewAmount(1107, 0), t.AmountReceived)
+	_, err = s.Store.GetTransaction(s.ctx, 0, "missing")
+	require.ErrorIs(s.T(), err, pkg.ErrTransactionNotFound)
+	// 5.00 USD * 110.12 = 550.6 JPY rounded to 551, the rest is 1107 - 551
+	report, err := s.Store.Report(s.ctx, jpy, nil, nil, pgStore.TransactionRefund)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 2)
+	require.Equal(s.T(), pkg.NewAmount(-551, 0), report[0].PostingAmount)
+	require.Equal(s.T(), pkg.NewAmount(-556, 0), report[1].PostingAmount)
+	require.Equal(s.T(), original.TransactionID, report[1].OriginalID)
+}
+
+func (s *Suite) TestFees() {
+	payer, receiver, feeWallet := s.wallet(1, "USD", 0), s.wallet(2, "USD", 0), s.wallet(0, "USD", 0)
+	s.Store.SetFeeWallet(feeWallet)
+	clientID := 1
+	// 1% of transfers but at least 0.50, 2.00 per withdrawal of client 1 and 3.00 for the rest
+	require.NoError(s.T(), s.Store.SetFeeRule(s.ctx, pkg.FeeRule{Type: int8(pgStore.TransactionTransferFunds), Percent: pkg.NewAmount(1, 0), Min: pkg.NewAmount(50, 2)}))
+	require.NoError(s.T(), s.Store.SetFeeRule(s.ctx, pkg.FeeRule{Type: int8(pgStore.TransactionWithdrawal), Flat: pkg.NewAmount(300, 2)}))
+	require.NoError(s.T(), s.Store.SetFeeRule(s.ctx, pkg.FeeRule{ClientID: &clientID, Type: int8(pgStore.TransactionWithdrawal), Flat: pkg.NewAmount(200, 2)}))
+	receipt, err := s.Store.DepositWithdraw(s.ctx, payer, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), receipt.Fee)
+	receipt, err = s.Store.TransferFunds(s.ctx, payer, receiver, pkg.NewAmount(1000, 2), "", "", "2")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(50, 2), receipt.Fee)
+	require.Equal(s.T(), pkg.NewAmount(-1050, 2), receipt.Total)
+	receipt, err = s.Store.TransferFunds(s.ctx, payer, receiver, pkg.NewAmount(6000, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(60, 2), receipt.Fee)
+	receipt, err = s.Store.DepositWithdraw(s.ctx, payer, pkg.NewAmount(-1000, 2), "", "4")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(200, 2), receipt.Fee)
+	require.Equal(s.T(), pkg.NewAmount(-1200, 2), receipt.Total)
+	// the fee is charged on top of the amount
+	_, err = s.Store.DepositWithdraw(s.ctx, payer, pkg.NewAmount(-1790, 2), "", "5")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	receipt, err = s.Store.DepositWithdraw(s.ctx, receiver, pkg.NewAmount(-1000, 2), "", "6")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(300, 2), receipt.Fee)
+	s.requireBalance(payer, pkg.NewAmount(1690, 2))
+	s.requireBalance(feeWallet, pkg.NewAmount(610, 2))
+	report, err := s.Store.Report(s.ctx, payer, nil, nil, pgStore.TransactionTransferFunds)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 2)
+	require.Equal(s.T(), pkg.NewAmount(50, 2), report[0].Fee)
+	require.Equal(s.T(), pkg.NewAmount(-1050, 2), report[0].PostingAmount)
+	require.Len(s.T(), report[0].Legs, 3)
+}
+
+func (s *Suite) TestWalletStatus() {
+	wallet, other := s.wallet(1, "USD", 10000), s.wallet(1, "USD", 0)
+	w, err := s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletFrozenDebit, "kyc", 1)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.WalletFrozenDebit, w.Status)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-1000, 2), "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.Store.TransferFunds(s.ctx, wallet, other, pkg.NewAmount(1000, 2), "", "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.Store.PlaceHold(s.ctx, wallet, pkg.NewAmount(1000, 2), "", time.Minute, "1")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletFrozenAll, "fraud", 1)
+	require.NoError(s.T(), err)
+	_, err = s.Store.TransferFunds(s.ctx, other, wallet, pkg.NewAmount(1000, 2), "", "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrReceiverFrozen)
+	_, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletClosed, "done", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotEmpty)
+	_, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletStatus(4), "unknown", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidWalletStatus)
+	_, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletActive, "cleared", 1)
+	require.NoError(s.T(), err)
+	// setting the same status isn't a change
+	_, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletActive, "cleared", 1)
+	require.NoError(s.T(), err)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-11000, 2), "", "2")
+	require.NoError(s.T(), err)
+	w, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletClosed, "done", 2)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.WalletClosed, w.Status)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletClosed)
+	_, err = s.Store.SetWalletStatus(s.ctx, wallet, pkg.WalletActive, "reopen", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletClosed)
+	_, err = s.Store.SetWalletStatus(s.ctx, uuid.New().String(), pkg.WalletActive, "missing", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+	history, err := s.Store.WalletStatusHistory(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), history, 4)
+	require.Equal(s.T(), pkg.WalletFrozenDebit, history[1].From)
+	require.Equal(s.T(), pkg.WalletFrozenAll, history[1].To)
+	require.Equal(s.T(), "fraud", history[1].Reason)
+	require.Equal(s.T(), pkg.WalletClosed, history[3].To)
+	require.Equal(s.T(), 2, history[3].ClientID)
+	history, err = s.Store.WalletStatusHistory(s.ctx, other)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), history)
+}
+
+func (s *Suite) TestClients() {
+	_, err := s.Store.GetClient(s.ctx, "missing")
+	require.ErrorIs(s.T(), err, pkg.ErrClientNotFound)
+	id, err := s.Store.CreateClient(s.ctx, pkg.Client{Name: "shop", LimitRPS: 10, Burst: 20, SigningSecret: "secret"}, "hash")
+	require.NoError(s.T(), err)
+	client, err := s.Store.GetClient(s.ctx, "hash")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.Client{ID: id, Name: "shop", LimitRPS: 10, Burst: 20, SigningSecret: "secret"}, client)
+	expires := time.Now().Add(time.Minute)
+	require.NoError(s.T(), s.Store.RegisterNonce(s.ctx, id, "n1", expires))
+	require.ErrorIs(s.T(), s.Store.RegisterNonce(s.ctx, id, "n1", expires), pkg.ErrNonceReused)
+	// nonces are per client and forgotten once expired
+	require.NoError(s.T(), s.Store.RegisterNonce(s.ctx, id+1, "n1", expires))
+	require.NoError(s.T(), s.Store.RegisterNonce(s.ctx, id, "n2", time.Now().Add(-time.Minute)))
+	require.NoError(s.T(), s.Store.RegisterNonce(s.ctx, id, "n2", expires))
+}
+
+func (s *Suite) TestIdempotencyKeys() {
+	_, reserved, err := s.Store.ReserveIdempotencyKey(s.ctx, 1, "1", "a")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	_, _, err = s.Store.ReserveIdempotencyKey(s.ctx, 1, "1", "a")
+	require.ErrorIs(s.T(), err, pkg.ErrRequestInProgress)
+	_, _, err = s.Store.ReserveIdempotencyKey(s.ctx, 1, "1", "b")
+	require.ErrorIs(s.T(), err, pkg.ErrKeyReused)
+	_, reserved, err = s.Store.ReserveIdempotencyKey(s.ctx, 2, "1", "b")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	require.NoError(s.T(), s.Store.SaveIdempotentResponse(s.ctx, 1, "1", 201, []byte(`{"code":201}`)))
+	// completed keys aren't released
+	require.NoError(s.T(), s.Store.ReleaseIdempotencyKey(s.ctx, 1, "1"))
+	record, reserved, err := s.Store.ReserveIdempotencyKey(s.ctx, 1, "1", "a")
+	require.NoError(s.T(), err)
+	require.False(s.T(), reserved)
+	require.Equal(s.T(), 201, record.Status)
+	require.Equal(s.T(), []byte(`{"code":201}`), record.Response)
+	require.NoError(s.T(), s.Store.ReleaseIdempotencyKey(s.ctx, 2, "1"))
+	_, reserved, err = s.Store.ReserveIdempotencyKey(s.ctx, 2, "1", "c")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	n, err := s.Store.PurgeIdempotencyKeys(s.ctx, time.Hour)
+	require.NoError(s.T(), err)
+	require.Zero(s.T(), n)
+	n, err = s.Store.PurgeIdempotencyKeys(s.ctx, -time.Minute)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(2), n)
+}
+
+func (s *Suite) TestBalances() {
+	wallet, receiver := s.wallet(1, "USD", 0), s.wallet(1, "USD", 0)
+	before := time.Now().Add(-time.Minute)
+	_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.Store.TransferFunds(s.ctx, wallet, receiver, pkg.NewAmount(3000, 2), "", "", "2")
+	require.NoError(s.T(), err)
+	for at, amount := range map[time.Time]int64{before: 0, time.Now().Add(time.Minute): 7000} {
+		balance, err := s.Store.BalanceAt(s.ctx, wallet, at)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), "USD", balance.Currency)
+		require.Equal(s.T(), pkg.NewAmount(amount, 2), balance.Amount, at)
+	}
+	_, err = s.Store.BalanceAt(s.ctx, uuid.New().String(), before)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	summary, err := s.Store.BalanceSummary(s.ctx, wallet, &today, &today)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.BalanceSummary{Opening: pkg.NewAmount(0, 2), Closing: pkg.NewAmount(7000, 2),
+		Credits: pkg.NewAmount(10000, 2), Debits: pkg.NewAmount(3000, 2)}, summary)
+	statement, err := s.Store.Statement(s.ctx, wallet, nil, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "USD", statement.Currency)
+	require.Len(s.T(), statement.Entries, 2)
+	require.Equal(s.T(), "1", statement.Entries[0].Key)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), statement.Opening)
+	require.Equal(s.T(), pkg.NewAmount(7000, 2), statement.Closing)
+	// postings before the period are in the opening balance
+	tomorrow := today.Add(24 * time.Hour)
+	statement, err = s.Store.Statement(s.ctx, wallet, &tomorrow, &tomorrow)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), statement.Entries)
+	require.Equal(s.T(), pkg.NewAmount(7000, 2), statement.Opening)
+	require.Equal(s.T(), statement.Opening, statement.Closing)
+}
+
+func (s *Suite) TestAggregateReport() {
+	wallet, receiver := s.wallet(1, "USD", 0), s.wallet(1, "USD", 0)
+	s.wallet(2, "USD", 5000)
+	for i, amount := range []int64{10000, 5000, -2000} {
+		_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(amount, 2), "", fmt.Sprintf("%d", i))
+		require.NoError(s.T(), err)
+	}
+	_, err := s.Store.TransferFunds(s.ctx, wallet, receiver, pkg.NewAmount(1000, 2), "", "", "transfer")
+	require.NoError(s.T(), err)
+	aggregates, err := s.Store.AggregateReport(s.ctx, wallet, 1, nil, nil, pgStore.PeriodMonth)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), aggregates, 3)
+	require.Equal(s.T(), pgStore.TransactionDeposit, aggregates[0].Type)
+	require.Equal(s.T(), int64(2), aggregates[0].Count)
+	require.Equal(s.T(), pkg.NewAmount(15000, 2), aggregates[0].Amount)
+	require.Equal(s.T(), pgStore.TransactionWithdrawal, aggregates[1].Type)
+	require.Equal(s.T(), pkg.NewAmount(2000, 2), aggregates[1].Amount)
+	require.Equal(s.T(), pgStore.TransactionTransferFunds, aggregates[2].Type)
+	require.Equal(s.T(), wallet, aggregates[2].Wallet)
+	now := time.Now().UTC()
+	require.Equal(s.T(), time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), aggregates[0].Period.UTC())
+	// across all wallets of the owner both sides of the transfer are there
+	aggregates, err = s.Store.AggregateReport(s.ctx, "", 1, nil, nil, pgStore.PeriodWeek)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), aggregates, 4)
+	require.Equal(s.T(), pgStore.TransactionTransferFundsTo, aggregates[3].Type)
+	require.Empty(s.T(), aggregates[3].Wallet)
+	require.Equal(s.T(), time.Monday, aggregates[0].Period.Weekday())
+	tomorrow := now.Add(24 * time.Hour)
+	aggregates, err = s.Store.AggregateReport(s.ctx, "", 1, &tomorrow, nil, pgStore.PeriodDay)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), aggregates)
+	_, err = s.Store.AggregateReport(s.ctx, wallet, 1, nil, nil, "year")
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidPeriod)
+}
+
+func (s *Suite) TestWebhookOutbox() {
+	wallet, sender := s.wallet(1, "USD", 0), s.wallet(2, "USD", 10000)
+	hook, err := s.Store.CreateWebhook(s.ctx, 1, "https://example.com/hook",
+		[]string{string(pkg.EventDepositSucceeded), string(pkg.EventTransferReceived)}, "secret")
+	require.NoError(s.T(), err)
+	require.True(s.T(), hook.Active)
+	require.Equal(s.T(), "secret", hook.Secret)
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	// events of failed transactions are rolled back with them
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100000, 2), "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.Store.TransferFunds(s.ctx, sender, wallet, pkg.NewAmount(1000, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	deliveries, err := s.Store.WebhookDeliveries(s.ctx, 1, hook.ID)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), deliveries, 2)
+	require.Equal(s.T(), pkg.EventTransferReceived, deliveries[0].EventType)
+	require.Equal(s.T(), pkg.EventDepositSucceeded, deliveries[1].EventType)
+	_, err = s.Store.WebhookDeliveries(s.ctx, 2, hook.ID)
+	require.ErrorIs(s.T(), err, pkg.ErrWebhookNotFound)
+
+	claimed, err := s.Store.ClaimWebhookDeliveries(s.ctx, 10, time.Minute)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), claimed, 2)
+	for _, d := range claimed {
+		require.Equal(s.T(), 1, d.Attempts)
+		require.Equal(s.T(), "https://example.com/hook", d.URL)
+		require.Equal(s.T(), "secret", d.Secret)
+		require.Contains(s.T(), string(d.Payload), wallet)
+	}
+	again, err := s.Store.ClaimWebhookDeliveries(s.ctx, 10, time.Minute)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), again)
+	require.NoError(s.T(), s.Store.CompleteWebhookDelivery(s.ctx, claimed[0].ID, pkg.DeliverySucceeded, 200, "", 0))
+	require.NoError(s.T(), s.Store.CompleteWebhookDelivery(s.ctx, claimed[1].ID, pkg.DeliveryFailed, 500, "err", 0))
+
+	_, err = s.Store.RedeliverWebhook(s.ctx, 2, hook.ID, claimed[1].ID)
+	require.ErrorIs(s.T(), err, pkg.ErrDeliveryNotFound)
+	redelivered, err := s.Store.RedeliverWebhook(s.ctx, 1, hook.ID, claimed[1].ID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.DeliveryPending, redelivered.Status)
+	require.Equal(s.T(), 0, redelivered.Attempts)
+	again, err = s.Store.ClaimWebhookDeliveries(s.ctx, 10, time.Minute)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), again, 1)
+	require.Equal(s.T(), claimed[1].ID, again[0].ID)
+
+	hooks, err := s.Store.ListWebhooks(s.ctx, 1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), hooks, 1)
+	require.Empty(s.T(), hooks[0].Secret)
+	require.NoError(s.T(), s.Store.DeleteWebhook(s.ctx, 1, hook.ID))
+	require.ErrorIs(s.T(), s.Store.DeleteWebhook(s.ctx, 1, hook.ID), pkg.ErrWebhookNotFound)
+	hooks, err = s.Store.ListWebhooks(s.ctx, 1)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), hooks)
+	// inactive webhooks get no more events
+	_, err = s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(100, 2), "", "4")
+	require.NoError(s.T(), err)
+	deliveries, err = s.Store.WebhookDeliveries(s.ctx, 1, hook.ID)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), deliveries, 2)
+}
+
+func (s *Suite) TestWalletActivity() {
+	wallet := s.wallet(1, "USD", 0)
+	activity, unsubscribe := s.Store.SubscribeWallet(wallet)
+	defer unsubscribe()
+	for i := 0; i < 3; i++ {
+		_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", fmt.Sprintf("%d", i))
+		require.NoError(s.T(), err)
+		select {
+		case <-activity:
+		case <-time.After(5 * time.Second):
+			s.T().Fatal("no notification of a committed deposit")
+		}
+	}
+	// failed transactions aren't notified
+	_, err := s.Store.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100000, 2), "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	select {
+	case <-activity:
+		s.T().Fatal("notified of a failed withdrawal")
+	case <-time.After(200 * time.Millisecond):
+	}
+	all, err := s.Store.TransactionsAfter(s.ctx, wallet, 0, 10)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), all, 3)
+	after, err := s.Store.TransactionsAfter(s.ctx, wallet, all[0].PostingID, 1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), after, 1)
+	require.Equal(s.T(), all[1].PostingID, after[0].PostingID)
+}
@@ -14,10 +14,24 @@ import (
 type PaymentsHTTPClient struct {
 	ConnHTTP *http.Client
 	Host     string
+	APIKey   string
+	Secret   string
+}
+
+func (c *PaymentsHTTPClient) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(rest.APIKeyHeader, c.APIKey)
+	if err = rest.SignRequest(req, c.Secret); err != nil {
+		return nil, err
+	}
+	return req, nil
 }
 
 func (c *PaymentsHTTPClient) CreateWallet(ctx context.Context, wallet string) int {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/createWallet?wallet=%s", c.Host, wallet), nil)
+	req, err := c.newRequest(ctx, fmt.Sprintf("%s/v1/createWallet?wallet=%s", c.Host, wallet))
 	if err != nil {
 		return http.StatusInternalServerError
 	}
@@ -32,7 +46,7 @@ func (c *PaymentsHTTPClient) CreateWallet(ctx context.Context, wallet string) in
 }
 
 func (c *PaymentsHTTPClient) GetWallet(ctx context.Context, wallet string) (*pkg.Wallet, string, int) {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/getWallet?wallet=%s", c.Host, wallet), nil)
+	req, err := c.newRequest(ctx, fmt.Sprintf("%s/v1/getWallet?wallet=%s", c.Host, wallet))
 	if err != nil {
 		return nil, "", http.StatusInternalServerError
 	}
@@ -59,8 +73,8 @@ func (c *PaymentsHTTPClient) GetWallet(ctx context.Context, wallet string) (*pkg
 	return nil, *response.Error, resp.StatusCode
 }
 
-func (c *PaymentsHTTPClient) Deposit(ctx context.Context, wallet string, amount float64, key string) int {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/deposit?wallet=%s&amount=%f&key=%s", c.Host, wallet, amount, key), nil)
+func (c *PaymentsHTTPClient) Deposit(ctx context.Context, wallet string, amount pkg.Amount, key string) int {
+	req, err := c.newRequest(ctx, fmt.Sprintf("%s/v1/deposit?wallet=%s&amount=%s&key=%s", c.Host, wallet, amount, key))
 	if err != nil {
 		return http.StatusInternalServerError
 	}
@@ -74,8 +88,8 @@ func (c *PaymentsHTTPClient) Deposit(ctx context.Context, wallet string, amount
 	return resp.StatusCode
 }
 
-func (c *PaymentsHTTPClient) Withdraw(ctx context.Context, wallet string, amount float64, key string) int {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/withdraw?wallet=%s&amount=%f&key=%s", c.Host, wallet, amount, key), nil)
+func (c *PaymentsHTTPClient) Withdraw(ctx context.Context, wallet string, amount pkg.Amount, key string) int {
+	req, err := c.newRequest(ctx, fmt.Sprintf("%s/v1/withdraw?wallet=%s&amount=%s&key=%s", c.Host, wallet, amount, key))
 	if err != nil {
 		return http.StatusInternalServerError
 	}
@@ -89,8 +103,8 @@ func (c *PaymentsHTTPClient) Withdraw(ctx context.Context, wallet string, amount
 	return resp.StatusCode
 }
 
-func (c *PaymentsHTTPClient) TransferFunds(ctx context.Context, from, to string, amount float64, key string) int {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/transferFunds?from=%s&to=%s&amount=%f&key=%s", c.Host, from, to, amount, key), nil)
+func (c *PaymentsHTTPClient) TransferFunds(ctx context.Context, from, to string, amount pkg.Amount, key string) int {
+	req, err := c.newRequest(ctx, fmt.Sprintf("%s/v1/transferFunds?from=%s&to=%s&amount=%s&key=%s", c.Host, from, to, amount, key))
 	if err != nil {
 		return http.StatusInternalServerError
 	}
@@ -106,7 +120,7 @@ func (c *PaymentsHTTPClient) TransferFunds(ctx context.Context, from, to string,
 
 func (c *PaymentsHTTPClient) Report(ctx context.Context, wallet string, from, to time.Time, tType int) ([]pgStore.Transaction, string, int) {
 	host := fmt.Sprintf("%s/v1/report?wallet=%s&from=%s&to=%s&type=%d", c.Host, wallet, from.Format(rest.DateFmt), to.Format(rest.DateFmt), tType)
-	req, err := http.NewRequestWithContext(ctx, "GET", host, nil)
+	req, err := c.newRequest(ctx, host)
 	if err != nil {
 		return nil, "", http.StatusInternalServerError
 	}
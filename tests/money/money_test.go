@@ -0,0 +1,241 @@
+package money_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gocarina/gocsv"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"payment-system/pkg"
+	"testing"
+)
+
+type MoneySuite struct {
+	suite.Suite
+}
+
+func (s *MoneySuite) TestParseAmount() {
+	valid := map[string]pkg.Amount{
+		"10":       pkg.NewAmount(10, 0),
+		"10.5":     pkg.NewAmount(105, 1),
+		"10.05":    pkg.NewAmount(1005, 2),
+		"-0.01":    pkg.NewAmount(-1, 2),
+		"007.10":   pkg.NewAmount(710, 2),
+		"0":        pkg.NewAmount(0, 0),
+		"92233.72": pkg.NewAmount(9223372, 2),
+	}
+	for in, expected := range valid {
+		a, err := pkg.ParseAmount(in, 2)
+		require.NoError(s.T(), err, in)
+		require.Equal(s.T(), expected, a, in)
+	}
+	for _, in := range []string{"", "-", ".5", "5.", "1e3", "0x10", "1,5", " 1", "+1", "NaN", "Inf", "1.2.3", "1234567890123456789"} {
+		_, err := pkg.ParseAmount(in, 2)
+		require.ErrorIs(s.T(), err, pkg.ErrInvalidAmount, in)
+	}
+	_, err := pkg.ParseAmount("0.001", 2)
+	require.ErrorIs(s.T(), err, pkg.ErrAmountPrecision)
+	_, err = pkg.ParseAmount("1.000", 2)
+	require.ErrorIs(s.T(), err, pkg.ErrAmountPrecision)
+}
+
+func (s *MoneySuite) TestArithmetics() {
+	a := pkg.NewAmount(1005, 2)
+	b := pkg.NewAmount(5, 1)
+	require.Equal(s.T(), pkg.NewAmount(1055, 2), a.Add(b))
+	require.Equal(s.T(), pkg.NewAmount(955, 2), a.Sub(b))
+	require.Equal(s.T(), pkg.NewAmount(-1005, 2), a.Neg())
+	require.Equal(s.T(), 1, a.Cmp(b))
+	require.Equal(s.T(), 0, pkg.NewAmount(50, 2).Cmp(b))
+	require.Equal(s.T(), -1, b.Neg().Sign())
+	r, err := b.Rescale(3)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(500, 3), r)
+	r, err = pkg.NewAmount(1000, 2).Rescale(0)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(10, 0), r)
+	_, err = a.Rescale(1)
+	require.Equal(s.T(), pkg.ErrAmountPrecision, err)
+	_, err = pkg.NewAmount(922337203685477580, 0).Rescale(2)
+	require.Equal(s.T(), pkg.ErrInvalidAmount, err)
+	// values too big for the common scale saturate rather than turn into zero or overflow
+	huge := pkg.NewAmount(922337203685477580, 0)
+	require.Equal(s.T(), 1, huge.Cmp(pkg.NewAmount(1, 2)))
+	require.Equal(s.T(), -1, huge.Neg().Cmp(pkg.NewAmount(-1, 2)))
+	require.Equal(s.T(), pkg.NewAmount(1<<63-1, 2), huge.Add(pkg.NewAmount(1, 2)))
+	require.Equal(s.T(), pkg.NewAmount(1<<63-1, 0), pkg.NewAmount(1<<63-1, 0).Add(pkg.NewAmount(1, 0)))
+}
+
+func (s *MoneySuite) TestConvert() {
+	for _, c := range []struct {
+		amount, rate pkg.Amount
+		scale        uint8
+		expected     pkg.Amount
+	}{
+		{pkg.NewAmount(1005, 2), pkg.NewAmount(11012, 2), 0, pkg.NewAmount(1107, 0)},
+		{pkg.NewAmount(1000, 2), pkg.NewAmount(3012, 4), 3, pkg.NewAmount(3012, 3)},
+		{pkg.NewAmount(100, 2), pkg.NewAmount(5, 1), 2, pkg.NewAmount(50, 2)},
+		{pkg.NewAmount(1, 2), pkg.NewAmount(5, 1), 2, pkg.NewAmount(1, 2)},
+		{pkg.NewAmount(-1, 2), pkg.NewAmount(5, 1), 2, pkg.NewAmount(-1, 2)},
+		{pkg.NewAmount(1, 2), pkg.NewAmount(4, 1), 2, pkg.NewAmount(0, 2)},
+		{pkg.NewAmount(7, 0), pkg.NewAmount(15, 1), 3, pkg.NewAmount(10500, 3)},
+	} {
+		result, err := c.amount.Convert(c.rate, c.scale)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), c.expected, result, "%s * %s", c.amount, c.rate)
+	}
+	_, err := pkg.NewAmount(1<<62, 0).Convert(pkg.NewAmount(4, 0), 0)
+	require.Equal(s.T(), pkg.ErrInvalidAmount, err)
+}
+
+// TestInCurrency checks amounts are rescaled to the currency and fit numeric(18, 3) columns
+func (s *MoneySuite) TestInCurrency() {
+	for _, c := range []struct {
+		amount   pkg.Amount
+		currency string
+		expected pkg.Amount
+		err      error
+	}{
+		{pkg.NewAmount(105, 1), "USD", pkg.NewAmount(1050, 2), nil},
+		{pkg.NewAmount(10, 0), "KWD", pkg.NewAmount(10000, 3), nil},
+		{pkg.NewAmount(105, 1), "JPY", pkg.Amount{}, pkg.ErrAmountPrecision},
+		{pkg.NewAmount(99999999999999999, 2), "USD", pkg.NewAmount(99999999999999999, 2), nil},
+		{pkg.NewAmount(-999999999999999999, 3), "KWD", pkg.NewAmount(-999999999999999999, 3), nil},
+		{pkg.NewAmount(1000000000000000, 0), "USD", pkg.Amount{}, pkg.ErrInvalidAmount},
+		{pkg.NewAmount(-1000000000000000, 0), "JPY", pkg.Amount{}, pkg.ErrInvalidAmount},
+		{pkg.NewAmount(1000000000000000, 0), "KWD", pkg.Amount{}, pkg.ErrInvalidAmount},
+	} {
+		result, err := pkg.InCurrency(c.amount, c.currency)
+		require.Equal(s.T(), c.err, err, "%s %s", c.amount, c.currency)
+		require.Equal(s.T(), c.expected, result, "%s %s", c.amount, c.currency)
+	}
+}
+
+func (s *MoneySuite) TestEncoding() {
+	for in, expected := range map[pkg.Amount]string{
+		pkg.NewAmount(1005, 2): "10.05",
+		pkg.NewAmount(-5, 2):   "-0.05",
+		pkg.NewAmount(5, 3):    "0.005",
+		pkg.NewAmount(12, 0):   "12",
+		pkg.NewAmount(0, 2):    "0.00",
+		pkg.NewAmount(-100, 1): "-10.0",
+	} {
+		require.Equal(s.T(), expected, in.String())
+	}
+	type row struct {
+		Amount pkg.Amount `json:"amount" csv:"AMOUNT"`
+	}
+	data, err := json.Marshal(row{Amount: pkg.NewAmount(1005, 2)})
+	require.NoError(s.T(), err)
+	require.JSONEq(s.T(), `{"amount":"10.05"}`, string(data))
+	var decoded row
+	require.NoError(s.T(), json.Unmarshal(data, &decoded))
+	require.Equal(s.T(), pkg.NewAmount(1005, 2), decoded.Amount)
+	require.NoError(s.T(), json.Unmarshal([]byte(`{"amount":0.1}`), &decoded))
+	require.Equal(s.T(), pkg.NewAmount(1, 1), decoded.Amount)
+	require.Error(s.T(), json.Unmarshal([]byte(`{"amount":1e-1}`), &decoded))
+	csv, err := gocsv.MarshalBytes([]row{{Amount: pkg.NewAmount(-1005, 2)}})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "AMOUNT\n-10.05\n", string(csv))
+	// pgx hands numerics to sql.Scanner as mantissa and exponent
+	var scanned pkg.Amount
+	require.NoError(s.T(), scanned.Scan("100057e-2"))
+	require.Equal(s.T(), pkg.NewAmount(100057, 2), scanned)
+	require.NoError(s.T(), scanned.Scan("1000.57"))
+	require.Equal(s.T(), pkg.NewAmount(100057, 2), scanned)
+	require.NoError(s.T(), scanned.Scan("12e2"))
+	require.Equal(s.T(), pkg.NewAmount(1200, 0), scanned)
+	value, err := pkg.NewAmount(-1005, 2).Value()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "-10.05", value)
+}
+
+func (s *MoneySuite) TestFee() {
+	// 1.5% but at least 0.30 and at most 5.00
+	rule := pkg.FeeRule{Percent: pkg.NewAmount(15, 1), Min: pkg.NewAmount(30, 2), Max: pkg.NewAmount(500, 2)}
+	cases := map[pkg.Amount]pkg.Amount{
+		pkg.NewAmount(100, 2):    pkg.NewAmount(30, 2),
+		pkg.NewAmount(10050, 2):  pkg.NewAmount(151, 2),
+		pkg.NewAmount(100000, 2): pkg.NewAmount(500, 2),
+	}
+	for amount, expected := range cases {
+		fee, err := rule.Fee(amount, 2)
+		require.NoError(s.T(), err, amount.String())
+		require.Equal(s.T(), expected, fee, amount.String())
+	}
+	// flat 0.25 plus 1%, no cap
+	rule = pkg.FeeRule{Flat: pkg.NewAmount(250, 3), Percent: pkg.NewAmount(1, 0)}
+	fee, err := rule.Fee(pkg.NewAmount(100000, 2), 2)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(1025, 2), fee)
+	fee, err = rule.Fee(pkg.NewAmount(1000, 0), 0)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(10, 0), fee)
+	fee, err = pkg.FeeRule{}.Fee(pkg.NewAmount(1000, 2), 2)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), fee)
+}
+
+func (s *MoneySuite) TestSplit() {
+	amount := func(units int64, scale uint8) *pkg.Amount {
+		a := pkg.NewAmount(units, scale)
+		return &a
+	}
+	to := "00000000-0000-4000-8000-000000000001"
+	cases := []struct {
+		amount   pkg.Amount
+		parts    []pkg.SplitPart
+		expected []pkg.Amount
+	}{
+		// thirds, the unit left goes to the largest remainder
+		{pkg.NewAmount(10000, 2), []pkg.SplitPart{
+			{To: to, Percent: amount(33333333, 6)}, {To: to, Percent: amount(33333333, 6)}, {To: to, Percent: amount(33333334, 6)},
+		}, []pkg.Amount{pkg.NewAmount(3333, 2), pkg.NewAmount(3333, 2), pkg.NewAmount(3334, 2)}},
+		// equal remainders, the first share gets the unit
+		{pkg.NewAmount(3, 2), []pkg.SplitPart{
+			{To: to, Percent: amount(50, 0)}, {To: to, Percent: amount(50, 0)},
+		}, []pkg.Amount{pkg.NewAmount(2, 2), pkg.NewAmount(1, 2)}},
+		// percents share what is left after amounts
+		{pkg.NewAmount(10000, 2), []pkg.SplitPart{
+			{To: to, Percent: amount(90, 0)}, {To: to, Percent: amount(10, 0)}, {To: to, Amount: amount(825, 2)},
+		}, []pkg.Amount{pkg.NewAmount(8258, 2), pkg.NewAmount(917, 2), pkg.NewAmount(825, 2)}},
+		{pkg.NewAmount(1000, 0), []pkg.SplitPart{
+			{To: to, Amount: amount(7000, 1)}, {To: to, Amount: amount(3000, 1)},
+		}, []pkg.Amount{pkg.NewAmount(700, 0), pkg.NewAmount(300, 0)}},
+	}
+	for _, c := range cases {
+		shares, err := pkg.Split(c.amount, c.parts)
+		require.NoError(s.T(), err, c.amount.String())
+		require.Equal(s.T(), c.expected, shares, c.amount.String())
+	}
+	failures := []struct {
+		amount pkg.Amount
+		parts  []pkg.SplitPart
+		index  int
+		err    error
+	}{
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Amount: amount(99, 2)}}, -1, pkg.ErrSplitTotal},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Amount: amount(101, 2)}, {To: to, Percent: amount(100, 0)}}, -1, pkg.ErrSplitTotal},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Percent: amount(60, 0)}, {To: to, Percent: amount(39, 0)}}, -1, pkg.ErrSplitTotal},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Percent: amount(60, 0)}, {To: to}}, 1, pkg.ErrInvalidSplit},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Amount: amount(1, 0), Percent: amount(100, 0)}}, 0, pkg.ErrInvalidSplit},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Percent: amount(101, 0)}}, 0, pkg.ErrInvalidPercent},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Amount: amount(100, 2)}, {To: to, Percent: amount(0, 0)}}, 1, pkg.ErrInvalidPercent},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Percent: amount(1, 7)}}, 0, pkg.ErrAmountPrecision},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Amount: amount(1, 3)}}, 0, pkg.ErrAmountPrecision},
+		{pkg.NewAmount(100, 2), []pkg.SplitPart{{To: to, Amount: amount(-1, 2)}}, 0, pkg.ErrInvalidAmount},
+		// 0.01 can't be split in halves
+		{pkg.NewAmount(1, 2), []pkg.SplitPart{{To: to, Percent: amount(50, 0)}, {To: to, Percent: amount(50, 0)}}, 1, pkg.ErrInvalidAmount},
+	}
+	for i, c := range failures {
+		_, err := pkg.Split(c.amount, c.parts)
+		require.ErrorIs(s.T(), err, c.err, i)
+		errPart := pkg.ErrBatchLeg{Index: -1}
+		errors.As(err, &errPart)
+		require.Equal(s.T(), c.index, errPart.Index, i)
+	}
+}
+
+func TestMoneySuite(t *testing.T) {
+	suite.Run(t, new(MoneySuite))
+}
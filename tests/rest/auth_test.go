@@ -0,0 +1,249 @@
+package rest_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"payment-system/pkg"
+	"payment-system/pkg/rest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "test-api-key"
+const testSigningSecret = "test-signing-secret"
+
+type AuthSuite struct {
+	router http.Handler
+	suite.Suite
+}
+
+func (s *AuthSuite) SetupSuite() {
+	log := &logrus.Logger{}
+	cs := NewFakeClientStore(pkg.Client{ID: 0, Name: "test", LimitRPS: 100, SigningSecret: testSigningSecret})
+	s.router = rest.NewRouter(log, cs, FakeStore{}, "test", rest.Options{SignatureSkew: time.Minute})
+}
+
+func (s *AuthSuite) TestAuth() {
+	host := fmt.Sprintf("/v1/getWallet?wallet=%s", uuid.New().String())
+	code := s.processGet(s.newRequest(host, ""))
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	code = s.processGet(s.newRequest(host, "rubbish"))
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	code = s.processGet(s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusOK, code)
+	code = s.processGet(s.newRequest("/ping", ""))
+	require.Equal(s.T(), http.StatusOK, code)
+}
+
+func (s *AuthSuite) TestSignature() {
+	host := fmt.Sprintf("/v1/deposit?wallet=%s&amount=10&key=a", uuid.New().String())
+	// unsigned
+	code := s.processGet(s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	// signed
+	req := s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusOK, code)
+	// replayed
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	// wrong secret
+	req = s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, "rubbish"))
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	// tampered query
+	req = s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	req.URL.RawQuery += "0"
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	// stale and future timestamps
+	req = s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequestAt(req, testSigningSecret, time.Now().Add(-2*time.Minute), "stale"))
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	req = s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequestAt(req, testSigningSecret, time.Now().Add(2*time.Minute), "future"))
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	// within the window
+	req = s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequestAt(req, testSigningSecret, time.Now().Add(-30*time.Second), "recent"))
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusOK, code)
+	// bodies too large to be signed whole are rejected rather than signed in part
+	large := strings.Repeat("a", 1<<20+1)
+	req = s.newRequest(host, testAPIKey)
+	req.Body = ioutil.NopCloser(strings.NewReader(large))
+	require.ErrorIs(s.T(), rest.SignRequest(req, testSigningSecret), rest.ErrBodyTooLarge)
+	req = s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	req.Body = ioutil.NopCloser(strings.NewReader(large))
+	code = s.processGet(req)
+	require.Equal(s.T(), http.StatusRequestEntityTooLarge, code)
+}
+
+func (s *AuthSuite) TestRateLimit() {
+	const otherAPIKey = "other-api-key"
+	cs := NewFakeClientStore(pkg.Client{ID: 0, Name: "limited", LimitRPS: 1, Burst: 3})
+	cs.clients[rest.HashAPIKey(otherAPIKey)] = pkg.Client{ID: 1, Name: "other", LimitRPS: 1, Burst: 3}
+	router := rest.NewRouter(&logrus.Logger{}, cs, FakeStore{}, "test", rest.Options{})
+	host := fmt.Sprintf("/v1/getWallet?wallet=%s", uuid.New().String())
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, s.newRequest(host, testAPIKey))
+		require.Equal(s.T(), http.StatusOK, w.Code)
+		require.Equal(s.T(), "1", w.Header().Get("X-RateLimit-Limit"))
+		require.Equal(s.T(), fmt.Sprintf("%d", 2-i), w.Header().Get("X-RateLimit-Remaining"))
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusTooManyRequests, w.Code)
+	require.Equal(s.T(), "1", w.Header().Get("Retry-After"))
+	require.Equal(s.T(), "0", w.Header().Get("X-RateLimit-Remaining"))
+	require.NotEmpty(s.T(), w.Header().Get("X-RateLimit-Reset"))
+	// another client of the same router has a bucket of its own
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, s.newRequest(fmt.Sprintf("/v1/createWallet?wallet=%s&currency=USD", uuid.New().String()), otherAPIKey))
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Equal(s.T(), "2", w.Header().Get("X-RateLimit-Remaining"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusTooManyRequests, w.Code)
+}
+
+func (s *AuthSuite) TestAdminOnly() {
+	host := fmt.Sprintf("/v1/admin/walletStatusHistory?wallet=%s", uuid.New().String())
+	code := s.processGet(s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusForbidden, code)
+	cs := NewFakeClientStore(pkg.Client{ID: 1, Name: "admin", LimitRPS: 100, SigningSecret: testSigningSecret, Admin: true})
+	router := rest.NewRouter(&logrus.Logger{}, cs, FakeStore{}, "test", rest.Options{SignatureSkew: time.Minute})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	// status changes must be signed
+	host = fmt.Sprintf("/v1/admin/setWalletStatus?wallet=%s&status=frozen_all&reason=fraud", uuid.New().String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, s.newRequest(host, testAPIKey))
+	require.Equal(s.T(), http.StatusUnauthorized, w.Code)
+	req := s.newRequest(host, testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(s.T(), http.StatusOK, w.Code)
+}
+
+// TestRefundWithdrawal checks only admins refund withdrawals, as the refund returns money paid out
+func (s *AuthSuite) TestRefundWithdrawal() {
+	req := s.newRequest("/v1/refund?original=withdrawal&key=r1", testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	require.Equal(s.T(), http.StatusForbidden, s.processGet(req))
+	req = s.newRequest("/v1/admin/refund?original=withdrawal&key=r1", testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	require.Equal(s.T(), http.StatusForbidden, s.processGet(req))
+	cs := NewFakeClientStore(pkg.Client{ID: 1, Name: "admin", LimitRPS: 100, SigningSecret: testSigningSecret, Admin: true})
+	router := rest.NewRouter(&logrus.Logger{}, cs, FakeStore{}, "test", rest.Options{SignatureSkew: time.Minute})
+	req = s.newRequest("/v1/admin/refund?original=withdrawal&key=r2", testAPIKey)
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(s.T(), http.StatusOK, w.Code)
+}
+
+func (s *AuthSuite) newRequest(host, apiKey string) *http.Request {
+	req, err := http.NewRequest("GET", host, nil)
+	require.NoError(s.T(), err)
+	if apiKey != "" {
+		req.Header.Set(rest.APIKeyHeader, apiKey)
+	}
+	return req
+}
+
+func (s *AuthSuite) processGet(req *http.Request) int {
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w.Result().StatusCode
+}
+
+func TestAuthSuite(t *testing.T) {
+	suite.Run(t, new(AuthSuite))
+}
+
+type FakeClientStore struct {
+	clients map[string]pkg.Client
+	mx      sync.Mutex
+	nonces  map[string]struct{}
+	keys    map[string]pkg.IdempotencyRecord
+}
+
+// NewFakeClientStore registers client given with testAPIKey
+func NewFakeClientStore(client pkg.Client) *FakeClientStore {
+	return &FakeClientStore{
+		clients: map[string]pkg.Client{rest.HashAPIKey(testAPIKey): client},
+		nonces:  make(map[string]struct{}),
+		keys:    make(map[string]pkg.IdempotencyRecord),
+	}
+}
+
+func (f *FakeClientStore) GetClient(_ context.Context, apiKeyHash string) (pkg.Client, error) {
+	if c, ok := f.clients[apiKeyHash]; ok {
+		return c, nil
+	}
+	return pkg.Client{}, pkg.ErrClientNotFound
+}
+
+func (f *FakeClientStore) RegisterNonce(_ context.Context, clientID int, nonce string, _ time.Time) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	key := fmt.Sprintf("%d:%s", clientID, nonce)
+	if _, ok := f.nonces[key]; ok {
+		return pkg.ErrNonceReused
+	}
+	f.nonces[key] = struct{}{}
+	return nil
+}
+
+func (f *FakeClientStore) ReserveIdempotencyKey(_ context.Context, clientID int, key, fingerprint string) (pkg.IdempotencyRecord, bool, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	id := fmt.Sprintf("%d:%s", clientID, key)
+	record, ok := f.keys[id]
+	switch {
+	case !ok:
+		f.keys[id] = pkg.IdempotencyRecord{ClientID: clientID, Key: key, Fingerprint: fingerprint}
+		return pkg.IdempotencyRecord{}, true, nil
+	case record.Fingerprint != fingerprint:
+		return record, false, pkg.ErrKeyReused
+	case record.Status == 0:
+		return record, false, pkg.ErrRequestInProgress
+	}
+	return record, false, nil
+}
+
+func (f *FakeClientStore) SaveIdempotentResponse(_ context.Context, clientID int, key string, status int, response []byte) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	id := fmt.Sprintf("%d:%s", clientID, key)
+	record := f.keys[id]
+	record.Status, record.Response = status, response
+	f.keys[id] = record
+	return nil
+}
+
+func (f *FakeClientStore) ReleaseIdempotencyKey(_ context.Context, clientID int, key string) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	delete(f.keys, fmt.Sprintf("%d:%s", clientID, key))
+	return nil
+}
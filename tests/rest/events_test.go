@@ -0,0 +1,137 @@
+package rest_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"payment-system/pkg"
+	"payment-system/pkg/rest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type EventsSuite struct {
+	server *httptest.Server
+	suite.Suite
+}
+
+func (s *EventsSuite) SetupSuite() {
+	cs := NewFakeClientStore(pkg.Client{ID: 0, Name: "test", LimitRPS: 100, Burst: 100, SigningSecret: testSigningSecret})
+	s.server = httptest.NewServer(rest.NewRouter(&logrus.Logger{}, cs, FakeStore{}, "test", rest.Options{ExportTimeout: 100 * time.Millisecond}))
+}
+
+func (s *EventsSuite) TearDownSuite() {
+	s.server.Close()
+}
+
+type sseEvent struct {
+	id, event, data string
+}
+
+func (s *EventsSuite) TestWalletEvents() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp := s.get(ctx, uuid.New().String(), "1")
+	defer resp.Body.Close()
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), "text/event-stream", resp.Header.Get("Content-Type"))
+	events := make(chan sseEvent)
+	go readEvents(resp, events)
+
+	// missed transactions after Last-Event-ID are sent first, then the balance
+	e := <-events
+	require.Equal(s.T(), sseEvent{id: "2", event: "transaction"}, sseEvent{id: e.id, event: e.event})
+	require.Contains(s.T(), e.data, `"posting_id":2`)
+	require.Equal(s.T(), "3", (<-events).id)
+	e = <-events
+	require.Equal(s.T(), "balance", e.event)
+	require.Empty(s.T(), e.id)
+
+	atomic.AddInt64(&fakeLatestPosting, 1)
+	fakeActivity <- struct{}{}
+	e = <-events
+	require.Equal(s.T(), sseEvent{id: "4", event: "transaction"}, sseEvent{id: e.id, event: e.event})
+	require.Equal(s.T(), "balance", (<-events).event)
+}
+
+// TestWalletEventsStayOpen checks streams aren't limited by request or export timeouts
+func (s *EventsSuite) TestWalletEventsStayOpen() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp := s.get(ctx, uuid.New().String(), strconv.FormatInt(atomic.LoadInt64(&fakeLatestPosting), 10))
+	defer resp.Body.Close()
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	events := make(chan sseEvent)
+	go readEvents(resp, events)
+	require.Equal(s.T(), "balance", (<-events).event)
+
+	time.Sleep(300 * time.Millisecond)
+	atomic.AddInt64(&fakeLatestPosting, 1)
+	fakeActivity <- struct{}{}
+	e, ok := <-events
+	require.True(s.T(), ok)
+	require.Equal(s.T(), "transaction", e.event)
+	require.Equal(s.T(), "balance", (<-events).event)
+}
+
+func (s *EventsSuite) TestWalletEventsErrors() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp := s.get(ctx, notFoundWallet, "")
+	require.NoError(s.T(), resp.Body.Close())
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+	resp = s.get(ctx, "rubbish", "")
+	require.NoError(s.T(), resp.Body.Close())
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+	resp = s.get(ctx, uuid.New().String(), "rubbish")
+	require.NoError(s.T(), resp.Body.Close())
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *EventsSuite) get(ctx context.Context, wallet, lastEventID string) *http.Response {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/wallets/%s/events", s.server.URL, wallet), nil)
+	require.NoError(s.T(), err)
+	req.Header.Set(rest.APIKeyHeader, testAPIKey)
+	if lastEventID != "" {
+		req.Header.Set(rest.LastEventIDHeader, lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(s.T(), err)
+	return resp
+}
+
+// readEvents parses the stream into events skipping comments and the retry field
+func readEvents(resp *http.Response, events chan<- sseEvent) {
+	defer close(events)
+	scanner := bufio.NewScanner(resp.Body)
+	var e sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if e.event != "" {
+				events <- e
+			}
+			e = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventsSuite(t *testing.T) {
+	suite.Run(t, new(EventsSuite))
+}
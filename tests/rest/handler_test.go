@@ -2,6 +2,8 @@ package rest_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -13,13 +15,13 @@ import (
 	"payment-system/pkg"
 	"payment-system/pkg/pgStore"
 	"payment-system/pkg/rest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-// TODO update tests after auth
-
 type RESTSuite struct {
 	h *rest.Handler
 	suite.Suite
@@ -28,7 +30,7 @@ type RESTSuite struct {
 func (s *RESTSuite) SetupSuite() {
 	log := &logrus.Logger{}
 	fs := FakeStore{}
-	s.h = rest.NewHandler(log, fs)
+	s.h = rest.NewHandler(log, fs, rest.Options{})
 }
 
 func (s *RESTSuite) TestGetWallet() {
@@ -58,6 +60,12 @@ func (s *RESTSuite) TestCreateWallet() {
 	host := "/createWallet?wallet=rubbish"
 	code, _ := s.processGetWithHandler(host, s.h.CreateWallet)
 	require.Equal(s.T(), code, http.StatusBadRequest)
+	host = fmt.Sprintf("/createWallet?wallet=%s&currency=XXX", uuid.New().String())
+	code, _ = s.processGetWithHandler(host, s.h.CreateWallet)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	host = fmt.Sprintf("/createWallet?wallet=%s&currency=jpy", uuid.New().String())
+	code, _ = s.processGetWithHandler(host, s.h.CreateWallet)
+	require.Equal(s.T(), code, http.StatusOK)
 	host = "/createWallet?wallet="
 	code, _ = s.processGetWithHandler(host, s.h.CreateWallet)
 	require.Equal(s.T(), code, http.StatusBadRequest)
@@ -87,6 +95,20 @@ func (s *RESTSuite) TestDeposit() {
 	require.Equal(s.T(), code, http.StatusBadRequest)
 	code, _ = s.processGetWithHandler(host+"&amount=asda", s.h.Deposit)
 	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=0.001&currency=USD", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=0.0001", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=10.5&currency=JPY", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=10&currency=XXX", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=1e3", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=922337203685477580", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(host+"&amount=1000000000000000", s.h.Deposit)
+	require.Equal(s.T(), code, http.StatusBadRequest)
 	code, _ = s.processGetWithHandler(fmt.Sprintf("/deposit?wallet=%s", uuid.New().String())+"&amount=10", s.h.Deposit)
 	require.Equal(s.T(), code, http.StatusBadRequest)
 	var wg sync.WaitGroup
@@ -143,6 +165,18 @@ func (s *RESTSuite) TestTransferFunds() {
 	host = fmt.Sprintf("/transferFunds?from=%s&to=%s&amount=100", uuid.New().String(), uuid.New().String())
 	code, _ = s.processGetWithHandler(host, s.h.TransferFunds)
 	require.Equal(s.T(), code, http.StatusBadRequest)
+	// the receiver is checked by the store along with the transfer
+	from := uuid.New().String()
+	for to, expected := range map[string]int{
+		from:           http.StatusBadRequest,
+		notFoundWallet: http.StatusNotFound,
+		frozenWallet:   http.StatusConflict,
+		closedWallet:   http.StatusConflict,
+	} {
+		host = fmt.Sprintf("/transferFunds?from=%s&to=%s&key=a&amount=100", from, to)
+		code, _ = s.processGetWithHandler(host, s.h.TransferFunds)
+		require.Equal(s.T(), expected, code, to)
+	}
 	var wg sync.WaitGroup
 	for i := 0; i < 100; i++ {
 		wg.Add(1)
@@ -195,9 +229,279 @@ func (s *RESTSuite) TestReport() {
 	require.Equal(s.T(), code, http.StatusOK)
 	host = fmt.Sprintf("/report?wallet=%s&type=4", uuid.New().String())
 	code, _ = s.processGetWithHandler(host, s.h.CreateReport)
+	require.Equal(s.T(), code, http.StatusOK)
+	host = fmt.Sprintf("/report?wallet=%s&type=refund", uuid.New().String())
+	code, _ = s.processGetWithHandler(host, s.h.CreateReport)
+	require.Equal(s.T(), code, http.StatusOK)
+	host = fmt.Sprintf("/report?wallet=%s&type=6", uuid.New().String())
+	code, _ = s.processGetWithHandler(host, s.h.CreateReport)
 	require.Equal(s.T(), code, http.StatusBadRequest)
 }
 
+func (s *RESTSuite) TestReportPagination() {
+	wallet := uuid.New().String()
+	code, body := s.processGetWithHandler(fmt.Sprintf("/report?wallet=%s&limit=1", wallet), s.h.CreateReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	var page struct {
+		Data       []pgStore.Transaction `json:"data"`
+		NextCursor string                `json:"next_cursor"`
+	}
+	require.NoError(s.T(), json.Unmarshal(body, &page))
+	require.Len(s.T(), page.Data, 1)
+	require.NotEmpty(s.T(), page.NextCursor)
+	code, body = s.processGetWithHandler(fmt.Sprintf("/report?wallet=%s&limit=1&order=desc&cursor=%s", wallet, page.NextCursor), s.h.CreateReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	require.Contains(s.T(), string(body), `"posting_id":2`)
+	require.NotContains(s.T(), string(body), `next_cursor`)
+	for _, query := range []string{"limit=0", "limit=1001", "limit=ten", "order=random", "cursor=rubbish"} {
+		code, _ = s.processGetWithHandler(fmt.Sprintf("/report?wallet=%s&%s", wallet, query), s.h.CreateReport)
+		require.Equal(s.T(), http.StatusBadRequest, code, query)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("/report?wallet=%s&csv=1", wallet), nil)
+	require.NoError(s.T(), err)
+	w := httptest.NewRecorder()
+	s.h.CreateReport(w, req)
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Equal(s.T(), page.NextCursor, w.Header().Get(rest.NextCursorHeader))
+}
+
+func (s *RESTSuite) TestBalanceAt() {
+	wallet := uuid.New().String()
+	code, body := s.processGetWithHandler(fmt.Sprintf("/balanceAt?wallet=%s&at=2021-09-30", wallet), s.h.BalanceAt)
+	require.Equal(s.T(), http.StatusOK, code)
+	var response struct {
+		Data pkg.Balance `json:"data"`
+	}
+	require.NoError(s.T(), json.Unmarshal(body, &response))
+	require.Equal(s.T(), pkg.NewAmount(10000, 2), response.Data.Amount)
+	require.Equal(s.T(), time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC), response.Data.At)
+	code, body = s.processGetWithHandler(fmt.Sprintf("/balanceAt?wallet=%s&at=1969-12-31T00:00:00Z", wallet), s.h.BalanceAt)
+	require.Equal(s.T(), http.StatusOK, code)
+	require.Contains(s.T(), string(body), `"amount":"0.00"`)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/balanceAt?wallet=%s", wallet), s.h.BalanceAt)
+	require.Equal(s.T(), http.StatusOK, code)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/balanceAt?wallet=%s&at=yesterday", wallet), s.h.BalanceAt)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/balanceAt?wallet=%s", notFoundWallet), s.h.BalanceAt)
+	require.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *RESTSuite) TestReportSummary() {
+	code, body := s.processGetWithHandler(fmt.Sprintf("/report?wallet=%s&from=2021-10-01&to=2021-10-31", uuid.New().String()), s.h.CreateReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	var response struct {
+		Summary pkg.BalanceSummary `json:"summary"`
+	}
+	require.NoError(s.T(), json.Unmarshal(body, &response))
+	require.Equal(s.T(), pkg.NewAmount(10000, 2), response.Summary.Opening)
+	require.Equal(s.T(), pkg.NewAmount(12500, 2), response.Summary.Closing)
+	require.Equal(s.T(), pkg.NewAmount(5500, 2), response.Summary.Credits)
+	require.Equal(s.T(), pkg.NewAmount(3000, 2), response.Summary.Debits)
+}
+
+func (s *RESTSuite) TestAggregateReport() {
+	wallet := uuid.New().String()
+	code, body := s.processGetWithHandler(fmt.Sprintf("/aggregate?wallet=%s&period=week", wallet), s.h.AggregateReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	var response struct {
+		Data []pgStore.Aggregate `json:"data"`
+	}
+	require.NoError(s.T(), json.Unmarshal(body, &response))
+	require.Len(s.T(), response.Data, 2)
+	require.Equal(s.T(), wallet, response.Data[0].Wallet)
+	require.Equal(s.T(), int64(2), response.Data[0].Count)
+	require.Equal(s.T(), pkg.NewAmount(15000, 2), response.Data[0].Amount)
+	// across all wallets of the client
+	code, body = s.processGetWithHandler("/aggregate?period=month&format=csv", s.h.AggregateReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(s.T(), lines, 3)
+	require.Equal(s.T(), "PERIOD,WALLET,TYPE,CURRENCY,COUNT,AMOUNT", lines[0])
+	require.Contains(s.T(), lines[2], ",,3,USD,1,5.00")
+	for _, query := range []string{"period=year", "format=xml", "wallet=rubbish", "from=yesterday"} {
+		code, _ = s.processGetWithHandler("/aggregate?"+query, s.h.AggregateReport)
+		require.Equal(s.T(), http.StatusBadRequest, code, query)
+	}
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/aggregate?wallet=%s", notFoundWallet), s.h.AggregateReport)
+	require.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *RESTSuite) TestStatement() {
+	wallet := uuid.New().String()
+	req, err := http.NewRequest("GET", fmt.Sprintf("/report?wallet=%s&from=2021-10-01&to=2021-10-31&format=camt053", wallet), nil)
+	require.NoError(s.T(), err)
+	w := httptest.NewRecorder()
+	s.h.CreateReport(w, req)
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Equal(s.T(), "application/xml", w.Header().Get("Content-type"))
+	body := w.Body.String()
+	require.Contains(s.T(), body, "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02")
+	require.Contains(s.T(), body, "<Cd>OPBD</Cd>")
+	require.Contains(s.T(), body, `<Amt Ccy="USD">100.00</Amt>`)
+	require.Contains(s.T(), body, "<Dt>2021-10-31</Dt>")
+	require.Contains(s.T(), body, "<NtryRef>withdrawal-1</NtryRef>")
+	require.Equal(s.T(), 2, strings.Count(body, "<CdtDbtInd>DBIT</CdtDbtInd>"))
+	require.Equal(s.T(), 4, strings.Count(body, "<CdtDbtInd>CRDT</CdtDbtInd>"))
+	require.Contains(s.T(), body, "<RvslInd>true</RvslInd>")
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("/report?wallet=%s&from=2021-10-01&to=2021-10-31&format=mt940", wallet), nil)
+	require.NoError(s.T(), err)
+	w = httptest.NewRecorder()
+	s.h.CreateReport(w, req)
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\r\n")
+	require.Equal(s.T(), ":25:"+strings.ReplaceAll(wallet, "-", ""), lines[1])
+	require.Equal(s.T(), ":60F:C211001USD100,00", lines[3])
+	require.Equal(s.T(), ":61:2110011001C50,00NMSCdeposit-1//1", lines[4])
+	require.Equal(s.T(), ":61:2110011001D20,00NMSCwithdrawal-1//2", lines[6])
+	require.Equal(s.T(), ":61:2110011001D10,00NTRFtransfer-1//3", lines[8])
+	require.Equal(s.T(), ":61:2110011001RD5,00NRTIrefund-1//4", lines[10])
+	require.Equal(s.T(), ":62F:C211031USD125,00", lines[12])
+
+	code, _ := s.processGetWithHandler(fmt.Sprintf("/report?wallet=%s&format=pdf", wallet), s.h.CreateReport)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+}
+
+func (s *RESTSuite) TestExportReport() {
+	wallet := uuid.New().String()
+	code, body := s.processGetWithHandler(fmt.Sprintf("/export?wallet=%s", wallet), s.h.ExportReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(s.T(), lines, 4)
+	require.True(s.T(), strings.HasPrefix(lines[0], "POSTING_ID"))
+	code, body = s.processGetWithHandler(fmt.Sprintf("/export?wallet=%s&format=ndjson&order=desc&type=deposit", wallet), s.h.ExportReport)
+	require.Equal(s.T(), http.StatusOK, code)
+	lines = strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(s.T(), lines, 3)
+	var t pgStore.Transaction
+	require.NoError(s.T(), json.Unmarshal([]byte(lines[2]), &t))
+	require.Equal(s.T(), pkg.NewAmount(300, 2), t.Amount)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/export?wallet=%s&format=xml", wallet), s.h.ExportReport)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/export?wallet=%s&type=6", wallet), s.h.ExportReport)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/export?wallet=%s", notFoundWallet), s.h.ExportReport)
+	require.Equal(s.T(), http.StatusNotFound, code)
+	// errors after the rows are sent
+	req, err := http.NewRequest("GET", fmt.Sprintf("/export?wallet=%s&format=ndjson", failingExportWallet), nil)
+	require.NoError(s.T(), err)
+	w := httptest.NewRecorder()
+	s.h.ExportReport(w, req)
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Equal(s.T(), "connection lost", w.Result().Trailer.Get(rest.ExportErrorTrailer))
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(s.T(), lines, 2)
+	require.Contains(s.T(), lines[1], `"message":"connection lost"`)
+}
+
+func (s *RESTSuite) TestFXQuote() {
+	code, _ := s.processGetWithHandler("/fxQuote?from=USD", s.h.CreateFXQuote)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/fxQuote?from=USD&to=XXX", s.h.CreateFXQuote)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/fxQuote?from=USD&to=usd", s.h.CreateFXQuote)
+	require.Equal(s.T(), code, http.StatusNotFound)
+	code, body := s.processGetWithHandler("/fxQuote?from=USD&to=eur", s.h.CreateFXQuote)
+	require.Equal(s.T(), code, http.StatusOK)
+	require.Contains(s.T(), string(body), `"rate":"0.92"`)
+	require.Contains(s.T(), string(body), `"quote":"EUR"`)
+	host := fmt.Sprintf("/transferFunds?from=%s&to=%s&key=a&amount=100&quote=rubbish", uuid.New().String(), uuid.New().String())
+	code, _ = s.processGetWithHandler(host, s.h.TransferFunds)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	host = fmt.Sprintf("/transferFunds?from=%s&to=%s&key=a&amount=100&quote=%s", uuid.New().String(), uuid.New().String(), uuid.New().String())
+	code, _ = s.processGetWithHandler(host, s.h.TransferFunds)
+	require.Equal(s.T(), code, http.StatusOK)
+}
+
+func (s *RESTSuite) TestReceipt() {
+	host := fmt.Sprintf("/transferFunds?from=%s&to=%s&key=a&amount=100.50", uuid.New().String(), uuid.New().String())
+	code, body := s.processGetWithHandler(host, s.h.TransferFunds)
+	require.Equal(s.T(), code, http.StatusOK)
+	require.Contains(s.T(), string(body), `"amount":"100.50"`)
+	require.Contains(s.T(), string(body), `"fee":"1.01"`)
+	require.Contains(s.T(), string(body), `"total":"-101.51"`)
+}
+
+func (s *RESTSuite) TestHolds() {
+	wallet := uuid.New().String()
+	code, _ := s.processGetWithHandler(fmt.Sprintf("/hold?wallet=%s&key=a", wallet), s.h.PlaceHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/hold?wallet=%s&key=a&amount=-10", wallet), s.h.PlaceHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/hold?wallet=%s&amount=10", wallet), s.h.PlaceHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, body := s.processGetWithHandler(fmt.Sprintf("/hold?wallet=%s&key=a&amount=10", wallet), s.h.PlaceHold)
+	require.Equal(s.T(), code, http.StatusOK)
+	require.Contains(s.T(), string(body), `"amount":"10"`)
+	hold := uuid.New().String()
+	code, _ = s.processGetWithHandler("/capture?key=b", s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/capture?hold=rubbish&key=b", s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/capture?hold=%s", hold), s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/capture?hold=%s&key=b&amount=0", hold), s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/capture?hold=%s&key=b&amount=1000", hold), s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, body = s.processGetWithHandler(fmt.Sprintf("/capture?hold=%s&key=b&amount=5", hold), s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusOK)
+	require.Contains(s.T(), string(body), `"captured":"5"`)
+	code, body = s.processGetWithHandler(fmt.Sprintf("/capture?hold=%s&key=b", hold), s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusOK)
+	require.Contains(s.T(), string(body), `"captured":"100.00"`)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/capture?hold=%s&key=b", notFoundHold), s.h.CaptureHold)
+	require.Equal(s.T(), code, http.StatusNotFound)
+	code, _ = s.processGetWithHandler("/void?hold=", s.h.VoidHold)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/void?hold=%s", notFoundHold), s.h.VoidHold)
+	require.Equal(s.T(), code, http.StatusNotFound)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/void?hold=%s", hold), s.h.VoidHold)
+	require.Equal(s.T(), code, http.StatusOK)
+}
+
+func (s *RESTSuite) TestRefund() {
+	code, _ := s.processGetWithHandler("/refund?key=a", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/refund?id=rubbish&key=a", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/refund?id=-1&key=a", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/refund?id=1", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/refund?id=1&key=a&amount=0", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/refund?id=1&key=a&amount=1000", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler("/refund?original=missing&key=a", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusNotFound)
+	code, _ = s.processGetWithHandler("/refund?id=1&key=a&amount=10", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusOK)
+	code, _ = s.processGetWithHandler("/refund?original=b&key=a", s.h.Refund)
+	require.Equal(s.T(), code, http.StatusOK)
+}
+
+func (s *RESTSuite) TestSetWalletStatus() {
+	wallet := uuid.New().String()
+	code, _ := s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&reason=kyc", wallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&status=4&reason=kyc", wallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&status=frozen", wallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&status=frozen_all", wallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&status=closed&reason=kyc", wallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusBadRequest)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&status=1&reason=kyc", notFoundWallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusNotFound)
+	code, body := s.processGetWithHandler(fmt.Sprintf("/setWalletStatus?wallet=%s&status=frozen_debit&reason=kyc", wallet), s.h.SetWalletStatus)
+	require.Equal(s.T(), code, http.StatusOK)
+	require.Contains(s.T(), string(body), `"status":1`)
+	code, _ = s.processGetWithHandler(fmt.Sprintf("/walletStatusHistory?wallet=%s", wallet), s.h.WalletStatusHistory)
+	require.Equal(s.T(), code, http.StatusOK)
+}
+
 func (s *RESTSuite) processGetWithHandler(host string, handler func(w http.ResponseWriter, r *http.Request)) (code int, body []byte) {
 	req, err := http.NewRequest("GET", host, nil)
 	require.NoError(s.T(), err)
@@ -219,18 +523,267 @@ type FakeStore struct {
 func (f FakeStore) GetWallet(_ context.Context, _ string) (pkg.Wallet, error) {
 	return pkg.Wallet{}, nil
 }
-func (f FakeStore) CreateWallet(_ context.Context, _ string, _ int) error {
+func (f FakeStore) CreateWallet(_ context.Context, wallet string, _ int, _ string) error {
+	if wallet == existingWallet {
+		return pkg.ErrDuplicateAction(wallet)
+	}
 	return nil
 }
-func (f FakeStore) DepositWithdraw(_ context.Context, _ string, _ float64, _ string) error {
+func (f FakeStore) DepositWithdraw(_ context.Context, _ string, amount pkg.Amount, currency, key string) (pkg.Receipt, error) {
+	if key == duplicateKey {
+		return pkg.Receipt{}, pkg.ErrDuplicateAction(key)
+	}
+	// wallets are in USD, amounts without a currency are checked against it as stores do
+	if _, err := pkg.InCurrency(amount, "USD"); currency == "" && err != nil {
+		return pkg.Receipt{}, err
+	}
+	return pkg.Receipt{Key: key, Amount: amount, Currency: currency, AmountReceived: amount, CurrencyReceiver: currency, Total: amount}, nil
+}
+func (f FakeStore) TransferFunds(ctx context.Context, from, to string, amount pkg.Amount, currency, _, key string) (pkg.Receipt, error) {
+	switch to {
+	case from:
+		return pkg.Receipt{}, pkg.ErrSelfTransfer
+	case slowWallet:
+		<-ctx.Done()
+		return pkg.Receipt{}, ctx.Err()
+	case notFoundWallet:
+		return pkg.Receipt{}, pkg.ErrReceiverNotFound
+	case frozenWallet:
+		return pkg.Receipt{}, pkg.ErrReceiverFrozen
+	case closedWallet:
+		return pkg.Receipt{}, pkg.ErrReceiverClosed
+	}
+	// 1% fee
+	fee, _ := amount.Convert(pkg.NewAmount(1, 2), amount.Scale)
+	return pkg.Receipt{Key: key, Amount: amount, Currency: currency, AmountReceived: amount, CurrencyReceiver: currency,
+		Fee: fee, Total: amount.Add(fee).Neg()}, nil
+}
+func (f FakeStore) TransferFundsBatch(ctx context.Context, from string, legs []pkg.TransferLeg) ([]pkg.Receipt, error) {
+	receipts := make([]pkg.Receipt, 0, len(legs))
+	for i, l := range legs {
+		receipt, err := f.TransferFunds(ctx, from, l.To, l.Amount, l.Currency, l.Quote, l.Key)
+		if err != nil {
+			return nil, pkg.ErrBatchLeg{Index: i, Err: err}
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+func (f FakeStore) SplitPayment(ctx context.Context, from string, amount pkg.Amount, _ string, parts []pkg.SplitPart, key string) (pkg.Payment, error) {
+	amount, err := pkg.InCurrency(amount, "USD")
+	if err != nil {
+		return pkg.Payment{}, err
+	}
+	shares, err := pkg.Split(amount, parts)
+	if err != nil {
+		return pkg.Payment{}, err
+	}
+	payment := pkg.Payment{ID: uuid.New().String(), Wallet: from, Key: key, Amount: amount, Currency: "USD", Total: amount.Neg()}
+	for i, p := range parts {
+		receipt, err := f.TransferFunds(ctx, from, p.To, shares[i], "USD", "", payment.ID)
+		if err != nil {
+			return pkg.Payment{}, pkg.ErrBatchLeg{Index: i, Err: err}
+		}
+		payment.Parts = append(payment.Parts, receipt)
+	}
+	return payment, nil
+}
+func (f FakeStore) CreateFXQuote(_ context.Context, base, quote string, ttl time.Duration) (pkg.FXQuote, error) {
+	if base == quote {
+		return pkg.FXQuote{}, pkg.ErrRateNotFound
+	}
+	return pkg.FXQuote{ID: uuid.New().String(), Base: base, Quote: quote, Rate: pkg.NewAmount(92, 2), Expires: time.Now().Add(ttl)}, nil
+}
+
+// notFoundHold is the only hold FakeStore doesn't have, the rest are active holds of 100.00
+const notFoundHold = "00000000-0000-4000-8000-000000000000"
+
+func (f FakeStore) PlaceHold(_ context.Context, wallet string, amount pkg.Amount, currency string, ttl time.Duration, key string) (pkg.Hold, error) {
+	return pkg.Hold{ID: uuid.New().String(), Wallet: wallet, Key: key, Amount: amount, Currency: currency, Expires: time.Now().Add(ttl)}, nil
+}
+func (f FakeStore) GetHold(_ context.Context, id string) (pkg.Hold, error) {
+	if id == notFoundHold {
+		return pkg.Hold{}, pkg.ErrHoldNotFound
+	}
+	return pkg.Hold{ID: id, Amount: pkg.NewAmount(10000, 2), Currency: pkg.DefaultCurrency}, nil
+}
+func (f FakeStore) CaptureHold(ctx context.Context, id string, amount pkg.Amount, _ string) (pkg.Hold, error) {
+	hold, err := f.GetHold(ctx, id)
+	if err != nil {
+		return hold, err
+	}
+	if amount.Sign() == 0 {
+		amount = hold.Amount
+	}
+	if amount.Cmp(hold.Amount) > 0 {
+		return pkg.Hold{}, pkg.ErrCaptureExceedsHold
+	}
+	hold.Captured, hold.Status = amount, pkg.HoldCaptured
+	return hold, nil
+}
+func (f FakeStore) VoidHold(ctx context.Context, id string) (pkg.Hold, error) {
+	hold, err := f.GetHold(ctx, id)
+	hold.Status = pkg.HoldVoided
+	return hold, err
+}
+
+// GetTransaction has every transaction but the one with key "missing", each is a deposit of 100.00
+// but the one with key "withdrawal", which is a withdrawal of it
+func (f FakeStore) GetTransaction(_ context.Context, id int64, key string) (pgStore.Transaction, error) {
+	if key == "missing" {
+		return pgStore.Transaction{}, pkg.ErrTransactionNotFound
+	}
+	if id == 0 {
+		id = 1
+	}
+	tType, amount := pgStore.TransactionDeposit, pkg.NewAmount(10000, 2)
+	if key == "withdrawal" {
+		tType, amount = pgStore.TransactionWithdrawal, amount.Neg()
+	}
+	return pgStore.Transaction{ID: id, Type: tType, Wallet: uuid.New().String(), Key: key,
+		Amount: amount, Currency: pkg.DefaultCurrency}, nil
+}
+func (f FakeStore) Refund(ctx context.Context, originalID int64, originalKey string, amount pkg.Amount, _ string) error {
+	original, err := f.GetTransaction(ctx, originalID, originalKey)
+	if err != nil {
+		return err
+	}
+	if amount.Cmp(original.Amount) > 0 {
+		return pkg.ErrRefundExceedsOriginal
+	}
 	return nil
 }
-func (f FakeStore) TransferFunds(_ context.Context, _, _ string, _ float64, _ string) error {
+func (f FakeStore) ReportPage(_ context.Context, _ string, _, _ *time.Time, _ pgStore.TransactionType, page pgStore.Page) ([]pgStore.Transaction, *pgStore.Cursor, error) {
+	// a page of a single posting, the first page has the next one
+	result := []pgStore.Transaction{{PostingID: 1, Ts: time.Unix(0, 0).UTC()}}
+	if page.Cursor != nil {
+		result[0].PostingID = page.Cursor.ID + 1
+		return result, nil, nil
+	}
+	return result, &pgStore.Cursor{Ts: result[0].Ts, ID: result[0].PostingID}, nil
+}
+
+const failingExportWallet = "00000000-0000-4000-8000-000000000003"
+
+// ExportReport streams 3 postings, failing after the first one on failingExportWallet
+func (f FakeStore) ExportReport(_ context.Context, wallet string, _, _ *time.Time, _ pgStore.TransactionType, _ bool, fn func(pgStore.Transaction) error) error {
+	for i := int64(1); i <= 3; i++ {
+		if wallet == failingExportWallet && i > 1 {
+			return errors.New("connection lost")
+		}
+		if err := fn(pgStore.Transaction{PostingID: i, Wallet: wallet, Amount: pkg.NewAmount(i*100, 2), Currency: "USD"}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
-func (f FakeStore) Report(_ context.Context, _ string, _, _ *time.Time, _ pgStore.TransactionType) ([]pgStore.Transaction, error) {
-	return make([]pgStore.Transaction, 0), nil
+
+// AggregateReport has deposits and incoming transfers of the day, the wallet is empty across wallets
+func (f FakeStore) AggregateReport(_ context.Context, wallet string, _ int, _, _ *time.Time, _ pgStore.AggregatePeriod) ([]pgStore.Aggregate, error) {
+	period := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	return []pgStore.Aggregate{
+		{Period: period, Wallet: wallet, Type: pgStore.TransactionDeposit, Currency: "USD", Count: 2, Amount: pkg.NewAmount(15000, 2)},
+		{Period: period, Wallet: wallet, Type: pgStore.TransactionTransferFundsTo, Currency: "USD", Count: 1, Amount: pkg.NewAmount(500, 2)},
+	}, nil
+}
+
+// BalanceAt is 100.00 at any moment after the epoch and zero before it
+func (f FakeStore) BalanceAt(_ context.Context, wallet string, at time.Time) (pkg.Balance, error) {
+	result := pkg.Balance{Wallet: wallet, Currency: "USD", Amount: pkg.NewAmount(0, 2), At: at}
+	if at.After(time.Unix(0, 0)) {
+		result.Amount = pkg.NewAmount(10000, 2)
+	}
+	return result, nil
+}
+func (f FakeStore) BalanceSummary(_ context.Context, _ string, _, _ *time.Time) (pkg.BalanceSummary, error) {
+	return pkg.BalanceSummary{Opening: pkg.NewAmount(10000, 2), Closing: pkg.NewAmount(12500, 2),
+		Credits: pkg.NewAmount(5500, 2), Debits: pkg.NewAmount(3000, 2)}, nil
+}
+
+// Statement has a deposit, a withdrawal, an outgoing transfer and a refund of it
+func (f FakeStore) Statement(_ context.Context, wallet string, from, to *time.Time) (pgStore.Statement, error) {
+	ts := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(id int64, tType pgStore.TransactionType, amount int64, key string) pgStore.Transaction {
+		return pgStore.Transaction{ID: id, PostingID: id, Type: tType, Wallet: wallet, Key: key, Ts: ts,
+			PostingAmount: pkg.NewAmount(amount, 2), Currency: "USD"}
+	}
+	return pgStore.Statement{Wallet: wallet, Currency: "USD", From: from, To: to,
+		Opening: pkg.NewAmount(10000, 2), Closing: pkg.NewAmount(12500, 2),
+		Entries: []pgStore.Transaction{
+			entry(1, pgStore.TransactionDeposit, 5000, "deposit-1"),
+			entry(2, pgStore.TransactionWithdrawal, -2000, "withdrawal-1"),
+			entry(3, pgStore.TransactionTransferFunds, -1000, "transfer-1"),
+			entry(4, pgStore.TransactionRefund, 500, "refund-1"),
+		}}, nil
 }
-func (f FakeStore) CheckOwnerWallet(_ context.Context, _ string, _ int) (bool, error) {
+func (f FakeStore) CheckOwnerWallet(_ context.Context, wallet string, _ int) (bool, error) {
+	if wallet == notFoundWallet {
+		return false, pkg.ErrWalletNotFound
+	}
 	return true, nil
 }
+
+const notFoundWallet = "00000000-0000-4000-8000-000000000001"
+const existingWallet = "00000000-0000-4000-8000-000000000002"
+const frozenWallet = "00000000-0000-4000-8000-000000000004"
+const closedWallet = "00000000-0000-4000-8000-000000000005"
+
+// slowWallet is the receiver transfers to which last until they are canceled
+const slowWallet = "00000000-0000-4000-8000-000000000006"
+const duplicateKey = "duplicate"
+
+func (f FakeStore) SetWalletStatus(_ context.Context, wallet string, status pkg.WalletStatus, _ string, _ int) (pkg.Wallet, error) {
+	switch {
+	case wallet == notFoundWallet:
+		return pkg.Wallet{}, pkg.ErrWalletNotFound
+	case status == pkg.WalletClosed:
+		return pkg.Wallet{}, pkg.ErrWalletNotEmpty
+	}
+	return pkg.Wallet{Wallet: wallet, Status: status}, nil
+}
+func (f FakeStore) WalletStatusHistory(_ context.Context, _ string) ([]pkg.WalletStatusChange, error) {
+	return make([]pkg.WalletStatusChange, 0), nil
+}
+
+const notFoundWebhook = 404
+
+func (f FakeStore) CreateWebhook(_ context.Context, clientID int, url string, events []string, secret string) (pkg.Webhook, error) {
+	return pkg.Webhook{ID: 1, ClientID: clientID, URL: url, Events: events, Secret: secret, Active: true, Created: time.Now()}, nil
+}
+func (f FakeStore) ListWebhooks(_ context.Context, clientID int) ([]pkg.Webhook, error) {
+	return []pkg.Webhook{{ID: 1, ClientID: clientID, URL: "https://example.com/hook", Events: []string{"deposit.succeeded"}, Active: true}}, nil
+}
+func (f FakeStore) DeleteWebhook(_ context.Context, _ int, id int64) error {
+	if id == notFoundWebhook {
+		return pkg.ErrWebhookNotFound
+	}
+	return nil
+}
+func (f FakeStore) WebhookDeliveries(_ context.Context, _ int, webhookID int64) ([]pkg.WebhookDelivery, error) {
+	if webhookID == notFoundWebhook {
+		return nil, pkg.ErrWebhookNotFound
+	}
+	return []pkg.WebhookDelivery{{ID: 1, WebhookID: webhookID, EventType: pkg.EventDepositSucceeded, Status: pkg.DeliveryFailed,
+		Attempts: 10, LastStatusCode: 500, Payload: []byte(`{"type":"deposit.succeeded"}`), Secret: "secret"}}, nil
+}
+func (f FakeStore) RedeliverWebhook(_ context.Context, _ int, webhookID, deliveryID int64) (pkg.WebhookDelivery, error) {
+	if webhookID == notFoundWebhook || deliveryID == notFoundWebhook {
+		return pkg.WebhookDelivery{}, pkg.ErrDeliveryNotFound
+	}
+	return pkg.WebhookDelivery{ID: deliveryID, WebhookID: webhookID, Status: pkg.DeliveryPending}, nil
+}
+
+// fakeActivity is notified of activity on any wallet, fakeLatestPosting is the id of the latest posting on them
+var fakeActivity = make(chan struct{}, 1)
+var fakeLatestPosting int64 = 3
+
+func (f FakeStore) SubscribeWallet(_ string) (<-chan struct{}, func()) {
+	return fakeActivity, func() {}
+}
+func (f FakeStore) TransactionsAfter(_ context.Context, wallet string, postingID int64, limit int) ([]pgStore.Transaction, error) {
+	result := make([]pgStore.Transaction, 0)
+	for id := postingID + 1; id <= atomic.LoadInt64(&fakeLatestPosting) && len(result) < limit; id++ {
+		result = append(result, pgStore.Transaction{PostingID: id, ID: id, Wallet: wallet, Type: pgStore.TransactionDeposit})
+	}
+	return result, nil
+}
@@ -0,0 +1,95 @@
+package rest_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"payment-system/pkg"
+	"payment-system/pkg/rest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type IdempotencySuite struct {
+	cs     *FakeClientStore
+	router http.Handler
+	suite.Suite
+}
+
+func (s *IdempotencySuite) SetupTest() {
+	s.cs = NewFakeClientStore(pkg.Client{ID: 0, Name: "test", LimitRPS: 100, Burst: 100, SigningSecret: testSigningSecret})
+	s.router = rest.NewRouter(&logrus.Logger{}, s.cs, FakeStore{}, "test", rest.Options{SignatureSkew: time.Minute})
+}
+
+func (s *IdempotencySuite) TestReplay() {
+	wallet := uuid.New().String()
+	w := s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=10&key=a", wallet), "")
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Empty(s.T(), w.Header().Get(rest.IdempotentReplayedHeader))
+	original := w.Body.String()
+	// a retry gets the original response
+	w = s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=10&key=a", wallet), "")
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Equal(s.T(), "true", w.Header().Get(rest.IdempotentReplayedHeader))
+	require.Equal(s.T(), original, w.Body.String())
+	// the same key with other parameters
+	w = s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=11&key=a", wallet), "")
+	require.Equal(s.T(), http.StatusUnprocessableEntity, w.Code)
+	w = s.do("GET", fmt.Sprintf("/v1/withdraw?wallet=%s&amount=10&key=a", wallet), "")
+	require.Equal(s.T(), http.StatusUnprocessableEntity, w.Code)
+	// v2
+	body := fmt.Sprintf(`{"from":"%s","to":"%s","amount":"10","key":"b"}`, wallet, uuid.New().String())
+	w = s.do("POST", "/v2/transfers", body)
+	require.Equal(s.T(), http.StatusCreated, w.Code)
+	original = w.Body.String()
+	w = s.do("POST", "/v2/transfers", body)
+	require.Equal(s.T(), http.StatusCreated, w.Code)
+	require.Equal(s.T(), "true", w.Header().Get(rest.IdempotentReplayedHeader))
+	require.Equal(s.T(), original, w.Body.String())
+	w = s.do("POST", "/v2/transfers", strings.Replace(body, `"10"`, `"20"`, 1))
+	require.Equal(s.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (s *IdempotencySuite) TestFailedRequests() {
+	wallet := uuid.New().String()
+	// failures aren't recorded, so the key may be used again
+	w := s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=-10&key=a", wallet), "")
+	require.Equal(s.T(), http.StatusBadRequest, w.Code)
+	w = s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=10&key=a", wallet), "")
+	require.Equal(s.T(), http.StatusOK, w.Code)
+	require.Empty(s.T(), w.Header().Get(rest.IdempotentReplayedHeader))
+	// keys used without a record are still duplicates
+	w = s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=10&key=%s", wallet, duplicateKey), "")
+	require.Equal(s.T(), http.StatusBadRequest, w.Code)
+	// concurrent retries
+	_, reserved, err := s.cs.ReserveIdempotencyKey(context.Background(), 0, "c", "in progress")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	w = s.do("GET", fmt.Sprintf("/v1/deposit?wallet=%s&amount=10&key=c", wallet), "")
+	require.Equal(s.T(), http.StatusUnprocessableEntity, w.Code)
+	_, _, err = s.cs.ReserveIdempotencyKey(context.Background(), 0, "c", "in progress")
+	require.ErrorIs(s.T(), err, pkg.ErrRequestInProgress)
+}
+
+func (s *IdempotencySuite) do(method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	require.NoError(s.T(), err)
+	req.Header.Set(rest.APIKeyHeader, testAPIKey)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencySuite(t *testing.T) {
+	suite.Run(t, new(IdempotencySuite))
+}
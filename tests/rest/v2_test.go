@@ -0,0 +1,325 @@
+package rest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"payment-system/pkg"
+	"payment-system/pkg/rest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type V2Suite struct {
+	router http.Handler
+	suite.Suite
+}
+
+func (s *V2Suite) SetupSuite() {
+	cs := NewFakeClientStore(pkg.Client{ID: 0, Name: "test", LimitRPS: 100, Burst: 100, SigningSecret: testSigningSecret})
+	s.router = rest.NewRouter(&logrus.Logger{}, cs, FakeStore{}, "test", rest.Options{SignatureSkew: time.Minute, MaxBatchTransfers: 3})
+}
+
+func (s *V2Suite) TestCreateWallet() {
+	code, body := s.do("POST", "/v2/wallets", `{"currency":"eur"}`, false)
+	require.Equal(s.T(), http.StatusCreated, code)
+	require.Contains(s.T(), body, `"code":201`)
+	code, _ = s.do("POST", "/v2/wallets", fmt.Sprintf(`{"id":"%s"}`, uuid.New().String()), false)
+	require.Equal(s.T(), http.StatusCreated, code)
+	code, _ = s.do("POST", "/v2/wallets", fmt.Sprintf(`{"id":"%s"}`, existingWallet), false)
+	require.Equal(s.T(), http.StatusConflict, code)
+	code, _ = s.do("POST", "/v2/wallets", `{"id":"rubbish"}`, false)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", "/v2/wallets", `{"currency":"EURO"}`, false)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", "/v2/wallets", `{"owner":1}`, false)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, _ = s.do("POST", "/v2/wallets", `{`, false)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	req := s.newRequest("POST", "/v2/wallets", `{}`)
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	require.Equal(s.T(), http.StatusUnsupportedMediaType, w.Code)
+	// v1 is still served
+	code, _ = s.do("GET", fmt.Sprintf("/v1/createWallet?wallet=%s", uuid.New().String()), "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+}
+
+func (s *V2Suite) TestGetWallet() {
+	code, _ := s.do("GET", fmt.Sprintf("/v2/wallets/%s", uuid.New().String()), "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+	code, _ = s.do("GET", fmt.Sprintf("/v2/wallets/%s", notFoundWallet), "", false)
+	require.Equal(s.T(), http.StatusNotFound, code)
+	code, _ = s.do("GET", "/v2/wallets/rubbish", "", false)
+	require.Equal(s.T(), http.StatusNotFound, code)
+	code, _ = s.do("GET", fmt.Sprintf("/v2/wallets/%s/transactions?type=deposit", uuid.New().String()), "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+	code, _ = s.do("GET", fmt.Sprintf("/v2/wallets/%s/transactions?type=6", uuid.New().String()), "", false)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, body := s.do("GET", fmt.Sprintf("/v2/wallets/%s/transactions", uuid.New().String()), "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+	require.Contains(s.T(), body, `"opening_balance":"100.00"`)
+	code, body = s.do("GET", fmt.Sprintf("/v2/wallets/%s/balance?at=2021-09-30T23:59:59Z", uuid.New().String()), "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+	require.Contains(s.T(), body, `"amount":"100.00"`)
+	code, _ = s.do("GET", fmt.Sprintf("/v2/wallets/%s/balance", notFoundWallet), "", false)
+	require.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *V2Suite) TestDeposit() {
+	path := fmt.Sprintf("/v2/wallets/%s/deposits", uuid.New().String())
+	code, _ := s.do("POST", path, `{"amount":"10.50","key":"a"}`, false)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+	code, body := s.do("POST", path, `{"amount":"10.50","key":"a"}`, true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	require.Contains(s.T(), body, `"amount":"10.50"`)
+	code, _ = s.do("POST", path, `{"amount":10.5,"currency":"usd","key":"b"}`, true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	code, _ = s.do("POST", path, fmt.Sprintf(`{"amount":"10","key":"%s"}`, duplicateKey), true)
+	require.Equal(s.T(), http.StatusConflict, code)
+	code, _ = s.do("POST", path, `{"amount":"-10","key":"c"}`, true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", path, `{"amount":"10.001","currency":"USD","key":"c"}`, true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", path, `{"amount":"10"}`, true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", path, `{"amount":"922337203685477580","key":"c"}`, true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", path, `{"amount":"ten","key":"c"}`, true)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, _ = s.do("POST", fmt.Sprintf("/v2/wallets/%s/deposits", notFoundWallet), `{"amount":"10","key":"c"}`, true)
+	require.Equal(s.T(), http.StatusNotFound, code)
+	code, body = s.do("POST", fmt.Sprintf("/v2/wallets/%s/withdrawals", uuid.New().String()), `{"amount":"10","key":"d"}`, true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	require.Contains(s.T(), body, `"amount":"-10"`)
+}
+
+func (s *V2Suite) TestTransfer() {
+	from, to := uuid.New().String(), uuid.New().String()
+	code, body := s.do("POST", "/v2/transfers", fmt.Sprintf(`{"from":"%s","to":"%s","amount":"100.50","key":"t"}`, from, to), true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	require.Contains(s.T(), body, `"fee":"1.01"`)
+	code, _ = s.do("POST", "/v2/transfers", fmt.Sprintf(`{"from":"%s","to":"rubbish","amount":"1","key":"t"}`, from), true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", "/v2/transfers", fmt.Sprintf(`{"from":"%s","to":"%s","amount":"1","key":"t"}`, notFoundWallet, to), true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", "/v2/transfers", fmt.Sprintf(`{"from":"%s","to":"%s","amount":"1","key":"t","quote":"rubbish"}`, from, to), true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	for to, expected := range map[string]int{
+		from:           http.StatusUnprocessableEntity,
+		notFoundWallet: http.StatusNotFound,
+		frozenWallet:   http.StatusConflict,
+		closedWallet:   http.StatusConflict,
+	} {
+		code, _ = s.do("POST", "/v2/transfers", fmt.Sprintf(`{"from":"%s","to":"%s","amount":"1","key":"%s"}`, from, to, to), true)
+		require.Equal(s.T(), expected, code, to)
+	}
+	code, _ = s.do("GET", "/v2/transfers", "", true)
+	require.Equal(s.T(), http.StatusMethodNotAllowed, code)
+}
+
+func (s *V2Suite) TestTransferBatch() {
+	from, to := uuid.New().String(), uuid.New().String()
+	batch := func(mode string, legs ...string) string {
+		return fmt.Sprintf(`{"from":"%s","mode":"%s","transfers":[%s]}`, from, mode, strings.Join(legs, ","))
+	}
+	leg := func(to, key string) string {
+		return fmt.Sprintf(`{"to":"%s","amount":"100.50","key":"%s"}`, to, key)
+	}
+	statuses := func(body string) []string {
+		var response struct {
+			Data struct {
+				Succeeded int `json:"succeeded"`
+				Failed    int `json:"failed"`
+				Transfers []struct {
+					Status  string       `json:"status"`
+					Code    int          `json:"code"`
+					Receipt *pkg.Receipt `json:"receipt"`
+				} `json:"transfers"`
+			} `json:"data"`
+		}
+		require.NoError(s.T(), json.Unmarshal([]byte(body), &response))
+		result := make([]string, 0)
+		for _, t := range response.Data.Transfers {
+			require.Equal(s.T(), t.Status == rest.TransferSucceeded, t.Receipt != nil)
+			result = append(result, t.Status)
+		}
+		return result
+	}
+	code, body := s.do("POST", "/v2/transfers/batch", batch("", leg(to, "b1"), leg(uuid.New().String(), "b2")), true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	require.Equal(s.T(), []string{rest.TransferSucceeded, rest.TransferSucceeded}, statuses(body))
+	require.Contains(s.T(), body, `"fee":"1.01"`)
+	code, _ = s.do("POST", "/v2/transfers/batch", fmt.Sprintf(`{"from":"%s","key":"batch","transfers":[%s]}`, from, leg(to, "b0")), true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	// atomic batches respond with the status of the failed transfer
+	code, body = s.do("POST", "/v2/transfers/batch", batch(rest.BatchAtomic, leg(to, "b3"), leg(frozenWallet, "b4"), leg(to, "b5")), true)
+	require.Equal(s.T(), http.StatusConflict, code)
+	require.Equal(s.T(), []string{rest.TransferRolledBack, rest.TransferFailed, rest.TransferSkipped}, statuses(body))
+	code, body = s.do("POST", "/v2/transfers/batch", batch(rest.BatchBestEffort, leg(to, "b6"), leg(notFoundWallet, "b7"), leg(to, "b8")), true)
+	require.Equal(s.T(), http.StatusMultiStatus, code)
+	require.Equal(s.T(), []string{rest.TransferSucceeded, rest.TransferFailed, rest.TransferSucceeded}, statuses(body))
+	require.Contains(s.T(), body, `"code":404`)
+	code, body = s.do("POST", "/v2/transfers/batch", batch(rest.BatchBestEffort, leg(from, "b9"), leg(closedWallet, "b10")), true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	require.Equal(s.T(), []string{rest.TransferFailed, rest.TransferFailed}, statuses(body))
+	// transfers are validated before any of them is made
+	for _, invalid := range []string{
+		batch("all", leg(to, "b11")),
+		batch(rest.BatchAtomic),
+		batch(rest.BatchAtomic, leg(to, "b11"), leg(to, "b12"), leg(to, "b13"), leg(to, "b14")),
+		batch(rest.BatchAtomic, leg(to, "b11"), leg(to, "b11")),
+		batch(rest.BatchAtomic, leg(to, "b11"), leg("rubbish", "b12")),
+		batch(rest.BatchAtomic, leg(to, "b11"), leg(to, "")),
+		batch(rest.BatchAtomic, fmt.Sprintf(`{"to":"%s","amount":"-1","key":"b11"}`, to)),
+	} {
+		code, _ = s.do("POST", "/v2/transfers/batch", invalid, true)
+		require.Equal(s.T(), http.StatusUnprocessableEntity, code, invalid)
+	}
+	code, _ = s.do("POST", "/v2/transfers/batch", fmt.Sprintf(`{"from":"%s","transfers":[%s]}`, notFoundWallet, leg(to, "b11")), true)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", "/v2/transfers/batch", batch(rest.BatchAtomic, leg(to, "b11")), false)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+}
+
+// TestTransferBatchTimeout checks transfers of a best effort batch not made before its timeout are skipped
+func (s *V2Suite) TestTransferBatchTimeout() {
+	cs := NewFakeClientStore(pkg.Client{ID: 0, Name: "test", LimitRPS: 100, Burst: 100, SigningSecret: testSigningSecret})
+	router := rest.NewRouter(&logrus.Logger{}, cs, FakeStore{}, "test", rest.Options{SignatureSkew: time.Minute, BatchTimeout: 50 * time.Millisecond})
+	from, to := uuid.New().String(), uuid.New().String()
+	batch := func(mode string) (int, string) {
+		body := fmt.Sprintf(`{"from":"%s","mode":"%s","transfers":[{"to":"%s","amount":"1","key":"t1"},{"to":"%s","amount":"1","key":"t2"},{"to":"%s","amount":"1","key":"t3"}]}`,
+			from, mode, to, slowWallet, to)
+		req := s.newRequest("POST", "/v2/transfers/batch", body)
+		require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	code, body := batch(rest.BatchBestEffort)
+	require.Equal(s.T(), http.StatusMultiStatus, code)
+	var response struct {
+		Data struct {
+			Succeeded int `json:"succeeded"`
+			Failed    int `json:"failed"`
+			Skipped   int `json:"skipped"`
+			Transfers []struct {
+				Status string `json:"status"`
+			} `json:"transfers"`
+		} `json:"data"`
+	}
+	require.NoError(s.T(), json.Unmarshal([]byte(body), &response))
+	require.Equal(s.T(), 1, response.Data.Succeeded)
+	require.Equal(s.T(), 0, response.Data.Failed)
+	require.Equal(s.T(), 2, response.Data.Skipped)
+	require.Equal(s.T(), rest.TransferSkipped, response.Data.Transfers[1].Status)
+	require.Equal(s.T(), rest.TransferSkipped, response.Data.Transfers[2].Status)
+	code, _ = batch(rest.BatchAtomic)
+	require.Equal(s.T(), http.StatusGatewayTimeout, code)
+}
+
+func (s *V2Suite) TestSplitPayment() {
+	from, seller, platform := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	payment := func(amount, key string, parts ...string) string {
+		return fmt.Sprintf(`{"from":"%s","amount":"%s","key":"%s","parts":[%s]}`, from, amount, key, strings.Join(parts, ","))
+	}
+	code, body := s.do("POST", "/v2/payments", payment("100.00", "p1",
+		fmt.Sprintf(`{"to":"%s","percent":"66.666667"}`, seller),
+		fmt.Sprintf(`{"to":"%s","percent":"33.333333"}`, platform),
+		fmt.Sprintf(`{"to":"%s","amount":"0.01"}`, platform),
+	), true)
+	require.Equal(s.T(), http.StatusCreated, code)
+	var response struct {
+		Data pkg.Payment `json:"data"`
+	}
+	require.NoError(s.T(), json.Unmarshal([]byte(body), &response))
+	require.Len(s.T(), response.Data.Parts, 3)
+	require.Equal(s.T(), pkg.NewAmount(6666, 2), response.Data.Parts[0].Amount)
+	require.Equal(s.T(), pkg.NewAmount(3333, 2), response.Data.Parts[1].Amount)
+	require.Equal(s.T(), response.Data.ID, response.Data.Parts[2].Key)
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{payment("100.00", "p2", fmt.Sprintf(`{"to":"%s","percent":"99"}`, seller)), http.StatusUnprocessableEntity},
+		{payment("100.00", "p2", fmt.Sprintf(`{"to":"%s"}`, seller)), http.StatusUnprocessableEntity},
+		{payment("100.00", "p2", fmt.Sprintf(`{"to":"%s","percent":"100"}`, notFoundWallet)), http.StatusNotFound},
+		{payment("100.00", "p2", fmt.Sprintf(`{"to":"%s","amount":"50"}`, seller), fmt.Sprintf(`{"to":"%s","amount":"50"}`, frozenWallet)), http.StatusConflict},
+		{payment("100.00", "p2", `{"to":"rubbish","percent":"100"}`), http.StatusUnprocessableEntity},
+		{payment("100.00", "p2"), http.StatusUnprocessableEntity},
+		{payment("0", "p2", fmt.Sprintf(`{"to":"%s","percent":"100"}`, seller)), http.StatusUnprocessableEntity},
+		{payment("100.00", "", fmt.Sprintf(`{"to":"%s","percent":"100"}`, seller)), http.StatusUnprocessableEntity},
+	} {
+		code, _ = s.do("POST", "/v2/payments", c.body, true)
+		require.Equal(s.T(), c.code, code, c.body)
+	}
+	code, _ = s.do("POST", "/v2/payments", payment("100.00", "p3", fmt.Sprintf(`{"to":"%s","percent":"100"}`, seller)), false)
+	require.Equal(s.T(), http.StatusUnauthorized, code)
+}
+
+func (s *V2Suite) TestWebhooks() {
+	code, body := s.do("POST", "/v2/webhooks", `{"url":"https://example.com/hook","events":["deposit.succeeded","hold.expired","deposit.succeeded"]}`, false)
+	require.Equal(s.T(), http.StatusCreated, code)
+	require.Contains(s.T(), body, `"secret":"whsec_`)
+	require.Contains(s.T(), body, `"events":["deposit.succeeded","hold.expired"]`)
+	code, _ = s.do("POST", "/v2/webhooks", `{"url":"ftp://example.com","events":["deposit.succeeded"]}`, false)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	for _, u := range []string{"http://127.0.0.1/hook", "http://localhost:8080", "http://10.0.0.1", "http://169.254.169.254/latest/meta-data", "http://[::1]:3000"} {
+		code, _ = s.do("POST", "/v2/webhooks", fmt.Sprintf(`{"url":"%s","events":["deposit.succeeded"]}`, u), false)
+		require.Equal(s.T(), http.StatusUnprocessableEntity, code, u)
+	}
+	code, _ = s.do("POST", "/v2/webhooks", `{"url":"https://example.com/hook","events":["deposit.failed"]}`, false)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, _ = s.do("POST", "/v2/webhooks", `{"url":"https://example.com/hook"}`, false)
+	require.Equal(s.T(), http.StatusUnprocessableEntity, code)
+	code, body = s.do("GET", "/v2/webhooks", "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+	require.NotContains(s.T(), body, `"secret"`)
+	code, body = s.do("GET", "/v2/webhooks/1/deliveries", "", false)
+	require.Equal(s.T(), http.StatusOK, code)
+	require.Contains(s.T(), body, `"last_status_code":500`)
+	require.NotContains(s.T(), body, `"secret"`)
+	code, _ = s.do("GET", fmt.Sprintf("/v2/webhooks/%d/deliveries", notFoundWebhook), "", false)
+	require.Equal(s.T(), http.StatusNotFound, code)
+	code, _ = s.do("POST", "/v2/webhooks/1/deliveries/1/redeliver", "", false)
+	require.Equal(s.T(), http.StatusAccepted, code)
+	code, _ = s.do("POST", fmt.Sprintf("/v2/webhooks/1/deliveries/%d/redeliver", notFoundWebhook), "", false)
+	require.Equal(s.T(), http.StatusNotFound, code)
+	code, _ = s.do("POST", "/v2/webhooks/1/deliveries/rubbish/redeliver", "", false)
+	require.Equal(s.T(), http.StatusBadRequest, code)
+	code, _ = s.do("DELETE", "/v2/webhooks/1", "", false)
+	require.Equal(s.T(), http.StatusNoContent, code)
+	code, _ = s.do("DELETE", fmt.Sprintf("/v2/webhooks/%d", notFoundWebhook), "", false)
+	require.Equal(s.T(), http.StatusNotFound, code)
+}
+
+func (s *V2Suite) newRequest(method, path, body string) *http.Request {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	require.NoError(s.T(), err)
+	req.Header.Set(rest.APIKeyHeader, testAPIKey)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+func (s *V2Suite) do(method, path, body string, sign bool) (int, string) {
+	req := s.newRequest(method, path, body)
+	if sign {
+		require.NoError(s.T(), rest.SignRequest(req, testSigningSecret))
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func TestV2Suite(t *testing.T) {
+	suite.Run(t, new(V2Suite))
+}
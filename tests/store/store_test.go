@@ -2,6 +2,7 @@ package store_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -11,8 +12,10 @@ import (
 	"github.com/stretchr/testify/suite"
 	"payment-system/pkg"
 	"payment-system/pkg/pgStore"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type PgStoreSuite struct {
@@ -50,9 +53,9 @@ func (s *PgStoreSuite) TearDownSuite() {
 
 func (s *PgStoreSuite) TestCreateWallets() {
 	uid := uuid.New()
-	err := s.pg.CreateWallet(s.ctx, uid.String(), 0)
+	err := s.pg.CreateWallet(s.ctx, uid.String(), 0, "USD")
 	require.NoError(s.T(), err)
-	err = s.pg.CreateWallet(s.ctx, uid.String(), 0)
+	err = s.pg.CreateWallet(s.ctx, uid.String(), 0, "USD")
 	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction(uid.String()))
 	var wg sync.WaitGroup
 	for i := 0; i < 200; i++ {
@@ -60,7 +63,7 @@ func (s *PgStoreSuite) TestCreateWallets() {
 		go func() {
 			defer wg.Done()
 			uid := uuid.New()
-			err := s.pg.CreateWallet(s.ctx, uid.String(), 0)
+			err := s.pg.CreateWallet(s.ctx, uid.String(), 0, "USD")
 			require.NoError(s.T(), err)
 		}()
 	}
@@ -69,13 +72,13 @@ func (s *PgStoreSuite) TestCreateWallets() {
 
 func (s *PgStoreSuite) TestDepositWithdraw() {
 	uid := uuid.New()
-	err := s.pg.CreateWallet(s.ctx, uid.String(), 0)
+	err := s.pg.CreateWallet(s.ctx, uid.String(), 0, "USD")
 	require.NoError(s.T(), err)
-	err = s.pg.DepositWithdraw(s.ctx, uid.String(), 1000, "1")
+	_, err = s.pg.DepositWithdraw(s.ctx, uid.String(), pkg.NewAmount(100000, 2), "", "1")
 	require.NoError(s.T(), err)
-	err = s.pg.DepositWithdraw(s.ctx, uid.String(), 1000, "1")
+	_, err = s.pg.DepositWithdraw(s.ctx, uid.String(), pkg.NewAmount(100000, 2), "", "1")
 	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("1"))
-	err = s.pg.DepositWithdraw(s.ctx, uid.String(), 1000, "2")
+	_, err = s.pg.DepositWithdraw(s.ctx, uid.String(), pkg.NewAmount(100000, 2), "", "2")
 	require.NoError(s.T(), err)
 	var wg sync.WaitGroup
 	for i := 3; i < 103; i ++ {
@@ -83,16 +86,16 @@ func (s *PgStoreSuite) TestDepositWithdraw() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := s.pg.DepositWithdraw(s.ctx, uid.String(), -10, fmt.Sprintf("%d", i))
+			_, err := s.pg.DepositWithdraw(s.ctx, uid.String(), pkg.NewAmount(-1000, 2), "", fmt.Sprintf("%d", i))
 			require.NoError(s.T(), err)
 		}()
 	}
-	err = s.pg.DepositWithdraw(s.ctx, uid.String(), -5000, "2000")
+	_, err = s.pg.DepositWithdraw(s.ctx, uid.String(), pkg.NewAmount(-500000, 2), "", "2000")
 	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
 	wg.Wait()
 	w, err := s.pg.GetWallet(s.ctx, uid.String())
 	require.NoError(s.T(), err)
-	require.Equal(s.T(), w.Amount, 1000.0)
+	require.Equal(s.T(), w.Amount, pkg.NewAmount(100000, 2))
 	// Testing reports by types
 	report, err := s.pg.Report(s.ctx, uid.String(), nil, nil, -1)
 	require.NoError(s.T(), err)
@@ -113,16 +116,16 @@ func (s *PgStoreSuite) TestDepositWithdraw() {
 
 func (s *PgStoreSuite) TestTransferFunds() {
 	uid1 := uuid.New()
-	err := s.pg.CreateWallet(s.ctx, uid1.String(), 0)
+	err := s.pg.CreateWallet(s.ctx, uid1.String(), 0, "USD")
 	require.NoError(s.T(), err)
-	err = s.pg.DepositWithdraw(s.ctx, uid1.String(), 1000, "1")
+	_, err = s.pg.DepositWithdraw(s.ctx, uid1.String(), pkg.NewAmount(100000, 2), "", "1")
 	require.NoError(s.T(), err)
 	uid2 := uuid.New()
-	err = s.pg.CreateWallet(s.ctx, uid2.String(), 0)
+	err = s.pg.CreateWallet(s.ctx, uid2.String(), 0, "USD")
 	require.NoError(s.T(), err)
-	err = s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), 0.5, "2")
+	_, err = s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), pkg.NewAmount(50, 2), "", "", "2")
 	require.NoError(s.T(), err)
-	err = s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), 0.5, "2")
+	_, err = s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), pkg.NewAmount(50, 2), "", "", "2")
 	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("2"))
 	var wg sync.WaitGroup
 	for i := 3; i < 103; i ++ {
@@ -130,19 +133,19 @@ func (s *PgStoreSuite) TestTransferFunds() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), 0.5, fmt.Sprintf("%d", i))
+			_, err := s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), pkg.NewAmount(50, 2), "", "", fmt.Sprintf("%d", i))
 			require.NoError(s.T(), err)
 		}()
 	}
-	err = s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), 5000, "2000")
+	_, err = s.pg.TransferFunds(s.ctx, uid1.String(), uid2.String(), pkg.NewAmount(500000, 2), "", "", "2000")
 	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
 	wg.Wait()
 	w, err := s.pg.GetWallet(s.ctx, uid1.String())
 	require.NoError(s.T(), err)
-	require.Equal(s.T(), w.Amount, 949.5)
+	require.Equal(s.T(), w.Amount, pkg.NewAmount(94950, 2))
 	w, err = s.pg.GetWallet(s.ctx, uid2.String())
 	require.NoError(s.T(), err)
-	require.Equal(s.T(), w.Amount, 50.5)
+	require.Equal(s.T(), w.Amount, pkg.NewAmount(5050, 2))
 	// Testing reports by types
 	report, err := s.pg.Report(s.ctx, uid1.String(), nil, nil, -1)
 	require.NoError(s.T(), err)
@@ -161,8 +164,644 @@ func (s *PgStoreSuite) TestTransferFunds() {
 	require.Len(s.T(), report, 101)
 }
 
+func (s *PgStoreSuite) TestCurrencies() {
+	usd, jpy, kwd := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, usd, 0, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, jpy, 0, "JPY"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, kwd, 0, "KWD"))
+	_, err := s.pg.DepositWithdraw(s.ctx, jpy, pkg.NewAmount(105, 1), "", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrAmountPrecision)
+	_, err = s.pg.DepositWithdraw(s.ctx, jpy, pkg.NewAmount(1000, 0), "USD", "1")
+	require.ErrorIs(s.T(), err, pkg.ErrCurrencyMismatch)
+	_, err = s.pg.DepositWithdraw(s.ctx, jpy, pkg.NewAmount(1000, 0), "JPY", "1")
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, kwd, pkg.NewAmount(1005, 3), "", "2")
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, usd, pkg.NewAmount(1005, 3), "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrAmountPrecision)
+	_, err = s.pg.TransferFunds(s.ctx, jpy, usd, pkg.NewAmount(10, 0), "USD", "", "4")
+	require.ErrorIs(s.T(), err, pkg.ErrCurrencyMismatch)
+	w, err := s.pg.GetWallet(s.ctx, jpy)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "JPY", w.Currency)
+	require.Equal(s.T(), pkg.NewAmount(1000, 0), w.Amount)
+	w, err = s.pg.GetWallet(s.ctx, kwd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "KWD", w.Currency)
+	require.Equal(s.T(), pkg.NewAmount(1005, 3), w.Amount)
+	report, err := s.pg.Report(s.ctx, kwd, nil, nil, -1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), "KWD", report[0].Currency)
+	require.Equal(s.T(), pkg.NewAmount(1005, 3), report[0].Amount)
+}
+
+func (s *PgStoreSuite) TestCrossCurrencyTransfer() {
+	s.pg.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(11012, 2), "USD/KWD": pkg.NewAmount(3012, 4)})
+	defer s.pg.SetFXRateProvider(s.pg)
+	usd, jpy, kwd := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, usd, 0, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, jpy, 0, "JPY"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, kwd, 0, "KWD"))
+	_, err := s.pg.DepositWithdraw(s.ctx, usd, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	// 10.05 USD * 110.12 = 1106.706 JPY rounded to 1107
+	_, err = s.pg.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(1005, 2), "", "", "2")
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, jpy, usd, pkg.NewAmount(100, 0), "", "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrRateNotFound)
+	// quoted rate is used even if the current one changes
+	quote, err := s.pg.CreateFXQuote(s.ctx, "USD", "KWD", time.Minute)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, pkg.NewAmount(3012, 4).Cmp(quote.Rate))
+	s.pg.SetFXRateProvider(pkg.StaticFXRates{"USD/KWD": pkg.NewAmount(1, 0)})
+	_, err = s.pg.TransferFunds(s.ctx, usd, kwd, pkg.NewAmount(1000, 2), "", quote.ID, "4")
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(1000, 2), "", quote.ID, "5")
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidQuote)
+	expired, err := s.pg.CreateFXQuote(s.ctx, "USD", "KWD", -time.Minute)
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, usd, kwd, pkg.NewAmount(1000, 2), "", expired.ID, "6")
+	require.ErrorIs(s.T(), err, pkg.ErrQuoteExpired)
+	w, err := s.pg.GetWallet(s.ctx, usd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(7995, 2), w.Amount)
+	w, err = s.pg.GetWallet(s.ctx, jpy)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(1107, 0), w.Amount)
+	w, err = s.pg.GetWallet(s.ctx, kwd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(3012, 3), w.Amount)
+	report, err := s.pg.Report(s.ctx, jpy, nil, nil, 3)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), pkg.NewAmount(1005, 2), report[0].Amount)
+	require.Equal(s.T(), "USD", report[0].Currency)
+	require.Equal(s.T(), pkg.NewAmount(1107, 0), report[0].AmountReceived)
+	require.Equal(s.T(), "JPY", report[0].CurrencyReceiver)
+	require.Equal(s.T(), 0, pkg.NewAmount(11012, 2).Cmp(report[0].Rate))
+}
+
 func TestPgStoreSuite(t *testing.T) {
 	// run ONLY on empty DB
 	//s.T().Skip()
 	suite.Run(t, new(PgStoreSuite))
 }
+
+func (s *PgStoreSuite) TestLedger() {
+	s.pg.SetFXRateProvider(pkg.StaticFXRates{"USD/EUR": pkg.NewAmount(92, 2)})
+	defer s.pg.SetFXRateProvider(s.pg)
+	usd, eur := uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, usd, 0, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, eur, 0, "EUR"))
+	_, err := s.pg.DepositWithdraw(s.ctx, usd, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, usd, pkg.NewAmount(-1000, 2), "", "2")
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, usd, eur, pkg.NewAmount(5000, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	for _, wallet := range []string{usd, eur} {
+		w, err := s.pg.GetWallet(s.ctx, wallet)
+		require.NoError(s.T(), err)
+		balance, err := s.pg.LedgerBalance(s.ctx, wallet)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), 0, w.Amount.Cmp(balance))
+	}
+	balance, err := s.pg.LedgerBalance(s.ctx, pgStore.AccountCashIn)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, pkg.NewAmount(-10000, 2).Cmp(balance))
+	balance, err = s.pg.LedgerBalance(s.ctx, pgStore.AccountCashOut)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, pkg.NewAmount(1000, 2).Cmp(balance))
+	// every leg of the transfer is visible
+	report, err := s.pg.Report(s.ctx, eur, nil, nil, -1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 1)
+	require.Equal(s.T(), pkg.NewAmount(4600, 2), report[0].PostingAmount)
+	require.Len(s.T(), report[0].Legs, 4)
+	report, err = s.pg.Report(s.ctx, usd, nil, nil, -1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 3)
+	require.Equal(s.T(), pkg.NewAmount(-5000, 2), report[2].PostingAmount)
+}
+
+// TestWalletIDCase checks a wallet given by its uuid in upper case has the same postings
+func (s *PgStoreSuite) TestWalletIDCase() {
+	owner := int(time.Now().UnixNano()%1e9) + 1000
+	wallet, receiver := uuid.New().String(), uuid.New().String()
+	upper := strings.ToUpper(wallet)
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, upper, owner, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, receiver, owner, "USD"))
+	_, err := s.pg.DepositWithdraw(s.ctx, upper, pkg.NewAmount(10000, 2), "", "case-1-"+wallet)
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, upper, strings.ToUpper(receiver), pkg.NewAmount(1000, 2), "", "", "case-2-"+wallet)
+	require.NoError(s.T(), err)
+	for _, id := range []string{wallet, upper} {
+		w, err := s.pg.GetWallet(s.ctx, id)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), pkg.NewAmount(9000, 2), w.Amount)
+		balance, err := s.pg.LedgerBalance(s.ctx, id)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), 0, w.Amount.Cmp(balance))
+		report, err := s.pg.Report(s.ctx, id, nil, nil, -1)
+		require.NoError(s.T(), err)
+		require.Len(s.T(), report, 2)
+		at, err := s.pg.BalanceAt(s.ctx, id, time.Now().Add(time.Minute))
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), 0, w.Amount.Cmp(at.Amount))
+	}
+	aggregates, err := s.pg.AggregateReport(s.ctx, "", owner, nil, nil, pgStore.PeriodMonth)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), aggregates, 3)
+}
+
+func (s *PgStoreSuite) TestHolds() {
+	wallet := uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.pg.PlaceHold(s.ctx, wallet, pkg.NewAmount(10001, 2), "", time.Minute, "2")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	hold, err := s.pg.PlaceHold(s.ctx, wallet, pkg.NewAmount(6000, 2), "", time.Minute, "2")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(6000, 2), hold.Amount)
+	_, err = s.pg.PlaceHold(s.ctx, wallet, pkg.NewAmount(100, 2), "", time.Minute, "2")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("2"))
+	w, err := s.pg.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(10000, 2), w.Amount)
+	require.Equal(s.T(), pkg.NewAmount(6000, 2), w.Held)
+	require.Equal(s.T(), pkg.NewAmount(4000, 2), w.Available)
+	// held funds can't be spent
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-5000, 2), "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.pg.CaptureHold(s.ctx, hold.ID, pkg.NewAmount(6001, 2), "4")
+	require.ErrorIs(s.T(), err, pkg.ErrCaptureExceedsHold)
+	hold, err = s.pg.CaptureHold(s.ctx, hold.ID, pkg.NewAmount(2500, 2), "4")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.HoldCaptured, hold.Status)
+	require.Equal(s.T(), pkg.NewAmount(2500, 2), hold.Captured)
+	_, err = s.pg.CaptureHold(s.ctx, hold.ID, pkg.Amount{}, "5")
+	require.ErrorIs(s.T(), err, pkg.ErrHoldNotActive)
+	_, err = s.pg.VoidHold(s.ctx, hold.ID)
+	require.ErrorIs(s.T(), err, pkg.ErrHoldNotActive)
+	w, err = s.pg.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(7500, 2), w.Amount)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), w.Held)
+	balance, err := s.pg.LedgerBalance(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, w.Amount.Cmp(balance))
+	// void and expiry release the funds
+	hold, err = s.pg.PlaceHold(s.ctx, wallet, pkg.NewAmount(1000, 2), "", time.Minute, "6")
+	require.NoError(s.T(), err)
+	hold, err = s.pg.VoidHold(s.ctx, hold.ID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.HoldVoided, hold.Status)
+	hold, err = s.pg.PlaceHold(s.ctx, wallet, pkg.NewAmount(1000, 2), "", -time.Minute, "7")
+	require.NoError(s.T(), err)
+	_, err = s.pg.CaptureHold(s.ctx, hold.ID, pkg.Amount{}, "8")
+	require.ErrorIs(s.T(), err, pkg.ErrHoldExpired)
+	n, err := s.pg.ExpireHolds(s.ctx)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(1), n)
+	hold, err = s.pg.GetHold(s.ctx, hold.ID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.HoldExpired, hold.Status)
+	w, err = s.pg.GetWallet(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(7500, 2), w.Available)
+	_, err = s.pg.GetHold(s.ctx, uuid.New().String())
+	require.ErrorIs(s.T(), err, pkg.ErrHoldNotFound)
+}
+
+func (s *PgStoreSuite) TestRefunds() {
+	s.pg.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(11012, 2)})
+	defer s.pg.SetFXRateProvider(s.pg)
+	usd, jpy := uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, usd, 0, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, jpy, 0, "JPY"))
+	_, err := s.pg.DepositWithdraw(s.ctx, usd, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, usd, pkg.NewAmount(-2000, 2), "", "2")
+	require.NoError(s.T(), err)
+	// partial refunds up to the original amount
+	require.NoError(s.T(), s.pg.Refund(s.ctx, 0, "2", pkg.NewAmount(500, 2), "r1"))
+	err = s.pg.Refund(s.ctx, 0, "2", pkg.NewAmount(1501, 2), "r2")
+	require.ErrorIs(s.T(), err, pkg.ErrRefundExceedsOriginal)
+	err = s.pg.Refund(s.ctx, 0, "2", pkg.NewAmount(100, 2), "r1")
+	require.ErrorIs(s.T(), err, pkg.ErrDuplicateAction("r1"))
+	require.NoError(s.T(), s.pg.Refund(s.ctx, 0, "2", pkg.Amount{}, "r2"))
+	err = s.pg.Refund(s.ctx, 0, "2", pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrRefundExceedsOriginal)
+	err = s.pg.Refund(s.ctx, 0, "r1", pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrNotRefundable)
+	err = s.pg.Refund(s.ctx, 0, "missing", pkg.Amount{}, "r3")
+	require.ErrorIs(s.T(), err, pkg.ErrTransactionNotFound)
+	w, err := s.pg.GetWallet(s.ctx, usd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(10000, 2), w.Amount)
+	// refunds of transfers go back from the receiver by the original rate
+	_, err = s.pg.TransferFunds(s.ctx, usd, jpy, pkg.NewAmount(1005, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	s.pg.SetFXRateProvider(pkg.StaticFXRates{"USD/JPY": pkg.NewAmount(1, 0)})
+	require.NoError(s.T(), s.pg.Refund(s.ctx, 0, "3", pkg.NewAmount(500, 2), "r3"))
+	require.NoError(s.T(), s.pg.Refund(s.ctx, 0, "3", pkg.Amount{}, "r4"))
+	w, err = s.pg.GetWallet(s.ctx, jpy)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(0, 0), w.Amount)
+	w, err = s.pg.GetWallet(s.ctx, usd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(10000, 2), w.Amount)
+	original, err := s.pg.GetTransaction(s.ctx, 0, "3")
+	require.NoError(s.T(), err)
+	report, err := s.pg.Report(s.ctx, usd, nil, nil, pgStore.TransactionRefund)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 4)
+	require.Equal(s.T(), original.ID, report[3].OriginalID)
+	require.Equal(s.T(), pkg.NewAmount(505, 2), report[3].PostingAmount)
+	// 5.00 USD * 110.12 = 550.6 JPY rounded to 551, the rest is 1107 - 551
+	report, err = s.pg.Report(s.ctx, jpy, nil, nil, pgStore.TransactionRefund)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 2)
+	require.Equal(s.T(), pkg.NewAmount(-551, 0), report[0].PostingAmount)
+	require.Equal(s.T(), pkg.NewAmount(-556, 0), report[1].PostingAmount)
+}
+
+func (s *PgStoreSuite) TestFees() {
+	payer, receiver, feeWallet := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, payer, 1, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, receiver, 2, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, feeWallet, 0, "USD"))
+	s.pg.SetFeeWallet(feeWallet)
+	defer s.pg.SetFeeWallet("")
+	clientID := 1
+	// 1% of transfers but at least 0.50, 2.00 per withdrawal of client 1 and 3.00 for the rest
+	require.NoError(s.T(), s.pg.SetFeeRule(s.ctx, pkg.FeeRule{Type: int8(pgStore.TransactionTransferFunds), Percent: pkg.NewAmount(1, 0), Min: pkg.NewAmount(50, 2)}))
+	require.NoError(s.T(), s.pg.SetFeeRule(s.ctx, pkg.FeeRule{Type: int8(pgStore.TransactionWithdrawal), Flat: pkg.NewAmount(300, 2)}))
+	require.NoError(s.T(), s.pg.SetFeeRule(s.ctx, pkg.FeeRule{ClientID: &clientID, Type: int8(pgStore.TransactionWithdrawal), Flat: pkg.NewAmount(200, 2)}))
+	receipt, err := s.pg.DepositWithdraw(s.ctx, payer, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), receipt.Fee)
+	receipt, err = s.pg.TransferFunds(s.ctx, payer, receiver, pkg.NewAmount(1000, 2), "", "", "2")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(50, 2), receipt.Fee)
+	require.Equal(s.T(), pkg.NewAmount(-1050, 2), receipt.Total)
+	receipt, err = s.pg.TransferFunds(s.ctx, payer, receiver, pkg.NewAmount(6000, 2), "", "", "3")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(60, 2), receipt.Fee)
+	receipt, err = s.pg.DepositWithdraw(s.ctx, payer, pkg.NewAmount(-1000, 2), "", "4")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(200, 2), receipt.Fee)
+	require.Equal(s.T(), pkg.NewAmount(-1200, 2), receipt.Total)
+	// the fee is charged on top of the amount
+	_, err = s.pg.DepositWithdraw(s.ctx, payer, pkg.NewAmount(-1790, 2), "", "5")
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	receipt, err = s.pg.DepositWithdraw(s.ctx, receiver, pkg.NewAmount(-1000, 2), "", "6")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(300, 2), receipt.Fee)
+	w, err := s.pg.GetWallet(s.ctx, payer)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(1690, 2), w.Amount)
+	w, err = s.pg.GetWallet(s.ctx, feeWallet)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.NewAmount(610, 2), w.Amount)
+	report, err := s.pg.Report(s.ctx, payer, nil, nil, pgStore.TransactionTransferFunds)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), report, 2)
+	require.Equal(s.T(), pkg.NewAmount(50, 2), report[0].Fee)
+	require.Equal(s.T(), pkg.NewAmount(-1050, 2), report[0].PostingAmount)
+	require.Len(s.T(), report[0].Legs, 3)
+}
+
+func (s *PgStoreSuite) TestWalletStatus() {
+	wallet, other := uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, other, 0, "USD"))
+	_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "1")
+	require.NoError(s.T(), err)
+	// frozen for debits wallets may still be credited
+	w, err := s.pg.SetWalletStatus(s.ctx, wallet, pkg.WalletFrozenDebit, "kyc", 1)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.WalletFrozenDebit, w.Status)
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-1000, 2), "", "2")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.pg.TransferFunds(s.ctx, wallet, other, pkg.NewAmount(1000, 2), "", "", "3")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.pg.PlaceHold(s.ctx, wallet, pkg.NewAmount(1000, 2), "", time.Minute, "4")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", "5")
+	require.NoError(s.T(), err)
+	// fully frozen wallets may be neither debited nor credited
+	_, err = s.pg.SetWalletStatus(s.ctx, wallet, pkg.WalletFrozenAll, "fraud", 1)
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", "6")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletFrozen)
+	_, err = s.pg.TransferFunds(s.ctx, other, wallet, pkg.NewAmount(1000, 2), "", "", "7")
+	require.ErrorIs(s.T(), err, pkg.ErrReceiverFrozen)
+	_, err = s.pg.SetWalletStatus(s.ctx, wallet, pkg.WalletClosed, "done", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotEmpty)
+	_, err = s.pg.SetWalletStatus(s.ctx, wallet, pkg.WalletActive, "cleared", 1)
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-11000, 2), "", "8")
+	require.NoError(s.T(), err)
+	// closing is final
+	w, err = s.pg.SetWalletStatus(s.ctx, wallet, pkg.WalletClosed, "done", 1)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.WalletClosed, w.Status)
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", "9")
+	require.ErrorIs(s.T(), err, pkg.ErrWalletClosed)
+	_, err = s.pg.SetWalletStatus(s.ctx, wallet, pkg.WalletActive, "reopen", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletClosed)
+	_, err = s.pg.SetWalletStatus(s.ctx, uuid.New().String(), pkg.WalletActive, "missing", 1)
+	require.ErrorIs(s.T(), err, pkg.ErrWalletNotFound)
+	history, err := s.pg.WalletStatusHistory(s.ctx, wallet)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), history, 4)
+	require.Equal(s.T(), pkg.WalletFrozenAll, history[1].To)
+	require.Equal(s.T(), "fraud", history[1].Reason)
+	require.Equal(s.T(), pkg.WalletClosed, history[3].To)
+}
+
+func (s *PgStoreSuite) TestIdempotencyKeys() {
+	_, reserved, err := s.pg.ReserveIdempotencyKey(s.ctx, 1, "1", "a")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	_, _, err = s.pg.ReserveIdempotencyKey(s.ctx, 1, "1", "a")
+	require.ErrorIs(s.T(), err, pkg.ErrRequestInProgress)
+	_, _, err = s.pg.ReserveIdempotencyKey(s.ctx, 1, "1", "b")
+	require.ErrorIs(s.T(), err, pkg.ErrKeyReused)
+	// keys are per client
+	_, reserved, err = s.pg.ReserveIdempotencyKey(s.ctx, 2, "1", "b")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	require.NoError(s.T(), s.pg.SaveIdempotentResponse(s.ctx, 1, "1", 201, []byte(`{"code":201}`)))
+	require.NoError(s.T(), s.pg.ReleaseIdempotencyKey(s.ctx, 1, "1"))
+	record, reserved, err := s.pg.ReserveIdempotencyKey(s.ctx, 1, "1", "a")
+	require.NoError(s.T(), err)
+	require.False(s.T(), reserved)
+	require.Equal(s.T(), 201, record.Status)
+	require.Equal(s.T(), []byte(`{"code":201}`), record.Response)
+	// released keys may be reserved again
+	require.NoError(s.T(), s.pg.ReleaseIdempotencyKey(s.ctx, 2, "1"))
+	_, reserved, err = s.pg.ReserveIdempotencyKey(s.ctx, 2, "1", "c")
+	require.NoError(s.T(), err)
+	require.True(s.T(), reserved)
+	n, err := s.pg.PurgeIdempotencyKeys(s.ctx, -time.Minute)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(2), n)
+}
+
+func (s *PgStoreSuite) TestReportPage() {
+	wallet := uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	for i := 1; i <= 5; i++ {
+		_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(int64(i*100), 2), "", fmt.Sprintf("page-%d", i))
+		require.NoError(s.T(), err)
+	}
+	all, err := s.pg.Report(s.ctx, wallet, nil, nil, pgStore.AllTransactions)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), all, 5)
+	for _, desc := range []bool{false, true} {
+		var ids []int64
+		page := pgStore.Page{Limit: 2, Desc: desc}
+		for {
+			result, next, err := s.pg.ReportPage(s.ctx, wallet, nil, nil, pgStore.AllTransactions, page)
+			require.NoError(s.T(), err)
+			for _, t := range result {
+				ids = append(ids, t.PostingID)
+			}
+			if next == nil {
+				break
+			}
+			cursor, err := pgStore.ParseCursor(next.String())
+			require.NoError(s.T(), err)
+			page.Cursor = &cursor
+		}
+		require.Len(s.T(), ids, 5)
+		for i, t := range all {
+			if desc {
+				require.Equal(s.T(), t.PostingID, ids[len(ids)-1-i])
+			} else {
+				require.Equal(s.T(), t.PostingID, ids[i])
+			}
+		}
+	}
+}
+
+func (s *PgStoreSuite) TestExportReport() {
+	wallet := uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	for i := 1; i <= 3; i++ {
+		_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(int64(i*100), 2), "", fmt.Sprintf("export-%d", i))
+		require.NoError(s.T(), err)
+	}
+	all, err := s.pg.Report(s.ctx, wallet, nil, nil, pgStore.AllTransactions)
+	require.NoError(s.T(), err)
+	var exported []pgStore.Transaction
+	err = s.pg.ExportReport(s.ctx, wallet, nil, nil, pgStore.AllTransactions, true, func(t pgStore.Transaction) error {
+		exported = append(exported, t)
+		return nil
+	})
+	require.NoError(s.T(), err)
+	require.Len(s.T(), exported, 3)
+	require.Equal(s.T(), all[0], exported[2])
+	// errors of the consumer stop the export
+	stop := errors.New("stop")
+	n := 0
+	err = s.pg.ExportReport(s.ctx, wallet, nil, nil, pgStore.AllTransactions, false, func(t pgStore.Transaction) error {
+		n++
+		return stop
+	})
+	require.ErrorIs(s.T(), err, stop)
+	require.Equal(s.T(), 1, n)
+}
+
+func (s *PgStoreSuite) TestStatement() {
+	wallet, receiver := uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, receiver, 0, "USD"))
+	_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "statement-1")
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, wallet, receiver, pkg.NewAmount(3000, 2), "", "", "statement-2")
+	require.NoError(s.T(), err)
+	statement, err := s.pg.Statement(s.ctx, wallet, nil, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "USD", statement.Currency)
+	require.Len(s.T(), statement.Entries, 2)
+	require.Equal(s.T(), "statement-1", statement.Entries[0].Key)
+	require.Equal(s.T(), pkg.NewAmount(0, 2), statement.Opening)
+	require.Equal(s.T(), pkg.NewAmount(7000, 2), statement.Closing)
+	// postings before the period are in the opening balance
+	tomorrow := time.Now().Add(24 * time.Hour)
+	statement, err = s.pg.Statement(s.ctx, wallet, &tomorrow, &tomorrow)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), statement.Entries)
+	require.Equal(s.T(), pkg.NewAmount(7000, 2), statement.Opening)
+	require.Equal(s.T(), statement.Opening, statement.Closing)
+}
+
+func (s *PgStoreSuite) TestBalanceAt() {
+	wallet := uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	before := time.Now().Add(-time.Minute)
+	_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "balance-1")
+	require.NoError(s.T(), err)
+	snapshot := time.Now().Add(time.Second)
+	time.Sleep(2 * time.Second)
+	_, err = s.pg.SnapshotBalances(s.ctx, snapshot)
+	require.NoError(s.T(), err)
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-3000, 2), "", "balance-2")
+	require.NoError(s.T(), err)
+	for at, amount := range map[time.Time]int64{before: 0, snapshot: 10000, time.Now().Add(time.Minute): 7000} {
+		balance, err := s.pg.BalanceAt(s.ctx, wallet, at)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), pkg.NewAmount(amount, 2), balance.Amount, at)
+	}
+	// snapshots are idempotent
+	n, err := s.pg.SnapshotBalances(s.ctx, snapshot)
+	require.NoError(s.T(), err)
+	require.Zero(s.T(), n)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	summary, err := s.pg.BalanceSummary(s.ctx, wallet, &today, &today)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.BalanceSummary{Opening: pkg.NewAmount(0, 2), Closing: pkg.NewAmount(7000, 2),
+		Credits: pkg.NewAmount(10000, 2), Debits: pkg.NewAmount(3000, 2)}, summary)
+}
+
+func (s *PgStoreSuite) TestAggregateReport() {
+	// a new owner every run for the aggregates across its wallets
+	owner := int(time.Now().UnixNano()%1e9) + 1000
+	wallet, receiver := uuid.New().String(), uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, owner, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, receiver, owner, "USD"))
+	for i, amount := range []int64{10000, 5000, -2000} {
+		_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(amount, 2), "", fmt.Sprintf("aggregate-%s-%d", wallet, i))
+		require.NoError(s.T(), err)
+	}
+	_, err := s.pg.TransferFunds(s.ctx, wallet, receiver, pkg.NewAmount(1000, 2), "", "", "aggregate-transfer-"+wallet)
+	require.NoError(s.T(), err)
+	aggregates, err := s.pg.AggregateReport(s.ctx, wallet, owner, nil, nil, pgStore.PeriodMonth)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), aggregates, 3)
+	require.Equal(s.T(), pgStore.TransactionDeposit, aggregates[0].Type)
+	require.Equal(s.T(), int64(2), aggregates[0].Count)
+	require.Equal(s.T(), pkg.NewAmount(15000, 2), aggregates[0].Amount)
+	require.Equal(s.T(), pgStore.TransactionWithdrawal, aggregates[1].Type)
+	require.Equal(s.T(), pkg.NewAmount(2000, 2), aggregates[1].Amount)
+	require.Equal(s.T(), pgStore.TransactionTransferFunds, aggregates[2].Type)
+	require.Equal(s.T(), wallet, aggregates[2].Wallet)
+	// across all wallets of the owner both sides of the transfer are there
+	aggregates, err = s.pg.AggregateReport(s.ctx, "", owner, nil, nil, pgStore.PeriodDay)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), aggregates, 4)
+	require.Equal(s.T(), pgStore.TransactionTransferFundsTo, aggregates[3].Type)
+	require.Empty(s.T(), aggregates[3].Wallet)
+	_, err = s.pg.AggregateReport(s.ctx, wallet, owner, nil, nil, "year")
+	require.ErrorIs(s.T(), err, pkg.ErrInvalidPeriod)
+}
+
+func (s *PgStoreSuite) TestWebhookOutbox() {
+	owner := int(time.Now().UnixNano()%1e9) + 1000
+	wallet, sender := uuid.New().String(), uuid.New().String()
+	hook, err := s.pg.CreateWebhook(s.ctx, owner, "https://example.com/hook",
+		[]string{string(pkg.EventDepositSucceeded), string(pkg.EventTransferReceived)}, "secret")
+	require.NoError(s.T(), err)
+	require.True(s.T(), hook.Active)
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, owner, "USD"))
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, sender, owner+1, "USD"))
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(10000, 2), "", "outbox-deposit-"+wallet)
+	require.NoError(s.T(), err)
+	// events of failed transactions are rolled back with them
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100000, 2), "", "outbox-withdrawal-"+wallet)
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	_, err = s.pg.DepositWithdraw(s.ctx, sender, pkg.NewAmount(10000, 2), "", "outbox-deposit-"+sender)
+	require.NoError(s.T(), err)
+	_, err = s.pg.TransferFunds(s.ctx, sender, wallet, pkg.NewAmount(1000, 2), "", "", "outbox-transfer-"+wallet)
+	require.NoError(s.T(), err)
+
+	deliveries, err := s.pg.WebhookDeliveries(s.ctx, owner, hook.ID)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), deliveries, 2)
+	require.Equal(s.T(), pkg.EventTransferReceived, deliveries[0].EventType)
+	require.Equal(s.T(), pkg.EventDepositSucceeded, deliveries[1].EventType)
+	_, err = s.pg.WebhookDeliveries(s.ctx, owner+1, hook.ID)
+	require.ErrorIs(s.T(), err, pkg.ErrWebhookNotFound)
+
+	claimed, err := s.pg.ClaimWebhookDeliveries(s.ctx, 10, time.Minute)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), claimed, 2)
+	for _, d := range claimed {
+		require.Equal(s.T(), 1, d.Attempts)
+		require.Equal(s.T(), "https://example.com/hook", d.URL)
+		require.Equal(s.T(), "secret", d.Secret)
+		require.Contains(s.T(), string(d.Payload), fmt.Sprintf(`"type" : "%s"`, d.EventType))
+	}
+	// claimed deliveries are leased
+	again, err := s.pg.ClaimWebhookDeliveries(s.ctx, 10, time.Minute)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), again)
+	require.NoError(s.T(), s.pg.CompleteWebhookDelivery(s.ctx, claimed[0].ID, pkg.DeliverySucceeded, 200, "", 0))
+	require.NoError(s.T(), s.pg.CompleteWebhookDelivery(s.ctx, claimed[1].ID, pkg.DeliveryFailed, 500, "err", 0))
+
+	_, err = s.pg.RedeliverWebhook(s.ctx, owner+1, hook.ID, claimed[1].ID)
+	require.ErrorIs(s.T(), err, pkg.ErrDeliveryNotFound)
+	redelivered, err := s.pg.RedeliverWebhook(s.ctx, owner, hook.ID, claimed[1].ID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), pkg.DeliveryPending, redelivered.Status)
+	require.Equal(s.T(), 0, redelivered.Attempts)
+	again, err = s.pg.ClaimWebhookDeliveries(s.ctx, 10, time.Minute)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), again, 1)
+	require.Equal(s.T(), claimed[1].ID, again[0].ID)
+
+	require.NoError(s.T(), s.pg.DeleteWebhook(s.ctx, owner, hook.ID))
+	require.ErrorIs(s.T(), s.pg.DeleteWebhook(s.ctx, owner, hook.ID), pkg.ErrWebhookNotFound)
+	hooks, err := s.pg.ListWebhooks(s.ctx, owner)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), hooks)
+	// inactive webhooks get no more events
+	_, err = s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(100, 2), "", "outbox-deposit-2-"+wallet)
+	require.NoError(s.T(), err)
+	deliveries, err = s.pg.WebhookDeliveries(s.ctx, owner, hook.ID)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), deliveries, 2)
+}
+
+func (s *PgStoreSuite) TestWalletActivity() {
+	go s.pg.ListenWalletActivity(s.ctx)
+	wallet := uuid.New().String()
+	require.NoError(s.T(), s.pg.CreateWallet(s.ctx, wallet, 0, "USD"))
+	activity, unsubscribe := s.pg.SubscribeWallet(wallet)
+	defer unsubscribe()
+	// the listener wakes subscribers up once it's listening
+	select {
+	case <-activity:
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("listener didn't start")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(1000, 2), "", fmt.Sprintf("activity-%s-%d", wallet, i))
+		require.NoError(s.T(), err)
+		select {
+		case <-activity:
+		case <-time.After(5 * time.Second):
+			s.T().Fatal("no notification of a committed deposit")
+		}
+	}
+	// rolled back transactions aren't notified
+	_, err := s.pg.DepositWithdraw(s.ctx, wallet, pkg.NewAmount(-100000, 2), "", "activity-withdrawal-"+wallet)
+	require.ErrorIs(s.T(), err, pkg.ErrInsufficientFunds)
+	select {
+	case <-activity:
+		s.T().Fatal("notified of a rolled back withdrawal")
+	case <-time.After(200 * time.Millisecond):
+	}
+	all, err := s.pg.TransactionsAfter(s.ctx, wallet, 0, 10)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), all, 3)
+	after, err := s.pg.TransactionsAfter(s.ctx, wallet, all[0].PostingID, 1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), after, 1)
+	require.Equal(s.T(), all[1].PostingID, after[0].PostingID)
+}
@@ -0,0 +1,201 @@
+package webhook_test
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"payment-system/pkg"
+	"payment-system/pkg/webhook"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_test"
+
+type completion struct {
+	status     pkg.DeliveryStatus
+	statusCode int
+	lastError  string
+	retryIn    time.Duration
+}
+
+// FakeStore hands out its pending deliveries once and records their completions
+type FakeStore struct {
+	mu          sync.Mutex
+	pending     []pkg.WebhookDelivery
+	completions map[int64]completion
+}
+
+func (f *FakeStore) ClaimWebhookDeliveries(_ context.Context, limit int, _ time.Duration) ([]pkg.WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if limit > len(f.pending) {
+		limit = len(f.pending)
+	}
+	result := f.pending[:limit]
+	f.pending = f.pending[limit:]
+	for i := range result {
+		result[i].Attempts++
+	}
+	return result, nil
+}
+
+func (f *FakeStore) CompleteWebhookDelivery(_ context.Context, id int64, status pkg.DeliveryStatus, statusCode int, lastError string, retryIn time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completions[id] = completion{status: status, statusCode: statusCode, lastError: lastError, retryIn: retryIn}
+	return nil
+}
+
+type received struct {
+	event     string
+	delivery  string
+	signature string
+	body      []byte
+}
+
+type WebhookSuite struct {
+	suite.Suite
+	server   *httptest.Server
+	mu       sync.Mutex
+	received []received
+}
+
+// SetupTest starts a receiver responding with 500 to /fail and 200 otherwise
+func (s *WebhookSuite) SetupTest() {
+	s.received = nil
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.received = append(s.received, received{
+			event:     r.Header.Get(webhook.EventHeader),
+			delivery:  r.Header.Get(webhook.DeliveryHeader),
+			signature: r.Header.Get(webhook.SignatureHeader),
+			body:      body,
+		})
+		s.mu.Unlock()
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func (s *WebhookSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *WebhookSuite) TestDispatch() {
+	store := &FakeStore{completions: make(map[int64]completion)}
+	store.pending = []pkg.WebhookDelivery{
+		{ID: 1, EventType: pkg.EventDepositSucceeded, URL: s.server.URL + "/ok", Secret: testSecret, Payload: []byte(`{"id":1}`)},
+		{ID: 2, EventType: pkg.EventHoldExpired, URL: s.server.URL + "/fail", Secret: testSecret, Payload: []byte(`{"id":2}`)},
+		{ID: 3, EventType: pkg.EventHoldExpired, URL: s.server.URL + "/fail", Secret: testSecret, Payload: []byte(`{"id":3}`), Attempts: 2},
+		{ID: 4, EventType: pkg.EventHoldExpired, URL: "http://127.0.0.1:0", Secret: testSecret, Payload: []byte(`{"id":4}`)},
+	}
+	d := webhook.NewDispatcher(&logrus.Logger{}, store, webhook.Options{MaxAttempts: 3, BaseBackoff: time.Minute, Timeout: time.Second,
+		AllowPrivateHosts: true})
+	n, err := d.DispatchOnce(context.Background())
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 4, n)
+	n, err = d.DispatchOnce(context.Background())
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, n)
+
+	require.Len(s.T(), s.received, 3)
+	for _, r := range s.received {
+		require.NoError(s.T(), webhook.Verify(testSecret, r.signature, r.body, time.Now(), webhook.DefaultTolerance))
+		if r.delivery == "1" {
+			require.Equal(s.T(), string(pkg.EventDepositSucceeded), r.event)
+			require.Equal(s.T(), `{"id":1}`, string(r.body))
+		}
+	}
+
+	ok := store.completions[1]
+	require.Equal(s.T(), pkg.DeliverySucceeded, ok.status)
+	require.Equal(s.T(), http.StatusOK, ok.statusCode)
+	require.Empty(s.T(), ok.lastError)
+
+	retried := store.completions[2]
+	require.Equal(s.T(), pkg.DeliveryPending, retried.status)
+	require.Equal(s.T(), http.StatusInternalServerError, retried.statusCode)
+	require.NotEmpty(s.T(), retried.lastError)
+	require.Equal(s.T(), time.Minute, retried.retryIn)
+
+	failed := store.completions[3]
+	require.Equal(s.T(), pkg.DeliveryFailed, failed.status)
+	require.Equal(s.T(), http.StatusInternalServerError, failed.statusCode)
+
+	unreachable := store.completions[4]
+	require.Equal(s.T(), pkg.DeliveryPending, unreachable.status)
+	require.Equal(s.T(), 0, unreachable.statusCode)
+	require.NotEmpty(s.T(), unreachable.lastError)
+}
+
+// TestPrivateHosts checks deliveries don't reach the service's own network, the receiver listens on loopback
+func (s *WebhookSuite) TestPrivateHosts() {
+	store := &FakeStore{completions: make(map[int64]completion)}
+	store.pending = []pkg.WebhookDelivery{
+		{ID: 1, EventType: pkg.EventDepositSucceeded, URL: s.server.URL + "/ok", Secret: testSecret, Payload: []byte(`{"id":1}`)},
+		{ID: 2, EventType: pkg.EventDepositSucceeded, URL: strings.Replace(s.server.URL, "127.0.0.1", "localhost", 1) + "/ok",
+			Secret: testSecret, Payload: []byte(`{"id":2}`)},
+	}
+	d := webhook.NewDispatcher(&logrus.Logger{}, store, webhook.Options{MaxAttempts: 3, BaseBackoff: time.Minute, Timeout: time.Second})
+	n, err := d.DispatchOnce(context.Background())
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 2, n)
+	require.Empty(s.T(), s.received)
+	for _, id := range []int64{1, 2} {
+		require.Equal(s.T(), pkg.DeliveryPending, store.completions[id].status)
+		require.Contains(s.T(), store.completions[id].lastError, pkg.ErrPrivateWebhookHost.Error())
+	}
+
+	for host, public := range map[string]bool{
+		"example.com": true, "93.184.216.34": true, "2606:2800:220:1:248:1893:25c8:1946": true,
+		"localhost": false, "api.localhost": false, "127.0.0.1": false, "10.1.2.3": false, "172.16.0.1": false,
+		"192.168.1.1": false, "169.254.169.254": false, "0.0.0.0": false, "::1": false, "fd00::1": false,
+		"fe80::1": false, "::ffff:127.0.0.1": false,
+	} {
+		err := webhook.CheckHost(host)
+		if public {
+			require.NoError(s.T(), err, host)
+		} else {
+			require.Equal(s.T(), pkg.ErrPrivateWebhookHost, err, host)
+		}
+	}
+}
+
+func (s *WebhookSuite) TestBackoff() {
+	base, max := time.Minute, time.Hour
+	require.Equal(s.T(), time.Minute, webhook.Backoff(1, base, max))
+	require.Equal(s.T(), 2*time.Minute, webhook.Backoff(2, base, max))
+	require.Equal(s.T(), 32*time.Minute, webhook.Backoff(6, base, max))
+	require.Equal(s.T(), time.Hour, webhook.Backoff(7, base, max))
+	require.Equal(s.T(), time.Hour, webhook.Backoff(1000, base, max))
+}
+
+func (s *WebhookSuite) TestSignature() {
+	body := []byte(`{"type":"deposit.succeeded"}`)
+	ts := time.Unix(1635724800, 0)
+	header := webhook.Sign(testSecret, ts, body)
+	require.Regexp(s.T(), `^t=1635724800,v1=[0-9a-f]{64}$`, header)
+	require.NoError(s.T(), webhook.Verify(testSecret, header, body, ts.Add(time.Minute), webhook.DefaultTolerance))
+	require.Equal(s.T(), webhook.ErrInvalidSignature, webhook.Verify("other", header, body, ts, webhook.DefaultTolerance))
+	require.Equal(s.T(), webhook.ErrInvalidSignature, webhook.Verify(testSecret, header, []byte(`{}`), ts, webhook.DefaultTolerance))
+	require.Equal(s.T(), webhook.ErrInvalidSignature, webhook.Verify(testSecret, "rubbish", body, ts, webhook.DefaultTolerance))
+	require.Equal(s.T(), webhook.ErrSignatureExpired, webhook.Verify(testSecret, header, body, ts.Add(time.Hour), webhook.DefaultTolerance))
+	secret, err := webhook.NewSecret()
+	require.NoError(s.T(), err)
+	other, err := webhook.NewSecret()
+	require.NoError(s.T(), err)
+	require.NotEqual(s.T(), secret, other)
+}
+
+func TestWebhookSuite(t *testing.T) {
+	suite.Run(t, new(WebhookSuite))
+}